@@ -8,15 +8,17 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 
-	"cloud.google.com/go/storage"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/improbable-eng/thanos/pkg/block"
 	"github.com/improbable-eng/thanos/pkg/objstore"
 	"github.com/improbable-eng/thanos/pkg/objstore/gcs"
+	"github.com/improbable-eng/thanos/pkg/shipper"
 	"github.com/oklog/run"
 	"github.com/oklog/ulid"
 	"github.com/opentracing/opentracing-go"
@@ -28,8 +30,60 @@ import (
 func registerBucket(m map[string]setupFunc, app *kingpin.Application, name string) {
 	cmd := app.Command(name, "inspect metric data in an object storage bucket")
 
-	gcsBucket := cmd.Flag("gcs-bucket", "Google Cloud Storage bucket name for stored blocks.").
-		PlaceHolder("<bucket>").Required().String()
+	gcsBucket := cmd.Flag("gcs-bucket", "Google Cloud Storage bucket name for stored blocks. Ignored if an objstore config is given.").
+		PlaceHolder("<bucket>").String()
+
+	objstoreConfig := registerObjstoreConfigFlags(cmd)
+
+	tlsConfig := registerTLSFlags(cmd)
+
+	encryptionKeys := registerEncryptionFlag(cmd)
+
+	maxConcurrency := cmd.Flag("objstore.max-concurrency", "maximum number of concurrent object storage operations. 0 disables the limit").
+		Default("0").Int()
+
+	rateLimit := cmd.Flag("objstore.rate-limit", "maximum number of object storage operations started per second. 0 disables the limit").
+		Default("0").Float64()
+
+	// newBucket creates the bucket the subcommands operate on from the objstore config, falling
+	// back to the GCS bucket flag.
+	newBucket := func(reg prometheus.Registerer) (objstore.Bucket, func() error, error) {
+		conf, err := objstoreConfig()
+		if err != nil {
+			return nil, nil, newConfigError(err)
+		}
+		tlsCfg, err := tlsConfig()
+		if err != nil {
+			return nil, nil, newConfigError(errors.Wrap(err, "parse TLS flags"))
+		}
+		var (
+			bkt     objstore.Bucket
+			closeFn func() error
+		)
+		if len(conf) > 0 {
+			bkt, _, closeFn, err = newBucketFromConfig(conf, tlsCfg, reg)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "create bucket")
+			}
+		} else if *gcsBucket != "" {
+			gcsClient, err := gcs.NewClient(context.Background(), nil, objstore.TransportConfig{}, tlsCfg)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "create GCS client")
+			}
+			bkt = gcs.NewBucket(*gcsBucket, gcsClient.Bucket(*gcsBucket), 0, reg)
+			closeFn = gcsClient.Close
+		} else {
+			return nil, nil, newConfigError(errors.New("no bucket configured, set --objstore.config, --objstore.config-file or --gcs-bucket"))
+		}
+		keys, err := encryptionKeys()
+		if err != nil {
+			return nil, nil, newConfigError(err)
+		}
+		if keys != nil {
+			bkt = objstore.EncryptedBucket(bkt, keys)
+		}
+		return objstore.LimitedBucket(bkt, *maxConcurrency, *rateLimit), closeFn, nil
+	}
 
 	check := cmd.Command("check", "verify all blocks in the bucket")
 
@@ -40,17 +94,91 @@ func registerBucket(m map[string]setupFunc, app *kingpin.Application, name strin
 		// Dummy actor to immediately kill the group after the run function returns.
 		g.Add(func() error { return nil }, func(error) {})
 
-		gcsClient, err := storage.NewClient(context.Background())
+		bkt, closeFn, err := newBucket(reg)
 		if err != nil {
-			return errors.Wrap(err, "create GCS client")
+			return err
 		}
-		defer gcsClient.Close()
-
-		bkt := gcs.NewBucket(*gcsBucket, gcsClient.Bucket(*gcsBucket), reg)
+		defer closeFn()
 
 		return runBucketCheck(logger, bkt, *checkRepair)
 	}
 
+	upload := cmd.Command("upload", "upload a local block to the bucket")
+
+	uploadBlockDir := upload.Flag("block-dir", "directory of the block to upload").
+		Required().ExistingDir()
+
+	uploadLabels := upload.Flag("label", "external labels to attach to the block's meta.json (repeated)").
+		PlaceHolder("<name>=\"<value>\"").Strings()
+
+	uploadOverwrite := upload.Flag("overwrite", "replace the block if it already exists in the bucket").
+		Default("false").Bool()
+
+	m[name+" upload"] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer) error {
+		// Dummy actor to immediately kill the group after the run function returns.
+		g.Add(func() error { return nil }, func(error) {})
+
+		lset, err := parseFlagLabels(*uploadLabels)
+		if err != nil {
+			return newConfigError(errors.Wrap(err, "parse labels"))
+		}
+		bkt, closeFn, err := newBucket(reg)
+		if err != nil {
+			return err
+		}
+		defer closeFn()
+
+		return shipper.UploadBlock(context.Background(), logger, bkt, *uploadBlockDir, lset, *uploadOverwrite)
+	}
+
+	cp := cmd.Command("cp", "copy blocks from one bucket to another, which may be of a different provider")
+
+	cpFromConfig := cp.Flag("from-config", "YAML file describing the source bucket").
+		Required().ExistingFile()
+
+	cpToConfig := cp.Flag("to-config", "YAML file describing the destination bucket").
+		Required().ExistingFile()
+
+	cpBlockIDs := cp.Flag("block-id", "ID of a block to copy (repeated). If none are given, all blocks are copied").
+		PlaceHolder("<ulid>").Strings()
+
+	cpConcurrency := cp.Flag("concurrency", "number of blocks copied concurrently").
+		Default("4").Int()
+
+	m[name+" cp"] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer) error {
+		// Dummy actor to immediately kill the group after the run function returns.
+		g.Add(func() error { return nil }, func(error) {})
+
+		var ids []ulid.ULID
+		for _, s := range *cpBlockIDs {
+			id, err := ulid.Parse(s)
+			if err != nil {
+				return newConfigError(errors.Wrapf(err, "invalid block ID %q", s))
+			}
+			ids = append(ids, id)
+		}
+		tlsCfg, err := tlsConfig()
+		if err != nil {
+			return newConfigError(errors.Wrap(err, "parse TLS flags"))
+		}
+		src, closeSrc, err := newBucketFromConfigFile(*cpFromConfig, tlsCfg)
+		if err != nil {
+			return errors.Wrap(err, "create source bucket")
+		}
+		defer closeSrc()
+
+		dst, closeDst, err := newBucketFromConfigFile(*cpToConfig, tlsCfg)
+		if err != nil {
+			return errors.Wrap(err, "create destination bucket")
+		}
+		defer closeDst()
+
+		src = objstore.LimitedBucket(src, *maxConcurrency, *rateLimit)
+		dst = objstore.LimitedBucket(dst, *maxConcurrency, *rateLimit)
+
+		return runBucketCopy(context.Background(), logger, src, dst, ids, *cpConcurrency)
+	}
+
 	ls := cmd.Command("ls", "list all blocks in the bucket")
 
 	lsOutput := ls.Flag("ouput", "format in which to print each block's information; may be 'json' or custom template").
@@ -60,7 +188,13 @@ func registerBucket(m map[string]setupFunc, app *kingpin.Application, name strin
 		// Dummy actor to immediately kill the group after the run function returns.
 		g.Add(func() error { return nil }, func(error) {})
 
-		return runBucketList(*gcsBucket, *lsOutput)
+		bkt, closeFn, err := newBucket(nil)
+		if err != nil {
+			return err
+		}
+		defer closeFn()
+
+		return runBucketList(bkt, *lsOutput)
 	}
 }
 
@@ -162,6 +296,118 @@ func repairBlock(ctx context.Context, bkt objstore.Bucket, id ulid.ULID) (resid
 	return resid, nil
 }
 
+// runBucketCopy copies the blocks with the given IDs, or all blocks if none are given, from src to dst.
+// Blocks that already exist in dst are skipped so that an interrupted copy can be resumed.
+func runBucketCopy(ctx context.Context, logger log.Logger, src, dst objstore.Bucket, ids []ulid.ULID, concurrency int) error {
+	if len(ids) == 0 {
+		err := src.Iter(ctx, "", func(name string) error {
+			if id, err := ulid.Parse(strings.TrimSuffix(name, "/")); err == nil {
+				ids = append(ids, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "iter source bucket")
+		}
+	}
+	level.Info(logger).Log("msg", "start copying blocks", "count", len(ids))
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		failures int
+		idc      = make(chan ulid.ULID)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for id := range idc {
+				if err := copyBlock(ctx, logger, src, dst, id); err != nil {
+					level.Error(logger).Log("msg", "copying block failed", "id", id, "err", err)
+
+					mtx.Lock()
+					failures++
+					mtx.Unlock()
+				}
+			}
+		}()
+	}
+	for _, id := range ids {
+		idc <- id
+	}
+	close(idc)
+	wg.Wait()
+
+	if failures > 0 {
+		return errors.Errorf("copying %d of %d blocks failed", failures, len(ids))
+	}
+	return nil
+}
+
+// copyBlock copies all objects of the block from src to dst. The meta file is copied last
+// so that a block is only considered present in dst once all its data was copied.
+func copyBlock(ctx context.Context, logger log.Logger, src, dst objstore.Bucket, id ulid.ULID) error {
+	metaFile := path.Join(id.String(), block.MetaFilename)
+
+	ok, err := dst.Exists(ctx, metaFile)
+	if err != nil {
+		return errors.Wrap(err, "check exists")
+	}
+	if ok {
+		level.Info(logger).Log("msg", "block already exists in destination, skipping", "id", id)
+		return nil
+	}
+	ok, err = src.Exists(ctx, metaFile)
+	if err != nil {
+		return errors.Wrap(err, "check exists in source")
+	}
+	if !ok {
+		return errors.Errorf("block %s not found in source", id)
+	}
+	level.Info(logger).Log("msg", "copy block", "id", id)
+
+	err = src.Iter(ctx, id.String(), func(name string) error {
+		if name == metaFile {
+			return nil
+		}
+		return copyObject(ctx, src, dst, name)
+	}, objstore.WithRecursiveIter())
+	if err != nil {
+		return err
+	}
+	return copyObject(ctx, src, dst, metaFile)
+}
+
+// copyObject copies a single object and verifies its size in the destination.
+func copyObject(ctx context.Context, src, dst objstore.Bucket, name string) error {
+	rc, err := src.Get(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "get %s", name)
+	}
+	defer rc.Close()
+
+	if err := dst.Upload(ctx, name, rc); err != nil {
+		return errors.Wrapf(err, "upload %s", name)
+	}
+	srcAttrs, err := src.Attributes(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "get attributes of %s", name)
+	}
+	dstAttrs, err := dst.Attributes(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "get attributes of copied %s", name)
+	}
+	if srcAttrs.Size != dstAttrs.Size {
+		return errors.Errorf("size mismatch for %s: %d in source, %d in destination", name, srcAttrs.Size, dstAttrs.Size)
+	}
+	return nil
+}
+
 func parseMeta(ctx context.Context, bkt objstore.Bucket, name string) (block.Meta, error) {
 	rc, err := bkt.Get(ctx, path.Join(name, "meta.json"))
 	if err != nil {
@@ -178,15 +424,7 @@ func parseMeta(ctx context.Context, bkt objstore.Bucket, name string) (block.Met
 	return m, nil
 }
 
-func runBucketList(gcsBucket, format string) error {
-	gcsClient, err := storage.NewClient(context.Background())
-	if err != nil {
-		return errors.Wrap(err, "create GCS client")
-	}
-
-	var bkt objstore.Bucket
-	bkt = gcs.NewBucket(gcsBucket, gcsClient.Bucket(gcsBucket), nil)
-
+func runBucketList(bkt objstore.Bucket, format string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
 
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/improbable-eng/thanos/pkg/objstore/inmem"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+	"github.com/oklog/ulid"
+)
+
+func uploadTestBlock(t *testing.T, bkt *inmem.Bucket, id ulid.ULID, content string) {
+	for _, name := range []string{"meta.json", "index", "chunks/000001", "chunks/000002"} {
+		err := bkt.Upload(context.Background(), path.Join(id.String(), name), bytes.NewReader([]byte(content)))
+		testutil.Ok(t, err)
+	}
+}
+
+func TestBucket_runBucketCopy(t *testing.T) {
+	randr := rand.New(rand.NewSource(0))
+	id1, id2, id3 := ulid.MustNew(1, randr), ulid.MustNew(2, randr), ulid.MustNew(3, randr)
+
+	src := inmem.NewBucket()
+	uploadTestBlock(t, src, id1, "block1")
+	uploadTestBlock(t, src, id2, "block2")
+	uploadTestBlock(t, src, id3, "block3")
+
+	// The second block was already copied before and must not be copied again.
+	dst := inmem.NewBucket()
+	uploadTestBlock(t, dst, id2, "existing")
+
+	testutil.Ok(t, runBucketCopy(context.Background(), log.NewNopLogger(), src, dst, nil, 2))
+
+	objs := dst.Objects()
+	testutil.Equals(t, 12, len(objs))
+	testutil.Equals(t, "block1", string(objs[path.Join(id1.String(), "chunks/000002")]))
+	testutil.Equals(t, "existing", string(objs[path.Join(id2.String(), "index")]))
+	testutil.Equals(t, "block3", string(objs[path.Join(id3.String(), "meta.json")]))
+
+	// Only the selected blocks must be copied.
+	dst = inmem.NewBucket()
+	testutil.Ok(t, runBucketCopy(context.Background(), log.NewNopLogger(), src, dst, []ulid.ULID{id3}, 1))
+	testutil.Equals(t, 4, len(dst.Objects()))
+
+	// Selecting a block missing in the source must fail.
+	err := runBucketCopy(context.Background(), log.NewNopLogger(), src, inmem.NewBucket(), []ulid.ULID{ulid.MustNew(4, randr)}, 1)
+	testutil.NotOk(t, err)
+}
+
+func TestBucket_newBucketFromConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "bucket.yaml")
+
+	for _, c := range []struct {
+		cfg string
+		ok  bool
+	}{
+		{
+			cfg: `
+type: S3
+config:
+  bucket: thanos
+  endpoint: s3.example.org
+  access_key: key
+  secret_key: secret
+`,
+			ok: true,
+		},
+		{cfg: "type: S3\nconfig:\n  bucket: thanos\n", ok: false},
+		{cfg: "type: S3\nconfig:\n  unknown: field\n", ok: false},
+		{cfg: "type: GCS\nconfig: {}\n", ok: false},
+		{cfg: "type: FTP\nconfig: {}\n", ok: false},
+	} {
+		testutil.Ok(t, ioutil.WriteFile(fn, []byte(c.cfg), 0666))
+
+		_, closeFn, err := newBucketFromConfigFile(fn, nil)
+		if !c.ok {
+			testutil.NotOk(t, err)
+			continue
+		}
+		testutil.Ok(t, err)
+		testutil.Ok(t, closeFn())
+	}
+}
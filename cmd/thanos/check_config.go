@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/oklog/run"
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func registerCheckConfig(m map[string]setupFunc, app *kingpin.Application, name string) {
+	cmd := app.Command(name, "validate an object storage config file and verify that the bucket can be accessed")
+
+	objstoreConfig := cmd.Flag("objstore.config-file", "YAML file describing the bucket, in the same format as used by 'bucket cp'").
+		PlaceHolder("<path>").Required().String()
+
+	checkWrite := cmd.Flag("objstore.check-write", "verify that objects can be written to, read from and deleted from the bucket in addition to listing it").
+		Default("true").Bool()
+
+	tlsConfig := registerTLSFlags(cmd)
+
+	timeout := cmd.Flag("timeout", "timeout for the connectivity checks against the bucket").
+		Default("30s").Duration()
+
+	m[name] = func(g *run.Group, logger log.Logger, _ *prometheus.Registry, _ opentracing.Tracer) error {
+		// Dummy actor to immediately kill the group after the run function returns.
+		g.Add(func() error { return nil }, func(error) {})
+
+		tlsCfg, err := tlsConfig()
+		if err != nil {
+			return newConfigError(errors.Wrap(err, "parse TLS flags"))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+
+		return runCheckConfig(ctx, logger, *objstoreConfig, tlsCfg, *checkWrite)
+	}
+}
+
+// runCheckConfig parses and validates the bucket config in the given file and probes the
+// bucket with the operations the Thanos components rely on.
+// Invalid configs are reported as config errors, failed probes name the permission they require.
+func runCheckConfig(ctx context.Context, logger log.Logger, fn string, tlsConfig *tls.Config, checkWrite bool) error {
+	bkt, closeFn, err := newBucketFromConfigFile(fn, tlsConfig)
+	if err != nil {
+		return errors.Wrapf(err, "invalid objstore config %s", fn)
+	}
+	defer closeFn()
+
+	level.Info(logger).Log("msg", "objstore config is valid", "file", fn)
+
+	begin := time.Now()
+	if err := bkt.Iter(ctx, "", func(string) error { return nil }); err != nil {
+		return errors.Wrap(err, "list objects in bucket, check that listing the bucket is permitted")
+	}
+	if checkWrite {
+		if err := objstore.CheckWritable(ctx, bkt); err != nil {
+			return errors.Wrap(err, "check that creating, reading and deleting objects in the bucket is permitted")
+		}
+	}
+	level.Info(logger).Log("msg", "bucket is accessible", "checkWrite", checkWrite, "duration", time.Since(begin))
+	return nil
+}
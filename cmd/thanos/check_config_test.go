@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/improbable-eng/thanos/pkg/objstore/objtesting"
+	"github.com/improbable-eng/thanos/pkg/objstore/s3"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+// decodeAWSChunked decodes an object uploaded with a streaming signature, which splits
+// the content into signed chunks.
+func decodeAWSChunked(r io.Reader) ([]byte, error) {
+	var (
+		br  = bufio.NewReader(r)
+		res []byte
+	)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return res, nil
+		}
+		// Each chunk is terminated by CRLF.
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, err
+		}
+		res = append(res, b[:size]...)
+	}
+}
+
+// newFakeS3Server returns a server implementing the subset of the S3 API used by the
+// bucket for the bucket "thanos". Writes are rejected if denyWrite is set.
+func newFakeS3Server(t *testing.T, denyWrite bool) *httptest.Server {
+	var (
+		mtx     sync.Mutex
+		objects = map[string][]byte{}
+		parts   = map[int][]byte{}
+	)
+	readBody := func(r *http.Request) []byte {
+		var (
+			b   []byte
+			err error
+		)
+		if r.Header.Get("X-Amz-Content-Sha256") == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+			b, err = decodeAWSChunked(r.Body)
+		} else {
+			b, err = ioutil.ReadAll(r.Body)
+		}
+		testutil.Ok(t, err)
+		return b
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		q := r.URL.Query()
+		if _, ok := q["location"]; ok {
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+			return
+		}
+		key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/thanos"), "/")
+
+		if denyWrite && (r.Method == http.MethodPut || r.Method == http.MethodPost) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+			return
+		}
+		_, uploads := q["uploads"]
+
+		switch {
+		case key == "" && r.Method == http.MethodGet:
+			listFakeS3Objects(w, objects, q.Get("prefix"), q.Get("delimiter"))
+		case key == "":
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPost && uploads:
+			parts = map[int][]byte{}
+			fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>thanos</Bucket><Key>%s</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>`, key)
+		case r.Method == http.MethodPut && q.Get("uploadId") != "":
+			n, err := strconv.Atoi(q.Get("partNumber"))
+			testutil.Ok(t, err)
+			parts[n] = readBody(r)
+			w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, n))
+		case r.Method == http.MethodPost && q.Get("uploadId") != "":
+			var ids []int
+			for id := range parts {
+				ids = append(ids, id)
+			}
+			sort.Ints(ids)
+
+			var b []byte
+			for _, id := range ids {
+				b = append(b, parts[id]...)
+			}
+			objects[key] = b
+			fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>thanos</Bucket><Key>%s</Key><ETag>"etag"</ETag></CompleteMultipartUploadResult>`, key)
+		case r.Method == http.MethodDelete && q.Get("uploadId") != "":
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPut:
+			objects[key] = readBody(r)
+			w.Header().Set("ETag", `"etag"`)
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			b, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				if r.Method == http.MethodGet {
+					fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+				}
+				return
+			}
+			w.Header().Set("ETag", `"etag"`)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			// Ranges beyond the end of the object are truncated like S3 does.
+			http.ServeContent(w, r, key, time.Unix(1000, 0), bytes.NewReader(b))
+		case r.Method == http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+// listFakeS3Objects writes the ListObjects response for the objects with the given prefix. Objects
+// below the delimiter following the prefix are grouped into common prefixes.
+func listFakeS3Objects(w http.ResponseWriter, objects map[string][]byte, prefix, delimiter string) {
+	var (
+		keys     []string
+		prefixes = map[string]bool{}
+	)
+	for k := range objects {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if i := strings.Index(k[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			prefixes[k[:len(prefix)+i+len(delimiter)]] = true
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
+<Name>thanos</Name><Prefix>%s</Prefix><Delimiter>%s</Delimiter><MaxKeys>1000</MaxKeys><IsTruncated>false</IsTruncated>`, prefix, delimiter)
+	for _, k := range keys {
+		fmt.Fprintf(w, `<Contents><Key>%s</Key><LastModified>%s</LastModified><ETag>"etag"</ETag><Size>%d</Size><StorageClass>STANDARD</StorageClass></Contents>`,
+			k, time.Unix(1000, 0).UTC().Format("2006-01-02T15:04:05.000Z"), len(objects[k]))
+	}
+	for p := range prefixes {
+		fmt.Fprintf(w, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, p)
+	}
+	fmt.Fprint(w, `</ListBucketResult>`)
+}
+
+func TestS3Bucket_Acceptance(t *testing.T) {
+	srv := newFakeS3Server(t, false)
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	bkt, err := s3.NewBucket(&s3.Config{
+		Bucket:    "thanos",
+		Endpoint:  u.Host,
+		AccessKey: "key",
+		SecretKey: "secret",
+		Insecure:  true,
+	}, nil)
+	testutil.Ok(t, err)
+
+	objtesting.AcceptanceTest(t, bkt)
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check-config-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "bucket.yaml")
+
+	srv := newFakeS3Server(t, false)
+	defer srv.Close()
+
+	deniedSrv := newFakeS3Server(t, true)
+	defer deniedSrv.Close()
+
+	s3Config := func(srv *httptest.Server) string {
+		u, err := url.Parse(srv.URL)
+		testutil.Ok(t, err)
+
+		return `
+type: S3
+config:
+  bucket: thanos
+  endpoint: ` + u.Host + `
+  access_key: key
+  secret_key: secret
+  insecure: true
+`
+	}
+
+	for _, c := range []struct {
+		name string
+		cfg  string
+		// code is the exit code for the returned error.
+		code int
+		// msg must be contained in the error message.
+		msg string
+	}{
+		{name: "valid", cfg: s3Config(srv), code: exitCodeClean},
+		{name: "write denied", cfg: s3Config(deniedSrv), code: exitCodeRuntime, msg: "creating, reading and deleting objects"},
+		{name: "invalid YAML", cfg: "type: [S3", code: exitCodeConfig, msg: "parse objstore config"},
+		{name: "missing S3 secret key", cfg: "type: S3\nconfig:\n  bucket: thanos\n  endpoint: localhost\n  access_key: key\n", code: exitCodeConfig, msg: "missing secret key"},
+		{name: "missing S3 endpoint", cfg: "type: S3\nconfig:\n  bucket: thanos\n", code: exitCodeConfig, msg: "missing endpoint"},
+		{name: "unknown field", cfg: "type: S3\nconfig:\n  unknown: field\n", code: exitCodeConfig, msg: "unknown"},
+		{name: "missing GCS bucket", cfg: "type: GCS\nconfig: {}\n", code: exitCodeConfig, msg: "missing GCS bucket name"},
+		{name: "unsupported type", cfg: "type: FTP\nconfig: {}\n", code: exitCodeConfig, msg: "unsupported bucket type"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			testutil.Ok(t, ioutil.WriteFile(fn, []byte(c.cfg), 0666))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			err := runCheckConfig(ctx, log.NewNopLogger(), fn, nil, true)
+			testutil.Equals(t, c.code, exitCode(err))
+			if c.msg != "" {
+				testutil.Assert(t, strings.Contains(err.Error(), c.msg), "unexpected error: %s", err)
+			}
+		})
+	}
+
+	// A missing config file is a config error as well.
+	err = runCheckConfig(context.Background(), log.NewNopLogger(), fn+".missing", nil, true)
+	testutil.Equals(t, exitCodeConfig, exitCode(err))
+}
@@ -2,17 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
 	"time"
 
-	"cloud.google.com/go/storage"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/improbable-eng/thanos/pkg/compact"
 	"github.com/improbable-eng/thanos/pkg/objstore"
-	"github.com/improbable-eng/thanos/pkg/objstore/gcs"
-	"github.com/improbable-eng/thanos/pkg/objstore/s3"
 	"github.com/improbable-eng/thanos/pkg/query/ui"
 	"github.com/improbable-eng/thanos/pkg/runutil"
 	"github.com/oklog/run"
@@ -33,29 +31,32 @@ func registerCompact(m map[string]setupFunc, app *kingpin.Application, name stri
 	dataDir := cmd.Flag("data-dir", "data directory to cache blocks and process compactions").
 		Default("./data").String()
 
-	gcsBucket := cmd.Flag("gcs.bucket", "Google Cloud Storage bucket name for stored blocks.").
-		PlaceHolder("<bucket>").Required().String()
+	bucketConfig := registerBucketFlags(cmd)
 
-	s3Bucket := cmd.Flag("s3.bucket", "S3-Compatible API bucket name for stored blocks.").
-		PlaceHolder("<bucket>").Envar("S3_BUCKET").String()
+	tlsConfig := registerTLSFlags(cmd)
 
-	s3Endpoint := cmd.Flag("s3.endpoint", "S3-Compatible API endpoint for stored blocks.").
-		PlaceHolder("<api-url>").Envar("S3_ENDPOINT").String()
+	encryptionKeys := registerEncryptionFlag(cmd)
 
-	s3AccessKey := cmd.Flag("s3.access-key", "Access key for an S3-Compatible API.").
-		PlaceHolder("<key>").Envar("S3_ACCESS_KEY").String()
-
-	s3SecretKey := cmd.Flag("s3.secret-key", "Secret key for an S3-Compatible API.").
-		PlaceHolder("<key>").Envar("S3_SECRET_KEY").String()
-
-	s3Insecure := cmd.Flag("s3.insecure", "Whether to use an insecure connection with an S3-Compatible API.").
-		Default("false").Envar("S3_INSECURE").Bool()
+	slowOpThreshold := cmd.Flag("objstore.slow-op-threshold", "log every object storage operation that takes longer than this duration, along with the object, its size and the time taken. 0 disables logging of slow operations").
+		Default("0s").Duration()
 
 	syncDelay := cmd.Flag("sync-delay", "minimum age of blocks before they are being processed.").
 		Default("2h").Duration()
 
 	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer) error {
-		return runCompact(g, logger, reg, *httpAddr, *dataDir, *gcsBucket, *s3Bucket, *s3Endpoint, *s3AccessKey, *s3SecretKey, *s3Insecure, *syncDelay)
+		keys, err := encryptionKeys()
+		if err != nil {
+			return newConfigError(err)
+		}
+		objstoreConf, err := bucketConfig()
+		if err != nil {
+			return newConfigError(err)
+		}
+		tlsCfg, err := tlsConfig()
+		if err != nil {
+			return newConfigError(errors.Wrap(err, "parse TLS flags"))
+		}
+		return runCompact(g, logger, reg, *httpAddr, *dataDir, objstoreConf, tlsCfg, keys, *slowOpThreshold, *syncDelay)
 	}
 }
 
@@ -65,47 +66,25 @@ func runCompact(
 	reg *prometheus.Registry,
 	httpAddr string,
 	dataDir string,
-	gcsBucket string,
-	s3Bucket string,
-	s3Endpoint string,
-	s3AccessKey string,
-	s3SecretKey string,
-	s3Insecure bool,
+	objstoreConfig []byte,
+	tlsConfig *tls.Config,
+	encryptionKeys objstore.KeyWrapper,
+	slowOpThreshold time.Duration,
 	syncDelay time.Duration,
 ) error {
-	var (
-		bkt    objstore.Bucket
-		bucket string
-	)
-
-	s3Config := &s3.Config{
-		Bucket:    s3Bucket,
-		Endpoint:  s3Endpoint,
-		AccessKey: s3AccessKey,
-		SecretKey: s3SecretKey,
-		Insecure:  s3Insecure,
+	if len(objstoreConfig) == 0 {
+		return errors.New("no valid GCS, S3, Azure, Swift, COS, OSS, HDFS or filesystem configuration supplied")
 	}
-
-	if gcsBucket != "" {
-		gcsClient, err := storage.NewClient(context.Background())
-		if err != nil {
-			return errors.Wrap(err, "create GCS client")
-		}
-		bkt = gcs.NewBucket(gcsBucket, gcsClient.Bucket(gcsBucket), reg)
-		bucket = gcsBucket
-	} else if s3Config.Validate() == nil {
-		b, err := s3.NewBucket(s3Config, reg)
-		if err != nil {
-			return errors.Wrap(err, "create s3 client")
-		}
-
-		bkt = b
-		bucket = s3Config.Bucket
-	} else {
-		return errors.New("no valid GCS or S3 configuration supplied")
+	bkt, bucket, _, err := newBucketFromConfig(objstoreConfig, tlsConfig, reg)
+	if err != nil {
+		return errors.Wrap(err, "create bucket")
 	}
 
+	if encryptionKeys != nil {
+		bkt = objstore.EncryptedBucket(bkt, encryptionKeys)
+	}
 	bkt = objstore.BucketWithMetrics(bucket, bkt, reg)
+	bkt = objstore.BucketWithSlowOpLog(bkt, logger, slowOpThreshold)
 
 	sy, err := compact.NewSyncer(logger, reg, dataDir, bkt, syncDelay)
 	if err != nil {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"net"
 	"net/http"
@@ -13,7 +14,6 @@ import (
 
 	"github.com/prometheus/tsdb/chunkenc"
 
-	"cloud.google.com/go/storage"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/improbable-eng/thanos/pkg/block"
@@ -41,11 +41,23 @@ func registerDownsample(m map[string]setupFunc, app *kingpin.Application, name s
 	gcsBucket := cmd.Flag("gcs.bucket", "Google Cloud Storage bucket name for stored blocks.").
 		PlaceHolder("<bucket>").Required().String()
 
+	encryptionKeys := registerEncryptionFlag(cmd)
+
+	tlsConfig := registerTLSFlags(cmd)
+
 	syncDelay := cmd.Flag("sync-delay", "minimum age of blocks before they are being processed.").
 		Default("2h").Duration()
 
 	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer) error {
-		return runDownsample(g, logger, reg, *httpAddr, *dataDir, *gcsBucket, *syncDelay)
+		keys, err := encryptionKeys()
+		if err != nil {
+			return newConfigError(err)
+		}
+		tlsCfg, err := tlsConfig()
+		if err != nil {
+			return newConfigError(errors.Wrap(err, "parse TLS flags"))
+		}
+		return runDownsample(g, logger, reg, *httpAddr, *dataDir, *gcsBucket, tlsCfg, keys, *syncDelay)
 	}
 }
 
@@ -56,14 +68,19 @@ func runDownsample(
 	httpAddr string,
 	dataDir string,
 	gcsBucket string,
+	tlsConfig *tls.Config,
+	encryptionKeys objstore.KeyWrapper,
 	syncDelay time.Duration,
 ) error {
-	gcsClient, err := storage.NewClient(context.Background())
+	gcsClient, err := gcs.NewClient(context.Background(), nil, objstore.TransportConfig{}, tlsConfig)
 	if err != nil {
 		return errors.Wrap(err, "create GCS client")
 	}
 	var bkt objstore.Bucket
-	bkt = gcs.NewBucket(gcsBucket, gcsClient.Bucket(gcsBucket), reg)
+	bkt = gcs.NewBucket(gcsBucket, gcsClient.Bucket(gcsBucket), 0, reg)
+	if encryptionKeys != nil {
+		bkt = objstore.EncryptedBucket(bkt, encryptionKeys)
+	}
 	bkt = objstore.BucketWithMetrics(gcsBucket, bkt, reg)
 
 	// Start cycle of syncing blocks from the bucket and garbage collecting the bucket.
@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"runtime/debug"
+	"strings"
 	"syscall"
 
 	"math"
@@ -25,11 +29,13 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/version"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
 )
 
 const (
@@ -38,6 +44,63 @@ const (
 	defaultHTTPAddr    = "0.0.0.0:10902"
 )
 
+// Exit codes of the process, which allow orchestration systems to tell apart why it terminated.
+const (
+	// exitCodeClean is returned after a graceful shutdown, e.g. on receiving a termination signal.
+	exitCodeClean = 0
+	// exitCodeConfig is returned if flags or configuration are invalid.
+	exitCodeConfig = 1
+	// exitCodeRuntime is returned if the process failed while running.
+	exitCodeRuntime = 2
+)
+
+// configError marks an error as caused by invalid flags or configuration.
+type configError struct {
+	err error
+}
+
+// newConfigError marks err as caused by invalid flags or configuration.
+func newConfigError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return configError{err: err}
+}
+
+func (e configError) Error() string { return e.err.Error() }
+func (e configError) Cause() error  { return e.err }
+
+// exitCode returns the exit code for terminating with the given error.
+func exitCode(err error) int {
+	if err == nil {
+		return exitCodeClean
+	}
+	for err != nil {
+		if _, ok := err.(configError); ok {
+			return exitCodeConfig
+		}
+		c, ok := err.(interface {
+			Cause() error
+		})
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return exitCodeRuntime
+}
+
+// logShutdown logs the reason for shutting down and returns the exit code to terminate with.
+func logShutdown(logger log.Logger, err error) int {
+	code := exitCode(err)
+	if err == nil {
+		level.Info(logger).Log("msg", "shutting down", "exit_code", code)
+		return code
+	}
+	level.Error(logger).Log("msg", "shutting down", "cause", errors.Cause(err), "err", err, "exit_code", code)
+	return code
+}
+
 type setupFunc func(*run.Group, log.Logger, *prometheus.Registry, opentracing.Tracer) error
 
 func main() {
@@ -69,12 +132,13 @@ func main() {
 	registerCompact(cmds, app, "compact")
 	registerBucket(cmds, app, "bucket")
 	registerDownsample(cmds, app, "downsample")
+	registerCheckConfig(cmds, app, "check-config")
 
 	cmd, err := app.Parse(os.Args[1:])
 	if err != nil {
 		fmt.Fprintln(os.Stderr, errors.Wrapf(err, "Error parsing commandline arguments"))
 		app.Usage(os.Args[1:])
-		os.Exit(2)
+		os.Exit(exitCodeConfig)
 	}
 
 	var logger log.Logger
@@ -129,8 +193,7 @@ func main() {
 	}
 
 	if err := cmds[cmd](&g, logger, metrics, tracer); err != nil {
-		fmt.Fprintln(os.Stderr, errors.Wrapf(err, "%s command failed", cmd))
-		os.Exit(1)
+		os.Exit(logShutdown(logger, errors.Wrapf(err, "%s command failed", cmd)))
 	}
 
 	// Listen for termination signals.
@@ -143,11 +206,7 @@ func main() {
 		})
 	}
 
-	if err := g.Run(); err != nil {
-		level.Error(logger).Log("msg", "running command failed", "err", err)
-		os.Exit(1)
-	}
-	level.Info(logger).Log("exiting")
+	os.Exit(logShutdown(logger, g.Run()))
 }
 
 func interrupt(cancel <-chan struct{}) error {
@@ -177,11 +236,165 @@ func registerMetrics(mux *http.ServeMux, g prometheus.Gatherer) {
 	mux.Handle("/metrics", promhttp.HandlerFor(g, promhttp.HandlerOpts{}))
 }
 
+// metricsRelabelConfig is a relabeling rule for the own metrics of a component. It accepts
+// the fields of Prometheus relabel configs that decide whether a metric is kept.
+type metricsRelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels,flow"`
+	Separator    string   `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	Action       string   `yaml:"action"`
+
+	regex *regexp.Regexp
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface. It applies the defaults of
+// Prometheus relabel configs and validates the rule.
+func (c *metricsRelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain metricsRelabelConfig
+	*c = metricsRelabelConfig{Separator: ";", Regex: "(.*)"}
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Action != "keep" && c.Action != "drop" {
+		return errors.Errorf("unsupported relabel action %q, only keep and drop are supported", c.Action)
+	}
+	if len(c.SourceLabels) == 0 {
+		return errors.Errorf("relabel action %s requires source labels", c.Action)
+	}
+	re, err := regexp.Compile("^(?:" + c.Regex + ")$")
+	if err != nil {
+		return errors.Wrapf(err, "compile relabel regex %q", c.Regex)
+	}
+	c.regex = re
+	return nil
+}
+
+// loadMetricsRelabelConfig loads the list of relabeling rules from the given file.
+// No rules are returned if the file name is empty.
+func loadMetricsRelabelConfig(fn string) ([]*metricsRelabelConfig, error) {
+	if fn == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "read metrics relabel config")
+	}
+	var cfgs []*metricsRelabelConfig
+	if err := yaml.UnmarshalStrict(b, &cfgs); err != nil {
+		return nil, errors.Wrapf(err, "parse metrics relabel config %s", fn)
+	}
+	return cfgs, nil
+}
+
+// relabelGatherer drops all metrics of the underlying gatherer that the relabeling
+// rules drop. Rules see the metric name as __name__ along with the metric's labels.
+// Only keep and drop actions are supported, the labels of kept metrics are not changed.
+type relabelGatherer struct {
+	g    prometheus.Gatherer
+	cfgs []*metricsRelabelConfig
+}
+
+// newRelabelGatherer returns g unchanged if there are no relabeling rules.
+func newRelabelGatherer(g prometheus.Gatherer, cfgs []*metricsRelabelConfig) prometheus.Gatherer {
+	if len(cfgs) == 0 {
+		return g
+	}
+	return &relabelGatherer{g: g, cfgs: cfgs}
+}
+
+func (r *relabelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	// Gathered metric families are created on each call and can be modified in place.
+	mfs, err := r.g.Gather()
+
+	res := mfs[:0]
+	for _, mf := range mfs {
+		ms := mf.Metric[:0]
+
+		for _, m := range mf.Metric {
+			if r.keep(mf.GetName(), m) {
+				ms = append(ms, m)
+			}
+		}
+		if len(ms) == 0 {
+			continue
+		}
+		mf.Metric = ms
+		res = append(res, mf)
+	}
+	return res, err
+}
+
+// keep applies the rules in order and reports whether none of them drops the metric.
+func (r *relabelGatherer) keep(name string, m *dto.Metric) bool {
+	value := func(ln string) string {
+		if ln == "__name__" {
+			return name
+		}
+		for _, l := range m.Label {
+			if l.GetName() == ln {
+				return l.GetValue()
+			}
+		}
+		return ""
+	}
+	vals := make([]string, 0, 1)
+
+	for _, c := range r.cfgs {
+		vals = vals[:0]
+		for _, ln := range c.SourceLabels {
+			vals = append(vals, value(ln))
+		}
+		matched := c.regex.MatchString(strings.Join(vals, c.Separator))
+
+		if (c.Action == "keep" && !matched) || (c.Action == "drop" && matched) {
+			return false
+		}
+	}
+	return true
+}
+
+// secretFlagPatterns are substrings of names of flags whose values must not be exposed.
+var secretFlagPatterns = []string{"secret", "key", "token", "password", "http-header"}
+
+// resolvedFlags returns the values of the global flags and the flags of the command
+// as they were resolved from arguments, environment variables and defaults.
+// Values of flags that may hold credentials are redacted.
+func resolvedFlags(app *kingpin.Application, cmd *kingpin.CmdClause) map[string]string {
+	flags := map[string]string{}
+
+	for _, f := range append(app.Model().Flags, cmd.Model().Flags...) {
+		v := f.Value.String()
+		for _, p := range secretFlagPatterns {
+			if v != "" && strings.Contains(f.Name, p) {
+				v = "<secret>"
+				break
+			}
+		}
+		flags[f.Name] = v
+	}
+	return flags
+}
+
+// registerFlagsStatus registers an endpoint reporting the resolved flag values in the
+// same format as the equivalent Prometheus endpoint.
+func registerFlagsStatus(mux *http.ServeMux, flags map[string]string) {
+	mux.HandleFunc("/api/v1/status/flags", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Status string            `json:"status"`
+			Data   map[string]string `json:"data"`
+		}{
+			Status: "success",
+			Data:   flags,
+		})
+	})
+}
+
 // defaultGRPCServerOpts returns default gRPC server opts that includes:
 // - request histogram
 // - tracing
-// - panic recovery with panic counter
-func defaultGRPCServerOpts(logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer) []grpc.ServerOption {
+// - panic recovery with panic counter, unless recoverPanics is false
+func defaultGRPCServerOpts(logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, recoverPanics bool) []grpc.ServerOption {
 	met := grpc_prometheus.NewServerMetrics()
 	met.EnableHandlingTimeHistogram(
 		grpc_prometheus.WithHistogramBuckets([]float64{
@@ -195,21 +408,26 @@ func defaultGRPCServerOpts(logger log.Logger, reg *prometheus.Registry, tracer o
 	})
 	grpcPanicRecoveryHandler := func(p interface{}) (err error) {
 		panicsTotal.Inc()
-		level.Error(logger).Log("msg", "recovered from panic", "panic", p, "stack", debug.Stack())
+		level.Error(logger).Log("msg", "recovered from panic", "panic", p, "stack", string(debug.Stack()))
 		return status.Errorf(codes.Internal, "%s", p)
 	}
 	reg.MustRegister(met, panicsTotal)
+
+	unary := []grpc.UnaryServerInterceptor{
+		met.UnaryServerInterceptor(),
+		tracing.UnaryServerInterceptor(tracer),
+	}
+	stream := []grpc.StreamServerInterceptor{
+		met.StreamServerInterceptor(),
+		tracing.StreamServerInterceptor(tracer),
+	}
+	if recoverPanics {
+		unary = append(unary, grpc_recovery.UnaryServerInterceptor(grpc_recovery.WithRecoveryHandler(grpcPanicRecoveryHandler)))
+		stream = append(stream, grpc_recovery.StreamServerInterceptor(grpc_recovery.WithRecoveryHandler(grpcPanicRecoveryHandler)))
+	}
 	return []grpc.ServerOption{
 		grpc.MaxSendMsgSize(math.MaxInt32),
-		grpc_middleware.WithUnaryServerChain(
-			met.UnaryServerInterceptor(),
-			tracing.UnaryServerInterceptor(tracer),
-			grpc_recovery.UnaryServerInterceptor(grpc_recovery.WithRecoveryHandler(grpcPanicRecoveryHandler)),
-		),
-		grpc_middleware.WithStreamServerChain(
-			met.StreamServerInterceptor(),
-			tracing.StreamServerInterceptor(tracer),
-			grpc_recovery.StreamServerInterceptor(grpc_recovery.WithRecoveryHandler(grpcPanicRecoveryHandler)),
-		),
+		grpc_middleware.WithUnaryServerChain(unary...),
+		grpc_middleware.WithStreamServerChain(stream...),
 	}
 }
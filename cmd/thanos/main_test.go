@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/improbable-eng/thanos/pkg/store/storepb"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestExitCode(t *testing.T) {
+	f, err := ioutil.TempFile("", "thanos-test")
+	testutil.Ok(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	for _, c := range []struct {
+		name string
+		err  error
+		code int
+	}{
+		{name: "clean shutdown", err: nil, code: exitCodeClean},
+		{name: "runtime failure", err: errors.Wrap(errors.New("connection refused"), "serve gRPC"), code: exitCodeRuntime},
+		{name: "invalid data dir", err: errors.Wrap(newConfigError(validateDataDir(f.Name())), "sidecar command failed"), code: exitCodeConfig},
+		{name: "invalid labels flag", err: newConfigError(func() error { _, err := parseOverrideLabels("region"); return err }()), code: exitCodeConfig},
+		{name: "invalid bucket config", err: func() error { _, _, err := newBucketFromConfigFile(f.Name()+".missing", nil); return err }(), code: exitCodeConfig},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			testutil.Equals(t, c.code, exitCode(c.err))
+		})
+	}
+	testutil.Equals(t, nil, newConfigError(nil))
+}
+
+func TestLogShutdown(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.NewLogfmtLogger(&buf)
+
+	cause := errors.New("invalid TSDB path")
+	code := logShutdown(logger, errors.Wrap(newConfigError(cause), "sidecar command failed"))
+	testutil.Equals(t, exitCodeConfig, code)
+
+	out := buf.String()
+	testutil.Assert(t, strings.Contains(out, `msg="shutting down"`), "missing shutdown message in %q", out)
+	testutil.Assert(t, strings.Contains(out, `cause="invalid TSDB path"`), "missing root cause in %q", out)
+	testutil.Assert(t, strings.Contains(out, "exit_code=1"), "missing exit code in %q", out)
+}
+
+func TestRegisterFlagsStatus(t *testing.T) {
+	app := kingpin.New("thanos", "")
+	app.Flag("log.level", "").Default("info").String()
+	registerSidecar(map[string]setupFunc{}, app, "sidecar")
+
+	_, err := app.Parse([]string{
+		"sidecar",
+		"--s3.bucket=blocks",
+		"--s3.access-key=AKIAEXAMPLE",
+		"--s3.secret-key=topsecret",
+		"--prometheus.http-header=Authorization: Bearer token",
+	})
+	testutil.Ok(t, err)
+
+	mux := http.NewServeMux()
+	registerFlagsStatus(mux, resolvedFlags(app, app.GetCommand("sidecar")))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/status/flags", nil))
+	testutil.Equals(t, http.StatusOK, rec.Code)
+
+	var resp struct {
+		Status string            `json:"status"`
+		Data   map[string]string `json:"data"`
+	}
+	testutil.Ok(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	testutil.Equals(t, "success", resp.Status)
+
+	// Explicitly set, defaulted and global flags must be reported.
+	testutil.Equals(t, "blocks", resp.Data["s3.bucket"])
+	testutil.Equals(t, "http://localhost:9090", resp.Data["prometheus.url"])
+	testutil.Equals(t, "info", resp.Data["log.level"])
+
+	for _, name := range []string{"s3.access-key", "s3.secret-key", "prometheus.http-header"} {
+		testutil.Equals(t, "<secret>", resp.Data[name])
+	}
+	testutil.Assert(t, !strings.Contains(rec.Body.String(), "topsecret"), "secret exposed in %s", rec.Body.String())
+}
+
+func TestRegisterMetrics_Relabel(t *testing.T) {
+	f, err := ioutil.TempFile("", "relabel-config")
+	testutil.Ok(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`
+- source_labels: [__name__]
+  regex: thanos_test_dropped_total
+  action: drop
+- source_labels: [__name__, job]
+  regex: thanos_test_.*;
+  action: keep
+`)
+	testutil.Ok(t, err)
+	testutil.Ok(t, f.Close())
+
+	cfgs, err := loadMetricsRelabelConfig(f.Name())
+	testutil.Ok(t, err)
+
+	reg := prometheus.NewRegistry()
+	kept := prometheus.NewCounter(prometheus.CounterOpts{Name: "thanos_test_kept_total", Help: "kept"})
+	dropped := prometheus.NewCounter(prometheus.CounterOpts{Name: "thanos_test_dropped_total", Help: "dropped"})
+	notKept := prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        "thanos_test_not_kept_total",
+		Help:        "not kept",
+		ConstLabels: prometheus.Labels{"job": "other"},
+	})
+	reg.MustRegister(kept, dropped, notKept)
+
+	mux := http.NewServeMux()
+	registerMetrics(mux, newRelabelGatherer(reg, cfgs))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	testutil.Equals(t, http.StatusOK, rec.Code)
+
+	body := rec.Body.String()
+	testutil.Assert(t, strings.Contains(body, "thanos_test_kept_total"), "kept metric missing in %q", body)
+	testutil.Assert(t, !strings.Contains(body, "thanos_test_dropped_total"), "dropped metric exposed in %q", body)
+	testutil.Assert(t, !strings.Contains(body, "thanos_test_not_kept_total"), "metric not kept exposed in %q", body)
+
+	// Invalid and unsupported rules must be rejected.
+	for _, c := range []string{
+		"- action: unknown\n",
+		"- source_labels: [__name__]\n  action: replace\n",
+		"- source_labels: [__name__]\n  regex: '('\n  action: drop\n",
+	} {
+		testutil.Ok(t, ioutil.WriteFile(f.Name(), []byte(c), 0666))
+		_, err = loadMetricsRelabelConfig(f.Name())
+		testutil.NotOk(t, err)
+	}
+}
+
+// panickingStore is a Store API server whose Info and Series handlers panic.
+type panickingStore struct {
+	storepb.StoreServer
+}
+
+func (panickingStore) Info(context.Context, *storepb.InfoRequest) (*storepb.InfoResponse, error) {
+	panic("info")
+}
+
+func (panickingStore) Series(*storepb.SeriesRequest, storepb.Store_SeriesServer) error {
+	panic("series")
+}
+
+func TestDefaultGRPCServerOpts_RecoverPanics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	s := grpc.NewServer(defaultGRPCServerOpts(log.NewNopLogger(), reg, &opentracing.NoopTracer{}, true)...)
+	storepb.RegisterStoreServer(s, panickingStore{})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	go s.Serve(l)
+	defer s.Stop()
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	testutil.Ok(t, err)
+	defer conn.Close()
+
+	client := storepb.NewStoreClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The server must keep serving after each panic.
+	for i := 0; i < 2; i++ {
+		_, err = client.Info(ctx, &storepb.InfoRequest{})
+		testutil.NotOk(t, err)
+		st, ok := status.FromError(err)
+		testutil.Assert(t, ok, "expected gRPC status error")
+		testutil.Equals(t, codes.Internal, st.Code())
+
+		sc, err := client.Series(ctx, &storepb.SeriesRequest{})
+		testutil.Ok(t, err)
+		_, err = sc.Recv()
+		testutil.NotOk(t, err)
+		st, ok = status.FromError(err)
+		testutil.Assert(t, ok, "expected gRPC status error")
+		testutil.Equals(t, codes.Internal, st.Code())
+	}
+
+	testutil.Equals(t, 4.0, testutil.CounterValue(t, reg, "thanos_grpc_req_panics_recovered_total"))
+}
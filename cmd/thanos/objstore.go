@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/azure"
+	"github.com/improbable-eng/thanos/pkg/objstore/client"
+	"github.com/improbable-eng/thanos/pkg/objstore/cos"
+	"github.com/improbable-eng/thanos/pkg/objstore/hdfs"
+	"github.com/improbable-eng/thanos/pkg/objstore/oss"
+	"github.com/improbable-eng/thanos/pkg/objstore/s3"
+	"github.com/improbable-eng/thanos/pkg/objstore/swift"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// registerAzureFlags registers flags for an Azure Blob Storage container on the command.
+// The returned config is populated once the flags are parsed.
+func registerAzureFlags(cmd *kingpin.CmdClause) *azure.Config {
+	var conf azure.Config
+
+	cmd.Flag("azure.container", "Azure Blob Storage container name for stored blocks.").
+		PlaceHolder("<container>").Envar("AZURE_CONTAINER").StringVar(&conf.ContainerName)
+
+	cmd.Flag("azure.storage-account", "Azure storage account name.").
+		PlaceHolder("<account>").Envar("AZURE_STORAGE_ACCOUNT").StringVar(&conf.StorageAccountName)
+
+	cmd.Flag("azure.storage-account-key", "Azure storage account access key.").
+		PlaceHolder("<key>").Envar("AZURE_STORAGE_ACCESS_KEY").StringVar(&conf.StorageAccountKey)
+
+	cmd.Flag("azure.connection-string", "Azure storage connection string including the account name and key. Must not be combined with the storage account flags.").
+		PlaceHolder("<connection-string>").Envar("AZURE_STORAGE_CONNECTION_STRING").StringVar(&conf.ConnectionString)
+
+	return &conf
+}
+
+// registerSwiftFlags registers flags for an OpenStack Swift container on the command.
+// The returned config is populated once the flags are parsed.
+func registerSwiftFlags(cmd *kingpin.CmdClause) *swift.Config {
+	var conf swift.Config
+
+	cmd.Flag("swift.container", "OpenStack Swift container name for stored blocks.").
+		PlaceHolder("<container>").Envar("OS_CONTAINER_NAME").StringVar(&conf.ContainerName)
+
+	cmd.Flag("swift.auth-url", "Keystone authentication URL, e.g. https://keystone.example.com/v3.").
+		PlaceHolder("<url>").Envar("OS_AUTH_URL").StringVar(&conf.AuthURL)
+
+	cmd.Flag("swift.auth-version", "Keystone API version, 2 or 3. Derived from the authentication URL if not set.").
+		Envar("OS_IDENTITY_API_VERSION").IntVar(&conf.AuthVersion)
+
+	cmd.Flag("swift.username", "OpenStack user name.").
+		PlaceHolder("<user>").Envar("OS_USERNAME").StringVar(&conf.Username)
+
+	cmd.Flag("swift.password", "OpenStack user password.").
+		PlaceHolder("<password>").Envar("OS_PASSWORD").StringVar(&conf.Password)
+
+	cmd.Flag("swift.user-domain-name", "Keystone v3 domain of the user.").
+		PlaceHolder("<domain>").Envar("OS_USER_DOMAIN_NAME").StringVar(&conf.UserDomainName)
+
+	cmd.Flag("swift.project-name", "OpenStack project, or tenant for Keystone v2, to scope the token to.").
+		PlaceHolder("<project>").Envar("OS_PROJECT_NAME").StringVar(&conf.ProjectName)
+
+	cmd.Flag("swift.project-domain-name", "Keystone v3 domain of the project.").
+		PlaceHolder("<domain>").Envar("OS_PROJECT_DOMAIN_NAME").StringVar(&conf.ProjectDomainName)
+
+	cmd.Flag("swift.region-name", "Region of the object storage endpoint to use. Defaults to the first one in the service catalog.").
+		PlaceHolder("<region>").Envar("OS_REGION_NAME").StringVar(&conf.RegionName)
+
+	cmd.Flag("swift.segment-container", "Container for segments of objects larger than 5GiB. Defaults to the container name suffixed with _segments.").
+		PlaceHolder("<container>").StringVar(&conf.SegmentContainerName)
+
+	return &conf
+}
+
+// registerCOSFlags registers flags for a Tencent Cloud Object Storage bucket on the command.
+// The returned config is populated once the flags are parsed.
+func registerCOSFlags(cmd *kingpin.CmdClause) *cos.Config {
+	var conf cos.Config
+
+	cmd.Flag("cos.bucket", "Tencent COS bucket name for stored blocks, optionally including the APPID suffix.").
+		PlaceHolder("<bucket>").Envar("COS_BUCKET").StringVar(&conf.Bucket)
+
+	cmd.Flag("cos.app-id", "Tencent Cloud APPID appended to the bucket name.").
+		PlaceHolder("<appid>").Envar("COS_APP_ID").StringVar(&conf.AppID)
+
+	cmd.Flag("cos.region", "Tencent COS region of the bucket, e.g. ap-guangzhou.").
+		PlaceHolder("<region>").Envar("COS_REGION").StringVar(&conf.Region)
+
+	cmd.Flag("cos.secret-id", "Tencent Cloud API secret ID.").
+		PlaceHolder("<secret-id>").Envar("COS_SECRET_ID").StringVar(&conf.SecretID)
+
+	cmd.Flag("cos.secret-key", "Tencent Cloud API secret key.").
+		PlaceHolder("<secret-key>").Envar("COS_SECRET_KEY").StringVar(&conf.SecretKey)
+
+	cmd.Flag("cos.endpoint", "Tencent COS bucket endpoint overriding the one derived from bucket and region.").
+		PlaceHolder("<url>").Envar("COS_ENDPOINT").StringVar(&conf.Endpoint)
+
+	return &conf
+}
+
+// registerOSSFlags registers flags for an Alibaba Cloud OSS bucket on the command.
+// The returned config is populated once the flags are parsed.
+func registerOSSFlags(cmd *kingpin.CmdClause) *oss.Config {
+	var conf oss.Config
+
+	cmd.Flag("oss.bucket", "Alibaba Cloud OSS bucket name for stored blocks.").
+		PlaceHolder("<bucket>").Envar("OSS_BUCKET").StringVar(&conf.Bucket)
+
+	cmd.Flag("oss.endpoint", "Alibaba Cloud OSS endpoint of the bucket's region, e.g. oss-cn-hangzhou.aliyuncs.com.").
+		PlaceHolder("<endpoint>").Envar("OSS_ENDPOINT").StringVar(&conf.Endpoint)
+
+	cmd.Flag("oss.access-key-id", "Alibaba Cloud access key ID.").
+		PlaceHolder("<key-id>").Envar("OSS_ACCESS_KEY_ID").StringVar(&conf.AccessKeyID)
+
+	cmd.Flag("oss.access-key-secret", "Alibaba Cloud access key secret.").
+		PlaceHolder("<secret>").Envar("OSS_ACCESS_KEY_SECRET").StringVar(&conf.AccessKeySecret)
+
+	return &conf
+}
+
+// registerHDFSFlags registers flags for a directory in HDFS on the command.
+// The returned config is populated once the flags are parsed.
+func registerHDFSFlags(cmd *kingpin.CmdClause) *hdfs.Config {
+	var conf hdfs.Config
+
+	cmd.Flag("hdfs.endpoint", "WebHDFS address of the HDFS NameNode or an HttpFS gateway, e.g. namenode:9870.").
+		PlaceHolder("<endpoint>").StringVar(&conf.Endpoint)
+
+	cmd.Flag("hdfs.directory", "Absolute path of the HDFS directory for stored blocks.").
+		PlaceHolder("<path>").StringVar(&conf.Directory)
+
+	cmd.Flag("hdfs.user", "HDFS user to act as on clusters using simple authentication.").
+		PlaceHolder("<user>").Envar("HADOOP_USER_NAME").StringVar(&conf.User)
+
+	cmd.Flag("hdfs.delegation-token-file", "File holding a delegation token to authenticate with on clusters secured by Kerberos, e.g. as written by 'hdfs fetchdt'. The file is read again whenever it changes.").
+		PlaceHolder("<path>").StringVar(&conf.DelegationTokenFile)
+
+	return &conf
+}
+
+// registerObjstoreConfigFlags registers flags for a YAML bucket configuration on the command.
+// The returned function reads the configuration once the flags are parsed. It returns no
+// content if neither flag is set.
+func registerObjstoreConfigFlags(cmd *kingpin.CmdClause) func() ([]byte, error) {
+	conf := cmd.Flag("objstore.config", "YAML document describing the bucket, with the provider in 'type' (GCS, S3, AZURE, SWIFT, COS, OSS, HDFS or FILESYSTEM) and its settings in 'config'. Takes precedence over the provider-specific flags.").
+		PlaceHolder("<yaml>").String()
+
+	confFile := cmd.Flag("objstore.config-file", "Path to a YAML file describing the bucket, in the same format as --objstore.config.").
+		PlaceHolder("<path>").String()
+
+	expandEnv := cmd.Flag("objstore.config-file.expand-env", "Replace ${VAR} references in the objstore config file with the values of the respective environment variables. Unset variables are an error.").
+		Default("false").Bool()
+
+	return func() ([]byte, error) {
+		if *conf != "" && *confFile != "" {
+			return nil, errors.New("only one of --objstore.config and --objstore.config-file may be set")
+		}
+		if *confFile == "" {
+			return []byte(*conf), nil
+		}
+		b, err := ioutil.ReadFile(*confFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read objstore config file")
+		}
+		if *expandEnv {
+			return client.ExpandEnv(b)
+		}
+		return b, nil
+	}
+}
+
+// registerBucketFlags registers the flags describing the bucket of a command on it, i.e. the
+// objstore config flags and the provider-specific flags that predate them. The returned function
+// builds the YAML bucket configuration once the flags are parsed. An objstore config takes
+// precedence. Otherwise the first provider whose bucket, container or directory is set is used,
+// in the order GCS, S3, Azure, Swift, COS, OSS, HDFS and filesystem. The function returns no
+// content if no bucket is configured.
+func registerBucketFlags(cmd *kingpin.CmdClause) func() ([]byte, error) {
+	objstoreConfig := registerObjstoreConfigFlags(cmd)
+
+	gcsBucket := cmd.Flag("gcs.bucket", "Google Cloud Storage bucket name for stored blocks.").
+		PlaceHolder("<bucket>").String()
+
+	gcsServiceAccount := registerGCSServiceAccountFlag(cmd)
+
+	gcsChunkSize := cmd.Flag("gcs.chunk-size", "size of the chunks uploads to Google Cloud Storage are buffered and sent in. Every concurrent upload holds one chunk in memory, so lowering it reduces memory usage at the cost of upload throughput").
+		Default("16MB").Bytes()
+
+	var s3Config s3.Config
+
+	cmd.Flag("s3.bucket", "S3-Compatible API bucket name for stored blocks.").
+		PlaceHolder("<bucket>").Envar("S3_BUCKET").StringVar(&s3Config.Bucket)
+
+	cmd.Flag("s3.endpoint", "S3-Compatible API endpoint for stored blocks.").
+		PlaceHolder("<api-url>").Envar("S3_ENDPOINT").StringVar(&s3Config.Endpoint)
+
+	cmd.Flag("s3.region", "Region of the S3 bucket. If empty, it is looked up through GetBucketLocation, which requires the s3:GetBucketLocation permission.").
+		PlaceHolder("<region>").Envar("S3_REGION").StringVar(&s3Config.Region)
+
+	cmd.Flag("s3.access-key", "Access key for an S3-Compatible API. If neither keys nor a profile are set, credentials are taken from the environment, a web identity token, the ECS task role or the EC2 instance profile.").
+		PlaceHolder("<key>").Envar("S3_ACCESS_KEY").StringVar(&s3Config.AccessKey)
+
+	cmd.Flag("s3.secret-key", "Secret key for an S3-Compatible API.").
+		PlaceHolder("<key>").Envar("S3_SECRET_KEY").StringVar(&s3Config.SecretKey)
+
+	cmd.Flag("s3.profile", "Name of a profile in the shared AWS config files to load S3 credentials and region from. Must not be combined with static keys.").
+		PlaceHolder("<profile>").Envar("S3_PROFILE").StringVar(&s3Config.Profile)
+
+	cmd.Flag("s3.insecure", "Whether to use an insecure connection with an S3-Compatible API.").
+		Default("false").Envar("S3_INSECURE").BoolVar(&s3Config.Insecure)
+
+	cmd.Flag("s3.disk-buffer-dir", "Directory in which uploads to an S3-Compatible API are buffered to bound memory usage. If empty, uploads are buffered in memory.").
+		PlaceHolder("<dir>").Envar("S3_DISK_BUFFER_DIR").StringVar(&s3Config.DiskBufferDir)
+
+	azureConfig := registerAzureFlags(cmd)
+
+	swiftConfig := registerSwiftFlags(cmd)
+
+	cosConfig := registerCOSFlags(cmd)
+
+	ossConfig := registerOSSFlags(cmd)
+
+	hdfsConfig := registerHDFSFlags(cmd)
+
+	fsPath := cmd.Flag("filesystem.path", "Local directory, e.g. an NFS mount, used as object storage for blocks.").
+		PlaceHolder("<path>").String()
+
+	return func() ([]byte, error) {
+		conf, err := objstoreConfig()
+		if err != nil || len(conf) > 0 {
+			return conf, err
+		}
+		var bc client.BucketConfig
+
+		switch {
+		case *gcsBucket != "":
+			key, err := gcsServiceAccount()
+			if err != nil {
+				return nil, err
+			}
+			bc = client.BucketConfig{Type: client.GCS, Config: client.GCSConfig{
+				Bucket:         *gcsBucket,
+				ServiceAccount: string(key),
+				ChunkSizeBytes: int(*gcsChunkSize),
+			}}
+		case s3Config.Bucket != "":
+			bc = client.BucketConfig{Type: client.S3, Config: s3Config}
+		case azureConfig.ContainerName != "":
+			bc = client.BucketConfig{Type: client.AZURE, Config: azureConfig}
+		case swiftConfig.ContainerName != "":
+			bc = client.BucketConfig{Type: client.SWIFT, Config: swiftConfig}
+		case cosConfig.Bucket != "":
+			bc = client.BucketConfig{Type: client.COS, Config: cosConfig}
+		case ossConfig.Bucket != "":
+			bc = client.BucketConfig{Type: client.OSS, Config: ossConfig}
+		case hdfsConfig.Directory != "":
+			bc = client.BucketConfig{Type: client.HDFS, Config: hdfsConfig}
+		case *fsPath != "":
+			bc = client.BucketConfig{Type: client.FILESYSTEM, Config: client.FilesystemConfig{Directory: *fsPath}}
+		default:
+			return nil, nil
+		}
+		b, err := yaml.Marshal(bc)
+		return b, errors.Wrap(err, "encode bucket config of provider flags")
+	}
+}
+
+// newBucketFromConfig creates a bucket from the given YAML configuration and returns it along
+// with its name. Connections to the provider are based on tlsConfig, which may be nil.
+// The returned function must be called to release the bucket's resources.
+// Buckets that can check their credentials do so, so that components fail on startup if
+// they are misconfigured rather than on the first upload.
+func newBucketFromConfig(conf []byte, tlsConfig *tls.Config, reg prometheus.Registerer) (objstore.Bucket, string, func() error, error) {
+	bkt, name, closeFn, err := createBucket(conf, tlsConfig, reg)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if c, ok := bkt.(interface {
+		CheckAccess() error
+	}); ok {
+		if err := c.CheckAccess(); err != nil {
+			closeFn()
+			return nil, "", nil, errors.Wrap(err, "validate bucket credentials")
+		}
+	}
+	return bkt, name, closeFn, nil
+}
+
+// createBucket creates a bucket from the given YAML configuration without contacting it.
+func createBucket(conf []byte, tlsConfig *tls.Config, reg prometheus.Registerer) (objstore.Bucket, string, func() error, error) {
+	bkt, name, closeFn, err := client.NewBucket(conf, tlsConfig, reg)
+	if client.IsConfigError(err) {
+		return nil, "", nil, newConfigError(err)
+	}
+	return bkt, name, closeFn, err
+}
+
+// newBucketFromConfigFile creates a bucket from the configuration in the given YAML file.
+// The returned function must be called to release the bucket's resources.
+func newBucketFromConfigFile(fn string, tlsConfig *tls.Config) (objstore.Bucket, func() error, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, nil, newConfigError(errors.Wrap(err, "read config file"))
+	}
+	bkt, _, closeFn, err := createBucket(b, tlsConfig, nil)
+	return bkt, closeFn, err
+}
+
+// registerGCSServiceAccountFlag registers a flag for the key file of a GCS service account on the command.
+// The returned function reads the key once the flags are parsed. It returns no key if the flag is not
+// set, in which case Application Default Credentials are used.
+func registerGCSServiceAccountFlag(cmd *kingpin.CmdClause) func() ([]byte, error) {
+	keyFile := cmd.Flag("gcs.service-account-file", "JSON key file of a service account to authenticate with against Google Cloud Storage instead of Application Default Credentials. The client is restricted to reading and writing objects.").
+		PlaceHolder("<path>").String()
+
+	return func() ([]byte, error) {
+		if *keyFile == "" {
+			return nil, nil
+		}
+		b, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read GCS service account file")
+		}
+		return b, nil
+	}
+}
+
+// registerEncryptionFlag registers a flag for the master key of client-side encryption on the command.
+// The returned function creates the key wrapper once the flags are parsed. It returns nil if the flag
+// is not set, in which case objects are not encrypted.
+func registerEncryptionFlag(cmd *kingpin.CmdClause) func() (objstore.KeyWrapper, error) {
+	keyFile := cmd.Flag("objstore.encryption-key-file", "File holding a 256 bit master key. If set, objects are encrypted with AES-GCM before they are uploaded and decrypted when they are read. All components accessing the bucket must use the same key.").
+		PlaceHolder("<path>").String()
+
+	return func() (objstore.KeyWrapper, error) {
+		if *keyFile == "" {
+			return nil, nil
+		}
+		key, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read encryption key file")
+		}
+		return objstore.NewMasterKeyWrapper(key)
+	}
+}
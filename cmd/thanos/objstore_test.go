@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/improbable-eng/thanos/pkg/objstore/client"
+	"github.com/improbable-eng/thanos/pkg/objstore/s3"
+	"github.com/improbable-eng/thanos/pkg/objstore/swift"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+	"gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestRegisterObjstoreConfigFlags(t *testing.T) {
+	f, err := ioutil.TempFile("", "objstore-config")
+	testutil.Ok(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("type: GCS\nconfig:\n  bucket: ${THANOS_TEST_BUCKET}\n")
+	testutil.Ok(t, err)
+	testutil.Ok(t, f.Close())
+
+	parse := func(args ...string) ([]byte, error) {
+		app := kingpin.New("thanos", "")
+		conf := registerObjstoreConfigFlags(app.Command("test", ""))
+		_, err := app.Parse(append([]string{"test"}, args...))
+		testutil.Ok(t, err)
+		return conf()
+	}
+
+	conf, err := parse()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(conf))
+
+	conf, err = parse("--objstore.config=type: GCS")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "type: GCS", string(conf))
+
+	conf, err = parse("--objstore.config-file=" + f.Name())
+	testutil.Ok(t, err)
+	testutil.Equals(t, "type: GCS\nconfig:\n  bucket: ${THANOS_TEST_BUCKET}\n", string(conf))
+
+	// Environment variables are only expanded if requested and must be set.
+	_, err = parse("--objstore.config-file="+f.Name(), "--objstore.config-file.expand-env")
+	testutil.NotOk(t, err)
+
+	testutil.Ok(t, os.Setenv("THANOS_TEST_BUCKET", "from-env"))
+	defer os.Unsetenv("THANOS_TEST_BUCKET")
+
+	conf, err = parse("--objstore.config-file="+f.Name(), "--objstore.config-file.expand-env")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "type: GCS\nconfig:\n  bucket: from-env\n", string(conf))
+
+	_, err = parse("--objstore.config=type: GCS", "--objstore.config-file="+f.Name())
+	testutil.NotOk(t, err)
+
+	_, err = parse("--objstore.config-file=" + f.Name() + ".missing")
+	testutil.NotOk(t, err)
+}
+
+func TestRegisterBucketFlags(t *testing.T) {
+	// parse returns the bucket config built from the given flags and decodes the provider
+	// config into conf.
+	parse := func(conf interface{}, args ...string) client.BucketConfig {
+		app := kingpin.New("thanos", "")
+		bucketConfig := registerBucketFlags(app.Command("test", ""))
+		_, err := app.Parse(append([]string{"test"}, args...))
+		testutil.Ok(t, err)
+
+		b, err := bucketConfig()
+		testutil.Ok(t, err)
+
+		var bc client.BucketConfig
+		testutil.Ok(t, yaml.UnmarshalStrict(b, &bc))
+		if conf != nil {
+			raw, err := yaml.Marshal(bc.Config)
+			testutil.Ok(t, err)
+			testutil.Ok(t, yaml.UnmarshalStrict(raw, conf))
+		}
+		return bc
+	}
+
+	testutil.Equals(t, "", parse(nil).Type)
+
+	// An objstore config takes precedence over the provider flags.
+	testutil.Equals(t, client.FILESYSTEM, parse(nil, "--objstore.config=type: FILESYSTEM", "--gcs.bucket=gcs").Type)
+
+	var gcsConfig client.GCSConfig
+	testutil.Equals(t, client.GCS, parse(&gcsConfig, "--gcs.bucket=gcs", "--s3.bucket=s3").Type)
+	testutil.Equals(t, "gcs", gcsConfig.Bucket)
+	testutil.Equals(t, 16<<20, gcsConfig.ChunkSizeBytes)
+
+	var s3Config s3.Config
+	testutil.Equals(t, client.S3, parse(&s3Config, "--s3.bucket=s3", "--s3.endpoint=localhost:9000", "--swift.container=swift").Type)
+	testutil.Equals(t, "s3", s3Config.Bucket)
+	testutil.Equals(t, "localhost:9000", s3Config.Endpoint)
+	testutil.Ok(t, s3Config.Validate())
+
+	var swiftConfig swift.Config
+	testutil.Equals(t, client.SWIFT, parse(&swiftConfig, "--swift.container=swift", "--filesystem.path=/data").Type)
+	testutil.Equals(t, "swift", swiftConfig.ContainerName)
+
+	var fsConfig client.FilesystemConfig
+	testutil.Equals(t, client.FILESYSTEM, parse(&fsConfig, "--filesystem.path=/data").Type)
+	testutil.Equals(t, "/data", fsConfig.Directory)
+}
@@ -42,6 +42,9 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application, name string
 	grpcAddr := cmd.Flag("grpc-address", "listen host:port for gRPC endpoints").
 		Default(defaultGRPCAddr).String()
 
+	grpcRecoverPanics := cmd.Flag("grpc.recover-panics", "recover from panics in gRPC handlers and return an internal error to the client instead of crashing. Disable to crash on panics when debugging").
+		Default("true").Bool()
+
 	queryTimeout := cmd.Flag("query.timeout", "maximum time to process query by query node").
 		Default("2m").Duration()
 
@@ -56,7 +59,10 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application, name string
 	clusterBindAddr := cmd.Flag("cluster.address", "listen address for cluster").
 		Default(defaultClusterAddr).String()
 
-	clusterAdvertiseAddr := cmd.Flag("cluster.advertise-address", "explicit address to advertise in cluster").
+	clusterDescription := cmd.Flag("cluster.description", "optional human-readable description of this peer that is gossiped to the cluster, e.g. its datacenter or owning team").
+		String()
+
+	clusterAdvertiseAddr := cmd.Flag("cluster.advertise-address", "explicit address to advertise in cluster. If no port is given, the port of the cluster bind address is advertised").
 		String()
 
 	gossipInterval := cmd.Flag("cluster.gossip-interval", "interval between sending gossip messages. By lowering this value (more frequent) gossip messages are propagated across the cluster more quickly at the expense of increased bandwidth.").
@@ -73,8 +79,9 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application, name string
 
 	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer) error {
 		pstate := cluster.PeerState{
-			Type:    cluster.PeerTypeQuery,
-			APIAddr: *httpAddr,
+			Type:        cluster.PeerTypeQuery,
+			APIAddr:     *httpAddr,
+			Description: *clusterDescription,
 		}
 		peer, err := cluster.Join(logger, reg,
 			*clusterBindAddr,
@@ -84,6 +91,7 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application, name string
 			true,
 			*gossipInterval,
 			*pushPullInterval,
+			0,
 		)
 		if err != nil {
 			return errors.Wrap(err, "join cluster")
@@ -96,6 +104,7 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application, name string
 		return runQuery(g, logger, reg, tracer,
 			*httpAddr,
 			*grpcAddr,
+			*grpcRecoverPanics,
 			*maxConcurrentQueries,
 			*queryTimeout,
 			*replicaLabel,
@@ -115,6 +124,7 @@ func runQuery(
 	tracer opentracing.Tracer,
 	httpAddr string,
 	grpcAddr string,
+	grpcRecoverPanics bool,
 	maxConcurrentQueries int,
 	queryTimeout time.Duration,
 	replicaLabel string,
@@ -185,7 +195,7 @@ func runQuery(
 		}
 		logger := log.With(logger, "component", "query")
 
-		s := grpc.NewServer(defaultGRPCServerOpts(logger, reg, tracer)...)
+		s := grpc.NewServer(defaultGRPCServerOpts(logger, reg, tracer, grpcRecoverPanics)...)
 		storepb.RegisterStoreServer(s, proxy)
 
 		g.Add(func() error {
@@ -325,7 +335,16 @@ func (s *storeSet) UpdateStatic(ctx context.Context) {
 func (s *storeSet) UpdatePeers(ctx context.Context) {
 	stores := make(map[string]*store.Info, len(s.peerStores))
 
-	for _, ps := range s.peer.PeerStates(cluster.PeerTypesStoreAPIs()...) {
+	for _, ps := range s.peer.PeerStatesWithMetadata(cluster.PeerTypesStoreAPIs()...) {
+		if !ps.CompatibleProtocol() {
+			level.Warn(s.logger).Log(
+				"msg", "ignoring peer with incompatible protocol version; upgrade this query node",
+				"addr", ps.APIAddr,
+				"version", ps.Metadata.ProtocolVersion,
+				"supported", cluster.ProtocolVersion,
+			)
+			continue
+		}
 		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 		defer cancel()
 
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hashicorp/memberlist"
+	"github.com/improbable-eng/thanos/pkg/cluster"
+	"github.com/improbable-eng/thanos/pkg/runutil"
+	"github.com/improbable-eng/thanos/pkg/store/storepb"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// legacyDelegate gossips a fixed state like peers that predate the Valid and ProtocolVersion
+// metadata fields.
+type legacyDelegate struct {
+	state []byte
+}
+
+func (d legacyDelegate) NodeMeta(limit int) []byte                  { return nil }
+func (d legacyDelegate) NotifyMsg(b []byte)                         {}
+func (d legacyDelegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (d legacyDelegate) LocalState(join bool) []byte                { return d.state }
+func (d legacyDelegate) MergeRemoteState(buf []byte, join bool)     {}
+
+func TestStoreSet_UpdatePeers_LegacyPeer(t *testing.T) {
+	port, err := testutil.FreePort()
+	testutil.Ok(t, err)
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	peer, err := cluster.Join(log.NewNopLogger(), prometheus.NewRegistry(), addr, addr, nil,
+		cluster.PeerState{Type: cluster.PeerTypeQuery}, false, 100*time.Millisecond, 50*time.Millisecond, 0)
+	testutil.Ok(t, err)
+	defer peer.Leave(0)
+
+	legacyPort, err := testutil.FreePort()
+	testutil.Ok(t, err)
+
+	cfg := memberlist.DefaultLANConfig()
+	cfg.Name = "legacy-sidecar"
+	cfg.BindAddr = "127.0.0.1"
+	cfg.BindPort = legacyPort
+	cfg.LogOutput = ioutil.Discard
+	cfg.Delegate = legacyDelegate{
+		state: []byte(`{"legacy-sidecar":{"Type":"source","APIAddr":"127.0.0.1:10901","Metadata":{"Labels":[{"name":"cluster","value":"eu"}],"MinTime":-1000,"MaxTime":9223372036854775807}}}`),
+	}
+	ml, err := memberlist.Create(cfg)
+	testutil.Ok(t, err)
+	defer ml.Shutdown()
+
+	_, err = ml.Join([]string{addr})
+	testutil.Ok(t, err)
+
+	s := newStoreSet(log.NewNopLogger(), nil, &opentracing.NoopTracer{}, peer, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	testutil.Ok(t, runutil.Retry(100*time.Millisecond, ctx.Done(), func() error {
+		s.UpdatePeers(ctx)
+		if len(s.Get()) != 1 {
+			return errors.New("legacy peer not in store set")
+		}
+		return nil
+	}))
+
+	stores := s.Get()
+	testutil.Equals(t, "127.0.0.1:10901", stores[0].Addr)
+	testutil.Equals(t, []storepb.Label{{Name: "cluster", Value: "eu"}}, stores[0].Labels)
+	testutil.Equals(t, int64(-1000), stores[0].MinTime)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"math"
@@ -19,14 +20,12 @@ import (
 	"syscall"
 	"time"
 
-	"cloud.google.com/go/storage"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/improbable-eng/thanos/pkg/alert"
+	"github.com/improbable-eng/thanos/pkg/block"
 	"github.com/improbable-eng/thanos/pkg/cluster"
 	"github.com/improbable-eng/thanos/pkg/objstore"
-	"github.com/improbable-eng/thanos/pkg/objstore/gcs"
-	"github.com/improbable-eng/thanos/pkg/objstore/s3"
 	"github.com/improbable-eng/thanos/pkg/runutil"
 	"github.com/improbable-eng/thanos/pkg/shipper"
 	"github.com/improbable-eng/thanos/pkg/store"
@@ -65,6 +64,9 @@ func registerRule(m map[string]setupFunc, app *kingpin.Application, name string)
 	grpcAddr := cmd.Flag("grpc-address", "listen host:port for gRPC endpoints").
 		Default(defaultGRPCAddr).String()
 
+	grpcRecoverPanics := cmd.Flag("grpc.recover-panics", "recover from panics in gRPC handlers and return an internal error to the client instead of crashing. Disable to crash on panics when debugging").
+		Default("true").Bool()
+
 	evalInterval := cmd.Flag("eval-interval", "the default evaluation interval to use").
 		Default("30s").Duration()
 	tsdbBlockDuration := cmd.Flag("tsdb.block-duration", "block duration for TSDB block").
@@ -75,23 +77,11 @@ func registerRule(m map[string]setupFunc, app *kingpin.Application, name string)
 	alertmgrs := cmd.Flag("alertmanagers.url", "Alertmanager URLs to push firing alerts to. The scheme may be prefixed with 'dns+' or 'dnssrv+' to detect Alertmanager IPs through respective DNS lookups. The port defaults to 9093 or the SRV record's value. The URL path is used as a prefix for the regular Alertmanager API path.").
 		Strings()
 
-	gcsBucket := cmd.Flag("gcs.bucket", "Google Cloud Storage bucket name for stored blocks. If empty ruler won't store any block inside Google Cloud Storage").
-		PlaceHolder("<bucket>").String()
-
-	s3Bucket := cmd.Flag("s3.bucket", "S3-Compatible API bucket name for stored blocks.").
-		PlaceHolder("<bucket>").Envar("S3_BUCKET").String()
-
-	s3Endpoint := cmd.Flag("s3.endpoint", "S3-Compatible API endpoint for stored blocks.").
-		PlaceHolder("<api-url>").Envar("S3_ENDPOINT").String()
+	bucketConfig := registerBucketFlags(cmd)
 
-	s3AccessKey := cmd.Flag("s3.access-key", "Access key for an S3-Compatible API.").
-		PlaceHolder("<key>").Envar("S3_ACCESS_KEY").String()
+	tlsConfig := registerTLSFlags(cmd)
 
-	s3SecretKey := cmd.Flag("s3.secret-key", "Secret key for an S3-Compatible API.").
-		PlaceHolder("<key>").Envar("S3_SECRET_KEY").String()
-
-	s3Insecure := cmd.Flag("s3.insecure", "Whether to use an insecure connection with an S3-Compatible API.").
-		Default("false").Envar("S3_INSECURE").Bool()
+	encryptionKeys := registerEncryptionFlag(cmd)
 
 	peers := cmd.Flag("cluster.peers", "initial peers to join the cluster. It can be either <ip:port>, or <domain:port>").Strings()
 
@@ -104,10 +94,25 @@ func registerRule(m map[string]setupFunc, app *kingpin.Application, name string)
 	pushPullInterval := cmd.Flag("cluster.pushpull-interval", "interval for gossip state syncs . Setting this interval lower (more frequent) will increase convergence speeds across larger clusters at the expense of increased bandwidth usage.").
 		Default(cluster.DefaultPushPullInterval.String()).Duration()
 
-	clusterAdvertiseAddr := cmd.Flag("cluster.advertise-address", "explicit address to advertise in cluster").
+	clusterDescription := cmd.Flag("cluster.description", "optional human-readable description of this peer that is gossiped to the cluster, e.g. its datacenter or owning team").
+		String()
+
+	clusterAdvertiseAddr := cmd.Flag("cluster.advertise-address", "explicit address to advertise in cluster. If no port is given, the port of the cluster bind address is advertised").
 		String()
 
 	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer) error {
+		keys, err := encryptionKeys()
+		if err != nil {
+			return newConfigError(err)
+		}
+		objstoreConf, err := bucketConfig()
+		if err != nil {
+			return newConfigError(err)
+		}
+		tlsCfg, err := tlsConfig()
+		if err != nil {
+			return newConfigError(errors.Wrap(err, "parse TLS flags"))
+		}
 		lset, err := parseFlagLabels(*labelStrs)
 		if err != nil {
 			return errors.Wrap(err, "parse labels")
@@ -123,8 +128,9 @@ func registerRule(m map[string]setupFunc, app *kingpin.Application, name string)
 			*clusterAdvertiseAddr,
 			*peers,
 			cluster.PeerState{
-				Type:    cluster.PeerTypeSource,
-				APIAddr: *grpcAddr,
+				Type:        cluster.PeerTypeSource,
+				APIAddr:     *grpcAddr,
+				Description: *clusterDescription,
 				Metadata: cluster.PeerMetadata{
 					Labels: storeLset,
 					// Start out with the full time range. The shipper will constrain it later.
@@ -136,6 +142,7 @@ func registerRule(m map[string]setupFunc, app *kingpin.Application, name string)
 			true,
 			*gossipInterval,
 			*pushPullInterval,
+			0,
 		)
 		if err != nil {
 			return errors.Wrap(err, "join cluster")
@@ -148,7 +155,7 @@ func registerRule(m map[string]setupFunc, app *kingpin.Application, name string)
 			NoLockfile:       true,
 			WALFlushInterval: 30 * time.Second,
 		}
-		return runRule(g, logger, reg, tracer, lset, *alertmgrs, *httpAddr, *grpcAddr, *evalInterval, *dataDir, *ruleFiles, peer, *gcsBucket, *s3Bucket, *s3Endpoint, *s3AccessKey, *s3SecretKey, *s3Insecure, tsdbOpts)
+		return runRule(g, logger, reg, tracer, lset, *alertmgrs, *httpAddr, *grpcAddr, *grpcRecoverPanics, *evalInterval, *dataDir, *ruleFiles, peer, objstoreConf, tlsCfg, keys, tsdbOpts)
 	}
 }
 
@@ -163,16 +170,14 @@ func runRule(
 	alertmgrURLs []string,
 	httpAddr string,
 	grpcAddr string,
+	grpcRecoverPanics bool,
 	evalInterval time.Duration,
 	dataDir string,
 	ruleFiles []string,
 	peer *cluster.Peer,
-	gcsBucket string,
-	s3Bucket string,
-	s3Endpoint string,
-	s3AccessKey string,
-	s3SecretKey string,
-	s3Insecure bool,
+	objstoreConfig []byte,
+	tlsConfig *tls.Config,
+	encryptionKeys objstore.KeyWrapper,
 	tsdbOpts *tsdb.Options,
 ) error {
 	db, err := tsdb.Open(dataDir, log.With(logger, "component", "tsdb"), reg, tsdbOpts)
@@ -352,7 +357,7 @@ func runRule(
 
 		store := store.NewTSDBStore(logger, reg, db, lset)
 
-		s := grpc.NewServer(defaultGRPCServerOpts(logger, reg, tracer)...)
+		s := grpc.NewServer(defaultGRPCServerOpts(logger, reg, tracer, grpcRecoverPanics)...)
 		storepb.RegisterStoreServer(s, store)
 
 		g.Add(func() error {
@@ -390,41 +395,26 @@ func runRule(
 		uploads = true
 	)
 
-	s3Config := &s3.Config{
-		Bucket:    s3Bucket,
-		Endpoint:  s3Endpoint,
-		AccessKey: s3AccessKey,
-		SecretKey: s3SecretKey,
-		Insecure:  s3Insecure,
-	}
-
 	// The background shipper continuously scans the data directory and uploads
-	// new blocks to Google Cloud Storage or an S3-compatible storage service.
-	if gcsBucket != "" {
-		gcsClient, err := storage.NewClient(context.Background())
+	// new blocks to the configured bucket.
+	if len(objstoreConfig) > 0 {
+		var err error
+		bkt, bucket, closeFn, err = newBucketFromConfig(objstoreConfig, tlsConfig, reg)
 		if err != nil {
-			return errors.Wrap(err, "create GCS client")
+			return errors.Wrap(err, "create bucket")
 		}
-
-		bkt = gcs.NewBucket(gcsBucket, gcsClient.Bucket(gcsBucket), reg)
-		closeFn = gcsClient.Close
-		bucket = gcsBucket
-	} else if s3Config.Validate() == nil {
-		bkt, err = s3.NewBucket(s3Config, reg)
-		if err != nil {
-			return errors.Wrap(err, "create s3 client")
-		}
-
-		bucket = s3Config.Bucket
 	} else {
-		level.Info(logger).Log("msg", "No GCS or S3 bucket configured, uploads will be disabled")
+		level.Info(logger).Log("msg", "No GCS, S3, Azure, Swift, COS, OSS, HDFS or filesystem bucket configured, uploads will be disabled")
 		uploads = false
 	}
 
 	if uploads {
+		if encryptionKeys != nil {
+			bkt = objstore.EncryptedBucket(bkt, encryptionKeys)
+		}
 		bkt = objstore.BucketWithMetrics(bucket, bkt, reg)
 
-		s := shipper.New(logger, nil, dataDir, bkt, func() labels.Labels { return lset })
+		s := shipper.New(logger, nil, dataDir, bkt, func() labels.Labels { return lset }, shipper.Options{Source: block.RulerSource})
 
 		ctx, cancel := context.WithCancel(context.Background())
 
@@ -2,32 +2,43 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
 	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	"cloud.google.com/go/storage"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/improbable-eng/thanos/pkg/block"
 	"github.com/improbable-eng/thanos/pkg/cluster"
 	"github.com/improbable-eng/thanos/pkg/objstore"
-	"github.com/improbable-eng/thanos/pkg/objstore/gcs"
-	"github.com/improbable-eng/thanos/pkg/objstore/s3"
 	"github.com/improbable-eng/thanos/pkg/runutil"
 	"github.com/improbable-eng/thanos/pkg/shipper"
 	"github.com/improbable-eng/thanos/pkg/store"
 	"github.com/improbable-eng/thanos/pkg/store/storepb"
 	"github.com/oklog/run"
+	"github.com/oklog/ulid"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/tsdb/fileutil"
 	"github.com/prometheus/tsdb/labels"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
 	"gopkg.in/alecthomas/kingpin.v2"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -41,38 +52,137 @@ func registerSidecar(m map[string]setupFunc, app *kingpin.Application, name stri
 	httpAddr := cmd.Flag("http-address", "listen address for HTTP endpoints").
 		Default(defaultHTTPAddr).String()
 
+	grpcReflection := cmd.Flag("grpc.enable-reflection", "register the gRPC reflection service to allow inspecting the Store API with tools like grpcurl").
+		Default("false").Bool()
+
+	grpcRecoverPanics := cmd.Flag("grpc.recover-panics", "recover from panics in gRPC handlers and return an internal error to the client instead of crashing. Disable to crash on panics when debugging").
+		Default("true").Bool()
+
 	promURL := cmd.Flag("prometheus.url", "URL at which to reach Prometheus's API").
 		Default("http://localhost:9090").URL()
 
+	promQueryTimeout := cmd.Flag("prometheus.query-timeout", "maximum time to wait for Prometheus to answer a forwarded Store API request. 0 disables the timeout").
+		Default("2m").Duration()
+
+	seriesLimit := cmd.Flag("store.series-limit", "maximum number of series returned for a single Store API series request. Requests exceeding it are aborted. 0 disables the limit").
+		Default("0").Int()
+
+	shedWhenUnhealthy := cmd.Flag("store.shed-when-unhealthy", "reject Store API series requests right away while Prometheus is reported as down or responds slowly to heartbeats, instead of adding load to it").
+		Default("false").Bool()
+
+	shedLatencyThreshold := cmd.Flag("store.shed-latency-threshold", "heartbeat latency above which Prometheus is considered unhealthy if --store.shed-when-unhealthy is set").
+		Default("2s").Duration()
+
+	memoryLimit := cmd.Flag("store.memory-limit", "maximum size of series responses of a single request buffered in memory. Responses beyond it are spilled into a temporary file in the TSDB path before being streamed to the client, trading latency for lower memory usage. 0 streams responses directly").
+		Default("0").Bytes()
+
+	metadataCacheTTL := cmd.Flag("store.metadata-cache-ttl", "time for which label values retrieved from Prometheus are cached. 0 disables the cache").
+		Default("0s").Duration()
+
+	maxQueryRange := cmd.Flag("store.max-query-range", "maximum age of data served through the Store API. Older data must be queried from the object storage. 0 serves all data").
+		Default("0s").Duration()
+
+	configCheckInterval := cmd.Flag("prometheus.config-check-interval", "interval at which the Prometheus config is checked for reloads. A detected reload updates the external labels right away instead of on the next heartbeat. 0 disables the check").
+		Default("5s").Duration()
+
+	upFailureThreshold := cmd.Flag("prometheus.up-failure-threshold", "number of consecutive failed heartbeats after which Prometheus is reported as down").
+		Default("1").Int()
+
+	upFailureWindow := cmd.Flag("prometheus.up-failure-window", "time within which the failed heartbeats counted towards --prometheus.up-failure-threshold must occur. Counting starts over with a failure that occurs later than that after the first counted one. 0 counts all consecutive failures").
+		Default("0s").Duration()
+
+	httpHeaders := cmd.Flag("prometheus.http-header", "HTTP header to attach to all requests against Prometheus (repeated)").
+		PlaceHolder("<name>:<value>").Strings()
+
+	dnsRefreshInterval := cmd.Flag("prometheus.dns-refresh-interval", "interval after which the host name of the Prometheus URL is resolved again. It is also resolved again after connecting fails").
+		Default("30s").Duration()
+
+	fallbackLabels := cmd.Flag("prometheus.external-label", "external label to use if Prometheus refuses to serve its configuration (repeated). If none is given, the config file named in the flags of Prometheus is read instead").
+		PlaceHolder("<name>=\"<value>\"").Strings()
+
+	overrideLabels := cmd.Flag("external-labels.override", "external labels that are advertised instead of the ones configured in Prometheus. Intended for testing only").
+		PlaceHolder("<name>=<value>,...").String()
+
 	dataDir := cmd.Flag("tsdb.path", "data directory of TSDB").
 		Default("./data").String()
 
-	gcsBucket := cmd.Flag("gcs.bucket", "Google Cloud Storage bucket name for stored blocks. If empty sidecar won't store any block inside Google Cloud Storage").
-		PlaceHolder("<bucket>").String()
+	maxLabelCount := cmd.Flag("external-labels.max-count", "maximum number of external labels that are published to the cluster. Label sets exceeding it are rejected. 0 disables the limit").
+		Default("64").Int()
+
+	labelsGracePeriod := cmd.Flag("external-labels.grace-period", "time after which the external labels persisted by a previous run are used if they cannot be fetched from Prometheus on startup").
+		Default("1m").Duration()
+
+	maxLabelSize := cmd.Flag("external-labels.max-size", "maximum total size of external label names and values that are published to the cluster. Label sets exceeding it are rejected. 0 disables the limit").
+		Default("8KB").Bytes()
+
+	bucketConfig := registerBucketFlags(cmd)
+
+	tlsConfig := registerTLSFlags(cmd)
+
+	encryptionKeys := registerEncryptionFlag(cmd)
+
+	uploadOrder := cmd.Flag("shipper.upload-order", "order in which new blocks are uploaded based on their oldest sample").
+		Default(string(shipper.UploadOldestFirst)).Enum(string(shipper.UploadOldestFirst), string(shipper.UploadNewestFirst))
+
+	uploadVerifyTimeout := cmd.Flag("shipper.upload-verify-timeout", "time within which an uploaded block must become visible in the bucket before the upload is considered successful. 0 disables the verification").
+		Default("10s").Duration()
+
+	uploadTimeout := cmd.Flag("shipper.block-upload-timeout", "maximum time for uploading a single block. Objects of an aborted upload are deleted and the block is retried on the next sync. 0 disables the timeout").
+		Default("0s").Duration()
+
+	uploadBandwidth := cmd.Flag("shipper.upload-bandwidth-limit", "maximum bandwidth in bytes per second used by all block uploads combined, e.g. 10MB. 0 disables the limit").
+		Default("0").Bytes()
+
+	uploadConcurrency := cmd.Flag("shipper.upload-concurrency", "number of files of a block that are uploaded concurrently. The meta file is always uploaded last, once all other files of the block were uploaded").
+		Default("1").Int()
+
+	maxBlockAge := cmd.Flag("shipper.max-block-age", "maximum age of the most recent data in a block for it to be uploaded. Older blocks are skipped and left to age out of the local retention. 0 uploads all blocks").
+		Default("0s").Duration()
 
-	s3Bucket := cmd.Flag("s3.bucket", "S3-Compatible API bucket name for stored blocks.").
-		PlaceHolder("<bucket>").Envar("S3_BUCKET").String()
+	uploadManifest := cmd.Flag("shipper.upload-manifest", "maintain a manifest of uploaded blocks in the bucket under shipper/<external labels hash>/uploads.json").
+		Default("false").Bool()
 
-	s3Endpoint := cmd.Flag("s3.endpoint", "S3-Compatible API endpoint for stored blocks.").
-		PlaceHolder("<api-url>").Envar("S3_ENDPOINT").String()
+	uploadTombstones := cmd.Flag("shipper.upload-tombstones", "upload the tombstones file of blocks, which records deletions, along with their meta file, index and chunks").
+		Default("false").Bool()
 
-	s3AccessKey := cmd.Flag("s3.access-key", "Access key for an S3-Compatible API.").
-		PlaceHolder("<key>").Envar("S3_ACCESS_KEY").String()
+	verifyChecksums := cmd.Flag("shipper.verify-checksums", "verify every uploaded object against its local file, by its ETag if it is the file's MD5 checksum or else by reading it back. Blocks that do not match are deleted from the bucket and uploaded again on the next sync. Reading objects back costs bandwidth").
+		Default("true").Bool()
 
-	s3SecretKey := cmd.Flag("s3.secret-key", "Secret key for an S3-Compatible API.").
-		PlaceHolder("<key>").Envar("S3_SECRET_KEY").String()
+	startupCheck := cmd.Flag("objstore.startup-check", "verify on startup that objects can be written to, read from and deleted from the bucket").
+		Default("true").Bool()
 
-	s3Insecure := cmd.Flag("s3.insecure", "Whether to use an insecure connection with an S3-Compatible API.").
-		Default("false").Envar("S3_INSECURE").Bool()
+	auditLog := cmd.Flag("objstore.audit-log", "log every write and delete operation against the object storage bucket").
+		Default("false").Bool()
+
+	slowOpThreshold := cmd.Flag("objstore.slow-op-threshold", "log every object storage operation that takes longer than this duration, along with the object, its size and the time taken. 0 disables logging of slow operations").
+		Default("0s").Duration()
+
+	metricsRelabelConfig := cmd.Flag("metrics.relabel-config", "path to a YAML file with a list of relabeling rules applied to the sidecar's own metrics before they are served on /metrics. Only the keep and drop actions are supported. Metrics dropped by the rules are not exposed").
+		PlaceHolder("<path>").String()
 
 	peers := cmd.Flag("cluster.peers", "initial peers to join the cluster. It can be either <ip:port>, or <domain:port>").Strings()
 
 	clusterBindAddr := cmd.Flag("cluster.address", "listen address for cluster").
 		Default(defaultClusterAddr).String()
 
-	clusterAdvertiseAddr := cmd.Flag("cluster.advertise-address", "explicit address to advertise in cluster").
+	strictUniqueLabels := cmd.Flag("cluster.strict-unique-labels", "exit if another sidecar in the cluster advertises identical external labels instead of only logging an error").
+		Default("false").Bool()
+
+	clusterDescription := cmd.Flag("cluster.description", "optional human-readable description of this peer that is gossiped to the cluster, e.g. its datacenter or owning team").
 		String()
 
+	clusterAdvertiseAddr := cmd.Flag("cluster.advertise-address", "explicit address to advertise in cluster. If no port is given, the port of the cluster bind address is advertised").
+		String()
+
+	joinTimeout := cmd.Flag("cluster.join-timeout", "time within which at least one of the initial peers must be reachable. Joining is retried with backoff until then and the sidecar fails afterwards. 0 starts out alone if no peer is reachable").
+		Default("0s").Duration()
+
+	bootstrapExpect := cmd.Flag("cluster.bootstrap-expect", "number of cluster members, including this sidecar, that must be visible before the cluster is considered formed. Until then /-/ready reports the sidecar as not ready. The Store API is served regardless").
+		Default("0").Int()
+
+	bootstrapTimeout := cmd.Flag("cluster.bootstrap-timeout", "time after which the sidecar reports ready even if fewer members than expected by --cluster.bootstrap-expect are visible. 0 waits indefinitely").
+		Default("5m").Duration()
+
 	gossipInterval := cmd.Flag("cluster.gossip-interval", "interval between sending gossip messages. By lowering this value (more frequent) gossip messages are propagated across the cluster more quickly at the expense of increased bandwidth.").
 		Default(cluster.DefaultGossipInterval.String()).Duration()
 
@@ -80,78 +190,281 @@ func registerSidecar(m map[string]setupFunc, app *kingpin.Application, name stri
 		Default(cluster.DefaultPushPullInterval.String()).Duration()
 
 	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer) error {
-		return runSidecar(g, logger, reg, tracer, *grpcAddr, *httpAddr, *promURL, *dataDir, *clusterBindAddr, *clusterAdvertiseAddr, *peers, *gossipInterval, *pushPullInterval, *gcsBucket, *s3Bucket, *s3Endpoint, *s3AccessKey, *s3SecretKey, *s3Insecure)
+		keys, err := encryptionKeys()
+		if err != nil {
+			return newConfigError(err)
+		}
+		objstoreConf, err := bucketConfig()
+		if err != nil {
+			return newConfigError(err)
+		}
+		tlsCfg, err := tlsConfig()
+		if err != nil {
+			return newConfigError(errors.Wrap(err, "parse TLS flags"))
+		}
+		fallbackLset, err := parseFlagLabels(*fallbackLabels)
+		if err != nil {
+			return newConfigError(errors.Wrap(err, "parse fallback external labels"))
+		}
+		overrideLset, err := parseOverrideLabels(*overrideLabels)
+		if err != nil {
+			return newConfigError(errors.Wrap(err, "parse overridden external labels"))
+		}
+		headers, err := parseHTTPHeaders(*httpHeaders)
+		if err != nil {
+			return newConfigError(errors.Wrap(err, "parse Prometheus HTTP headers"))
+		}
+		relabelCfgs, err := loadMetricsRelabelConfig(*metricsRelabelConfig)
+		if err != nil {
+			return newConfigError(err)
+		}
+		return runSidecar(g, logger, reg, tracer, sidecarConfig{
+			grpcAddr:          *grpcAddr,
+			grpcReflection:    *grpcReflection,
+			grpcRecoverPanics: *grpcRecoverPanics,
+			httpAddr:          *httpAddr,
+			dataDir:           *dataDir,
+			prometheus: promConfig{
+				url:                 *promURL,
+				httpHeaders:         headers,
+				dnsRefreshInterval:  *dnsRefreshInterval,
+				upFailureThreshold:  *upFailureThreshold,
+				upFailureWindow:     *upFailureWindow,
+				configCheckInterval: *configCheckInterval,
+			},
+			extLabels: extLabelsConfig{
+				fallback:    fallbackLset,
+				override:    overrideLset,
+				maxCount:    *maxLabelCount,
+				maxSize:     int(*maxLabelSize),
+				gracePeriod: *labelsGracePeriod,
+			},
+			store: store.PrometheusStoreOptions{
+				QueryTimeout:     *promQueryTimeout,
+				MaxQueryRange:    *maxQueryRange,
+				SeriesLimit:      *seriesLimit,
+				MetadataCacheTTL: *metadataCacheTTL,
+				MemoryLimit:      int(*memoryLimit),
+			},
+			shedWhenUnhealthy:    *shedWhenUnhealthy,
+			shedLatencyThreshold: *shedLatencyThreshold,
+			cluster: clusterConfig{
+				bindAddr:           *clusterBindAddr,
+				advertiseAddr:      *clusterAdvertiseAddr,
+				description:        *clusterDescription,
+				peers:              *peers,
+				joinTimeout:        *joinTimeout,
+				bootstrapExpect:    *bootstrapExpect,
+				bootstrapTimeout:   *bootstrapTimeout,
+				gossipInterval:     *gossipInterval,
+				pushPullInterval:   *pushPullInterval,
+				strictUniqueLabels: *strictUniqueLabels,
+			},
+			bucket: sidecarBucketConfig{
+				objstoreConfig:  objstoreConf,
+				tlsConfig:       tlsCfg,
+				encryptionKeys:  keys,
+				startupCheck:    *startupCheck,
+				auditLog:        *auditLog,
+				slowOpThreshold: *slowOpThreshold,
+			},
+			shipper: shipper.Options{
+				Order:             shipper.UploadOrder(*uploadOrder),
+				UploadManifest:    *uploadManifest,
+				UploadTombstones:  *uploadTombstones,
+				VerifyChecksums:   *verifyChecksums,
+				VerifyTimeout:     *uploadVerifyTimeout,
+				UploadTimeout:     *uploadTimeout,
+				UploadBandwidth:   int64(*uploadBandwidth),
+				UploadConcurrency: *uploadConcurrency,
+				MaxBlockAge:       *maxBlockAge,
+				Source:            block.SidecarSource,
+			},
+			metricsRelabelConfigs: relabelCfgs,
+			flags:                 resolvedFlags(app, cmd),
+		})
 	}
 }
 
+// sidecarConfig holds the settings of a sidecar as given by its flags.
+type sidecarConfig struct {
+	grpcAddr          string
+	grpcReflection    bool
+	grpcRecoverPanics bool
+	httpAddr          string
+	// dataDir is the TSDB directory of Prometheus.
+	dataDir string
+
+	prometheus promConfig
+	extLabels  extLabelsConfig
+	// store configures the Store API. Its health check, spill directory and timestamps
+	// are set by the sidecar.
+	store store.PrometheusStoreOptions
+	// shedWhenUnhealthy rejects Store API requests while Prometheus is down or its
+	// heartbeats take longer than shedLatencyThreshold.
+	shedWhenUnhealthy    bool
+	shedLatencyThreshold time.Duration
+
+	cluster clusterConfig
+	bucket  sidecarBucketConfig
+	shipper shipper.Options
+
+	metricsRelabelConfigs []*metricsRelabelConfig
+	// flags are the values of all flags, which are served for inspection.
+	flags map[string]string
+}
+
+// promConfig describes how the sidecar talks to Prometheus.
+type promConfig struct {
+	url                *url.URL
+	httpHeaders        http.Header
+	dnsRefreshInterval time.Duration
+	// upFailureThreshold is the number of consecutive failed heartbeats after which
+	// Prometheus is reported as down.
+	upFailureThreshold int
+	// upFailureWindow is the time within which the failures counted towards
+	// upFailureThreshold must occur. Zero disables the window.
+	upFailureWindow time.Duration
+	// configCheckInterval is the interval at which config reloads are checked for. Zero
+	// disables the check.
+	configCheckInterval time.Duration
+}
+
+// extLabelsConfig describes where external labels come from and which ones are accepted.
+type extLabelsConfig struct {
+	fallback labels.Labels
+	override labels.Labels
+	maxCount int
+	maxSize  int
+	// gracePeriod is the time after which labels persisted by a previous run are used if
+	// Prometheus cannot be reached on startup.
+	gracePeriod time.Duration
+}
+
+// clusterConfig describes how the sidecar joins the gossip cluster.
+type clusterConfig struct {
+	bindAddr           string
+	advertiseAddr      string
+	description        string
+	peers              []string
+	joinTimeout        time.Duration
+	bootstrapExpect    int
+	bootstrapTimeout   time.Duration
+	gossipInterval     time.Duration
+	pushPullInterval   time.Duration
+	strictUniqueLabels bool
+}
+
+// sidecarBucketConfig describes the bucket blocks are shipped to. Uploads are disabled if
+// objstoreConfig is empty.
+type sidecarBucketConfig struct {
+	objstoreConfig  []byte
+	tlsConfig       *tls.Config
+	encryptionKeys  objstore.KeyWrapper
+	startupCheck    bool
+	auditLog        bool
+	slowOpThreshold time.Duration
+}
+
 func runSidecar(
 	g *run.Group,
 	logger log.Logger,
 	reg *prometheus.Registry,
 	tracer opentracing.Tracer,
-	grpcAddr string,
-	httpAddr string,
-	promURL *url.URL,
-	dataDir string,
-	clusterBindAddr string,
-	clusterAdvertiseAddr string,
-	knownPeers []string,
-	gossipInterval time.Duration,
-	pushPullInterval time.Duration,
-	gcsBucket string,
-	s3Bucket string,
-	s3Endpoint string,
-	s3AccessKey string,
-	s3SecretKey string,
-	s3Insecure bool,
+	conf sidecarConfig,
 ) error {
-	externalLabels := &extLabelSet{promURL: promURL}
+	if err := validateDataDir(conf.dataDir); err != nil {
+		return newConfigError(err)
+	}
+	// All requests against Prometheus share a client, which follows Prometheus
+	// to a new address once its host name resolves differently.
+	var promTransport http.RoundTripper = newPrometheusTransport(newResolvingDialer(conf.prometheus.dnsRefreshInterval))
+	if len(conf.prometheus.httpHeaders) > 0 {
+		promTransport = &headerRoundTripper{rt: promTransport, headers: conf.prometheus.httpHeaders}
+	}
+	promClient := &http.Client{Transport: promTransport}
 
-	// Blocking query of external labels before anything else.
-	// We retry infinitely until we reach and fetch labels from our Prometheus.
-	{
-		ctx := context.Background()
-		err := runutil.Retry(2*time.Second, ctx.Done(), func() error {
-			err := externalLabels.Update(ctx)
-			if err != nil {
-				level.Warn(logger).Log(
-					"msg", "failed to fetch initial external labels. Retrying",
-					"err", err,
-				)
-			}
-			return err
-		})
-		if err != nil {
+	configReloads := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_sidecar_prometheus_config_reloads_total",
+		Help: "Total number of detected reloads of a changed Prometheus configuration.",
+	})
+	externalLabels := &extLabelSet{
+		logger:   logger,
+		client:   promClient,
+		promURL:  conf.prometheus.url,
+		fallback: conf.extLabels.fallback,
+		override: conf.extLabels.override,
+		maxCount: conf.extLabels.maxCount,
+		maxSize:  conf.extLabels.maxSize,
+		dir:      conf.dataDir,
+		reloads:  configReloads,
+	}
+	if len(conf.extLabels.fallback) > 0 {
+		level.Info(logger).Log(
+			"msg", "external labels are read from the Prometheus config endpoint first, falling back to the labels given by flag if it is unavailable",
+			"fallback", conf.extLabels.fallback.String(),
+		)
+	} else if len(conf.extLabels.override) == 0 {
+		level.Info(logger).Log(
+			"msg", "external labels are read from the Prometheus config endpoint first, falling back to the config file named in the Prometheus flags if it is unavailable",
+		)
+	}
+
+	if len(conf.extLabels.override) > 0 {
+		if err := checkLabelLimits(conf.extLabels.override, conf.extLabels.maxCount, conf.extLabels.maxSize); err != nil {
+			return newConfigError(errors.Wrap(err, "check overridden external labels"))
+		}
+		level.Warn(logger).Log(
+			"msg", "EXTERNAL LABELS ARE OVERRIDDEN. The labels configured in Prometheus are ignored. Do not use this in production",
+			"labels", conf.extLabels.override.String(),
+		)
+	} else {
+		// Blocking query of external labels before anything else.
+		// We retry infinitely until we reach and fetch labels from our Prometheus, unless
+		// we can fall back to labels persisted by a previous run after the grace period.
+		if err := initExternalLabels(logger, externalLabels, conf.extLabels.gracePeriod); err != nil {
 			return errors.Wrap(err, "initial external labels query")
 		}
 	}
 
-	peer, err := cluster.Join(logger, reg, clusterBindAddr, clusterAdvertiseAddr, knownPeers,
+	peer, err := cluster.Join(logger, reg, conf.cluster.bindAddr, conf.cluster.advertiseAddr, conf.cluster.peers,
 		cluster.PeerState{
-			Type:    cluster.PeerTypeSource,
-			APIAddr: grpcAddr,
+			Type:        cluster.PeerTypeSource,
+			APIAddr:     conf.grpcAddr,
+			Description: conf.cluster.description,
 			Metadata: cluster.PeerMetadata{
 				Labels: externalLabels.GetPB(),
-				// Start out with the full time range. The shipper will constrain it later.
-				// TODO(fabxc): minimum timestamp is never adjusted if shipping is disabled.
-				MinTime: 0,
+				// Start out with the full time range. It is constrained later based on
+				// the blocks found in the data directory.
+				MinTime: clampMinTime(time.Now(), 0, conf.store.MaxQueryRange),
 				MaxTime: math.MaxInt64,
 			},
 		}, false,
-		gossipInterval,
-		pushPullInterval,
+		conf.cluster.gossipInterval,
+		conf.cluster.pushPullInterval,
+		conf.cluster.joinTimeout,
 	)
 	if err != nil {
 		return errors.Wrap(err, "join cluster")
 	}
 
+	// Handlers may be registered on the mux after it started serving.
+	mux := http.NewServeMux()
+
 	// Setup all the concurrent groups.
 	{
-		mux := http.NewServeMux()
-		registerMetrics(mux, reg)
+		registerMetrics(mux, newRelabelGatherer(reg, conf.metricsRelabelConfigs))
 		registerProfile(mux)
+		registerFlagsStatus(mux, conf.flags)
+		registerStoreSD(mux, func() []cluster.PeerState {
+			return peer.PeerStates(cluster.PeerTypeSource)
+		})
+		registerReady(mux, newBootstrapReadiness(logger, conf.cluster.bootstrapExpect, conf.cluster.bootstrapTimeout, peer.ClusterSize, time.Now).Ready)
 
-		l, err := net.Listen("tcp", httpAddr)
+		// On Unix systems net.Listen sets SO_REUSEADDR on listening sockets. Restarts can
+		// therefore bind the address immediately, even while connections of the previous
+		// process are still in TIME_WAIT.
+		l, err := net.Listen("tcp", conf.httpAddr)
 		if err != nil {
 			return errors.Wrap(err, "listen metrics address")
 		}
@@ -162,23 +475,33 @@ func runSidecar(
 			l.Close()
 		})
 	}
+	// The health of Prometheus is updated by the heartbeat.
+	promHealth := &healthState{maxLatency: conf.shedLatencyThreshold}
 	{
-		l, err := net.Listen("tcp", grpcAddr)
+		l, err := net.Listen("tcp", conf.grpcAddr)
 		if err != nil {
 			return errors.Wrap(err, "listen API address")
 		}
 		logger := log.With(logger, "component", "store")
 
-		var client http.Client
-
-		promStore, err := store.NewPrometheusStore(
-			logger, prometheus.DefaultRegisterer, &client, promURL, externalLabels.Get)
+		var healthy func() bool
+		if conf.shedWhenUnhealthy {
+			healthy = promHealth.Healthy
+		}
+		storeOpts := conf.store
+		storeOpts.Healthy = healthy
+		storeOpts.SpillDir = conf.dataDir
+		storeOpts.Timestamps = peer.Timestamps
+		promStore, err := store.NewPrometheusStore(logger, reg, promClient, conf.prometheus.url, externalLabels.Get, storeOpts)
 		if err != nil {
 			return errors.Wrap(err, "create Prometheus store")
 		}
 
-		s := grpc.NewServer(defaultGRPCServerOpts(logger, reg, tracer)...)
+		s := grpc.NewServer(defaultGRPCServerOpts(logger, reg, tracer, conf.grpcRecoverPanics)...)
 		storepb.RegisterStoreServer(s, promStore)
+		if conf.grpcReflection {
+			reflection.Register(s)
+		}
 
 		g.Add(func() error {
 			return errors.Wrap(s.Serve(l), "serve gRPC")
@@ -190,39 +513,49 @@ func runSidecar(
 	// Periodically query the Prometheus config. We use this as a heartbeat as well as for updating
 	// the external labels we apply.
 	{
-		promUp := prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "thanos_sidecar_prometheus_up",
-			Help: "Boolean indicator whether the sidecar can reach its Prometheus peer.",
-		})
-		lastHeartbeat := prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "thanos_sidecar_last_heartbeat_success_time_seconds",
-			Help: "Second timestamp of the last successful heartbeat.",
-		})
-		reg.MustRegister(promUp, lastHeartbeat)
+		reg.MustRegister(configReloads)
+
+		hb := &heartbeat{
+			logger:             logger,
+			metrics:            newHeartbeatMetrics(reg),
+			labels:             externalLabels,
+			peer:               peer,
+			upStatus:           &upStatus{threshold: conf.prometheus.upFailureThreshold, window: conf.prometheus.upFailureWindow},
+			health:             promHealth,
+			strictUniqueLabels: conf.cluster.strictUniqueLabels,
+			now:                time.Now,
+		}
+		// A detected config reload triggers a heartbeat right away.
+		reloadc := make(chan struct{}, 1)
 
 		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
-			return runutil.Repeat(30*time.Second, ctx.Done(), func() error {
-				iterCtx, iterCancel := context.WithTimeout(context.Background(), 5*time.Second)
-				defer iterCancel()
-
-				err := externalLabels.Update(iterCtx)
-				if err != nil {
-					level.Warn(logger).Log("msg", "heartbeat failed", "err", err)
-					promUp.Set(0)
-				} else {
-					// Update gossip.
-					peer.SetLabels(externalLabels.GetPB())
+			tick := time.NewTicker(30 * time.Second)
+			defer tick.Stop()
 
-					promUp.Set(1)
-					lastHeartbeat.Set(float64(time.Now().Unix()))
+			for {
+				if err := hb.once(ctx); err != nil {
+					return err
 				}
-
-				return nil
-			})
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-tick.C:
+				case <-reloadc:
+				}
+			}
 		}, func(error) {
 			cancel()
 		})
+
+		if conf.prometheus.configCheckInterval > 0 && len(conf.extLabels.override) == 0 {
+			ctx, cancel := context.WithCancel(context.Background())
+			g.Add(func() error {
+				return watchConfigReloads(ctx, logger, externalLabels, conf.prometheus.configCheckInterval, reloadc)
+			}, func(error) {
+				cancel()
+			})
+		}
 	}
 
 	var (
@@ -233,41 +566,40 @@ func runSidecar(
 		uploads bool = true
 	)
 
-	s3Config := &s3.Config{
-		Bucket:    s3Bucket,
-		Endpoint:  s3Endpoint,
-		AccessKey: s3AccessKey,
-		SecretKey: s3SecretKey,
-		Insecure:  s3Insecure,
-	}
-
 	// The background shipper continuously scans the data directory and uploads
-	// new blocks to Google Cloud Storage or an S3-compatible storage service.
-	if gcsBucket != "" {
-		gcsClient, err := storage.NewClient(context.Background())
-		if err != nil {
-			return errors.Wrap(err, "create GCS client")
-		}
-
-		bkt = gcs.NewBucket(gcsBucket, gcsClient.Bucket(gcsBucket), reg)
-		closeFn = gcsClient.Close
-		bucket = gcsBucket
-	} else if s3Config.Validate() == nil {
-		bkt, err = s3.NewBucket(s3Config, reg)
+	// new blocks to the configured bucket.
+	if len(conf.bucket.objstoreConfig) > 0 {
+		var err error
+		bkt, bucket, closeFn, err = newBucketFromConfig(conf.bucket.objstoreConfig, conf.bucket.tlsConfig, reg)
 		if err != nil {
-			return errors.Wrap(err, "create s3 client")
+			return errors.Wrap(err, "create bucket")
 		}
-
-		bucket = s3Config.Bucket
 	} else {
 		uploads = false
-		level.Info(logger).Log("msg", "No GCS or S3 bucket were configured, uploads will be disabled")
+		level.Info(logger).Log("msg", "No GCS, S3, Azure, Swift, COS, OSS, HDFS or filesystem bucket were configured, uploads will be disabled")
 	}
 
 	if uploads {
+		if conf.bucket.encryptionKeys != nil {
+			bkt = objstore.EncryptedBucket(bkt, conf.bucket.encryptionKeys)
+		}
 		bkt = objstore.BucketWithMetrics(bucket, bkt, reg)
+		bkt = objstore.TracingBucket(bkt, tracer)
+		bkt = objstore.BucketWithSlowOpLog(bkt, logger, conf.bucket.slowOpThreshold)
+		if conf.bucket.auditLog {
+			bkt = objstore.BucketWithAuditLog(bkt, logger)
+		}
+		if conf.bucket.startupCheck {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := objstore.CheckWritable(ctx, bkt)
+			cancel()
+			if err != nil {
+				return errors.Wrapf(err, "bucket %s is not writable", bucket)
+			}
+		}
 
-		s := shipper.New(logger, nil, dataDir, bkt, externalLabels.Get)
+		s := shipper.New(logger, reg, conf.dataDir, bkt, externalLabels.Get, conf.shipper)
+		registerShipperControl(mux, logger, s)
 
 		ctx, cancel := context.WithCancel(context.Background())
 
@@ -275,13 +607,23 @@ func runSidecar(
 			defer closeFn()
 
 			return runutil.Repeat(30*time.Second, ctx.Done(), func() error {
-				s.Sync(ctx)
+				shipOnce(ctx, logger, s, peer, conf.store.MaxQueryRange, time.Now)
+				return nil
+			})
+		}, func(error) {
+			cancel()
+		})
+	} else {
+		// Without a shipper we still advertise the time range of locally available data.
+		ctx, cancel := context.WithCancel(context.Background())
 
-				minTime, _, err := s.Timestamps()
+		g.Add(func() error {
+			return runutil.Repeat(30*time.Second, ctx.Done(), func() error {
+				minTime, err := localMinTime(logger, conf.dataDir)
 				if err != nil {
-					level.Warn(logger).Log("msg", "reading timestamps failed", "err", err)
+					level.Warn(logger).Log("msg", "reading local timestamps failed", "err", err)
 				} else {
-					peer.SetTimestamps(minTime, math.MaxInt64)
+					peer.SetTimestamps(clampMinTime(time.Now(), minTime, conf.store.MaxQueryRange), math.MaxInt64)
 				}
 				return nil
 			})
@@ -294,27 +636,738 @@ func runSidecar(
 	return nil
 }
 
+// validateDataDir checks that the TSDB directory exists and its contents can be listed.
+// Otherwise the shipper would silently find no blocks to upload.
+func validateDataDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return errors.Wrapf(err, "invalid TSDB path %s", dir)
+	}
+	if !fi.IsDir() {
+		return errors.Errorf("invalid TSDB path %s: not a directory", dir)
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "invalid TSDB path %s", dir)
+	}
+	defer f.Close()
+
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return errors.Wrapf(err, "invalid TSDB path %s", dir)
+	}
+	return nil
+}
+
+// registerShipperControl registers endpoints to pause and resume uploads of the shipper,
+// e.g. during maintenance of the object storage.
+func registerShipperControl(mux *http.ServeMux, logger log.Logger, s *shipper.Shipper) {
+	handle := func(f func(), msg string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "only POST requests are allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			f()
+			level.Info(logger).Log("msg", msg)
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+	mux.Handle("/-/shipper/pause", handle(s.Pause, "shipping paused"))
+	mux.Handle("/-/shipper/resume", handle(s.Resume, "shipping resumed"))
+}
+
+// targetGroup is a group of targets sharing the same labels in the Prometheus file SD format.
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// storeSDTargetGroups groups the Store API addresses of the given peers by their labels.
+// Groups and targets are sorted to produce stable output.
+func storeSDTargetGroups(states []cluster.PeerState) []targetGroup {
+	groups := map[string]*targetGroup{}
+
+	for _, s := range states {
+		if s.APIAddr == "" {
+			continue
+		}
+		lset := make(labels.Labels, 0, len(s.Metadata.Labels))
+		for _, l := range s.Metadata.Labels {
+			lset = append(lset, labels.Label{Name: l.Name, Value: l.Value})
+		}
+		sort.Sort(lset)
+
+		key := lset.String()
+		g, ok := groups[key]
+		if !ok {
+			g = &targetGroup{Labels: lset.Map()}
+			groups[key] = g
+		}
+		g.Targets = append(g.Targets, s.APIAddr)
+	}
+	res := make([]targetGroup, 0, len(groups))
+	for _, g := range groups {
+		sort.Strings(g.Targets)
+		res = append(res, *g)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Targets[0] < res[j].Targets[0]
+	})
+	return res
+}
+
+// registerStoreSD registers an endpoint that exports the Store API addresses of the
+// source peers in the cluster in the Prometheus file SD format. It allows to snapshot
+// the cluster into a static configuration.
+func registerStoreSD(mux *http.ServeMux, states func() []cluster.PeerState) {
+	mux.HandleFunc("/api/v1/cluster/store-sd", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET requests are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(storeSDTargetGroups(states()))
+	})
+}
+
+// clampMinTime returns the given minimum timestamp, limited to the maximum query range
+// before now. A zero range does not limit the timestamp.
+func clampMinTime(now time.Time, minTime int64, maxQueryRange time.Duration) int64 {
+	if maxQueryRange <= 0 {
+		return minTime
+	}
+	if mint := timestamp.FromTime(now.Add(-maxQueryRange)); minTime < mint {
+		return mint
+	}
+	return minTime
+}
+
+// localMinTime returns the minimum timestamp of all blocks in the TSDB directory.
+// It returns 0 if no blocks exist yet as the in-memory head block may hold data of any age.
+func localMinTime(logger log.Logger, dir string) (int64, error) {
+	names, err := fileutil.ReadDir(dir)
+	if err != nil {
+		return 0, errors.Wrap(err, "read dir")
+	}
+	minTime := int64(math.MaxInt64)
+
+	for _, n := range names {
+		if _, err := ulid.Parse(n); err != nil {
+			continue
+		}
+		m, err := block.ReadMetaFile(filepath.Join(dir, n))
+		if err != nil {
+			level.Warn(logger).Log("msg", "reading meta file failed", "block", n, "err", err)
+			continue
+		}
+		if m.MinTime < minTime {
+			minTime = m.MinTime
+		}
+	}
+	if minTime == math.MaxInt64 {
+		return 0, nil
+	}
+	return minTime, nil
+}
+
 type extLabelSet struct {
+	logger  log.Logger
+	client  *http.Client
 	promURL *url.URL
+	// fallback labels are used if Prometheus does not expose its configuration.
+	fallback labels.Labels
+	// override labels are used instead of the ones configured in Prometheus if set.
+	// Updates then only check whether Prometheus is healthy.
+	override labels.Labels
+	// maxCount and maxSize limit the label sets that are accepted. Zero disables a limit.
+	maxCount int
+	maxSize  int
+	// dir is the directory in which the last valid label set is persisted.
+	// If empty, labels are not persisted.
+	dir string
 
 	mtx    sync.Mutex
 	labels labels.Labels
+	// configHash is the hash of the last Prometheus configuration that was seen.
+	configHash uint64
+	// reloads is incremented if a changed configuration is seen. It may be nil.
+	reloads prometheus.Counter
 }
 
 func (s *extLabelSet) Update(ctx context.Context) error {
-	elset, err := queryExternalLabels(ctx, s.promURL)
+	client := s.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if len(s.override) > 0 {
+		return checkPrometheusHealthy(ctx, client, s.promURL)
+	}
+	var elset labels.Labels
+	cfg, err := queryConfig(ctx, client, s.promURL)
+	if err == nil {
+		s.setConfigHash(configHash(cfg))
+		elset, err = parseExternalLabels(cfg)
+	}
+	if errors.Cause(err) == errConfigUnavailable {
+		elset, err = s.fallbackLabels(ctx, client, err)
+	}
 	if err != nil {
 		return err
 	}
+	if err := checkLabelLimits(elset, s.maxCount, s.maxSize); err != nil {
+		return err
+	}
 
 	s.mtx.Lock()
+	changed := !labels.Equal(s.labels, elset)
 	s.labels = elset
 	s.mtx.Unlock()
 
+	if changed && s.dir != "" {
+		if err := writeExtLabelsFile(s.dir, elset); err != nil {
+			level.Warn(s.logger).Log("msg", "persisting external labels failed", "err", err)
+		}
+	}
+	return nil
+}
+
+// fallbackLabels returns the external labels to use if Prometheus refuses to serve its configuration.
+// Labels given by flag take precedence. Otherwise the configuration file named in the flags of
+// Prometheus is read, which requires the sidecar to share the file system with Prometheus.
+func (s *extLabelSet) fallbackLabels(ctx context.Context, client *http.Client, cause error) (labels.Labels, error) {
+	if len(s.fallback) > 0 {
+		level.Debug(s.logger).Log("msg", "Prometheus config endpoint unavailable, using external labels given by flag", "err", cause)
+		return s.fallback, nil
+	}
+	level.Debug(s.logger).Log("msg", "Prometheus config endpoint unavailable, reading the config file named in the Prometheus flags", "err", cause)
+
+	fn, err := queryConfigFile(ctx, client, s.promURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s, and no external labels given by flag", cause)
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s, and read config file named in the Prometheus flags", cause)
+	}
+	return parseExternalLabels(string(b))
+}
+
+func (s *extLabelSet) setConfigHash(h uint64) (changed bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	changed = s.configHash != 0 && s.configHash != h
+	s.configHash = h
+
+	if changed && s.reloads != nil {
+		s.reloads.Inc()
+	}
+	return changed
+}
+
+// CheckReload fetches the Prometheus configuration and reports whether it changed since it
+// was last seen, which indicates that Prometheus reloaded a modified configuration.
+// Labels are not updated.
+func (s *extLabelSet) CheckReload(ctx context.Context) (bool, error) {
+	if len(s.override) > 0 {
+		return false, nil
+	}
+	client := s.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	cfg, err := queryConfig(ctx, client, s.promURL)
+	if err != nil {
+		return false, err
+	}
+	return s.setConfigHash(configHash(cfg)), nil
+}
+
+// watchConfigReloads checks for reloads of the Prometheus config at the given interval
+// and notifies reloadc of detected reloads until ctx is canceled.
+func watchConfigReloads(ctx context.Context, logger log.Logger, s *extLabelSet, interval time.Duration, reloadc chan<- struct{}) error {
+	return runutil.Repeat(interval, ctx.Done(), func() error {
+		iterCtx, iterCancel := context.WithTimeout(ctx, 5*time.Second)
+		defer iterCancel()
+
+		reloaded, err := s.CheckReload(iterCtx)
+		if err != nil {
+			level.Debug(logger).Log("msg", "checking for Prometheus config reload failed", "err", err)
+			return nil
+		}
+		if reloaded {
+			level.Info(logger).Log("msg", "Prometheus config reload detected, updating external labels")
+			select {
+			case reloadc <- struct{}{}:
+			default:
+			}
+		}
+		return nil
+	})
+}
+
+// LoadPersisted sets the labels to the ones persisted by a previous successful update.
+func (s *extLabelSet) LoadPersisted() error {
+	elset, err := readExtLabelsFile(s.dir)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	s.labels = elset
+	s.mtx.Unlock()
+
+	return nil
+}
+
+// initExternalLabels fetches the initial external labels from Prometheus. If this does not
+// succeed within the grace period, persisted labels are used if available. Otherwise
+// it retries infinitely.
+func initExternalLabels(logger log.Logger, s *extLabelSet, gracePeriod time.Duration) error {
+	update := func() error {
+		err := s.Update(context.Background())
+		if err != nil {
+			level.Warn(logger).Log(
+				"msg", "failed to fetch initial external labels. Retrying",
+				"err", err,
+			)
+		}
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	if err := runutil.Retry(2*time.Second, ctx.Done(), update); err == nil {
+		return nil
+	}
+	if err := s.LoadPersisted(); err == nil {
+		level.Warn(logger).Log("msg", "using external labels persisted by a previous run", "labels", s.Get().String())
+		return nil
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		level.Warn(logger).Log("msg", "reading persisted external labels failed", "err", err)
+	}
+	return runutil.Retry(2*time.Second, nil, update)
+}
+
+// newPrometheusTransport returns a transport like http.DefaultTransport that dials
+// connections through the given dialer.
+func newPrometheusTransport(d *resolvingDialer) *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           d.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// headerRoundTripper attaches a fixed set of headers to all requests.
+type headerRoundTripper struct {
+	rt      http.RoundTripper
+	headers http.Header
+}
+
+func (t *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the given request.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+len(t.headers))
+
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	for k, v := range t.headers {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	return t.rt.RoundTrip(r)
+}
+
+// parseHTTPHeaders parses headers given as <name>:<value>.
+func parseHTTPHeaders(s []string) (http.Header, error) {
+	h := http.Header{}
+	for _, hdr := range s {
+		parts := strings.SplitN(hdr, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("unrecognized header %q", hdr)
+		}
+		name := strings.TrimSpace(parts[0])
+		if name == "" || strings.ContainsAny(name, " \t\r\n") {
+			return nil, errors.Errorf("invalid header name %q", parts[0])
+		}
+		value := strings.TrimSpace(parts[1])
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, errors.Errorf("invalid value for header %q", name)
+		}
+		h.Add(name, value)
+	}
+	return h, nil
+}
+
+// resolvingDialer dials addresses after resolving their host names itself. Resolved addresses
+// are cached for the refresh interval and dropped as soon as dialing all of them fails, so that
+// new connections follow a host that moved to a different IP.
+type resolvingDialer struct {
+	refreshInterval time.Duration
+	lookupHost      func(ctx context.Context, host string) ([]string, error)
+	dial            func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mtx   sync.Mutex
+	cache map[string]resolvedHost
+}
+
+type resolvedHost struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newResolvingDialer(refreshInterval time.Duration) *resolvingDialer {
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return &resolvingDialer{
+		refreshInterval: refreshInterval,
+		lookupHost:      net.DefaultResolver.LookupHost,
+		dial:            d.DialContext,
+		cache:           map[string]resolvedHost{},
+	}
+}
+
+func (d *resolvingDialer) resolve(ctx context.Context, host string) ([]string, error) {
+	d.mtx.Lock()
+	r, ok := d.cache[host]
+	d.mtx.Unlock()
+
+	if ok && time.Now().Before(r.expires) {
+		return r.addrs, nil
+	}
+	addrs, err := d.lookupHost(ctx, host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lookup %s", host)
+	}
+	d.mtx.Lock()
+	d.cache[host] = resolvedHost{addrs: addrs, expires: time.Now().Add(d.refreshInterval)}
+	d.mtx.Unlock()
+
+	return addrs, nil
+}
+
+// DialContext connects to the address on the named network.
+func (d *resolvingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.dial(ctx, network, addr)
+	}
+	addrs, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	err = errors.Errorf("no addresses found for %s", host)
+
+	for _, a := range addrs {
+		var conn net.Conn
+		if conn, err = d.dial(ctx, network, net.JoinHostPort(a, port)); err == nil {
+			return conn, nil
+		}
+	}
+	// Resolve the host again on the next attempt as it may have moved.
+	d.mtx.Lock()
+	delete(d.cache, host)
+	d.mtx.Unlock()
+
+	return nil, err
+}
+
+// upStatus tracks heartbeat results and only considers Prometheus down after a threshold
+// of consecutive failures within a window, so transient errors do not flip its reported state.
+type upStatus struct {
+	threshold int
+	// window is the time within which the failures must occur. Zero disables the window.
+	window   time.Duration
+	failures int
+	// first is the time of the first counted failure.
+	first time.Time
+}
+
+// Observe records the result of a heartbeat that finished at t and returns whether
+// Prometheus is considered up.
+func (u *upStatus) Observe(t time.Time, err error) bool {
+	if err == nil {
+		u.failures = 0
+		return true
+	}
+	if u.failures == 0 || (u.window > 0 && t.Sub(u.first) > u.window) {
+		u.failures = 0
+		u.first = t
+	}
+	u.failures++
+	return u.failures < u.threshold
+}
+
+// sidecarPeer is the part of the cluster peer the sidecar loops update.
+type sidecarPeer interface {
+	SetLabels(labels []storepb.Label)
+	SetTimestamps(mint int64, maxt int64)
+	PeersWithLabels(lset []storepb.Label, types ...cluster.PeerType) []cluster.PeerState
+}
+
+type heartbeatMetrics struct {
+	promUp        prometheus.Gauge
+	lastHeartbeat prometheus.Gauge
+}
+
+func newHeartbeatMetrics(reg prometheus.Registerer) *heartbeatMetrics {
+	var m heartbeatMetrics
+
+	m.promUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_sidecar_prometheus_up",
+		Help: "Boolean indicator whether the sidecar can reach its Prometheus peer.",
+	})
+	m.lastHeartbeat = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_sidecar_last_heartbeat_success_time_seconds",
+		Help: "Second timestamp of the last successful heartbeat.",
+	})
+
+	if reg != nil {
+		reg.MustRegister(m.promUp, m.lastHeartbeat)
+	}
+	return &m
+}
+
+// heartbeat checks the health of Prometheus and publishes its external labels to the cluster.
+type heartbeat struct {
+	logger  log.Logger
+	metrics *heartbeatMetrics
+	labels  interface {
+		Update(ctx context.Context) error
+		GetPB() []storepb.Label
+	}
+	peer               sidecarPeer
+	upStatus           *upStatus
+	health             *healthState
+	strictUniqueLabels bool
+	now                func() time.Time
+}
+
+// once runs a single heartbeat. It only returns an error if the sidecar must terminate.
+func (h *heartbeat) once(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	start := h.now()
+	err := h.labels.Update(ctx)
+	end := h.now()
+	latency := end.Sub(start)
+
+	if errors.Cause(err) == errLabelLimitExceeded {
+		// Prometheus is reachable but its labels must not be published.
+		level.Error(h.logger).Log("msg", "rejected external labels, keeping last valid set", "err", err)
+		h.metrics.promUp.Set(1)
+		h.metrics.lastHeartbeat.Set(float64(h.now().Unix()))
+		h.upStatus.Observe(end, nil)
+		h.health.Set(true, latency)
+	} else if err != nil {
+		level.Warn(h.logger).Log("msg", "heartbeat failed", "err", err)
+		if !h.upStatus.Observe(end, err) {
+			h.metrics.promUp.Set(0)
+			h.health.Set(false, latency)
+		}
+	} else {
+		// Update gossip.
+		h.peer.SetLabels(h.labels.GetPB())
+
+		h.metrics.promUp.Set(1)
+		h.metrics.lastHeartbeat.Set(float64(h.now().Unix()))
+		h.upStatus.Observe(end, nil)
+		h.health.Set(true, latency)
+	}
+
+	others := h.peer.PeersWithLabels(h.labels.GetPB(), cluster.PeerTypeSource)
+	return checkUniqueLabels(h.logger, others, h.strictUniqueLabels)
+}
+
+// shipOnce uploads new blocks and advertises the time range of the data available through
+// the sidecar to the cluster. Data older than maxQueryRange before now is not advertised.
+func shipOnce(ctx context.Context, logger log.Logger, s *shipper.Shipper, peer sidecarPeer, maxQueryRange time.Duration, now func() time.Time) {
+	s.Sync(ctx)
+
+	minTime, _, err := s.Timestamps()
+	if err != nil {
+		level.Warn(logger).Log("msg", "reading timestamps failed", "err", err)
+		return
+	}
+	peer.SetTimestamps(clampMinTime(now(), minTime, maxQueryRange), math.MaxInt64)
+}
+
+// healthState holds the health of Prometheus as observed by the last heartbeat.
+// Prometheus is considered healthy until a heartbeat reports otherwise.
+type healthState struct {
+	// maxLatency is the heartbeat latency above which Prometheus is unhealthy. Zero disables the check.
+	maxLatency time.Duration
+
+	mtx     sync.Mutex
+	down    bool
+	latency time.Duration
+}
+
+// Set records whether Prometheus is up and the latency of the heartbeat.
+func (h *healthState) Set(up bool, latency time.Duration) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.down = !up
+	h.latency = latency
+}
+
+// Healthy returns true if Prometheus is up and responded within the maximum latency.
+func (h *healthState) Healthy() bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.down {
+		return false
+	}
+	return h.maxLatency <= 0 || h.latency <= h.maxLatency
+}
+
+// bootstrapReadiness considers the cluster formed once at least the expected number of
+// members is visible or the bootstrap timeout elapsed. Once formed, it stays formed.
+type bootstrapReadiness struct {
+	logger   log.Logger
+	expect   int
+	size     func() int
+	deadline time.Time
+	now      func() time.Time
+
+	mtx    sync.Mutex
+	formed bool
+}
+
+// newBootstrapReadiness returns a readiness check expecting the given number of cluster members.
+// A zero timeout waits for them indefinitely.
+func newBootstrapReadiness(logger log.Logger, expect int, timeout time.Duration, size func() int, now func() time.Time) *bootstrapReadiness {
+	r := &bootstrapReadiness{
+		logger: logger,
+		expect: expect,
+		size:   size,
+		now:    now,
+		formed: expect <= 1,
+	}
+	if timeout > 0 {
+		r.deadline = now().Add(timeout)
+	}
+	return r
+}
+
+// Ready returns true if the cluster is considered formed.
+func (r *bootstrapReadiness) Ready() bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.formed {
+		return true
+	}
+	if n := r.size(); n >= r.expect {
+		level.Info(r.logger).Log("msg", "expected number of cluster members visible, cluster formed", "members", n, "expected", r.expect)
+		r.formed = true
+	} else if !r.deadline.IsZero() && !r.now().Before(r.deadline) {
+		level.Warn(r.logger).Log("msg", "bootstrap timeout elapsed before the expected number of cluster members was visible, reporting ready", "members", n, "expected", r.expect)
+		r.formed = true
+	}
+	return r.formed
+}
+
+// registerReady registers an endpoint reporting whether the sidecar is ready.
+func registerReady(mux *http.ServeMux, ready func() bool) {
+	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		if !ready() {
+			http.Error(w, "cluster not formed yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ready")
+	})
+}
+
+var errDuplicateLabels = errors.New("external labels are not unique in the cluster")
+
+// checkUniqueLabels reports other peers that advertise identical external labels. Their data
+// overlaps, which breaks deduplication and produces confusing query results.
+// If strict is set, an error is returned instead of only logging one.
+func checkUniqueLabels(logger log.Logger, others []cluster.PeerState, strict bool) error {
+	if len(others) == 0 {
+		return nil
+	}
+	addrs := make([]string, 0, len(others))
+	for _, o := range others {
+		addrs = append(addrs, o.APIAddr)
+	}
+	if strict {
+		return errors.Wrapf(errDuplicateLabels, "peers %s", strings.Join(addrs, ","))
+	}
+	level.Error(logger).Log(
+		"msg", "other peers advertise identical external labels; ensure they have a distinct replica label",
+		"peers", strings.Join(addrs, ","),
+	)
+	return nil
+}
+
+// extLabelsFilename is the name of the file in which the last valid external labels are persisted.
+const extLabelsFilename = "thanos.external-labels.json"
+
+func writeExtLabelsFile(dir string, lset labels.Labels) error {
+	b, err := json.Marshal(lset.Map())
+	if err != nil {
+		return errors.Wrap(err, "encode labels")
+	}
+	// Make any changes to the file appear atomic.
+	fn := filepath.Join(dir, extLabelsFilename)
+	tmp := fn + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return errors.Wrap(err, "write file")
+	}
+	return errors.Wrap(os.Rename(tmp, fn), "rename file")
+}
+
+func readExtLabelsFile(dir string) (labels.Labels, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, extLabelsFilename))
+	if err != nil {
+		return nil, errors.Wrap(err, "read file")
+	}
+	var m map[string]string
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.Wrap(err, "decode labels")
+	}
+	return labels.FromMap(m), nil
+}
+
+// errLabelLimitExceeded is returned if a label set exceeds the configured limits.
+var errLabelLimitExceeded = errors.New("external label limit exceeded")
+
+// checkLabelLimits ensures that the label set is small enough to be safely gossiped
+// across the cluster.
+func checkLabelLimits(lset labels.Labels, maxCount, maxSize int) error {
+	if maxCount > 0 && len(lset) > maxCount {
+		return errors.Wrapf(errLabelLimitExceeded, "%d labels exceed limit of %d", len(lset), maxCount)
+	}
+	size := 0
+	for _, l := range lset {
+		size += len(l.Name) + len(l.Value)
+	}
+	if maxSize > 0 && size > maxSize {
+		return errors.Wrapf(errLabelLimitExceeded, "labels of %d bytes exceed limit of %d bytes", size, maxSize)
+	}
 	return nil
 }
 
 func (s *extLabelSet) Get() labels.Labels {
+	if len(s.override) > 0 {
+		return s.override
+	}
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
@@ -322,11 +1375,10 @@ func (s *extLabelSet) Get() labels.Labels {
 }
 
 func (s *extLabelSet) GetPB() []storepb.Label {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
+	elset := s.Get()
 
-	lset := make([]storepb.Label, 0, len(s.labels))
-	for _, l := range s.labels {
+	lset := make([]storepb.Label, 0, len(elset))
+	for _, l := range elset {
 		lset = append(lset, storepb.Label{
 			Name:  l.Name,
 			Value: l.Value,
@@ -335,35 +1387,224 @@ func (s *extLabelSet) GetPB() []storepb.Label {
 	return lset
 }
 
-func queryExternalLabels(ctx context.Context, base *url.URL) (labels.Labels, error) {
+// errConfigUnavailable is returned if Prometheus refuses to serve its configuration,
+// which hardened deployments commonly do.
+var errConfigUnavailable = errors.New("config endpoint unavailable")
+
+// queryConfig returns the YAML configuration Prometheus is currently running with.
+func queryConfig(ctx context.Context, client *http.Client, base *url.URL) (string, error) {
 	u := *base
 	u.Path = path.Join(u.Path, "/api/v1/status/config")
 
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
-		return nil, errors.Wrap(err, "create request")
+		return "", errors.Wrap(err, "create request")
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrapf(err, "request config against %s", u.String())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound {
+		return "", errors.Wrapf(errConfigUnavailable, "request config against %s returned %s", u.String(), resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "read response")
+	}
+	cfg, err := parseConfigResponse(b, "")
+	if err != errUnrecognizedConfigResponse {
+		return cfg, err
+	}
+	// The response may only be understood by knowing which Prometheus version sent it.
+	version, verr := queryVersion(ctx, client, base)
+	if verr != nil {
+		return "", errors.Wrapf(err, "decode response of %s (Prometheus version unknown: %s)", u.String(), verr)
+	}
+	cfg, err = parseConfigResponse(b, version)
+	if err != nil {
+		return "", errors.Wrapf(err, "decode response of %s from Prometheus %s", u.String(), version)
+	}
+	return cfg, nil
+}
+
+// queryConfigFile returns the path of the configuration file from the flags of Prometheus.
+func queryConfigFile(ctx context.Context, client *http.Client, base *url.URL) (string, error) {
+	u := *base
+	u.Path = path.Join(u.Path, "/api/v1/status/flags")
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "create request")
 	}
-	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		return nil, errors.Wrapf(err, "request config against %s", u.String())
+		return "", errors.Wrapf(err, "request flags against %s", u.String())
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("request flags against %s returned %s", u.String(), resp.Status)
+	}
 	var d struct {
-		Data struct {
-			YAML string `json:"yaml"`
-		} `json:"data"`
+		Data map[string]string `json:"data"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
-		return nil, errors.Wrap(err, "decode response")
+		return "", errors.Wrapf(err, "decode response of %s", u.String())
 	}
+	fn := d.Data["config.file"]
+	if fn == "" {
+		return "", errors.Errorf("no config file in the flags returned by %s", u.String())
+	}
+	return fn, nil
+}
+
+// errUnrecognizedConfigResponse is returned if the response of the config endpoint has
+// none of the shapes known from the Prometheus versions supported by the sidecar.
+var errUnrecognizedConfigResponse = errors.New("unrecognized config response, Prometheus 1.8 or 2.x is required")
+
+// parseConfigResponse returns the YAML configuration from a response of the Prometheus
+// config endpoint. Prometheus 2.x wraps the configuration in the API response envelope,
+// some older builds returned it unwrapped. Prometheus 1.x may return the plain YAML
+// configuration, which can only be told apart from garbage if the version is known.
+// An empty version means the version of Prometheus is unknown.
+func parseConfigResponse(b []byte, version string) (string, error) {
+	var d struct {
+		Status string           `json:"status"`
+		Error  string           `json:"error"`
+		Data   *json.RawMessage `json:"data"`
+		YAML   *string          `json:"yaml"`
+	}
+	if err := json.Unmarshal(b, &d); err == nil {
+		if d.Status == "error" {
+			return "", errors.Errorf("config endpoint returned error: %s", d.Error)
+		}
+		if d.YAML != nil {
+			return *d.YAML, nil
+		}
+		if d.Data != nil {
+			var data struct {
+				YAML *string `json:"yaml"`
+			}
+			if err := json.Unmarshal(*d.Data, &data); err == nil && data.YAML != nil {
+				return *data.YAML, nil
+			}
+		}
+		return "", errUnrecognizedConfigResponse
+	}
+	if strings.HasPrefix(version, "1.") {
+		var cfg map[string]interface{}
+		if err := yaml.Unmarshal(b, &cfg); err != nil {
+			return "", errors.Wrap(err, "parse plain config response")
+		}
+		return string(b), nil
+	}
+	return "", errUnrecognizedConfigResponse
+}
+
+// queryVersion returns the version of Prometheus from its build information. Prometheus 1.x
+// serves it on /version, later versions through the API.
+func queryVersion(ctx context.Context, client *http.Client, base *url.URL) (string, error) {
+	var errs []string
+
+	for _, p := range []string{"/api/v1/status/buildinfo", "/version"} {
+		u := *base
+		u.Path = path.Join(u.Path, p)
+
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return "", errors.Wrap(err, "create request")
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return "", errors.Wrapf(err, "request build information against %s", u.String())
+		}
+		var d struct {
+			Version string `json:"version"`
+			Data    struct {
+				Version string `json:"version"`
+			} `json:"data"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&d)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			errs = append(errs, fmt.Sprintf("%s returned %s", u.String(), resp.Status))
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("decode response of %s: %s", u.String(), err))
+			continue
+		}
+		if d.Data.Version != "" {
+			return d.Data.Version, nil
+		}
+		if d.Version != "" {
+			return d.Version, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s returned no version", u.String()))
+	}
+	return "", errors.New(strings.Join(errs, "; "))
+}
+
+// parseExternalLabels returns the external labels of the given Prometheus configuration.
+func parseExternalLabels(s string) (labels.Labels, error) {
 	var cfg struct {
 		Global struct {
 			ExternalLabels map[string]string `yaml:"external_labels"`
 		} `yaml:"global"`
 	}
-	if err := yaml.Unmarshal([]byte(d.Data.YAML), &cfg); err != nil {
+	if err := yaml.Unmarshal([]byte(s), &cfg); err != nil {
 		return nil, errors.Wrap(err, "parse Prometheus config")
 	}
 	return labels.FromMap(cfg.Global.ExternalLabels), nil
 }
+
+// configHash returns a hash of the content of a Prometheus configuration.
+func configHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// checkPrometheusHealthy returns an error if Prometheus does not report itself as healthy.
+func checkPrometheusHealthy(ctx context.Context, client *http.Client, base *url.URL) error {
+	u := *base
+	u.Path = path.Join(u.Path, "/-/healthy")
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return errors.Wrap(err, "create request")
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "request health against %s", u.String())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("request health against %s returned %s", u.String(), resp.Status)
+	}
+	return nil
+}
+
+// parseOverrideLabels parses a comma separated list of <name>=<value> pairs.
+func parseOverrideLabels(s string) (labels.Labels, error) {
+	if s == "" {
+		return nil, nil
+	}
+	m := map[string]string{}
+	for _, l := range strings.Split(s, ",") {
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("unrecognized label %q", l)
+		}
+		if _, ok := m[parts[0]]; ok {
+			return nil, errors.Errorf("duplicate label name %q", parts[0])
+		}
+		m[parts[0]] = parts[1]
+	}
+	return labels.FromMap(m), nil
+}
@@ -2,15 +2,42 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"fmt"
 
+	"github.com/go-kit/kit/log"
+	"github.com/improbable-eng/thanos/pkg/block"
+	"github.com/improbable-eng/thanos/pkg/cluster"
+	"github.com/improbable-eng/thanos/pkg/objstore/inmem"
+	"github.com/improbable-eng/thanos/pkg/runutil"
+	"github.com/improbable-eng/thanos/pkg/shipper"
+	"github.com/improbable-eng/thanos/pkg/store/storepb"
 	"github.com/improbable-eng/thanos/pkg/testutil"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"gopkg.in/alecthomas/kingpin.v2"
 )
 
-func TestSidecar_queryExternalLabels(t *testing.T) {
+func TestSidecar_extLabelSetUpdate(t *testing.T) {
 	p, err := testutil.NewPrometheus()
 	testutil.Ok(t, err)
 
@@ -28,10 +55,871 @@ global:
 	u, err := url.Parse(fmt.Sprintf("http://%s", p.Addr()))
 	testutil.Ok(t, err)
 
-	ext, err := queryExternalLabels(context.Background(), u)
-	testutil.Ok(t, err)
+	s := &extLabelSet{logger: log.NewNopLogger(), promURL: u}
+	testutil.Ok(t, s.Update(context.Background()))
 
+	ext := s.Get()
 	testutil.Equals(t, 2, len(ext))
 	testutil.Equals(t, "eu-west", ext.Get("region"))
 	testutil.Equals(t, "1", ext.Get("az"))
 }
+
+func TestSidecar_extLabelSetUpdate_Versions(t *testing.T) {
+	const cfg = "global:\n  external_labels:\n    region: eu-west\n"
+
+	for _, c := range []struct {
+		name string
+		// responses maps request paths to response bodies. Other paths return 404.
+		responses map[string]string
+		err       string
+	}{
+		{
+			name: "Prometheus 2.x",
+			responses: map[string]string{
+				"/api/v1/status/config": `{"status":"success","data":{"yaml":"global:\n  external_labels:\n    region: eu-west\n"}}`,
+			},
+		},
+		{
+			name: "unwrapped JSON response",
+			responses: map[string]string{
+				"/api/v1/status/config": `{"yaml":"global:\n  external_labels:\n    region: eu-west\n"}`,
+			},
+		},
+		{
+			name: "Prometheus 1.x plain YAML",
+			responses: map[string]string{
+				"/api/v1/status/config": cfg,
+				"/version":              `{"version":"1.8.2","revision":"5211b96d4d1291c3dd1a569f711d3b301b635ecb","branch":"HEAD"}`,
+			},
+		},
+		{
+			name: "plain YAML from Prometheus 2.x",
+			responses: map[string]string{
+				"/api/v1/status/config":    cfg,
+				"/api/v1/status/buildinfo": `{"status":"success","data":{"version":"2.14.0","revision":"edeb7a44cbf745f1d8be4ea6f215e79e651bfe19"}}`,
+			},
+			err: "from Prometheus 2.14.0",
+		},
+		{
+			name: "unknown JSON shape",
+			responses: map[string]string{
+				"/api/v1/status/config": `{"status":"success","data":{"config":"global: {}"}}`,
+				"/version":              `{"version":"2.0.0"}`,
+			},
+			err: "unrecognized config response",
+		},
+		{
+			name: "unknown version",
+			responses: map[string]string{
+				"/api/v1/status/config": "<html></html>",
+			},
+			err: "Prometheus version unknown",
+		},
+		{
+			name: "error response",
+			responses: map[string]string{
+				"/api/v1/status/config": `{"status":"error","errorType":"internal","error":"config unavailable"}`,
+			},
+			err: "config unavailable",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, ok := c.responses[r.URL.Path]
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				fmt.Fprint(w, b)
+			}))
+			defer srv.Close()
+
+			u, err := url.Parse(srv.URL)
+			testutil.Ok(t, err)
+
+			s := &extLabelSet{logger: log.NewNopLogger(), promURL: u}
+			err = s.Update(context.Background())
+			if c.err != "" {
+				testutil.NotOk(t, err)
+				testutil.Assert(t, strings.Contains(err.Error(), c.err), "unexpected error %v", err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, labels.FromStrings("region", "eu-west"), s.Get())
+		})
+	}
+}
+
+func TestSidecar_extLabelSetFallback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	_, err = queryConfig(context.Background(), http.DefaultClient, u)
+	testutil.Assert(t, errors.Cause(err) == errConfigUnavailable, "unexpected error %v", err)
+
+	// Without fallback labels and flags the update must fail.
+	s := &extLabelSet{logger: log.NewNopLogger(), promURL: u}
+	testutil.NotOk(t, s.Update(context.Background()))
+
+	s.fallback = labels.FromStrings("region", "eu-west")
+	testutil.Ok(t, s.Update(context.Background()))
+	testutil.Equals(t, labels.FromStrings("region", "eu-west"), s.Get())
+}
+
+func TestSidecar_extLabelSetFallbackConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecar-config-file")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "prometheus.yml")
+	testutil.Ok(t, ioutil.WriteFile(fn, []byte(`
+global:
+  external_labels:
+    region: eu-west
+`), 0666))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/status/flags" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"config.file":%q,"web.enable-lifecycle":"false"}}`, fn)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	s := &extLabelSet{logger: log.NewNopLogger(), promURL: u}
+	testutil.Ok(t, s.Update(context.Background()))
+	testutil.Equals(t, labels.FromStrings("region", "eu-west"), s.Get())
+
+	// Labels given by flag take precedence over the config file.
+	s.fallback = labels.FromStrings("region", "us-east")
+	testutil.Ok(t, s.Update(context.Background()))
+	testutil.Equals(t, labels.FromStrings("region", "us-east"), s.Get())
+
+	// The update fails if the config file cannot be read.
+	s.fallback = nil
+	testutil.Ok(t, os.Remove(fn))
+	testutil.NotOk(t, s.Update(context.Background()))
+}
+
+func TestSidecar_extLabelSetOverride(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		healthy = true
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		switch r.URL.Path {
+		case "/-/healthy":
+			if !healthy {
+				http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+			}
+		case "/api/v1/status/config":
+			fmt.Fprint(w, `{"status":"success","data":{"yaml":"global:\n  external_labels:\n    region: us-east\n"}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	override := labels.FromStrings("region", "eu-west", "replica", "test")
+	s := &extLabelSet{logger: log.NewNopLogger(), promURL: u, override: override}
+
+	testutil.Equals(t, override, s.Get())
+
+	testutil.Ok(t, s.Update(context.Background()))
+	testutil.Equals(t, override, s.Get())
+	testutil.Equals(t, 2, len(s.GetPB()))
+
+	// An unhealthy Prometheus fails the update but does not affect the labels.
+	mtx.Lock()
+	healthy = false
+	mtx.Unlock()
+	testutil.NotOk(t, s.Update(context.Background()))
+	testutil.Equals(t, override, s.Get())
+}
+
+func TestSidecar_watchConfigReloads(t *testing.T) {
+	var (
+		mtx    sync.Mutex
+		region = "eu-west"
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		fmt.Fprintf(w, `{"status":"success","data":{"yaml":"global:\n  external_labels:\n    region: %s\n"}}`, region)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	reloads := prometheus.NewCounter(prometheus.CounterOpts{Name: "reloads"})
+	s := &extLabelSet{logger: log.NewNopLogger(), promURL: u, reloads: reloads}
+	testutil.Ok(t, s.Update(context.Background()))
+	testutil.Equals(t, labels.FromStrings("region", "eu-west"), s.Get())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloadc := make(chan struct{}, 1)
+	go watchConfigReloads(ctx, log.NewNopLogger(), s, 10*time.Millisecond, reloadc)
+
+	// An unchanged config must not trigger an update.
+	select {
+	case <-reloadc:
+		t.Fatal("unexpected reload")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mtx.Lock()
+	region = "us-east"
+	mtx.Unlock()
+
+	select {
+	case <-reloadc:
+	case <-time.After(5 * time.Second):
+		t.Fatal("config reload not detected")
+	}
+	testutil.Ok(t, s.Update(context.Background()))
+	testutil.Equals(t, labels.FromStrings("region", "us-east"), s.Get())
+
+	var m dto.Metric
+	testutil.Ok(t, reloads.Write(&m))
+	testutil.Equals(t, float64(1), m.GetCounter().GetValue())
+}
+
+func TestSidecar_parseOverrideLabels(t *testing.T) {
+	lset, err := parseOverrideLabels("")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(lset))
+
+	lset, err = parseOverrideLabels("replica=a,region=eu-west")
+	testutil.Ok(t, err)
+	testutil.Equals(t, labels.FromStrings("region", "eu-west", "replica", "a"), lset)
+
+	_, err = parseOverrideLabels("region")
+	testutil.NotOk(t, err)
+
+	_, err = parseOverrideLabels("region=a,region=b")
+	testutil.NotOk(t, err)
+}
+
+func TestSidecar_localMinTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecar-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	// Without any blocks the full range is advertised.
+	minTime, err := localMinTime(log.NewNopLogger(), dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(0), minTime)
+
+	randr := rand.New(rand.NewSource(0))
+	for i, mint := range []int64{3000, 1000, 2000} {
+		id := ulid.MustNew(uint64(i), randr)
+		bdir := filepath.Join(dir, id.String())
+		testutil.Ok(t, os.MkdirAll(bdir, 0777))
+
+		meta := &block.Meta{
+			Version: 1,
+			BlockMeta: tsdb.BlockMeta{
+				ULID:    id,
+				MinTime: mint,
+				MaxTime: mint + 1000,
+			},
+		}
+		testutil.Ok(t, block.WriteMetaFile(bdir, meta))
+	}
+	// Directories that are not blocks must be ignored.
+	testutil.Ok(t, os.MkdirAll(filepath.Join(dir, "wal"), 0777))
+
+	minTime, err = localMinTime(log.NewNopLogger(), dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(1000), minTime)
+}
+
+func TestSidecar_extLabelSetLimits(t *testing.T) {
+	var cfg string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]string{"yaml": cfg},
+		})
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	s := &extLabelSet{logger: log.NewNopLogger(), promURL: u, maxCount: 2, maxSize: 24}
+
+	cfg = `
+global:
+  external_labels:
+    region: eu-west
+    replica: a
+`
+	testutil.Ok(t, s.Update(context.Background()))
+	testutil.Equals(t, labels.FromStrings("region", "eu-west", "replica", "a"), s.Get())
+
+	// Exceeding the count must be rejected and the last valid set kept.
+	cfg = `
+global:
+  external_labels:
+    region: eu-west
+    replica: a
+    az: 1
+`
+	err = s.Update(context.Background())
+	testutil.Assert(t, errors.Cause(err) == errLabelLimitExceeded, "unexpected error %v", err)
+	testutil.Equals(t, labels.FromStrings("region", "eu-west", "replica", "a"), s.Get())
+
+	// Exceeding the size must be rejected and the last valid set kept.
+	cfg = `
+global:
+  external_labels:
+    region: eu-west-very-long-region-name
+`
+	err = s.Update(context.Background())
+	testutil.Assert(t, errors.Cause(err) == errLabelLimitExceeded, "unexpected error %v", err)
+	testutil.Equals(t, labels.FromStrings("region", "eu-west", "replica", "a"), s.Get())
+}
+
+func TestSidecar_extLabelsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecar-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = readExtLabelsFile(dir)
+	testutil.Assert(t, os.IsNotExist(errors.Cause(err)), "unexpected error %v", err)
+
+	lset := labels.FromStrings("region", "eu-west", "replica", "a")
+	testutil.Ok(t, writeExtLabelsFile(dir, lset))
+
+	res, err := readExtLabelsFile(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, lset, res)
+}
+
+func TestSidecar_initExternalLabelsPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecar-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	lset := labels.FromStrings("region", "eu-west")
+	testutil.Ok(t, writeExtLabelsFile(dir, lset))
+
+	s := &extLabelSet{logger: log.NewNopLogger(), promURL: u, dir: dir}
+	testutil.Ok(t, initExternalLabels(log.NewNopLogger(), s, 100*time.Millisecond))
+	testutil.Equals(t, lset, s.Get())
+}
+
+func TestSidecar_checkUniqueLabels(t *testing.T) {
+	testutil.Ok(t, checkUniqueLabels(log.NewNopLogger(), nil, true))
+
+	others := []cluster.PeerState{{Type: cluster.PeerTypeSource, APIAddr: "prom-2:10901"}}
+
+	testutil.Ok(t, checkUniqueLabels(log.NewNopLogger(), others, false))
+
+	err := checkUniqueLabels(log.NewNopLogger(), others, true)
+	testutil.Assert(t, errors.Cause(err) == errDuplicateLabels, "unexpected error %v", err)
+}
+
+func TestSidecar_resolvingDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	var (
+		lookups int
+		addrs   = []string{"10.0.0.1"}
+		dialed  []string
+	)
+	d := newResolvingDialer(time.Hour)
+	d.lookupHost = func(_ context.Context, host string) ([]string, error) {
+		testutil.Equals(t, "prometheus", host)
+		lookups++
+		return addrs, nil
+	}
+	d.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		// Simulate that Prometheus moved away from its old address.
+		if addr != "10.0.0.2:9090" {
+			return nil, errors.New("connection refused")
+		}
+		return net.Dial(network, l.Addr().String())
+	}
+	ctx := context.Background()
+
+	_, err = d.DialContext(ctx, "tcp", "prometheus:9090")
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 1, lookups)
+
+	// After the failure the host must be resolved again.
+	addrs = []string{"10.0.0.2"}
+
+	conn, err := d.DialContext(ctx, "tcp", "prometheus:9090")
+	testutil.Ok(t, err)
+	conn.Close()
+	testutil.Equals(t, 2, lookups)
+
+	// Successful resolutions are cached for the refresh interval.
+	conn, err = d.DialContext(ctx, "tcp", "prometheus:9090")
+	testutil.Ok(t, err)
+	conn.Close()
+	testutil.Equals(t, 2, lookups)
+
+	testutil.Equals(t, []string{"10.0.0.1:9090", "10.0.0.2:9090", "10.0.0.2:9090"}, dialed)
+}
+
+func TestSidecar_upStatus(t *testing.T) {
+	var (
+		u            = &upStatus{threshold: 3}
+		errHeartbeat = errors.New("heartbeat failed")
+		now          = time.Unix(1000, 0)
+	)
+	observe := func(err error) bool {
+		now = now.Add(10 * time.Second)
+		return u.Observe(now, err)
+	}
+
+	// Intermittent failures must not trip the threshold.
+	for _, err := range []error{errHeartbeat, errHeartbeat, nil, errHeartbeat, nil, errHeartbeat, errHeartbeat} {
+		testutil.Assert(t, observe(err), "unexpected down state after %v", err)
+	}
+	testutil.Assert(t, !observe(errHeartbeat), "expected down state after consecutive failures")
+	testutil.Assert(t, !observe(errHeartbeat), "expected down state after consecutive failures")
+
+	testutil.Assert(t, observe(nil), "expected up state after success")
+
+	// Failures spread out further than the window must not trip the threshold either.
+	u = &upStatus{threshold: 3, window: 15 * time.Second}
+	for i := 0; i < 6; i++ {
+		testutil.Assert(t, observe(errHeartbeat), "unexpected down state after failure %d", i)
+	}
+	u = &upStatus{threshold: 3, window: 20 * time.Second}
+	testutil.Assert(t, observe(errHeartbeat), "unexpected down state after failure")
+	testutil.Assert(t, observe(errHeartbeat), "unexpected down state after failure")
+	testutil.Assert(t, !observe(errHeartbeat), "expected down state after failures within window")
+
+	// A threshold of one reports every failure.
+	u = &upStatus{threshold: 1}
+	testutil.Assert(t, !observe(errHeartbeat), "expected down state after failure")
+}
+
+func TestSidecar_healthState(t *testing.T) {
+	h := &healthState{maxLatency: time.Second}
+	testutil.Assert(t, h.Healthy(), "expected healthy state before first heartbeat")
+
+	h.Set(true, 100*time.Millisecond)
+	testutil.Assert(t, h.Healthy(), "expected healthy state after fast heartbeat")
+
+	h.Set(true, 2*time.Second)
+	testutil.Assert(t, !h.Healthy(), "expected unhealthy state after slow heartbeat")
+
+	h.Set(false, 100*time.Millisecond)
+	testutil.Assert(t, !h.Healthy(), "expected unhealthy state while down")
+
+	// Without a latency threshold only the up state counts.
+	h = &healthState{}
+	h.Set(true, time.Minute)
+	testutil.Assert(t, h.Healthy(), "expected healthy state without latency threshold")
+}
+
+func TestSidecar_parseHTTPHeaders(t *testing.T) {
+	h, err := parseHTTPHeaders([]string{"X-Scope-OrgID: tenant-1", "X-Route:a:b"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, "tenant-1", h.Get("X-Scope-OrgID"))
+	testutil.Equals(t, "a:b", h.Get("X-Route"))
+
+	for _, hdr := range []string{"X-Scope-OrgID", ":value", "X Scope: value"} {
+		_, err := parseHTTPHeaders([]string{hdr})
+		testutil.NotOk(t, err)
+	}
+}
+
+func TestSidecar_verifyChecksumsFlag(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		// Uploads are verified unless disabled explicitly.
+		{args: []string{"sidecar"}, want: "true"},
+		{args: []string{"sidecar", "--no-shipper.verify-checksums"}, want: "false"},
+	} {
+		app := kingpin.New("thanos", "")
+		registerSidecar(map[string]setupFunc{}, app, "sidecar")
+
+		_, err := app.Parse(c.args)
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.want, resolvedFlags(app, app.GetCommand("sidecar"))["shipper.verify-checksums"])
+	}
+}
+
+func TestSidecar_headerRoundTripper(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Scope-OrgID") != "tenant-1" {
+			http.Error(w, "missing tenant", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]string{"yaml": "global:\n  external_labels:\n    region: eu-west\n"},
+		})
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	h, err := parseHTTPHeaders([]string{"X-Scope-OrgID: tenant-1"})
+	testutil.Ok(t, err)
+
+	client := &http.Client{Transport: &headerRoundTripper{rt: http.DefaultTransport, headers: h}}
+
+	s := &extLabelSet{logger: log.NewNopLogger(), client: client, promURL: u}
+	testutil.Ok(t, s.Update(context.Background()))
+	testutil.Equals(t, labels.FromStrings("region", "eu-west"), s.Get())
+}
+
+func TestSidecar_validateDataDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecar-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	testutil.Ok(t, validateDataDir(dir))
+
+	missing := filepath.Join(dir, "missing")
+	err = validateDataDir(missing)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, os.IsNotExist(errors.Cause(err)), "unexpected error %v", err)
+
+	fn := filepath.Join(dir, "file")
+	testutil.Ok(t, ioutil.WriteFile(fn, []byte("x"), 0666))
+	testutil.NotOk(t, validateDataDir(fn))
+}
+
+func TestSidecar_clampMinTime(t *testing.T) {
+	now := time.Unix(10000, 0)
+
+	testutil.Equals(t, int64(0), clampMinTime(now, 0, 0))
+	testutil.Equals(t, int64(math.MaxInt64-1), clampMinTime(now, math.MaxInt64-1, time.Hour))
+	testutil.Equals(t, timestamp.FromTime(now.Add(-time.Hour)), clampMinTime(now, 0, time.Hour))
+}
+
+type fakeLabelUpdater struct {
+	err  error
+	lset []storepb.Label
+}
+
+func (f *fakeLabelUpdater) Update(context.Context) error { return f.err }
+func (f *fakeLabelUpdater) GetPB() []storepb.Label       { return f.lset }
+
+type fakeSidecarPeer struct {
+	lset       []storepb.Label
+	mint, maxt int64
+	others     []cluster.PeerState
+}
+
+func (p *fakeSidecarPeer) SetLabels(lset []storepb.Label) { p.lset = lset }
+
+func (p *fakeSidecarPeer) SetTimestamps(mint int64, maxt int64) { p.mint, p.maxt = mint, maxt }
+
+func (p *fakeSidecarPeer) PeersWithLabels([]storepb.Label, ...cluster.PeerType) []cluster.PeerState {
+	return p.others
+}
+
+func TestSidecar_heartbeatOnce(t *testing.T) {
+	var (
+		now  = time.Unix(1000, 0)
+		lset = []storepb.Label{{Name: "region", Value: "eu-west"}}
+		lbls = &fakeLabelUpdater{lset: lset}
+		peer = &fakeSidecarPeer{}
+	)
+	hb := &heartbeat{
+		logger:   log.NewNopLogger(),
+		metrics:  newHeartbeatMetrics(nil),
+		labels:   lbls,
+		peer:     peer,
+		upStatus: &upStatus{threshold: 2},
+		health:   &healthState{maxLatency: time.Second},
+		now: func() time.Time {
+			// Every call advances the clock, so each heartbeat takes 500ms.
+			now = now.Add(500 * time.Millisecond)
+			return now
+		},
+	}
+	gauge := func(g prometheus.Gauge) float64 {
+		var m dto.Metric
+		testutil.Ok(t, g.Write(&m))
+		return m.GetGauge().GetValue()
+	}
+
+	testutil.Ok(t, hb.once(context.Background()))
+	testutil.Equals(t, lset, peer.lset)
+	testutil.Equals(t, float64(1), gauge(hb.metrics.promUp))
+	testutil.Equals(t, float64(1001), gauge(hb.metrics.lastHeartbeat))
+	testutil.Assert(t, hb.health.Healthy(), "expected healthy state")
+
+	// A single failure is below the threshold and must not report Prometheus as down.
+	lbls.err = errors.New("connection refused")
+	testutil.Ok(t, hb.once(context.Background()))
+	testutil.Equals(t, float64(1), gauge(hb.metrics.promUp))
+	testutil.Equals(t, float64(1001), gauge(hb.metrics.lastHeartbeat))
+
+	testutil.Ok(t, hb.once(context.Background()))
+	testutil.Equals(t, float64(0), gauge(hb.metrics.promUp))
+	testutil.Assert(t, !hb.health.Healthy(), "expected unhealthy state")
+
+	// Other sources with identical labels must terminate the sidecar in strict mode.
+	lbls.err = nil
+	peer.others = []cluster.PeerState{{APIAddr: "10.0.0.1:10901"}}
+	testutil.Ok(t, hb.once(context.Background()))
+
+	hb.strictUniqueLabels = true
+	testutil.NotOk(t, hb.once(context.Background()))
+}
+
+func TestSidecar_shipOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecar-ship")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(10000, 0)
+	bkt := inmem.NewBucket()
+	s := shipper.New(nil, nil, dir, bkt, nil, shipper.Options{Source: block.SidecarSource})
+
+	id := ulid.MustNew(1, rand.New(rand.NewSource(0)))
+	bdir := filepath.Join(dir, id.String())
+	testutil.Ok(t, os.MkdirAll(filepath.Join(bdir, "chunks"), 0777))
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(bdir, "index"), []byte("index"), 0666))
+	testutil.Ok(t, block.WriteMetaFile(bdir, &block.Meta{
+		Version:   1,
+		BlockMeta: tsdb.BlockMeta{ULID: id, MinTime: 1000, MaxTime: 2000},
+	}))
+
+	peer := &fakeSidecarPeer{}
+	shipOnce(context.Background(), log.NewNopLogger(), s, peer, 0, func() time.Time { return now })
+
+	ok, err := bkt.Exists(context.Background(), filepath.Join(id.String(), block.MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "block not uploaded")
+	testutil.Equals(t, int64(1000), peer.mint)
+	testutil.Equals(t, int64(math.MaxInt64), peer.maxt)
+
+	// The advertised minimum time must be clamped to the maximum query range.
+	shipOnce(context.Background(), log.NewNopLogger(), s, peer, time.Second, func() time.Time { return now })
+	testutil.Equals(t, timestamp.FromTime(now.Add(-time.Second)), peer.mint)
+}
+
+// Sidecar restarts must be able to bind their addresses again right away, even if
+// connections of the previous listener are still in TIME_WAIT.
+func TestSidecar_rebindAfterClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	addr := l.Addr().String()
+
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			// Closing the server side first leaves it in TIME_WAIT.
+			err = c.Close()
+		}
+		accepted <- err
+	}()
+
+	c, err := net.Dial("tcp", addr)
+	testutil.Ok(t, err)
+	testutil.Ok(t, <-accepted)
+	testutil.Ok(t, l.Close())
+	defer c.Close()
+
+	l, err = net.Listen("tcp", addr)
+	testutil.Ok(t, err)
+	testutil.Ok(t, l.Close())
+}
+
+func TestSidecar_registerShipperControl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecar-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	s := shipper.New(nil, nil, dir, inmem.NewBucket(), nil, shipper.Options{Source: block.SidecarSource})
+
+	mux := http.NewServeMux()
+	registerShipperControl(mux, log.NewNopLogger(), s)
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/-/shipper/pause")
+	testutil.Ok(t, err)
+	resp.Body.Close()
+	testutil.Equals(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	testutil.Assert(t, !s.Paused(), "shipper paused by GET request")
+
+	resp, err = http.Post(srv.URL+"/-/shipper/pause", "", nil)
+	testutil.Ok(t, err)
+	resp.Body.Close()
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	testutil.Assert(t, s.Paused(), "shipper not paused")
+
+	resp, err = http.Post(srv.URL+"/-/shipper/resume", "", nil)
+	testutil.Ok(t, err)
+	resp.Body.Close()
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	testutil.Assert(t, !s.Paused(), "shipper not resumed")
+}
+
+func TestSidecar_registerStoreSD(t *testing.T) {
+	mux := http.NewServeMux()
+	registerStoreSD(mux, func() []cluster.PeerState {
+		return []cluster.PeerState{
+			{
+				Type:     cluster.PeerTypeSource,
+				APIAddr:  "10.0.0.2:10901",
+				Metadata: cluster.PeerMetadata{Labels: []storepb.Label{{Name: "replica", Value: "b"}, {Name: "cluster", Value: "eu"}}},
+			},
+			{
+				Type:     cluster.PeerTypeSource,
+				APIAddr:  "10.0.0.1:10901",
+				Metadata: cluster.PeerMetadata{Labels: []storepb.Label{{Name: "cluster", Value: "eu"}, {Name: "replica", Value: "a"}}},
+			},
+		}
+	})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/cluster/store-sd", nil))
+	testutil.Equals(t, http.StatusOK, rec.Code)
+
+	// The output must be valid for Prometheus file SD, which only allows the targets and labels keys.
+	var groups []map[string]json.RawMessage
+	testutil.Ok(t, json.Unmarshal(rec.Body.Bytes(), &groups))
+	testutil.Equals(t, 2, len(groups))
+
+	for _, g := range groups {
+		testutil.Equals(t, 2, len(g))
+
+		var targets []string
+		testutil.Ok(t, json.Unmarshal(g["targets"], &targets))
+		testutil.Equals(t, 1, len(targets))
+
+		var lset map[string]string
+		testutil.Ok(t, json.Unmarshal(g["labels"], &lset))
+	}
+	var res []targetGroup
+	testutil.Ok(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	testutil.Equals(t, []targetGroup{
+		{Targets: []string{"10.0.0.1:10901"}, Labels: map[string]string{"cluster": "eu", "replica": "a"}},
+		{Targets: []string{"10.0.0.2:10901"}, Labels: map[string]string{"cluster": "eu", "replica": "b"}},
+	}, res)
+
+	// Peers with identical labels are grouped and peers without an address are skipped.
+	testutil.Equals(t, []targetGroup{
+		{Targets: []string{"10.0.0.1:10901", "10.0.0.2:10901"}, Labels: map[string]string{"cluster": "eu"}},
+	}, storeSDTargetGroups([]cluster.PeerState{
+		{APIAddr: "10.0.0.2:10901", Metadata: cluster.PeerMetadata{Labels: []storepb.Label{{Name: "cluster", Value: "eu"}}}},
+		{APIAddr: "10.0.0.1:10901", Metadata: cluster.PeerMetadata{Labels: []storepb.Label{{Name: "cluster", Value: "eu"}}}},
+		{Metadata: cluster.PeerMetadata{Labels: []storepb.Label{{Name: "cluster", Value: "us"}}}},
+	}))
+}
+
+func TestBootstrapReadiness(t *testing.T) {
+	join := func(knownPeers []string) (string, *cluster.Peer) {
+		port, err := testutil.FreePort()
+		testutil.Ok(t, err)
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+
+		p, err := cluster.Join(log.NewNopLogger(), prometheus.NewRegistry(), addr, addr, knownPeers,
+			cluster.PeerState{Type: cluster.PeerTypeSource, APIAddr: addr}, false, 100*time.Millisecond, 50*time.Millisecond, 0)
+		testutil.Ok(t, err)
+		return addr, p
+	}
+	addr1, peer1 := join(nil)
+	defer peer1.Leave(0)
+
+	r := newBootstrapReadiness(log.NewNopLogger(), 3, 0, peer1.ClusterSize, time.Now)
+
+	mux := http.NewServeMux()
+	registerReady(mux, r.Ready)
+	status := func() int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/-/ready", nil))
+		return rec.Code
+	}
+	testutil.Equals(t, http.StatusServiceUnavailable, status())
+
+	_, peer2 := join([]string{addr1})
+	defer peer2.Leave(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	testutil.Ok(t, runutil.Retry(100*time.Millisecond, ctx.Done(), func() error {
+		if peer1.ClusterSize() != 2 {
+			return errors.New("second peer not visible")
+		}
+		return nil
+	}))
+	testutil.Equals(t, http.StatusServiceUnavailable, status())
+
+	_, peer3 := join([]string{addr1})
+	defer peer3.Leave(0)
+
+	testutil.Ok(t, runutil.Retry(100*time.Millisecond, ctx.Done(), func() error {
+		if status() != http.StatusOK {
+			return errors.New("not ready")
+		}
+		return nil
+	}))
+
+	// Readiness must not flip back if members leave afterwards.
+	testutil.Ok(t, peer3.Leave(0))
+	testutil.Equals(t, http.StatusOK, status())
+}
+
+func TestBootstrapReadiness_Timeout(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := newBootstrapReadiness(log.NewNopLogger(), 3, time.Minute, func() int { return 1 }, func() time.Time { return now })
+	testutil.Assert(t, !r.Ready(), "expected not ready before timeout")
+
+	now = now.Add(time.Minute)
+	testutil.Assert(t, r.Ready(), "expected ready after timeout")
+
+	// Expecting a single member is satisfied by the sidecar itself.
+	r = newBootstrapReadiness(log.NewNopLogger(), 1, 0, func() int { return 1 }, time.Now)
+	testutil.Assert(t, r.Ready(), "expected ready")
+}
@@ -2,18 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"math"
 	"net"
 	"net/http"
 	"time"
 
-	"cloud.google.com/go/storage"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/improbable-eng/thanos/pkg/cluster"
 	"github.com/improbable-eng/thanos/pkg/objstore"
-	"github.com/improbable-eng/thanos/pkg/objstore/gcs"
-	"github.com/improbable-eng/thanos/pkg/objstore/s3"
 	"github.com/improbable-eng/thanos/pkg/runutil"
 	"github.com/improbable-eng/thanos/pkg/store"
 	"github.com/improbable-eng/thanos/pkg/store/storepb"
@@ -32,29 +30,23 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application, name string
 	grpcAddr := cmd.Flag("grpc-address", "listen address for gRPC endpoints").
 		Default(defaultGRPCAddr).String()
 
+	grpcRecoverPanics := cmd.Flag("grpc.recover-panics", "recover from panics in gRPC handlers and return an internal error to the client instead of crashing. Disable to crash on panics when debugging").
+		Default("true").Bool()
+
 	httpAddr := cmd.Flag("http-address", "listen address for HTTP endpoints").
 		Default(defaultHTTPAddr).String()
 
 	dataDir := cmd.Flag("tsdb.path", "data directory of TSDB").
 		Default("./data").String()
 
-	gcsBucket := cmd.Flag("gcs.bucket", "Google Cloud Storage bucket name for stored blocks. If empty sidecar won't store any block inside Google Cloud Storage").
-		PlaceHolder("<bucket>").Required().String()
-
-	s3Bucket := cmd.Flag("s3.bucket", "S3-Compatible API bucket name for stored blocks.").
-		PlaceHolder("<bucket>").Envar("S3_BUCKET").String()
+	bucketConfig := registerBucketFlags(cmd)
 
-	s3Endpoint := cmd.Flag("s3.endpoint", "S3-Compatible API endpoint for stored blocks.").
-		PlaceHolder("<api-url>").Envar("S3_ENDPOINT").String()
+	tlsConfig := registerTLSFlags(cmd)
 
-	s3AccessKey := cmd.Flag("s3.access-key", "Access key for an S3-Compatible API.").
-		PlaceHolder("<key>").Envar("S3_ACCESS_KEY").String()
+	encryptionKeys := registerEncryptionFlag(cmd)
 
-	s3SecretKey := cmd.Flag("s3.secret-key", "Secret key for an S3-Compatible API.").
-		PlaceHolder("<key>").Envar("S3_SECRET_KEY").String()
-
-	s3Insecure := cmd.Flag("s3.insecure", "Whether to use an insecure connection with an S3-Compatible API.").
-		Default("false").Envar("S3_INSECURE").Bool()
+	slowOpThreshold := cmd.Flag("objstore.slow-op-threshold", "log every object storage operation that takes longer than this duration, along with the object, its size and the time taken. 0 disables logging of slow operations").
+		Default("0s").Duration()
 
 	indexCacheSize := cmd.Flag("index-cache-size", "Maximum size of items held in the index cache.").
 		Default("250MB").Bytes()
@@ -67,7 +59,10 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application, name string
 	clusterBindAddr := cmd.Flag("cluster.address", "listen address for clutser").
 		Default(defaultClusterAddr).String()
 
-	clusterAdvertiseAddr := cmd.Flag("cluster.advertise-address", "explicit address to advertise in cluster").
+	clusterDescription := cmd.Flag("cluster.description", "optional human-readable description of this peer that is gossiped to the cluster, e.g. its datacenter or owning team").
+		String()
+
+	clusterAdvertiseAddr := cmd.Flag("cluster.advertise-address", "explicit address to advertise in cluster. If no port is given, the port of the cluster bind address is advertised").
 		String()
 
 	gossipInterval := cmd.Flag("cluster.gossip-interval", "interval between sending gossip messages. By lowering this value (more frequent) gossip messages are propagated across the cluster more quickly at the expense of increased bandwidth.").
@@ -77,9 +72,22 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application, name string
 		Default(cluster.DefaultPushPullInterval.String()).Duration()
 
 	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer) error {
+		keys, err := encryptionKeys()
+		if err != nil {
+			return newConfigError(err)
+		}
+		objstoreConf, err := bucketConfig()
+		if err != nil {
+			return newConfigError(err)
+		}
+		tlsCfg, err := tlsConfig()
+		if err != nil {
+			return newConfigError(errors.Wrap(err, "parse TLS flags"))
+		}
 		pstate := cluster.PeerState{
-			Type:    cluster.PeerTypeStore,
-			APIAddr: *grpcAddr,
+			Type:        cluster.PeerTypeStore,
+			APIAddr:     *grpcAddr,
+			Description: *clusterDescription,
 			Metadata: cluster.PeerMetadata{
 				MinTime: math.MinInt64,
 				MaxTime: math.MaxInt64,
@@ -95,6 +103,7 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application, name string
 			false,
 			*gossipInterval,
 			*pushPullInterval,
+			0,
 		)
 		if err != nil {
 			return errors.Wrap(err, "join cluster")
@@ -103,14 +112,13 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application, name string
 			logger,
 			reg,
 			tracer,
-			*gcsBucket,
-			*s3Bucket,
-			*s3Endpoint,
-			*s3AccessKey,
-			*s3SecretKey,
-			*s3Insecure,
+			objstoreConf,
+			tlsCfg,
+			keys,
+			*slowOpThreshold,
 			*dataDir,
 			*grpcAddr,
+			*grpcRecoverPanics,
 			*httpAddr,
 			p,
 			uint64(*indexCacheSize),
@@ -127,57 +135,33 @@ func runStore(
 	logger log.Logger,
 	reg *prometheus.Registry,
 	tracer opentracing.Tracer,
-	gcsBucket string,
-	s3Bucket string,
-	s3Endpoint string,
-	s3AccessKey string,
-	s3SecretKey string,
-	s3Insecure bool,
+	objstoreConfig []byte,
+	tlsConfig *tls.Config,
+	encryptionKeys objstore.KeyWrapper,
+	slowOpThreshold time.Duration,
 	dataDir string,
 	grpcAddr string,
+	grpcRecoverPanics bool,
 	httpAddr string,
 	peer *cluster.Peer,
 	indexCacheSizeBytes uint64,
 	chunkPoolSizeBytes uint64,
 ) error {
 	{
-		var (
-			bkt objstore.Bucket
-			// closeFn gets called when the sync loop ends to close clients, clean up, etc
-			closeFn = func() error { return nil }
-			bucket  string
-		)
-
-		s3Config := &s3.Config{
-			Bucket:    s3Bucket,
-			Endpoint:  s3Endpoint,
-			AccessKey: s3AccessKey,
-			SecretKey: s3SecretKey,
-			Insecure:  s3Insecure,
+		if len(objstoreConfig) == 0 {
+			return errors.New("no valid GCS, S3, Azure, Swift, COS, OSS, HDFS or filesystem configuration supplied")
 		}
-
-		if gcsBucket != "" {
-			gcsClient, err := storage.NewClient(context.Background())
-			if err != nil {
-				return errors.Wrap(err, "create GCS client")
-			}
-
-			bkt = gcs.NewBucket(gcsBucket, gcsClient.Bucket(gcsBucket), reg)
-			closeFn = gcsClient.Close
-			bucket = gcsBucket
-		} else if s3Config.Validate() == nil {
-			b, err := s3.NewBucket(s3Config, reg)
-			if err != nil {
-				return errors.Wrap(err, "create s3 client")
-			}
-
-			bkt = b
-			bucket = s3Config.Bucket
-		} else {
-			return errors.New("no valid GCS or S3 configuration supplied")
+		bkt, bucket, closeFn, err := newBucketFromConfig(objstoreConfig, tlsConfig, reg)
+		if err != nil {
+			return errors.Wrap(err, "create bucket")
 		}
 
+		if encryptionKeys != nil {
+			bkt = objstore.EncryptedBucket(bkt, encryptionKeys)
+		}
 		bkt = objstore.BucketWithMetrics(bucket, bkt, reg)
+		bkt = objstore.TracingBucket(bkt, tracer)
+		bkt = objstore.BucketWithSlowOpLog(bkt, logger, slowOpThreshold)
 
 		bs, err := store.NewBucketStore(
 			logger,
@@ -214,7 +198,7 @@ func runStore(
 			return errors.Wrap(err, "listen API address")
 		}
 
-		s := grpc.NewServer(defaultGRPCServerOpts(logger, reg, tracer)...)
+		s := grpc.NewServer(defaultGRPCServerOpts(logger, reg, tracer, grpcRecoverPanics)...)
 		storepb.RegisterStoreServer(s, bs)
 
 		g.Add(func() error {
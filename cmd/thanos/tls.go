@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/improbable-eng/thanos/pkg/tlsconfig"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// registerTLSFlags registers flags for the TLS policy on the command. The returned function
+// builds the TLS config that all TLS connections of the command are based on, which are the
+// connections to object storage of any provider. Settings in the http_config of an objstore
+// config take precedence over the flags.
+func registerTLSFlags(cmd *kingpin.CmdClause) func() (*tls.Config, error) {
+	minVersion := cmd.Flag("tls.min-version", "minimum TLS version accepted for TLS connections").
+		Default("1.2").Enum(tlsconfig.Versions()...)
+
+	cipherSuites := cmd.Flag("tls.cipher-suites", "comma separated list of cipher suites allowed for TLS connections up to TLS 1.2. Defaults to suites with forward secrecy and authenticated encryption").
+		Default(strings.Join(tlsconfig.DefaultCipherSuites, ",")).String()
+
+	return func() (*tls.Config, error) {
+		return tlsconfig.New(*minVersion, strings.Split(*cipherSuites, ","))
+	}
+}
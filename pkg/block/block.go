@@ -23,12 +23,25 @@ type Meta struct {
 	Thanos ThanosMeta `json:"thanos"`
 }
 
+// SourceType identifies the component that created or uploaded a block.
+type SourceType string
+
+// Known block sources.
+const (
+	UnknownSource      SourceType = ""
+	SidecarSource      SourceType = "sidecar"
+	RulerSource        SourceType = "ruler"
+	BucketUploadSource SourceType = "bucket-upload"
+)
+
 // ThanosMeta holds block meta information specific to Thanos.
 type ThanosMeta struct {
 	Labels     map[string]string `json:"labels"`
 	Downsample struct {
 		Resolution int64 `json:"resolution"`
 	} `json:"downsample"`
+	// Source is the component that uploaded the block.
+	Source SourceType `json:"source,omitempty"`
 }
 
 // MetaFilename is the known JSON filename for meta information.
@@ -14,7 +14,7 @@ import (
 
 	"context"
 
-	"io/ioutil"
+	"bytes"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -33,6 +33,8 @@ type Peer struct {
 	mtx   sync.RWMutex
 	data  map[string]PeerState
 	stopc chan struct{}
+
+	metadataBytes prometheus.Gauge
 }
 
 const (
@@ -46,25 +48,63 @@ type PeerType string
 // Constants holding valid PeerType values.
 const (
 	// PeerTypeStore is for peers that implements StoreAPI and are used for browsing historical data.
-	PeerTypeStore = "store"
+	PeerTypeStore PeerType = "store"
 	// PeerTypeSource is for peers that implements StoreAPI and are used for scraping data. They tend to
 	// have data accessible only for short period.
-	PeerTypeSource = "source"
+	PeerTypeSource PeerType = "source"
 
 	// PeerTypeQuery is for peers that implements QueryAPI and are used for querying the metrics.
-	PeerTypeQuery = "query"
+	PeerTypeQuery PeerType = "query"
 )
 
+// StoreAPI returns true if peers of the type expose the StoreAPI. Only their metadata
+// describes data that can be queried.
+func (t PeerType) StoreAPI() bool {
+	return t == PeerTypeStore || t == PeerTypeSource
+}
+
+// MaxDescriptionLength is the maximum length of a peer description in bytes. It bounds the
+// size added to every gossiped state.
+const MaxDescriptionLength = 256
+
 // PeerState contains state for the peer.
 type PeerState struct {
 	Type    PeerType
 	APIAddr string
+	// Description is an optional human-readable description of the peer set by the operator,
+	// e.g. the datacenter it runs in or the team owning it.
+	Description string
 
 	Metadata PeerMetadata
 }
 
+// HasMetadata returns true if the state holds metadata that was set by the owning peer.
+// States seen before their metadata was propagated must not be used for routing decisions.
+// Peers predating the Valid flag never set it, so metadata advertising labels or a time
+// range is taken as set as well. Every peer exposing the StoreAPI advertises a non-zero
+// MaxTime, while metadata that has not been propagated is entirely zero.
+func (s PeerState) HasMetadata() bool {
+	return s.Metadata.Valid || len(s.Metadata.Labels) > 0 || s.Metadata.MinTime != 0 || s.Metadata.MaxTime != 0
+}
+
+// CompatibleProtocol returns true if the peer speaks a protocol version this peer understands.
+// Peers predating versioning are treated as speaking the first version.
+func (s PeerState) CompatibleProtocol() bool {
+	return s.Metadata.ProtocolVersion <= ProtocolVersion
+}
+
+// ProtocolVersion is the version of the Store API and gossip protocol spoken by this peer.
+// It must be incremented on changes that break compatibility with peers running older versions.
+const ProtocolVersion = 1
+
 // PeerMetadata are the information that can change in runtime of the peer.
 type PeerMetadata struct {
+	// Valid is set by the owning peer to indicate that the metadata reflects its actual state.
+	// Peers predating it leave it unset, see PeerState.HasMetadata.
+	Valid bool
+	// ProtocolVersion advertised by the peer. Peers predating versioning advertise zero.
+	ProtocolVersion int
+
 	Labels []storepb.Label
 
 	// MinTime indicates the minTime of the oldest block available from this peer.
@@ -83,7 +123,11 @@ func Join(
 	waitIfEmpty bool,
 	pushPullInterval time.Duration,
 	gossipInterval time.Duration,
+	joinTimeout time.Duration,
 ) (*Peer, error) {
+	if len(initialState.Description) > MaxDescriptionLength {
+		return nil, errors.Errorf("peer description of %d bytes exceeds limit of %d bytes", len(initialState.Description), MaxDescriptionLength)
+	}
 	bindHost, bindPortStr, err := net.SplitHostPort(bindAddr)
 	if err != nil {
 		return nil, err
@@ -96,14 +140,21 @@ func Join(
 	var advertisePort int
 
 	if advertiseAddr != "" {
-		var advertisePortStr string
-		advertiseHost, advertisePortStr, err = net.SplitHostPort(advertiseAddr)
+		advertiseHost, advertisePort, err = parseAdvertiseAddr(advertiseAddr, bindPort)
 		if err != nil {
 			return nil, errors.Wrap(err, "invalid advertise address")
 		}
-		advertisePort, err = strconv.Atoi(advertisePortStr)
-		if err != nil {
-			return nil, errors.Wrap(err, "invalid advertise address, wrong port")
+	}
+
+	var selfAddr string
+	if advertiseAddr != "" {
+		selfAddr = net.JoinHostPort(advertiseHost, strconv.Itoa(advertisePort))
+	}
+	knownPeers, removed := filterPeers(knownPeers, selfAddr)
+	if len(removed) > 0 {
+		level.Warn(l).Log("msg", "removed duplicate peers and references to this node from the configured peers", "removed", strings.Join(removed, ","))
+		if len(knownPeers) == 0 {
+			level.Warn(l).Log("msg", "no peers left to join after filtering, starting a new cluster")
 		}
 	}
 
@@ -145,7 +196,12 @@ func Join(
 	p := &Peer{
 		data:  map[string]PeerState{},
 		stopc: make(chan struct{}),
+		metadataBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_cluster_peer_metadata_bytes",
+			Help: "Size of the JSON encoded metadata this peer gossips about itself.",
+		}),
 	}
+	reg.MustRegister(p.metadataBytes)
 	d := newDelegate(l, reg, p)
 
 	cfg := memberlist.DefaultLANConfig()
@@ -156,7 +212,7 @@ func Join(
 	cfg.Events = d
 	cfg.GossipInterval = gossipInterval
 	cfg.PushPullInterval = pushPullInterval
-	cfg.LogOutput = ioutil.Discard
+	cfg.LogOutput = newMemberlistLogWriter(l, reg)
 	if advertiseAddr != "" {
 		cfg.AdvertiseAddr = advertiseHost
 		cfg.AdvertisePort = advertisePort
@@ -168,7 +224,11 @@ func Join(
 	}
 	p.mlist = ml
 
-	n, _ := ml.Join(knownPeers)
+	n, err := joinPeers(l, ml, knownPeers, joinTimeout)
+	if err != nil {
+		ml.Shutdown()
+		return nil, err
+	}
 	level.Debug(l).Log("msg", "joined cluster", "peers", n)
 
 	if n > 0 {
@@ -176,13 +236,68 @@ func Join(
 	}
 
 	// Initialize state with ourselves.
-	p.mtx.RLock()
-	p.data[p.Name()] = initialState
-	p.mtx.RUnlock()
+	initialState.Metadata.Valid = true
+	initialState.Metadata.ProtocolVersion = ProtocolVersion
+
+	p.mtx.Lock()
+	p.setState(initialState)
+	p.mtx.Unlock()
 
 	return p, nil
 }
 
+// joinPeers joins the cluster through the known peers. If joinTimeout is not zero and no peer
+// can be reached, joining is retried with backoff and fails once the timeout is exceeded.
+// Otherwise the peer starts out alone if no known peer is reachable.
+func joinPeers(l log.Logger, ml *memberlist.Memberlist, knownPeers []string, joinTimeout time.Duration) (int, error) {
+	n, err := ml.Join(knownPeers)
+	if n > 0 || len(knownPeers) == 0 || joinTimeout <= 0 {
+		return n, nil
+	}
+	deadline := time.Now().Add(joinTimeout)
+	backoff := 500 * time.Millisecond
+
+	for {
+		level.Warn(l).Log("msg", "joining cluster failed, retrying", "err", err, "backoff", backoff)
+
+		if time.Now().Add(backoff).After(deadline) {
+			return 0, errors.Wrapf(err, "no known peer reachable within join timeout of %s", joinTimeout)
+		}
+		time.Sleep(backoff)
+
+		if n, err = ml.Join(knownPeers); n > 0 {
+			return n, nil
+		}
+		if backoff *= 2; backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
+
+// parseAdvertiseAddr splits the advertise address into host and port. If the address
+// has no port, the bind port is advertised.
+func parseAdvertiseAddr(addr string, bindPort int) (host string, port int, err error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		if aerr, ok := err.(*net.AddrError); !ok || aerr.Err != "missing port in address" {
+			return "", 0, err
+		}
+		host, port = addr, bindPort
+	} else {
+		port, err = strconv.Atoi(portStr)
+		if err != nil {
+			return "", 0, errors.Wrap(err, "wrong port")
+		}
+	}
+	if host == "" {
+		return "", 0, errors.New("missing host")
+	}
+	if port == 0 {
+		return "", 0, errors.New("advertise port must not be zero")
+	}
+	return host, port, nil
+}
+
 func (p *Peer) warnIfAlone(logger log.Logger, d time.Duration) {
 	tick := time.NewTicker(d)
 	defer tick.Stop()
@@ -206,8 +321,9 @@ func (p *Peer) SetLabels(labels []storepb.Label) {
 	defer p.mtx.Unlock()
 
 	s := p.data[p.Name()]
-	s.Metadata.Labels = labels
-	p.data[p.Name()] = s
+	// Copy the labels so later modifications by the caller cannot change the state unlocked.
+	s.Metadata.Labels = copyLabels(labels)
+	p.setState(s)
 }
 
 // SetTimestamps updates internal metadata's timestamps stored in PeerState for this peer.
@@ -219,7 +335,26 @@ func (p *Peer) SetTimestamps(mint int64, maxt int64) {
 	s := p.data[p.Name()]
 	s.Metadata.MinTime = mint
 	s.Metadata.MaxTime = maxt
+	p.setState(s)
+}
+
+// Timestamps returns the timestamps currently advertised by this peer.
+func (p *Peer) Timestamps() (mint int64, maxt int64) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	s := p.data[p.Name()]
+	return s.Metadata.MinTime, s.Metadata.MaxTime
+}
+
+// setState sets the state of this peer and updates the size of its metadata.
+// The caller must hold the write lock.
+func (p *Peer) setState(s PeerState) {
 	p.data[p.Name()] = s
+
+	if b, err := json.Marshal(s.Metadata); err == nil {
+		p.metadataBytes.Set(float64(len(b)))
+	}
 }
 
 // Leave the cluster, waiting up to timeout.
@@ -235,20 +370,22 @@ func (p *Peer) Name() string {
 
 // Peers returns a sorted address list of peers of the given type.
 func (p *Peer) Peers(t PeerType) (ps []string) {
-	p.mtx.RLock()
-	defer p.mtx.RUnlock()
-
-	for _, o := range p.mlist.Members() {
-		os, ok := p.data[o.Name]
-		if !ok || os.Type != t {
-			continue
-		}
-		ps = append(ps, o.Address())
+	for _, e := range p.snapshot(t) {
+		ps = append(ps, e.addr)
 	}
 	sort.Strings(ps)
 	return ps
 }
 
+func copyLabels(lset []storepb.Label) []storepb.Label {
+	if lset == nil {
+		return nil
+	}
+	res := make([]storepb.Label, len(lset))
+	copy(res, lset)
+	return res
+}
+
 // PeerTypesStoreAPIs gives a PeerType that allows all types that exposes StoreAPI.
 func PeerTypesStoreAPIs() []PeerType {
 	return []PeerType{PeerTypeStore, PeerTypeSource}
@@ -256,6 +393,27 @@ func PeerTypesStoreAPIs() []PeerType {
 
 // PeerStates returns the custom state information for each peer.
 func (p *Peer) PeerStates(types ...PeerType) (ps []PeerState) {
+	return p.Snapshot(types...)
+}
+
+// Snapshot returns a copy of the states of all peers of the given types. All states are
+// taken at the same point in time, so they are consistent with each other, and are not
+// affected by later gossip updates.
+func (p *Peer) Snapshot(types ...PeerType) (ps []PeerState) {
+	for _, e := range p.snapshot(types...) {
+		ps = append(ps, e.state)
+	}
+	return ps
+}
+
+type snapshotEntry struct {
+	addr  string
+	state PeerState
+}
+
+// snapshot returns the addresses and copied states of all peers of the given types
+// under a single lock acquisition.
+func (p *Peer) snapshot(types ...PeerType) (es []snapshotEntry) {
 	p.mtx.RLock()
 	defer p.mtx.RUnlock()
 
@@ -266,14 +424,141 @@ func (p *Peer) PeerStates(types ...PeerType) (ps []PeerState) {
 		}
 		for _, t := range types {
 			if os.Type == t {
-				ps = append(ps, os)
+				os.Metadata.Labels = copyLabels(os.Metadata.Labels)
+				es = append(es, snapshotEntry{addr: o.Address(), state: os})
 				break
 			}
 		}
 	}
+	return es
+}
+
+// PeerStatesWithMetadata returns the custom state information for each peer like PeerStates
+// but omits peers whose metadata has not been propagated yet.
+// Peers of types not exposing the StoreAPI are always omitted as their metadata carries
+// no information about queryable data.
+func (p *Peer) PeerStatesWithMetadata(types ...PeerType) (ps []PeerState) {
+	for _, s := range p.PeerStates(types...) {
+		if s.Type.StoreAPI() && s.HasMetadata() {
+			ps = append(ps, s)
+		}
+	}
 	return ps
 }
 
+// PeersWithLabels returns the states of all other peers of the given types that advertise
+// the same label set as given, regardless of the label order.
+func (p *Peer) PeersWithLabels(lset []storepb.Label, types ...PeerType) (ps []PeerState) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	self := p.Name()
+	key := sortedLabelsKey(lset)
+
+	for _, o := range p.mlist.Members() {
+		if o.Name == self {
+			continue
+		}
+		s, ok := p.data[o.Name]
+		if !ok || !s.HasMetadata() {
+			continue
+		}
+		for _, t := range types {
+			if s.Type == t && sortedLabelsKey(s.Metadata.Labels) == key {
+				ps = append(ps, s)
+				break
+			}
+		}
+	}
+	return ps
+}
+
+// ReplicaGroup is a logical data source formed by all peers that only differ in the value
+// of their replica label, e.g. a pair of HA Prometheus servers.
+type ReplicaGroup struct {
+	// Labels are the peers' labels without the replica label.
+	Labels []storepb.Label
+	// APIAddrs of all replicas in the group.
+	APIAddrs []string
+
+	// MinTime and MaxTime span the time ranges of all replicas.
+	MinTime int64
+	MaxTime int64
+}
+
+// ReplicaGroups groups the states of peers of the given types into logical sources along the
+// given replica label and merges their time ranges.
+func (p *Peer) ReplicaGroups(replicaLabel string, types ...PeerType) []ReplicaGroup {
+	return groupReplicas(p.PeerStatesWithMetadata(types...), replicaLabel)
+}
+
+func groupReplicas(states []PeerState, replicaLabel string) []ReplicaGroup {
+	var (
+		groups []ReplicaGroup
+		byKey  = map[string]int{}
+	)
+	for _, s := range states {
+		lset := make([]storepb.Label, 0, len(s.Metadata.Labels))
+		for _, l := range s.Metadata.Labels {
+			if l.Name == replicaLabel {
+				continue
+			}
+			lset = append(lset, l)
+		}
+		sort.Slice(lset, func(i, j int) bool {
+			return lset[i].Name < lset[j].Name
+		})
+		key := labelsKey(lset)
+
+		i, ok := byKey[key]
+		if !ok {
+			byKey[key] = len(groups)
+			groups = append(groups, ReplicaGroup{
+				Labels:   lset,
+				APIAddrs: []string{s.APIAddr},
+				MinTime:  s.Metadata.MinTime,
+				MaxTime:  s.Metadata.MaxTime,
+			})
+			continue
+		}
+		g := &groups[i]
+		g.APIAddrs = append(g.APIAddrs, s.APIAddr)
+
+		if s.Metadata.MinTime < g.MinTime {
+			g.MinTime = s.Metadata.MinTime
+		}
+		if s.Metadata.MaxTime > g.MaxTime {
+			g.MaxTime = s.Metadata.MaxTime
+		}
+	}
+	for _, g := range groups {
+		sort.Strings(g.APIAddrs)
+	}
+	return groups
+}
+
+// sortedLabelsKey is like labelsKey but does not require lset to be sorted.
+func sortedLabelsKey(lset []storepb.Label) string {
+	sorted := make([]storepb.Label, len(lset))
+	copy(sorted, lset)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return labelsKey(sorted)
+}
+
+func labelsKey(lset []storepb.Label) string {
+	var b bytes.Buffer
+	for _, l := range lset {
+		b.WriteString(l.Name)
+		b.WriteByte(0xff)
+		b.WriteString(l.Value)
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
 // ClusterSize returns the current number of alive members in the cluster.
 func (p *Peer) ClusterSize() int {
 	return p.mlist.NumMembers()
@@ -308,6 +593,7 @@ type delegate struct {
 
 	gossipMsgsReceived   prometheus.Counter
 	gossipClusterMembers prometheus.Gauge
+	lastConvergence      prometheus.Gauge
 }
 
 func newDelegate(l log.Logger, reg *prometheus.Registry, p *Peer) *delegate {
@@ -324,8 +610,14 @@ func newDelegate(l log.Logger, reg *prometheus.Registry, p *Peer) *delegate {
 		Help: "Number indicating current number of members in cluster.",
 	})
 
+	lastConvergence := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_cluster_last_convergence_seconds",
+		Help: "Unix timestamp of the last successful push-pull state merge with another peer.",
+	})
+
 	reg.MustRegister(gossipMsgsReceived)
 	reg.MustRegister(gossipClusterMembers)
+	reg.MustRegister(lastConvergence)
 
 	return &delegate{
 		logger:               l,
@@ -333,6 +625,7 @@ func newDelegate(l log.Logger, reg *prometheus.Registry, p *Peer) *delegate {
 		bcast:                bcast,
 		gossipMsgsReceived:   gossipMsgsReceived,
 		gossipClusterMembers: gossipClusterMembers,
+		lastConvergence:      lastConvergence,
 	}
 }
 
@@ -393,6 +686,8 @@ func (d *delegate) MergeRemoteState(buf []byte, _ bool) {
 		level.Error(d.logger).Log("method", "MergeRemoteState", "err", err)
 		return
 	}
+	d.lastConvergence.Set(float64(time.Now().Unix()))
+
 	d.mtx.Lock()
 	defer d.mtx.Unlock()
 	for k, v := range data {
@@ -420,6 +715,46 @@ func (d *delegate) NotifyUpdate(n *memberlist.Node) {
 	level.Debug(d.logger).Log("received", "NotifyUpdate", "node", n.Name, "addr", n.Address())
 }
 
+// memberlistLogWriter forwards memberlist's log output to our logger and counts the
+// failures it reports. memberlist exposes no callbacks for failed probes and
+// push-pull syncs, so its log lines are the only place we learn about them.
+type memberlistLogWriter struct {
+	logger           log.Logger
+	probeFailures    prometheus.Counter
+	pushPullFailures prometheus.Counter
+}
+
+func newMemberlistLogWriter(l log.Logger, reg *prometheus.Registry) *memberlistLogWriter {
+	w := &memberlistLogWriter{
+		logger: l,
+		probeFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_cluster_probe_failures_total",
+			Help: "Total number of failed probes of cluster peers.",
+		}),
+		pushPullFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_cluster_push_pull_failures_total",
+			Help: "Total number of failed push-pull state syncs with cluster peers.",
+		}),
+	}
+	reg.MustRegister(w.probeFailures, w.pushPullFailures)
+	return w
+}
+
+// Write implements io.Writer. memberlist writes a single log line per call.
+func (w *memberlistLogWriter) Write(b []byte) (int, error) {
+	switch {
+	case bytes.Contains(b, []byte("memberlist: Suspect")),
+		bytes.Contains(b, []byte("memberlist: Failed to send ping")),
+		bytes.Contains(b, []byte("but other probes failed")):
+		w.probeFailures.Inc()
+	case bytes.Contains(b, []byte("memberlist: Push/Pull with")),
+		bytes.Contains(b, []byte("memberlist: Failed push/pull merge")):
+		w.pushPullFailures.Inc()
+	}
+	level.Debug(w.logger).Log("msg", string(bytes.TrimSpace(b)))
+	return len(b), nil
+}
+
 func resolvePeers(ctx context.Context, peers []string, myAddress string, res net.Resolver, waitIfEmpty bool) ([]string, error) {
 	var resolvedPeers []string
 
@@ -475,6 +810,22 @@ func resolvePeers(ctx context.Context, peers []string, myAddress string, res net
 	return resolvedPeers, nil
 }
 
+// filterPeers removes duplicates and the node's own address from the given peers.
+// It returns the remaining peers in their original order and the removed ones.
+func filterPeers(peers []string, self string) (filtered, removed []string) {
+	seen := map[string]struct{}{}
+
+	for _, peer := range peers {
+		if _, ok := seen[peer]; ok || (self != "" && peer == self) {
+			removed = append(removed, peer)
+			continue
+		}
+		seen[peer] = struct{}{}
+		filtered = append(filtered, peer)
+	}
+	return filtered, removed
+}
+
 func removeMyAddr(ips []net.IPAddr, targetPort string, myAddr string) []net.IPAddr {
 	var result []net.IPAddr
 
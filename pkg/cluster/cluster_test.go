@@ -6,8 +6,10 @@ import (
 	"time"
 
 	"context"
+	"encoding/json"
 	"errors"
 	"sort"
+	"strings"
 
 	"reflect"
 
@@ -20,6 +22,14 @@ import (
 )
 
 func joinPeer(num int, knownPeers []string) (peerAddr string, peer *Peer, err error) {
+	return joinPeerWithRegistry(num, knownPeers, prometheus.NewRegistry())
+}
+
+func joinPeerWithRegistry(num int, knownPeers []string, reg *prometheus.Registry) (peerAddr string, peer *Peer, err error) {
+	return joinPeerWithType(num, knownPeers, reg, PeerTypeSource)
+}
+
+func joinPeerWithType(num int, knownPeers []string, reg *prometheus.Registry, typ PeerType) (peerAddr string, peer *Peer, err error) {
 	port, err := testutil.FreePort()
 	if err != nil {
 		return "", nil, err
@@ -27,7 +37,7 @@ func joinPeer(num int, knownPeers []string) (peerAddr string, peer *Peer, err er
 	peerAddr = fmt.Sprintf("127.0.0.1:%d", port)
 	now := time.Now()
 	peerState1 := PeerState{
-		Type:    PeerTypeSource,
+		Type:    typ,
 		APIAddr: fmt.Sprintf("sidecar-address:%d", num),
 		Metadata: PeerMetadata{
 			Labels: []storepb.Label{
@@ -43,7 +53,7 @@ func joinPeer(num int, knownPeers []string) (peerAddr string, peer *Peer, err er
 
 	peer, err = Join(
 		log.NewNopLogger(),
-		prometheus.NewRegistry(),
+		reg,
 		peerAddr,
 		peerAddr,
 		knownPeers,
@@ -51,6 +61,7 @@ func joinPeer(num int, knownPeers []string) (peerAddr string, peer *Peer, err er
 		false,
 		100*time.Millisecond,
 		50*time.Millisecond,
+		0,
 	)
 
 	return peerAddr, peer, nil
@@ -87,6 +98,8 @@ func TestPeers_PropagatingState(t *testing.T) {
 	// Update peer1 state.
 	now := time.Now()
 	newPeerMeta1 := PeerMetadata{
+		Valid:           true,
+		ProtocolVersion: ProtocolVersion,
 		Labels: []storepb.Label{
 			{
 				Name:  "b",
@@ -99,6 +112,10 @@ func TestPeers_PropagatingState(t *testing.T) {
 	peer1.SetLabels(newPeerMeta1.Labels)
 	peer1.SetTimestamps(newPeerMeta1.MinTime, newPeerMeta1.MaxTime)
 
+	mint, maxt := peer1.Timestamps()
+	testutil.Equals(t, newPeerMeta1.MinTime, mint)
+	testutil.Equals(t, newPeerMeta1.MaxTime, maxt)
+
 	// Check if peer2 got the updated meta about peer1.
 	ctx2, cancel2 := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel2()
@@ -115,3 +132,465 @@ func TestPeers_PropagatingState(t *testing.T) {
 		return errors.New("outdated metadata")
 	}))
 }
+
+func TestPeers_ProbeFailures(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	addr1, peer1, err := joinPeerWithRegistry(1, nil, reg)
+	testutil.Ok(t, err)
+	defer peer1.Leave(0)
+
+	_, peer2, err := joinPeer(2, []string{addr1})
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, 0.0, testutil.CounterValue(t, reg, "thanos_cluster_probe_failures_total"))
+
+	// Kill the second peer without gracefully leaving the cluster.
+	testutil.Ok(t, peer2.mlist.Shutdown())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	testutil.Ok(t, runutil.Retry(1*time.Second, ctx.Done(), func() error {
+		if testutil.CounterValue(t, reg, "thanos_cluster_probe_failures_total") > 0 {
+			return nil
+		}
+		return errors.New("no probe failure observed")
+	}))
+}
+
+func TestGroupReplicas(t *testing.T) {
+	states := []PeerState{
+		{
+			Type:    PeerTypeSource,
+			APIAddr: "prom-1b:10901",
+			Metadata: PeerMetadata{
+				Labels:  []storepb.Label{{Name: "region", Value: "eu"}, {Name: "replica", Value: "b"}},
+				MinTime: 200,
+				MaxTime: 1100,
+			},
+		},
+		{
+			Type:    PeerTypeSource,
+			APIAddr: "prom-1a:10901",
+			Metadata: PeerMetadata{
+				Labels:  []storepb.Label{{Name: "replica", Value: "a"}, {Name: "region", Value: "eu"}},
+				MinTime: 100,
+				MaxTime: 1000,
+			},
+		},
+		{
+			Type:    PeerTypeSource,
+			APIAddr: "prom-2:10901",
+			Metadata: PeerMetadata{
+				Labels:  []storepb.Label{{Name: "region", Value: "us"}, {Name: "replica", Value: "a"}},
+				MinTime: 300,
+				MaxTime: 900,
+			},
+		},
+	}
+
+	testutil.Equals(t, []ReplicaGroup{
+		{
+			Labels:   []storepb.Label{{Name: "region", Value: "eu"}},
+			APIAddrs: []string{"prom-1a:10901", "prom-1b:10901"},
+			MinTime:  100,
+			MaxTime:  1100,
+		},
+		{
+			Labels:   []storepb.Label{{Name: "region", Value: "us"}},
+			APIAddrs: []string{"prom-2:10901"},
+			MinTime:  300,
+			MaxTime:  900,
+		},
+	}, groupReplicas(states, "replica"))
+}
+
+func TestPeers_PeerStatesWithMetadata(t *testing.T) {
+	addr1, peer1, err := joinPeer(1, nil)
+	testutil.Ok(t, err)
+
+	_, peer2, err := joinPeer(2, []string{addr1})
+	testutil.Ok(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	testutil.Ok(t, runutil.Retry(1*time.Second, ctx.Done(), func() error {
+		if len(peer1.PeerStatesWithMetadata(PeerTypeSource)) == 2 {
+			return nil
+		}
+		return errors.New("state of second peer not propagated")
+	}))
+
+	// Stop gossiping so the following modification is not overwritten by state syncs.
+	testutil.Ok(t, peer2.mlist.Shutdown())
+	testutil.Ok(t, peer1.mlist.Shutdown())
+
+	// Simulate the second peer being known before its metadata was propagated.
+	peer1.mtx.Lock()
+	peer1.data[peer2.Name()] = PeerState{Type: PeerTypeSource, APIAddr: "sidecar-address:2"}
+	peer1.mtx.Unlock()
+
+	testutil.Equals(t, 2, len(peer1.PeerStates(PeerTypeSource)))
+
+	states := peer1.PeerStatesWithMetadata(PeerTypeSource)
+	testutil.Equals(t, 1, len(states))
+	testutil.Equals(t, "sidecar-address:1", states[0].APIAddr)
+}
+
+func TestParseAdvertiseAddr(t *testing.T) {
+	for _, c := range []struct {
+		addr     string
+		bindPort int
+		host     string
+		port     int
+		err      bool
+	}{
+		{addr: "10.0.0.1:10900", bindPort: 10901, host: "10.0.0.1", port: 10900},
+		{addr: "10.0.0.1", bindPort: 10901, host: "10.0.0.1", port: 10901},
+		{addr: "example.org:8080", bindPort: 10901, host: "example.org", port: 8080},
+		{addr: "[::1]:8080", bindPort: 10901, host: "::1", port: 8080},
+		{addr: "10.0.0.1:0", bindPort: 10901, err: true},
+		{addr: "10.0.0.1", bindPort: 0, err: true},
+		{addr: ":8080", bindPort: 10901, err: true},
+		{addr: "10.0.0.1:abc", bindPort: 10901, err: true},
+	} {
+		host, port, err := parseAdvertiseAddr(c.addr, c.bindPort)
+		if c.err {
+			testutil.NotOk(t, err)
+			continue
+		}
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.host, host)
+		testutil.Equals(t, c.port, port)
+	}
+}
+
+func TestFilterPeers(t *testing.T) {
+	for _, c := range []struct {
+		peers    []string
+		self     string
+		filtered []string
+		removed  []string
+	}{
+		{peers: nil, self: "10.0.0.1:10900"},
+		{
+			peers:    []string{"10.0.0.2:10900", "10.0.0.3:10900"},
+			self:     "10.0.0.1:10900",
+			filtered: []string{"10.0.0.2:10900", "10.0.0.3:10900"},
+		},
+		{
+			peers:    []string{"10.0.0.2:10900", "10.0.0.3:10900", "10.0.0.2:10900"},
+			filtered: []string{"10.0.0.2:10900", "10.0.0.3:10900"},
+			removed:  []string{"10.0.0.2:10900"},
+		},
+		{
+			peers:    []string{"10.0.0.1:10900", "10.0.0.2:10900", "10.0.0.1:10901"},
+			self:     "10.0.0.1:10900",
+			filtered: []string{"10.0.0.2:10900", "10.0.0.1:10901"},
+			removed:  []string{"10.0.0.1:10900"},
+		},
+		{
+			peers:   []string{"10.0.0.1:10900", "10.0.0.1:10900"},
+			self:    "10.0.0.1:10900",
+			removed: []string{"10.0.0.1:10900", "10.0.0.1:10900"},
+		},
+	} {
+		filtered, removed := filterPeers(c.peers, c.self)
+		testutil.Equals(t, c.filtered, filtered)
+		testutil.Equals(t, c.removed, removed)
+	}
+}
+
+func TestJoin_SelfReference(t *testing.T) {
+	bindPort, err := testutil.FreePort()
+	testutil.Ok(t, err)
+	addr := fmt.Sprintf("127.0.0.1:%d", bindPort)
+
+	// Listing only ourselves as peer must be a valid single-node bootstrap.
+	peer, err := Join(
+		log.NewNopLogger(),
+		prometheus.NewRegistry(),
+		addr,
+		addr,
+		[]string{addr, addr},
+		PeerState{Type: PeerTypeSource},
+		false,
+		100*time.Millisecond,
+		50*time.Millisecond,
+		0,
+	)
+	testutil.Ok(t, err)
+	defer peer.Leave(0)
+
+	testutil.Equals(t, 1, peer.mlist.NumMembers())
+}
+
+func TestJoin_RetryUntilTimeout(t *testing.T) {
+	port1, err := testutil.FreePort()
+	testutil.Ok(t, err)
+	port2, err := testutil.FreePort()
+	testutil.Ok(t, err)
+	addr1, addr2 := fmt.Sprintf("127.0.0.1:%d", port1), fmt.Sprintf("127.0.0.1:%d", port2)
+
+	join := func(addr string, knownPeers []string, timeout time.Duration) (*Peer, error) {
+		return Join(log.NewNopLogger(), prometheus.NewRegistry(), addr, addr, knownPeers,
+			PeerState{Type: PeerTypeSource}, false, 100*time.Millisecond, 50*time.Millisecond, timeout)
+	}
+
+	// Without any reachable peer joining must fail after the timeout.
+	start := time.Now()
+	_, err = join(addr2, []string{addr1}, time.Second)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, time.Since(start) < 5*time.Second, "join did not time out")
+
+	// The first peer only comes up after the second one started joining.
+	peerc := make(chan *Peer, 1)
+	go func() {
+		time.Sleep(time.Second)
+		p, err := join(addr1, nil, 0)
+		testutil.Ok(t, err)
+		peerc <- p
+	}()
+	peer2, err := join(addr2, []string{addr1}, 10*time.Second)
+	testutil.Ok(t, err)
+	defer peer2.Leave(0)
+
+	peer1 := <-peerc
+	defer peer1.Leave(0)
+
+	testutil.Equals(t, 2, peer2.mlist.NumMembers())
+}
+
+func TestJoin_AdvertisePort(t *testing.T) {
+	bindPort, err := testutil.FreePort()
+	testutil.Ok(t, err)
+	advertisePort, err := testutil.FreePort()
+	testutil.Ok(t, err)
+
+	peer, err := Join(
+		log.NewNopLogger(),
+		prometheus.NewRegistry(),
+		fmt.Sprintf("127.0.0.1:%d", bindPort),
+		fmt.Sprintf("127.0.0.1:%d", advertisePort),
+		nil,
+		PeerState{Type: PeerTypeSource},
+		false,
+		100*time.Millisecond,
+		50*time.Millisecond,
+		0,
+	)
+	testutil.Ok(t, err)
+	defer peer.Leave(0)
+
+	testutil.Equals(t, uint16(advertisePort), peer.mlist.LocalNode().Port)
+}
+
+func TestPeers_PeersWithLabels(t *testing.T) {
+	addr1, peer1, err := joinPeer(1, nil)
+	testutil.Ok(t, err)
+	defer peer1.Leave(0)
+
+	_, peer2, err := joinPeer(2, []string{addr1})
+	testutil.Ok(t, err)
+	defer peer2.Leave(0)
+
+	lset := []storepb.Label{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}
+	peer1.SetLabels(lset)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	testutil.Ok(t, runutil.Retry(1*time.Second, ctx.Done(), func() error {
+		if len(peer2.PeerStatesWithMetadata(PeerTypeSource)) == 2 {
+			return nil
+		}
+		return errors.New("state of first peer not propagated")
+	}))
+	// The peer itself must never be reported.
+	testutil.Equals(t, 0, len(peer1.PeersWithLabels(lset, PeerTypeSource)))
+
+	// Label sets differing in the replica label are not reported.
+	replicaLset := []storepb.Label{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}, {Name: "replica", Value: "x"}}
+	testutil.Equals(t, 0, len(peer2.PeersWithLabels(replicaLset, PeerTypeSource)))
+
+	// Identical label sets are reported regardless of their order.
+	testutil.Ok(t, runutil.Retry(1*time.Second, ctx.Done(), func() error {
+		if len(peer2.PeersWithLabels([]storepb.Label{{Name: "b", Value: "2"}, {Name: "a", Value: "1"}}, PeerTypeSource)) == 1 {
+			return nil
+		}
+		return errors.New("duplicate labels not detected")
+	}))
+	ps := peer2.PeersWithLabels([]storepb.Label{{Name: "b", Value: "2"}, {Name: "a", Value: "1"}}, PeerTypeSource)
+	testutil.Equals(t, "sidecar-address:1", ps[0].APIAddr)
+}
+
+func TestPeerState_CompatibleProtocol(t *testing.T) {
+	for _, c := range []struct {
+		version int
+		ok      bool
+	}{
+		{version: 0, ok: true},
+		{version: ProtocolVersion, ok: true},
+		{version: ProtocolVersion + 1, ok: false},
+	} {
+		s := PeerState{Metadata: PeerMetadata{Valid: true, ProtocolVersion: c.version}}
+		testutil.Equals(t, c.ok, s.CompatibleProtocol())
+	}
+}
+
+func TestPeerState_HasMetadata(t *testing.T) {
+	for _, c := range []struct {
+		state string
+		ok    bool
+	}{
+		// Peers predating the Valid and ProtocolVersion fields.
+		{state: `{"Type":"source","APIAddr":"prom-1:10901","Metadata":{"Labels":[{"name":"a","value":"1"}],"MinTime":-1000,"MaxTime":9223372036854775807}}`, ok: true},
+		{state: `{"Type":"store","APIAddr":"store-1:10901","Metadata":{"Labels":null,"MinTime":-9223372036854775808,"MaxTime":9223372036854775807}}`, ok: true},
+		{state: `{"Type":"source","APIAddr":"prom-1:10901","Metadata":{"Valid":true,"ProtocolVersion":1}}`, ok: true},
+		// States seen before their metadata was propagated.
+		{state: `{"Type":"source","APIAddr":"prom-1:10901","Metadata":{}}`, ok: false},
+		{state: `{"Type":"source","APIAddr":"prom-1:10901"}`, ok: false},
+	} {
+		var s PeerState
+		testutil.Ok(t, json.Unmarshal([]byte(c.state), &s))
+		testutil.Equals(t, c.ok, s.HasMetadata())
+		testutil.Assert(t, s.CompatibleProtocol(), "peer of state %s has incompatible protocol", c.state)
+	}
+}
+
+func TestPeers_MixedTypes(t *testing.T) {
+	addr1, peer1, err := joinPeerWithType(1, nil, prometheus.NewRegistry(), PeerTypeSource)
+	testutil.Ok(t, err)
+	defer peer1.Leave(0)
+
+	addr2, peer2, err := joinPeerWithType(2, []string{addr1}, prometheus.NewRegistry(), PeerTypeStore)
+	testutil.Ok(t, err)
+	defer peer2.Leave(0)
+
+	addr3, peer3, err := joinPeerWithType(3, []string{addr1}, prometheus.NewRegistry(), PeerTypeQuery)
+	testutil.Ok(t, err)
+	defer peer3.Leave(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	testutil.Ok(t, runutil.Retry(1*time.Second, ctx.Done(), func() error {
+		if len(peer1.PeerStates(PeerTypeSource, PeerTypeStore, PeerTypeQuery)) == 3 {
+			return nil
+		}
+		return errors.New("not all peer states propagated")
+	}))
+
+	testutil.Equals(t, []string{addr1}, peer1.Peers(PeerTypeSource))
+	testutil.Equals(t, []string{addr2}, peer1.Peers(PeerTypeStore))
+	testutil.Equals(t, []string{addr3}, peer1.Peers(PeerTypeQuery))
+
+	for _, typ := range []PeerType{PeerTypeSource, PeerTypeStore, PeerTypeQuery} {
+		states := peer1.PeerStates(typ)
+		testutil.Equals(t, 1, len(states))
+		testutil.Equals(t, typ, states[0].Type)
+	}
+	testutil.Equals(t, 2, len(peer1.PeerStatesWithMetadata(PeerTypesStoreAPIs()...)))
+
+	// The query peer's metadata must never be treated as describing queryable data.
+	testutil.Equals(t, 0, len(peer1.PeerStatesWithMetadata(PeerTypeQuery)))
+}
+
+func TestPeers_SnapshotConsistent(t *testing.T) {
+	_, peer, err := joinPeer(1, nil)
+	testutil.Ok(t, err)
+	defer peer.Leave(0)
+
+	var (
+		stopc = make(chan struct{})
+		donec = make(chan struct{})
+	)
+	go func() {
+		defer close(donec)
+
+		// Reusing the slice must not leak partial updates into the state.
+		lset := make([]storepb.Label, 2)
+		for i := 0; ; i++ {
+			select {
+			case <-stopc:
+				return
+			default:
+			}
+			v := fmt.Sprintf("%d", i)
+			lset[0] = storepb.Label{Name: "a", Value: v}
+			lset[1] = storepb.Label{Name: "b", Value: v}
+			peer.SetLabels(lset)
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		for _, s := range peer.Snapshot(PeerTypeSource) {
+			lset := s.Metadata.Labels
+			if len(lset) != 2 {
+				continue
+			}
+			testutil.Equals(t, lset[0].Value, lset[1].Value)
+		}
+	}
+	close(stopc)
+	<-donec
+
+	testutil.Equals(t, len(peer.Peers(PeerTypeSource)), len(peer.Snapshot(PeerTypeSource)))
+}
+
+func TestPeers_Description(t *testing.T) {
+	port, err := testutil.FreePort()
+	testutil.Ok(t, err)
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	state := PeerState{
+		Type:        PeerTypeStore,
+		APIAddr:     "store-address:1",
+		Description: "dc=eu-west-1 team=observability",
+	}
+	peer1, err := Join(log.NewNopLogger(), prometheus.NewRegistry(), addr, addr, nil, state, false, 100*time.Millisecond, 50*time.Millisecond, 0)
+	testutil.Ok(t, err)
+	defer peer1.Leave(0)
+
+	_, peer2, err := joinPeerWithType(2, []string{addr}, prometheus.NewRegistry(), PeerTypeSource)
+	testutil.Ok(t, err)
+	defer peer2.Leave(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	testutil.Ok(t, runutil.Retry(1*time.Second, ctx.Done(), func() error {
+		if len(peer2.PeerStates(PeerTypeStore)) == 1 {
+			return nil
+		}
+		return errors.New("store peer state not propagated")
+	}))
+	testutil.Equals(t, "dc=eu-west-1 team=observability", peer2.PeerStates(PeerTypeStore)[0].Description)
+
+	// Overly long descriptions must be rejected.
+	port, err = testutil.FreePort()
+	testutil.Ok(t, err)
+	addr = fmt.Sprintf("127.0.0.1:%d", port)
+
+	state.Description = strings.Repeat("x", MaxDescriptionLength+1)
+	_, err = Join(log.NewNopLogger(), prometheus.NewRegistry(), addr, addr, nil, state, false, 100*time.Millisecond, 50*time.Millisecond, 0)
+	testutil.NotOk(t, err)
+}
+
+func TestPeers_MetadataBytes(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	_, peer, err := joinPeerWithRegistry(1, nil, reg)
+	testutil.Ok(t, err)
+	defer peer.Leave(0)
+
+	before := testutil.GaugeValue(t, reg, "thanos_cluster_peer_metadata_bytes")
+	testutil.Assert(t, before > 0, "expected initial metadata size to be set")
+
+	peer.SetLabels([]storepb.Label{
+		{Name: "cluster", Value: "eu-west-1"},
+		{Name: "replica", Value: "prometheus-0"},
+	})
+	after := testutil.GaugeValue(t, reg, "thanos_cluster_peer_metadata_bytes")
+	testutil.Assert(t, after > before, "expected metadata size to grow with labels, got %v <= %v", after, before)
+
+	peer.SetLabels([]storepb.Label{{Name: "a", Value: "1"}})
+	testutil.Equals(t, before, testutil.GaugeValue(t, reg, "thanos_cluster_peer_metadata_bytes"))
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/objtesting"
 
 	"github.com/go-kit/kit/log"
 	"github.com/improbable-eng/thanos/pkg/block"
@@ -27,7 +28,7 @@ func TestSyncer_SyncMetas(t *testing.T) {
 	testutil.Ok(t, err)
 	defer os.RemoveAll(dir)
 
-	bkt, close := testutil.NewObjectStoreBucket(t)
+	bkt, close := objtesting.NewGCSBucket(t)
 	defer close()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
@@ -84,7 +85,7 @@ func TestSyncer_GarbageCollect(t *testing.T) {
 	testutil.Ok(t, err)
 	defer os.RemoveAll(dir)
 
-	bkt, close := testutil.NewObjectStoreBucket(t)
+	bkt, close := objtesting.NewGCSBucket(t)
 	defer close()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
@@ -185,7 +186,7 @@ func TestGroup_Compact(t *testing.T) {
 	testutil.Ok(t, err)
 	defer os.RemoveAll(dir)
 
-	bkt, close := testutil.NewObjectStoreBucket(t)
+	bkt, close := objtesting.NewGCSBucket(t)
 	defer close()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
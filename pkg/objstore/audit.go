@@ -0,0 +1,106 @@
+package objstore
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// BucketWithAuditLog wraps a bucket so that every write and delete operation is logged
+// at info level along with the object name, the number of bytes written, the time
+// it was started at, and its outcome.
+func BucketWithAuditLog(b Bucket, logger log.Logger) Bucket {
+	return &auditBucket{
+		Bucket: b,
+		logger: log.With(logger, "component", "objstore-audit"),
+	}
+}
+
+type auditBucket struct {
+	Bucket
+	logger log.Logger
+}
+
+func (b *auditBucket) Type() string {
+	return BackendType(b.Bucket)
+}
+
+func (b *auditBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	start := time.Now()
+	n, err := countedUpload(r, func(r io.Reader) error {
+		return b.Bucket.Upload(ctx, name, r)
+	})
+	b.log("upload", name, n, start, err)
+
+	return err
+}
+
+func (b *auditBucket) Delete(ctx context.Context, name string) error {
+	start := time.Now()
+
+	err := b.Bucket.Delete(ctx, name)
+	b.log("delete", name, 0, start, err)
+
+	return err
+}
+
+func (b *auditBucket) log(op, name string, size int64, start time.Time, err error) {
+	kvs := []interface{}{
+		"msg", "audit",
+		"operation", op,
+		"object", name,
+		"size", size,
+		"time", start.UTC().Format(time.RFC3339Nano),
+		"duration", time.Since(start),
+	}
+	if err != nil {
+		kvs = append(kvs, "outcome", "failure", "err", err)
+	} else {
+		kvs = append(kvs, "outcome", "success")
+	}
+	level.Info(b.logger).Log(kvs...)
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// countedUpload calls upload with r and returns the number of bytes uploaded.
+// Files and readers telling their size, like files read through RateLimitedBucket, are
+// passed through unwrapped and counted by their size, as backends such as S3 only learn
+// the object size from them and otherwise buffer uploads of unknown size in memory.
+func countedUpload(r io.Reader, upload func(io.Reader) error) (int64, error) {
+	if sr, ok := r.(interface{ Size() int64 }); ok {
+		if err := upload(r); err != nil {
+			return 0, err
+		}
+		return sr.Size(), nil
+	}
+	f, ok := r.(*os.File)
+	if !ok {
+		cr := &countingReader{r: r}
+		err := upload(cr)
+		return cr.n, err
+	}
+	if err := upload(f); err != nil {
+		return 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		// The object was uploaded, only its size is unknown.
+		return 0, nil
+	}
+	return fi.Size(), nil
+}
@@ -0,0 +1,81 @@
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/inmem"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+	"github.com/pkg/errors"
+)
+
+func TestBucketWithAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.NewLogfmtLogger(log.NewSyncWriter(&buf))
+
+	bkt := objstore.BucketWithAuditLog(objstore.BucketWithMetrics("test", inmem.NewBucket(), nil), logger)
+
+	testutil.Ok(t, bkt.Upload(context.Background(), "dir/obj", bytes.NewReader([]byte("content"))))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	testutil.Equals(t, 1, len(lines))
+
+	for _, f := range []string{
+		"level=info",
+		"msg=audit",
+		"operation=upload",
+		"object=dir/obj",
+		"size=7",
+		"time=",
+		"outcome=success",
+	} {
+		testutil.Assert(t, strings.Contains(lines[0], f), "field %q missing in %q", f, lines[0])
+	}
+
+	// Reads are not audited.
+	buf.Reset()
+	_, err := bkt.Exists(context.Background(), "dir/obj")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "", buf.String())
+
+	testutil.Ok(t, bkt.Delete(context.Background(), "dir/obj"))
+	testutil.Assert(t, strings.Contains(buf.String(), "operation=delete"), "delete not audited")
+}
+
+// fileOnlyBucket fails uploads of readers that are not files.
+type fileOnlyBucket struct {
+	objstore.Bucket
+}
+
+func (b fileOnlyBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if _, ok := r.(*os.File); !ok {
+		return errors.Errorf("upload of %s is %T, not a file", name, r)
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestBucketWithAuditLog_FileUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-log")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "obj")
+	testutil.Ok(t, ioutil.WriteFile(fn, []byte("content"), 0666))
+
+	var buf bytes.Buffer
+	logger := log.NewLogfmtLogger(log.NewSyncWriter(&buf))
+
+	// Files must reach the backend unwrapped so that it can learn their size.
+	bkt := objstore.BucketWithAuditLog(fileOnlyBucket{inmem.NewBucket()}, logger)
+
+	testutil.Ok(t, objstore.UploadFile(context.Background(), bkt, fn, "dir/obj"))
+	testutil.Assert(t, strings.Contains(buf.String(), "size=7"), "size missing in %q", buf.String())
+}
@@ -0,0 +1,551 @@
+// Package azure implements common object storage abstractions against Azure Blob Storage.
+package azure
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	opObjectsList  = "ListBlobs"
+	opObjectInsert = "PutBlob"
+	opObjectGet    = "GetBlob"
+	opObjectStat   = "GetBlobProperties"
+	opObjectDelete = "DeleteBlob"
+)
+
+// DirDelim is the delimiter used to model a directory structure in an object store bucket.
+const DirDelim = "/"
+
+const (
+	// apiVersion is the version of the Blob service REST API requests are made against.
+	apiVersion = "2017-07-29"
+	// defaultEndpointSuffix is the suffix of blob service endpoints in the public Azure cloud.
+	defaultEndpointSuffix = "core.windows.net"
+	// defaultBlockSize is the size of the blocks larger objects are uploaded in. Objects of at
+	// most this size are uploaded in a single request.
+	defaultBlockSize = 32 * 1024 * 1024
+)
+
+// Config encapsulates the necessary config values to instantiate an Azure Blob Storage client.
+// Requests are authenticated either with the storage account name and key or with a connection
+// string as shown in the Azure portal, which includes both.
+type Config struct {
+	StorageAccountName string `yaml:"storage_account"`
+	StorageAccountKey  string `yaml:"storage_account_key"`
+	ContainerName      string `yaml:"container"`
+	// ConnectionString must not be combined with the storage account name and key.
+	ConnectionString string `yaml:"connection_string"`
+	// EndpointSuffix is the suffix of the blob service endpoint, e.g. for national clouds.
+	// It defaults to core.windows.net.
+	EndpointSuffix string `yaml:"endpoint_suffix"`
+	// TLSConfig is the TLS policy of connections to the blob service, e.g. to enforce a
+	// minimum TLS version. It cannot be set through YAML.
+	TLSConfig *tls.Config `yaml:"-"`
+	// HTTPConfig tunes the connection pool of the client. Its TLS settings take precedence
+	// over TLSConfig.
+	HTTPConfig objstore.TransportConfig `yaml:"http_config"`
+}
+
+// Validate checks to see if any of the Azure config options are set.
+func (conf *Config) Validate() error {
+	switch {
+	case conf.ContainerName == "":
+		return errors.New("insufficient azure configuration information: missing container")
+	case conf.ConnectionString != "" && (conf.StorageAccountName != "" || conf.StorageAccountKey != ""):
+		return errors.New("azure connection string and storage account must not be configured at the same time")
+	case conf.ConnectionString == "" && conf.StorageAccountName == "":
+		return errors.New("insufficient azure configuration information: missing storage account or connection string")
+	case conf.ConnectionString == "" && conf.StorageAccountKey == "":
+		return errors.New("insufficient azure configuration information: missing storage account key")
+	}
+	return conf.HTTPConfig.Validate()
+}
+
+// Bucket implements the store.Bucket and shipper.Bucket interfaces against an Azure Blob Storage container.
+type Bucket struct {
+	client    *http.Client
+	endpoint  *url.URL
+	account   string
+	key       []byte
+	container string
+	blockSize int
+	// buffers holds block buffers of earlier uploads for reuse.
+	buffers  sync.Pool
+	opsTotal *prometheus.CounterVec
+}
+
+// NewBucket returns a new Bucket using the provided Azure config values.
+func NewBucket(conf *Config, reg prometheus.Registerer) (*Bucket, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	account, key, endpoint := conf.StorageAccountName, conf.StorageAccountKey, ""
+
+	if conf.ConnectionString != "" {
+		var err error
+		account, key, endpoint, err = parseConnectionString(conf.ConnectionString)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse azure connection string")
+		}
+	}
+	if endpoint == "" {
+		suffix := conf.EndpointSuffix
+		if suffix == "" {
+			suffix = defaultEndpointSuffix
+		}
+		endpoint = fmt.Sprintf("https://%s.blob.%s", account, suffix)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse azure endpoint %s", endpoint)
+	}
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode azure storage account key")
+	}
+
+	bkt := &Bucket{
+		client:    &http.Client{Transport: conf.HTTPConfig.NewTransport(conf.TLSConfig)},
+		endpoint:  u,
+		account:   account,
+		key:       k,
+		container: conf.ContainerName,
+		blockSize: defaultBlockSize,
+		opsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_objstore_azure_bucket_operations_total",
+			Help:        "Total number of operations that were executed against an Azure Blob Storage container.",
+			ConstLabels: prometheus.Labels{"bucket": conf.ContainerName},
+		}, []string{"operation"}),
+	}
+	if reg != nil {
+		reg.MustRegister(bkt.opsTotal)
+	}
+	return bkt, nil
+}
+
+// parseConnectionString returns the account name, key and, if set explicitly, the blob service
+// endpoint of the given connection string.
+func parseConnectionString(s string) (account, key, endpoint string, err error) {
+	var (
+		protocol = "https"
+		suffix   = defaultEndpointSuffix
+	)
+	for _, kv := range strings.Split(s, ";") {
+		if kv == "" {
+			continue
+		}
+		// Account keys are base64 encoded and may contain '='.
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return "", "", "", errors.Errorf("invalid key-value pair %q", kv)
+		}
+		switch parts[0] {
+		case "DefaultEndpointsProtocol":
+			protocol = parts[1]
+		case "AccountName":
+			account = parts[1]
+		case "AccountKey":
+			key = parts[1]
+		case "EndpointSuffix":
+			suffix = parts[1]
+		case "BlobEndpoint":
+			endpoint = parts[1]
+		}
+	}
+	if account == "" || key == "" {
+		return "", "", "", errors.New("missing account name or key")
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, account, suffix)
+	}
+	return account, key, endpoint, nil
+}
+
+// Type returns the type of the bucket's backend.
+func (b *Bucket) Type() string {
+	return "AZURE"
+}
+
+// newRequest returns a new signed request against the blob with the given name. If name is empty,
+// the request is made against the container.
+func (b *Bucket) newRequest(ctx context.Context, method, name string, q url.Values, body io.Reader) (*http.Request, error) {
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.container
+	if name != "" {
+		u.Path += "/" + name
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", apiVersion)
+
+	return req, nil
+}
+
+// do signs and sends the request. It returns an error if the response status is not among the given ones.
+func (b *Bucket) do(req *http.Request, status ...int) (*http.Response, error) {
+	req.Header.Set("Authorization", "SharedKey "+b.account+":"+signature(b.key, b.account, req))
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range status {
+		if resp.StatusCode == s {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	// Responses to HEAD requests have no body to describe the error.
+	if body, err := ioutil.ReadAll(resp.Body); err == nil && len(body) > 0 {
+		xml.Unmarshal(body, &e)
+	}
+	if e.Code == "" {
+		e.Code = resp.Status
+	}
+	return nil, errors.Errorf("%s %s: %s %s", req.Method, req.URL.Path, e.Code, strings.TrimSpace(e.Message))
+}
+
+// signature returns the Shared Key signature of the request as described in
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key.
+func signature(key []byte, account string, req *http.Request) string {
+	var contentLength string
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+	h := req.Header
+
+	s := strings.Join([]string{
+		req.Method,
+		h.Get("Content-Encoding"),
+		h.Get("Content-Language"),
+		contentLength,
+		h.Get("Content-MD5"),
+		h.Get("Content-Type"),
+		// The Date header is empty as x-ms-date is set.
+		"",
+		h.Get("If-Modified-Since"),
+		h.Get("If-Match"),
+		h.Get("If-None-Match"),
+		h.Get("If-Unmodified-Since"),
+		h.Get("Range"),
+		canonicalizedHeaders(h) + canonicalizedResource(account, req.URL),
+	}, "\n")
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func canonicalizedHeaders(h http.Header) string {
+	var names []string
+	for k := range h {
+		if n := strings.ToLower(k); strings.HasPrefix(n, "x-ms-") {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	var s string
+	for _, n := range names {
+		s += n + ":" + strings.TrimSpace(strings.Join(h[http.CanonicalHeaderKey(n)], ",")) + "\n"
+	}
+	return s
+}
+
+func canonicalizedResource(account string, u *url.URL) string {
+	s := "/" + account + u.EscapedPath()
+
+	q := u.Query()
+	var names []string
+	for k := range q {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		vs := q[n]
+		sort.Strings(vs)
+		s += "\n" + strings.ToLower(n) + ":" + strings.Join(vs, ",")
+	}
+	return s
+}
+
+// listResult is the response to a List Blobs request. Blobs and prefixes are kept in a single
+// list to preserve their order.
+type listResult struct {
+	Blobs struct {
+		Entries []struct {
+			XMLName xml.Name
+			Name    string `xml:"Name"`
+		} `xml:",any"`
+	} `xml:"Blobs"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// Iter calls f for each entry in the given directory. The argument to f is the full
+// object name including the prefix of the inspected directory. If the listing is
+// recursive, the names of all objects below the directory are passed to f instead.
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	b.opsTotal.WithLabelValues(opObjectsList).Inc()
+	params := objstore.ApplyIterOptions(options...)
+
+	// Ensure the object name actually ends with a dir suffix. Otherwise we'll just iterate the
+	// object itself as one prefix item.
+	if dir != "" {
+		dir = strings.TrimSuffix(dir, DirDelim) + DirDelim
+	}
+	var marker string
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		q := url.Values{
+			"restype":   []string{"container"},
+			"comp":      []string{"list"},
+			"prefix":    []string{dir},
+			"delimiter": []string{DirDelim},
+		}
+		if params.Recursive {
+			q.Del("delimiter")
+		}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		req, err := b.newRequest(ctx, http.MethodGet, "", q, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := b.do(req, http.StatusOK)
+		if err != nil {
+			return errors.Wrap(err, "list azure blobs")
+		}
+		var res listResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return errors.Wrap(err, "decode azure blob list")
+		}
+		for _, e := range res.Blobs.Entries {
+			if err := f(e.Name); err != nil {
+				return err
+			}
+		}
+		if res.NextMarker == "" {
+			return nil
+		}
+		marker = res.NextMarker
+	}
+}
+
+// Get returns a reader for the given object name.
+func (b *Bucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.opsTotal.WithLabelValues(opObjectGet).Inc()
+
+	req, err := b.newRequest(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(req, http.StatusOK)
+	if err != nil {
+		return nil, errors.Wrap(err, "get azure blob")
+	}
+	return resp.Body, nil
+}
+
+// GetRange returns a new range reader for the given object name and range.
+func (b *Bucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b.opsTotal.WithLabelValues(opObjectGet).Inc()
+
+	req, err := b.newRequest(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+
+	resp, err := b.do(req, http.StatusOK, http.StatusPartialContent)
+	if err != nil {
+		return nil, errors.Wrap(err, "get azure blob range")
+	}
+	return resp.Body, nil
+}
+
+// properties returns the response to a Get Blob Properties request or nil if the blob does not exist.
+func (b *Bucket) properties(ctx context.Context, name string) (*http.Response, error) {
+	b.opsTotal.WithLabelValues(opObjectStat).Inc()
+
+	req, err := b.newRequest(ctx, http.MethodHead, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(req, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return nil, errors.Wrap(err, "get azure blob properties")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+// Exists checks if the given object exists.
+func (b *Bucket) Exists(ctx context.Context, name string) (bool, error) {
+	resp, err := b.properties(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	return resp != nil, nil
+}
+
+// Attributes returns information about the object with the given name.
+func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	resp, err := b.properties(ctx, name)
+	if err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	if resp == nil {
+		return objstore.ObjectAttributes{}, errors.Errorf("azure blob %s does not exist", name)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrap(err, "parse content length")
+	}
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrap(err, "parse last modified time")
+	}
+	return objstore.ObjectAttributes{
+		Size:         size,
+		LastModified: modified,
+		ETag:         strings.Trim(resp.Header.Get("ETag"), `"`),
+	}, nil
+}
+
+// Upload the contents of the reader as an object into the bucket.
+// Objects larger than the block size are uploaded in blocks, which are committed at the end.
+func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.opsTotal.WithLabelValues(opObjectInsert).Inc()
+
+	buf := b.getBuffer()
+	if err := b.upload(ctx, name, r, buf); err != nil {
+		// The transport may still read a request body after a failed request, so the
+		// buffer is not reused.
+		return err
+	}
+	b.buffers.Put(buf)
+	return nil
+}
+
+// getBuffer returns a buffer of the block size, reusing the buffer of an earlier upload if possible.
+func (b *Bucket) getBuffer() []byte {
+	if buf, ok := b.buffers.Get().([]byte); ok && len(buf) == b.blockSize {
+		return buf
+	}
+	return make([]byte, b.blockSize)
+}
+
+// upload uploads the content of r as the blob with the given name, reading it into buf a
+// block at a time.
+func (b *Bucket) upload(ctx context.Context, name string, r io.Reader, buf []byte) error {
+
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.Wrap(b.put(ctx, name, nil, buf[:n]), "upload azure blob")
+	}
+	if err != nil {
+		return errors.Wrap(err, "read upload")
+	}
+
+	var ids []string
+	for err != io.EOF {
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return errors.Wrap(err, "read upload")
+		}
+		// Block IDs must be of equal length within a blob.
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(ids))))
+
+		q := url.Values{"comp": []string{"block"}, "blockid": []string{id}}
+		if err := b.put(ctx, name, q, buf[:n]); err != nil {
+			return errors.Wrapf(err, "upload block %d of azure blob", len(ids))
+		}
+		ids = append(ids, id)
+
+		n, err = io.ReadFull(r, buf)
+	}
+
+	var list bytes.Buffer
+	list.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range ids {
+		fmt.Fprintf(&list, "<Latest>%s</Latest>", id)
+	}
+	list.WriteString(`</BlockList>`)
+
+	q := url.Values{"comp": []string{"blocklist"}}
+	return errors.Wrap(b.put(ctx, name, q, list.Bytes()), "commit azure block list")
+}
+
+// put sends a PUT request with the given body against the blob. Without a query, the body
+// is written as the full blob.
+func (b *Bucket) put(ctx context.Context, name string, q url.Values, body []byte) error {
+	req, err := b.newRequest(ctx, http.MethodPut, name, q, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if q == nil {
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+	}
+	resp, err := b.do(req, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Delete removes the object with the given name.
+func (b *Bucket) Delete(ctx context.Context, name string) error {
+	b.opsTotal.WithLabelValues(opObjectDelete).Inc()
+
+	req, err := b.newRequest(ctx, http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req, http.StatusAccepted)
+	if err != nil {
+		return errors.Wrap(err, "delete azure blob")
+	}
+	return resp.Body.Close()
+}
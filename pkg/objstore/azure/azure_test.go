@@ -0,0 +1,269 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/objtesting"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+const (
+	testAccount = "devstoreaccount1"
+	// testKey is the well-known key of the Azure storage emulator.
+	testKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// fakeBlobServer implements the subset of the Blob service REST API used by the bucket
+// and verifies the Shared Key signature of every request.
+type fakeBlobServer struct {
+	t *testing.T
+
+	mtx      sync.Mutex
+	blobs    map[string][]byte
+	blocks   map[string][]byte
+	pageSize int
+}
+
+func newFakeBlobServer(t *testing.T) (*fakeBlobServer, *httptest.Server) {
+	s := &fakeBlobServer{t: t, blobs: map[string][]byte{}, blocks: map[string][]byte{}, pageSize: 2}
+	return s, httptest.NewServer(s)
+}
+
+// verify checks the Shared Key signature of the request. The string to sign is built from
+// the Blob service documentation independently of the client's signing code.
+func (s *fakeBlobServer) verify(r *http.Request) bool {
+	var contentLength string
+	if r.ContentLength > 0 {
+		contentLength = strconv.FormatInt(r.ContentLength, 10)
+	}
+	var headerNames []string
+	for k := range r.Header {
+		if strings.HasPrefix(strings.ToLower(k), "x-ms-") {
+			headerNames = append(headerNames, k)
+		}
+	}
+	sort.Slice(headerNames, func(i, j int) bool { return strings.ToLower(headerNames[i]) < strings.ToLower(headerNames[j]) })
+
+	var toSign bytes.Buffer
+	for _, v := range []string{
+		r.Method,
+		r.Header.Get("Content-Encoding"),
+		r.Header.Get("Content-Language"),
+		contentLength,
+		r.Header.Get("Content-MD5"),
+		r.Header.Get("Content-Type"),
+		// Date is signed empty since requests carry x-ms-date instead.
+		"",
+		r.Header.Get("If-Modified-Since"),
+		r.Header.Get("If-Match"),
+		r.Header.Get("If-None-Match"),
+		r.Header.Get("If-Unmodified-Since"),
+		r.Header.Get("Range"),
+	} {
+		toSign.WriteString(v + "\n")
+	}
+	for _, k := range headerNames {
+		fmt.Fprintf(&toSign, "%s:%s\n", strings.ToLower(k), strings.Join(r.Header[k], ","))
+	}
+	// The emulator's paths start with the account, which the resource names once more.
+	fmt.Fprintf(&toSign, "/%s%s", testAccount, r.URL.EscapedPath())
+
+	q := r.URL.Query()
+	var params []string
+	for k := range q {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		vs := q[k]
+		sort.Strings(vs)
+		fmt.Fprintf(&toSign, "\n%s:%s", strings.ToLower(k), strings.Join(vs, ","))
+	}
+
+	key, err := base64.StdEncoding.DecodeString(testKey)
+	testutil.Ok(s.t, err)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(toSign.Bytes())
+
+	return r.Header.Get("Authorization") == "SharedKey "+testAccount+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *fakeBlobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.verify(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>AuthenticationFailed</Code><Message>signature mismatch</Message></Error>`)
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// Paths are of the form /<account>/<container>/<blob> as with the storage emulator.
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	q := r.URL.Query()
+
+	if len(parts) == 2 {
+		s.list(w, q.Get("prefix"), q.Get("delimiter"), q.Get("marker"))
+		return
+	}
+	name := parts[2]
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch r.Method {
+	case http.MethodPut:
+		switch q.Get("comp") {
+		case "block":
+			s.blocks[name+"/"+q.Get("blockid")] = body
+		case "blocklist":
+			var list struct {
+				Latest []string `xml:"Latest"`
+			}
+			testutil.Ok(s.t, xml.Unmarshal(body, &list))
+
+			var b []byte
+			for _, id := range list.Latest {
+				b = append(b, s.blocks[name+"/"+id]...)
+			}
+			s.blobs[name] = b
+		default:
+			testutil.Equals(s.t, "BlockBlob", r.Header.Get("x-ms-blob-type"))
+			s.blobs[name] = body
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(s.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodGet, http.MethodHead:
+		b, ok := s.blobs[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Unix(1000, 0).UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(b)))
+
+		if rng := r.Header.Get("x-ms-range"); rng != "" {
+			var start, end int
+			fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+			if end >= len(b) {
+				end = len(b) - 1
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(b[start : end+1])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	}
+}
+
+// list answers List Blobs requests with at most pageSize entries per page.
+func (s *fakeBlobServer) list(w http.ResponseWriter, prefix, delimiter, marker string) {
+	var names []string
+	for n := range s.blobs {
+		names = append(names, n)
+	}
+	entries, truncated := objtesting.List(names, prefix, delimiter, marker, s.pageSize)
+
+	var next string
+	if truncated {
+		next = entries[len(entries)-1].Name
+	}
+	fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`)
+	for _, e := range entries {
+		if e.Prefix {
+			fmt.Fprintf(w, "<BlobPrefix><Name>%s</Name></BlobPrefix>", e.Name)
+		} else {
+			fmt.Fprintf(w, "<Blob><Name>%s</Name><Properties></Properties></Blob>", e.Name)
+		}
+	}
+	fmt.Fprintf(w, "</Blobs><NextMarker>%s</NextMarker></EnumerationResults>", next)
+}
+
+func newTestBucket(t *testing.T, srv *httptest.Server, key string) *Bucket {
+	bkt, err := NewBucket(&Config{
+		ContainerName:    "thanos",
+		ConnectionString: fmt.Sprintf("DefaultEndpointsProtocol=http;AccountName=%s;AccountKey=%s;BlobEndpoint=%s/%s;", testAccount, key, srv.URL, testAccount),
+	}, nil)
+	testutil.Ok(t, err)
+	return bkt
+}
+
+func TestBucket(t *testing.T) {
+	_, srv := newFakeBlobServer(t)
+	defer srv.Close()
+
+	bkt := newTestBucket(t, srv, testKey)
+	bkt.blockSize = 4
+
+	objtesting.ObjectsTest(t, bkt, func(b []byte) objstore.ObjectAttributes {
+		return objstore.ObjectAttributes{
+			Size:         int64(len(b)),
+			LastModified: time.Unix(1000, 0).UTC(),
+			ETag:         fmt.Sprintf("%x", md5.Sum(b)),
+		}
+	})
+
+	// Empty objects are uploaded in a single request.
+	ctx := context.Background()
+	testutil.Ok(t, bkt.Upload(ctx, "empty", bytes.NewReader(nil)))
+
+	attrs, err := bkt.Attributes(ctx, "empty")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(0), attrs.Size)
+}
+
+func TestBucket_Acceptance(t *testing.T) {
+	_, srv := newFakeBlobServer(t)
+	defer srv.Close()
+
+	objtesting.AcceptanceTest(t, newTestBucket(t, srv, testKey))
+}
+
+func TestBucket_WrongKey(t *testing.T) {
+	_, srv := newFakeBlobServer(t)
+	defer srv.Close()
+
+	objtesting.WrongCredentialsTest(t, newTestBucket(t, srv, base64.StdEncoding.EncodeToString([]byte("wrong"))), "AuthenticationFailed")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	objtesting.ValidateTest(t, []objtesting.ConfigCase{
+		{Conf: &Config{ContainerName: "c", StorageAccountName: "a", StorageAccountKey: "k"}, OK: true},
+		{Conf: &Config{ContainerName: "c", ConnectionString: "AccountName=a;AccountKey=k"}, OK: true},
+		{Conf: &Config{StorageAccountName: "a", StorageAccountKey: "k"}},
+		{Conf: &Config{ContainerName: "c", StorageAccountName: "a"}},
+		{Conf: &Config{ContainerName: "c"}},
+		{Conf: &Config{ContainerName: "c", ConnectionString: "AccountName=a;AccountKey=k", StorageAccountName: "a"}},
+	})
+}
+
+func TestParseConnectionString(t *testing.T) {
+	account, key, endpoint, err := parseConnectionString("DefaultEndpointsProtocol=https;AccountName=acc;AccountKey=a2V5==;EndpointSuffix=core.chinacloudapi.cn")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "acc", account)
+	testutil.Equals(t, "a2V5==", key)
+	testutil.Equals(t, "https://acc.blob.core.chinacloudapi.cn", endpoint)
+
+	_, _, _, err = parseConnectionString("AccountName=acc")
+	testutil.NotOk(t, err)
+}
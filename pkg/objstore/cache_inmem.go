@@ -0,0 +1,95 @@
+package objstore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	"github.com/pkg/errors"
+)
+
+type inMemoryCacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// InMemoryCache is a Cache that holds values in memory. Once the total size of the values
+// exceeds its maximum, the least recently used values are evicted.
+type InMemoryCache struct {
+	maxSize int64
+
+	mtx     sync.Mutex
+	lru     *lru.LRU
+	curSize int64
+}
+
+// NewInMemoryCache returns a cache that holds values of at most maxSizeBytes in total.
+func NewInMemoryCache(maxSizeBytes int64) (*InMemoryCache, error) {
+	if maxSizeBytes <= 0 {
+		return nil, errors.New("maximum cache size must be positive")
+	}
+	c := &InMemoryCache{maxSize: maxSizeBytes}
+
+	// Initialize LRU cache with a high size limit since we will manage evictions ourselves
+	// based on stored size.
+	l, err := lru.NewLRU(1e12, func(_, val interface{}) {
+		c.curSize -= int64(len(val.(inMemoryCacheEntry).value))
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.lru = l
+	return c, nil
+}
+
+// Fetch implements Cache.
+func (c *InMemoryCache) Fetch(_ context.Context, keys []string) map[string][]byte {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	res := map[string][]byte{}
+	for _, k := range keys {
+		v, ok := c.lru.Get(k)
+		if !ok {
+			continue
+		}
+		e := v.(inMemoryCacheEntry)
+		if !time.Now().Before(e.expires) {
+			c.lru.Remove(k)
+			continue
+		}
+		res[k] = e.value
+	}
+	return res
+}
+
+// Store implements Cache. Values larger than the maximum size of the cache are not stored.
+func (c *InMemoryCache) Store(_ context.Context, data map[string][]byte, ttl time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for k, v := range data {
+		if int64(len(v)) > c.maxSize {
+			continue
+		}
+		// Remove a previous value first so that it is not accounted for twice.
+		c.lru.Remove(k)
+
+		for c.curSize+int64(len(v)) > c.maxSize {
+			c.lru.RemoveOldest()
+		}
+		c.lru.Add(k, inMemoryCacheEntry{value: v, expires: time.Now().Add(ttl)})
+		c.curSize += int64(len(v))
+	}
+}
+
+// Delete implements Cache.
+func (c *InMemoryCache) Delete(_ context.Context, keys []string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, k := range keys {
+		c.lru.Remove(k)
+	}
+}
@@ -0,0 +1,372 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Cache stores byte values under string keys for a limited time.
+// Failures of the cache are not reported, they behave like misses.
+type Cache interface {
+	// Fetch returns the values of the given keys that are in the cache.
+	Fetch(ctx context.Context, keys []string) map[string][]byte
+	// Store adds the given values to the cache, which expire after ttl.
+	Store(ctx context.Context, data map[string][]byte, ttl time.Duration)
+	// Delete removes the given keys from the cache.
+	Delete(ctx context.Context, keys []string)
+}
+
+const (
+	cacheTypeIter  = "iter"
+	cacheTypeMeta  = "meta"
+	cacheTypeRange = "range"
+
+	// metaFilename is the name of the objects that hold the metadata of blocks.
+	metaFilename = "meta.json"
+
+	defaultCacheRangeSize = 16 * 1024
+)
+
+// CachingConfig configures which results of bucket operations are cached and for how long.
+// Caching of a content type is disabled if its TTL is zero.
+type CachingConfig struct {
+	// IterTTL is how long results of Iter are cached.
+	IterTTL time.Duration `yaml:"iter_ttl"`
+	// MetaTTL is how long the content of meta.json objects is cached.
+	MetaTTL time.Duration `yaml:"meta_ttl"`
+	// RangeTTL is how long byte ranges of objects that match RangeObjects are cached.
+	RangeTTL time.Duration `yaml:"range_ttl"`
+	// RangeSize is the size of the aligned sections that ranges are cached in. It defaults
+	// to 16KiB.
+	RangeSize int64 `yaml:"range_size"`
+	// RangeObjects are path patterns of the objects whose ranges are cached, e.g. "index" or
+	// "chunks/*". A pattern is matched against as many trailing elements of the object name
+	// as it has itself.
+	RangeObjects []string `yaml:"range_objects"`
+}
+
+// Validate returns an error if the configuration is invalid.
+func (c CachingConfig) Validate() error {
+	if c.IterTTL < 0 || c.MetaTTL < 0 || c.RangeTTL < 0 {
+		return errors.New("cache TTLs must not be negative")
+	}
+	if c.RangeSize < 0 {
+		return errors.New("cache range size must not be negative")
+	}
+	for _, p := range c.RangeObjects {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.Wrapf(err, "invalid range object pattern %q", p)
+		}
+	}
+	return nil
+}
+
+// CachingBucket wraps a bucket so that listings, meta.json files and byte ranges of the
+// configured objects are served from the cache c where possible.
+// Uploads and deletions through the bucket invalidate the cached data of the object and the
+// listings of its parent directories. Changes made by other processes become visible once
+// the cached data expires.
+func CachingBucket(name string, b Bucket, c Cache, conf CachingConfig, r prometheus.Registerer) Bucket {
+	if conf.RangeSize <= 0 {
+		conf.RangeSize = defaultCacheRangeSize
+	}
+	constLabels := prometheus.Labels{"bucket": name, "backend": BackendType(b)}
+
+	cb := &cachingBucket{
+		bkt:       b,
+		cache:     c,
+		conf:      conf,
+		keyPrefix: name + ":",
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_objstore_bucket_cache_requests_total",
+			Help:        "Total number of requests to the cache of the bucket.",
+			ConstLabels: constLabels,
+		}, []string{"item_type"}),
+		hits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_objstore_bucket_cache_hits_total",
+			Help:        "Total number of requests to the cache of the bucket that were a hit.",
+			ConstLabels: constLabels,
+		}, []string{"item_type"}),
+	}
+	if r != nil {
+		r.MustRegister(cb.requests, cb.hits)
+	}
+	return cb
+}
+
+type cachingBucket struct {
+	bkt   Bucket
+	cache Cache
+	conf  CachingConfig
+	// keyPrefix separates the cache keys of different buckets.
+	keyPrefix string
+
+	requests *prometheus.CounterVec
+	hits     *prometheus.CounterVec
+}
+
+func (b *cachingBucket) Type() string {
+	return BackendType(b.bkt)
+}
+
+func (b *cachingBucket) fetch(ctx context.Context, typ string, keys []string) map[string][]byte {
+	res := b.cache.Fetch(ctx, keys)
+
+	b.requests.WithLabelValues(typ).Add(float64(len(keys)))
+	b.hits.WithLabelValues(typ).Add(float64(len(res)))
+
+	if res == nil {
+		res = map[string][]byte{}
+	}
+	return res
+}
+
+func (b *cachingBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	if b.conf.IterTTL == 0 {
+		return b.bkt.Iter(ctx, dir, f, options...)
+	}
+	key := b.iterKey(dir, ApplyIterOptions(options...).Recursive)
+
+	var names []string
+	if v, ok := b.fetch(ctx, cacheTypeIter, []string{key})[key]; ok && json.Unmarshal(v, &names) == nil {
+		for _, n := range names {
+			if err := f(n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Only complete listings are cached.
+	names = names[:0]
+	if err := b.bkt.Iter(ctx, dir, func(name string) error {
+		names = append(names, name)
+		return f(name)
+	}, options...); err != nil {
+		return err
+	}
+	if v, err := json.Marshal(names); err == nil {
+		b.cache.Store(ctx, map[string][]byte{key: v}, b.conf.IterTTL)
+	}
+	return nil
+}
+
+func (b *cachingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if b.conf.MetaTTL == 0 || path.Base(name) != metaFilename {
+		return b.bkt.Get(ctx, name)
+	}
+	key := b.metaKey(name)
+
+	if v, ok := b.fetch(ctx, cacheTypeMeta, []string{key})[key]; ok {
+		return ioutil.NopCloser(bytes.NewReader(v)), nil
+	}
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	v, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", name)
+	}
+	b.cache.Store(ctx, map[string][]byte{key: v}, b.conf.MetaTTL)
+
+	return ioutil.NopCloser(bytes.NewReader(v)), nil
+}
+
+// cacheRange reports whether byte ranges of the named object are cached.
+func (b *cachingBucket) cacheRange(name string) bool {
+	if b.conf.RangeTTL == 0 {
+		return false
+	}
+	elems := strings.Split(name, DirDelim)
+
+	for _, p := range b.conf.RangeObjects {
+		n := strings.Count(p, DirDelim) + 1
+		if n > len(elems) {
+			continue
+		}
+		if ok, _ := path.Match(p, strings.Join(elems[len(elems)-n:], DirDelim)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *cachingBucket) rangeKey(name string, off int64) string {
+	return fmt.Sprintf("%srange:%s:%d", b.keyPrefix, name, off)
+}
+
+// GetRange serves the range from sections of RangeSize bytes that are aligned to multiples of
+// it. Sections missing from the cache are read from the bucket with a single request, which
+// spans from the first to the last missing section.
+func (b *cachingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if off < 0 || length <= 0 || !b.cacheRange(name) {
+		return b.bkt.GetRange(ctx, name, off, length)
+	}
+	size := b.conf.RangeSize
+	first := off / size * size
+	last := (off + length - 1) / size * size
+
+	var keys []string
+	for o := first; o <= last; o += size {
+		keys = append(keys, b.rangeKey(name, o))
+	}
+	sections := b.fetch(ctx, cacheTypeRange, keys)
+
+	missingFirst, missingLast := int64(-1), int64(-1)
+	for o := first; o <= last; o += size {
+		if s, ok := sections[b.rangeKey(name, o)]; ok {
+			// A section shorter than RangeSize marks the end of the object.
+			if int64(len(s)) < size {
+				last = o
+			}
+			continue
+		}
+		if missingFirst < 0 {
+			missingFirst = o
+		}
+		missingLast = o
+	}
+	if missingFirst >= 0 {
+		rc, err := b.bkt.GetRange(ctx, name, missingFirst, missingLast+size-missingFirst)
+		if err != nil {
+			return nil, err
+		}
+		v, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "read range of %s", name)
+		}
+		store := map[string][]byte{}
+		for o := missingFirst; o <= missingLast; o += size {
+			start := o - missingFirst
+			if start > int64(len(v)) {
+				break
+			}
+			end := start + size
+			if end > int64(len(v)) {
+				end = int64(len(v))
+			}
+			key := b.rangeKey(name, o)
+			// Sections in between the missing ones may have been cached already.
+			if _, ok := sections[key]; !ok {
+				sections[key] = v[start:end]
+				store[key] = v[start:end]
+			}
+		}
+		b.cache.Store(ctx, store, b.conf.RangeTTL)
+	}
+
+	// Assemble the requested range.
+	buf := make([]byte, 0, length)
+	for o := first; o <= last; o += size {
+		s := sections[b.rangeKey(name, o)]
+
+		start, end := int64(0), int64(len(s))
+		if o < off {
+			start = off - o
+		}
+		if o+end > off+length {
+			end = off + length - o
+		}
+		if start < end {
+			buf = append(buf, s[start:end]...)
+		}
+		if int64(len(s)) < size {
+			break
+		}
+	}
+	return ioutil.NopCloser(bytes.NewReader(buf)), nil
+}
+
+func (b *cachingBucket) Exists(ctx context.Context, name string) (bool, error) {
+	return b.bkt.Exists(ctx, name)
+}
+
+func (b *cachingBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	return b.bkt.Attributes(ctx, name)
+}
+
+func (b *cachingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	keys, err := b.invalidationKeys(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := b.bkt.Upload(ctx, name, r); err != nil {
+		return err
+	}
+	b.cache.Delete(ctx, keys)
+	return nil
+}
+
+func (b *cachingBucket) Delete(ctx context.Context, name string) error {
+	keys, err := b.invalidationKeys(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := b.bkt.Delete(ctx, name); err != nil {
+		return err
+	}
+	b.cache.Delete(ctx, keys)
+	return nil
+}
+
+func (b *cachingBucket) iterKey(dir string, recursive bool) string {
+	return fmt.Sprintf("%siter:%s:%t", b.keyPrefix, strings.TrimSuffix(dir, DirDelim), recursive)
+}
+
+func (b *cachingBucket) metaKey(name string) string {
+	return b.keyPrefix + "meta:" + name
+}
+
+// invalidationKeys returns the cache keys that may hold data of the named object: its
+// content and byte ranges as well as the listings of all its parent directories. It must be
+// called before the object is changed, since the existing object's size determines which
+// ranges may be cached.
+func (b *cachingBucket) invalidationKeys(ctx context.Context, name string) ([]string, error) {
+	var keys []string
+
+	if b.conf.IterTTL > 0 {
+		for dir := name; dir != ""; {
+			dir = path.Dir(dir)
+			if dir == "." {
+				dir = ""
+			}
+			keys = append(keys, b.iterKey(dir, false), b.iterKey(dir, true))
+		}
+	}
+	if b.conf.MetaTTL > 0 && path.Base(name) == metaFilename {
+		keys = append(keys, b.metaKey(name))
+	}
+	if !b.cacheRange(name) {
+		return keys, nil
+	}
+	ok, err := b.bkt.Exists(ctx, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "check existence of %s", name)
+	}
+	if !ok {
+		return keys, nil
+	}
+	attrs, err := b.bkt.Attributes(ctx, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get attributes of %s", name)
+	}
+	// The last section of an object is cached even if it is empty.
+	for o := int64(0); o <= attrs.Size; o += b.conf.RangeSize {
+		keys = append(keys, b.rangeKey(name, o))
+	}
+	return keys, nil
+}
@@ -0,0 +1,235 @@
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/inmem"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+// countingBucket counts the calls of read operations.
+type countingBucket struct {
+	*inmem.Bucket
+
+	iters, gets int
+	ranges      [][2]int64
+}
+
+func (b *countingBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	b.iters++
+	return b.Bucket.Iter(ctx, dir, f, options...)
+}
+
+func (b *countingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.gets++
+	return b.Bucket.Get(ctx, name)
+}
+
+func (b *countingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b.ranges = append(b.ranges, [2]int64{off, length})
+	return b.Bucket.GetRange(ctx, name, off, length)
+}
+
+func newCachingBucket(t *testing.T, conf objstore.CachingConfig) (*countingBucket, objstore.Bucket) {
+	c, err := objstore.NewInMemoryCache(1024 * 1024)
+	testutil.Ok(t, err)
+
+	inner := &countingBucket{Bucket: inmem.NewBucket()}
+	return inner, objstore.CachingBucket("test", inner, c, conf, nil)
+}
+
+func iterNames(t *testing.T, bkt objstore.Bucket, dir string) []string {
+	var names []string
+	testutil.Ok(t, bkt.Iter(context.Background(), dir, func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	return names
+}
+
+func TestCachingBucket_Iter(t *testing.T) {
+	ctx := context.Background()
+	inner, bkt := newCachingBucket(t, objstore.CachingConfig{IterTTL: time.Minute})
+
+	testutil.Ok(t, bkt.Upload(ctx, "a/1", bytes.NewReader(nil)))
+	testutil.Equals(t, []string{"a/1"}, iterNames(t, bkt, "a"))
+
+	// The cached listing is served until it expires if the bucket is changed elsewhere.
+	testutil.Ok(t, inner.Upload(ctx, "a/2", bytes.NewReader(nil)))
+	testutil.Equals(t, []string{"a/1"}, iterNames(t, bkt, "a"))
+	testutil.Equals(t, 1, inner.iters)
+
+	// Recursive listings are cached separately.
+	testutil.Ok(t, bkt.Iter(ctx, "a", func(string) error { return nil }, objstore.WithRecursiveIter()))
+	testutil.Equals(t, 2, inner.iters)
+
+	// Listings that were interrupted by the callback are not cached.
+	errAbort := errors.New("abort")
+	testutil.Equals(t, errAbort, bkt.Iter(ctx, "", func(string) error { return errAbort }))
+	testutil.Equals(t, []string{"a/"}, iterNames(t, bkt, ""))
+	testutil.Equals(t, 4, inner.iters)
+
+	// Uploads and deletions through the bucket invalidate the listings of all parent directories.
+	testutil.Ok(t, bkt.Upload(ctx, "a/b/3", bytes.NewReader(nil)))
+	testutil.Equals(t, []string{"a/1", "a/2", "a/b/"}, iterNames(t, bkt, "a/"))
+	testutil.Equals(t, []string{"a/"}, iterNames(t, bkt, ""))
+	testutil.Equals(t, 6, inner.iters)
+
+	testutil.Ok(t, bkt.Delete(ctx, "a/1"))
+	testutil.Equals(t, []string{"a/2", "a/b/"}, iterNames(t, bkt, "a"))
+	testutil.Equals(t, 7, inner.iters)
+}
+
+func TestCachingBucket_Get(t *testing.T) {
+	ctx := context.Background()
+	inner, bkt := newCachingBucket(t, objstore.CachingConfig{MetaTTL: time.Minute})
+
+	testutil.Ok(t, bkt.Upload(ctx, "block/meta.json", bytes.NewReader([]byte("meta"))))
+	testutil.Ok(t, bkt.Upload(ctx, "block/index", bytes.NewReader([]byte("index"))))
+
+	for i := 0; i < 3; i++ {
+		for name, exp := range map[string]string{"block/meta.json": "meta", "block/index": "index"} {
+			rc, err := bkt.Get(ctx, name)
+			testutil.Ok(t, err)
+			b, err := ioutil.ReadAll(rc)
+			testutil.Ok(t, err)
+			testutil.Ok(t, rc.Close())
+			testutil.Equals(t, exp, string(b))
+		}
+	}
+	// Only meta.json is cached.
+	testutil.Equals(t, 4, inner.gets)
+
+	_, err := bkt.Get(ctx, "missing/meta.json")
+	testutil.NotOk(t, err)
+
+	// Overwriting meta.json through the bucket invalidates its cached content.
+	testutil.Ok(t, bkt.Upload(ctx, "block/meta.json", bytes.NewReader([]byte("meta2"))))
+	rc, err := bkt.Get(ctx, "block/meta.json")
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "meta2", string(b))
+
+	testutil.Ok(t, bkt.Delete(ctx, "block/meta.json"))
+	_, err = bkt.Get(ctx, "block/meta.json")
+	testutil.NotOk(t, err)
+}
+
+func TestCachingBucket_GetRange(t *testing.T) {
+	ctx := context.Background()
+	inner, bkt := newCachingBucket(t, objstore.CachingConfig{
+		RangeTTL:     time.Minute,
+		RangeSize:    10,
+		RangeObjects: []string{"index", "chunks/*"},
+	})
+
+	content := make([]byte, 95)
+	rand.New(rand.NewSource(0)).Read(content)
+	for _, name := range []string{"block/index", "block/chunks/000001", "block/other"} {
+		testutil.Ok(t, bkt.Upload(ctx, name, bytes.NewReader(content)))
+	}
+
+	getRange := func(name string, off, length int64) []byte {
+		rc, err := bkt.GetRange(ctx, name, off, length)
+		testutil.Ok(t, err)
+		defer rc.Close()
+
+		b, err := ioutil.ReadAll(rc)
+		testutil.Ok(t, err)
+		return b
+	}
+
+	testutil.Equals(t, content[15:35], getRange("block/index", 15, 20))
+	testutil.Equals(t, [][2]int64{{10, 30}}, inner.ranges)
+
+	// Only the sections that are not cached yet are read, in a single request.
+	testutil.Equals(t, content[5:55], getRange("block/index", 5, 50))
+	testutil.Equals(t, [][2]int64{{10, 30}, {0, 60}}, inner.ranges)
+
+	testutil.Equals(t, content[12:28], getRange("block/index", 12, 16))
+	testutil.Equals(t, 2, len(inner.ranges))
+
+	// Ranges beyond the end of the object are truncated.
+	testutil.Equals(t, content[85:], getRange("block/chunks/000001", 85, 100))
+	testutil.Equals(t, content[85:], getRange("block/chunks/000001", 85, 100))
+	testutil.Equals(t, content[90:], getRange("block/chunks/000001", 90, 20))
+	testutil.Equals(t, 3, len(inner.ranges))
+
+	for i := 0; i < 2; i++ {
+		testutil.Equals(t, content[3:7], getRange("block/other", 3, 4))
+	}
+	testutil.Equals(t, 5, len(inner.ranges))
+
+	for i := 0; i < 100; i++ {
+		off := rand.Int63n(int64(len(content)))
+		length := rand.Int63n(int64(len(content))-off) + 1
+		testutil.Equals(t, content[off:off+length], getRange("block/chunks/000001", off, length))
+	}
+
+	// Overwriting an object through the bucket invalidates all its cached sections.
+	content2 := make([]byte, 40)
+	rand.New(rand.NewSource(1)).Read(content2)
+	testutil.Ok(t, bkt.Upload(ctx, "block/index", bytes.NewReader(content2)))
+	testutil.Equals(t, content2[5:40], getRange("block/index", 5, 50))
+	testutil.Equals(t, content2[30:], getRange("block/index", 30, 100))
+}
+
+func TestCachingConfig_Validate(t *testing.T) {
+	for _, c := range []struct {
+		conf objstore.CachingConfig
+		ok   bool
+	}{
+		{conf: objstore.CachingConfig{}, ok: true},
+		{conf: objstore.CachingConfig{IterTTL: time.Minute, RangeTTL: time.Hour, RangeObjects: []string{"chunks/*"}}, ok: true},
+		{conf: objstore.CachingConfig{MetaTTL: -time.Minute}, ok: false},
+		{conf: objstore.CachingConfig{RangeSize: -1}, ok: false},
+		{conf: objstore.CachingConfig{RangeObjects: []string{"[index"}}, ok: false},
+	} {
+		err := c.conf.Validate()
+		if c.ok {
+			testutil.Ok(t, err)
+		} else {
+			testutil.NotOk(t, err)
+		}
+	}
+}
+
+func TestInMemoryCache(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := objstore.NewInMemoryCache(0)
+	testutil.NotOk(t, err)
+
+	c, err := objstore.NewInMemoryCache(10)
+	testutil.Ok(t, err)
+
+	c.Store(ctx, map[string][]byte{"a": []byte("1234"), "b": []byte("5678")}, time.Minute)
+	testutil.Equals(t, map[string][]byte{"a": []byte("1234"), "b": []byte("5678")}, c.Fetch(ctx, []string{"a", "b", "c"}))
+
+	// Values that do not fit evict the least recently used ones.
+	c.Fetch(ctx, []string{"a"})
+	c.Store(ctx, map[string][]byte{"c": []byte("901")}, time.Minute)
+	testutil.Equals(t, map[string][]byte{"a": []byte("1234"), "c": []byte("901")}, c.Fetch(ctx, []string{"a", "b", "c"}))
+
+	// Replacing a value frees its previous size.
+	c.Store(ctx, map[string][]byte{"a": []byte("1234567")}, time.Minute)
+	testutil.Equals(t, map[string][]byte{"a": []byte("1234567"), "c": []byte("901")}, c.Fetch(ctx, []string{"a", "c"}))
+
+	// Values larger than the cache are not stored.
+	c.Store(ctx, map[string][]byte{"d": make([]byte, 11)}, time.Minute)
+	testutil.Equals(t, map[string][]byte{}, c.Fetch(ctx, []string{"d"}))
+
+	c.Store(ctx, map[string][]byte{"e": []byte("1")}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	testutil.Equals(t, map[string][]byte{}, c.Fetch(ctx, []string{"e"}))
+}
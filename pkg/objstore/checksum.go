@@ -0,0 +1,71 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrChecksumMismatch is returned if the content of an uploaded object differs from its source.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// IsChecksumMismatch returns true if the error was caused by a checksum mismatch.
+func IsChecksumMismatch(err error) bool {
+	return errors.Cause(err) == ErrChecksumMismatch
+}
+
+// fileChecksums returns the MD5 and SHA256 checksums of the file.
+func fileChecksums(name string) (md5sum, sha256sum []byte, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "open file %s", name)
+	}
+	defer f.Close()
+
+	m, s := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(m, s), f); err != nil {
+		return nil, nil, errors.Wrapf(err, "read file %s", name)
+	}
+	return m.Sum(nil), s.Sum(nil), nil
+}
+
+// VerifyFile checks that the object dst holds the same content as the file src.
+// If the object's ETag is the MD5 checksum of the file, as it is for objects that were
+// uploaded in one piece to most providers, the object is not read. Otherwise, e.g. for
+// multipart uploads or encrypted objects, the object is read back and its SHA256 checksum
+// compared to the file's.
+func VerifyFile(ctx context.Context, bkt BucketReader, src, dst string) error {
+	md5sum, sha256sum, err := fileChecksums(src)
+	if err != nil {
+		return err
+	}
+	attrs, err := bkt.Attributes(ctx, dst)
+	if err != nil {
+		return errors.Wrapf(err, "get attributes of %s", dst)
+	}
+	if strings.EqualFold(strings.Trim(attrs.ETag, `"`), hex.EncodeToString(md5sum)) {
+		return nil
+	}
+
+	rc, err := bkt.Get(ctx, dst)
+	if err != nil {
+		return errors.Wrapf(err, "get %s", dst)
+	}
+	defer rc.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return errors.Wrapf(err, "read %s", dst)
+	}
+	if !bytes.Equal(h.Sum(nil), sha256sum) {
+		return errors.Wrapf(ErrChecksumMismatch, "verify %s against %s", dst, src)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/inmem"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+// opaqueETagBucket returns ETags that are not the MD5 checksum of the content, as
+// providers do for multipart uploads and encrypted objects.
+type opaqueETagBucket struct {
+	*inmem.Bucket
+	gets int
+}
+
+func (b *opaqueETagBucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	attrs, err := b.Bucket.Attributes(ctx, name)
+	attrs.ETag = `"` + attrs.ETag + `-2"`
+	return attrs, err
+}
+
+func (b *opaqueETagBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.gets++
+	return b.Bucket.Get(ctx, name)
+}
+
+func TestVerifyFile(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "verify-file")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "index")
+	testutil.Ok(t, ioutil.WriteFile(src, []byte("indexcontents"), 0666))
+
+	bkt := &opaqueETagBucket{Bucket: inmem.NewBucket()}
+	testutil.Ok(t, objstore.UploadFile(ctx, bkt, src, "block/index"))
+
+	// Objects whose ETag is the MD5 checksum are not read back.
+	testutil.Ok(t, objstore.VerifyFile(ctx, bkt.Bucket, src, "block/index"))
+
+	testutil.Ok(t, objstore.VerifyFile(ctx, bkt, src, "block/index"))
+	testutil.Equals(t, 1, bkt.gets)
+
+	for _, b := range []objstore.BucketReader{bkt.Bucket, bkt} {
+		testutil.Ok(t, bkt.Bucket.Upload(ctx, "block/index", bytes.NewReader([]byte("indexcontentz"))))
+
+		err = objstore.VerifyFile(ctx, b, src, "block/index")
+		testutil.NotOk(t, err)
+		testutil.Assert(t, objstore.IsChecksumMismatch(err), "unexpected error %s", err)
+	}
+
+	err = objstore.VerifyFile(ctx, bkt, src, "block/missing")
+	testutil.NotOk(t, err)
+	testutil.Assert(t, !objstore.IsChecksumMismatch(err), "unexpected checksum mismatch")
+}
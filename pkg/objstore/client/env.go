@@ -0,0 +1,40 @@
+package client
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// envRe matches ${VAR} references. Bare $VAR references are left alone, since dollar signs are
+// common in secrets.
+var envRe = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// ExpandEnv replaces ${VAR} references in the configuration with the values of the respective
+// environment variables. It fails listing all referenced variables that are not set.
+func ExpandEnv(conf []byte) ([]byte, error) {
+	missing := map[string]struct{}{}
+
+	res := envRe.ReplaceAllFunc(conf, func(ref []byte) []byte {
+		name := string(envRe.FindSubmatch(ref)[1])
+
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing[name] = struct{}{}
+			return ref
+		}
+		return []byte(v)
+	})
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for n := range missing {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, configError{errors.Errorf("unresolved environment variables in objstore config: %s", strings.Join(names, ", "))}
+	}
+	return res, nil
+}
@@ -0,0 +1,25 @@
+package client
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+func TestExpandEnv(t *testing.T) {
+	testutil.Ok(t, os.Setenv("THANOS_TEST_ACCESS_KEY", "key"))
+	testutil.Ok(t, os.Setenv("THANOS_TEST_EMPTY", ""))
+	defer os.Unsetenv("THANOS_TEST_ACCESS_KEY")
+	defer os.Unsetenv("THANOS_TEST_EMPTY")
+
+	conf, err := ExpandEnv([]byte("access_key: ${THANOS_TEST_ACCESS_KEY}\nsecret_key: a$b${THANOS_TEST_EMPTY}\n"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "access_key: key\nsecret_key: a$b\n", string(conf))
+
+	_, err = ExpandEnv([]byte("access_key: ${THANOS_TEST_UNSET_B}\nsecret_key: ${THANOS_TEST_UNSET_A}${THANOS_TEST_UNSET_B}\n"))
+	testutil.NotOk(t, err)
+	testutil.Assert(t, IsConfigError(err), "expected config error, got %s", err)
+	testutil.Assert(t, strings.HasSuffix(err.Error(), "THANOS_TEST_UNSET_A, THANOS_TEST_UNSET_B"), "unexpected error: %s", err)
+}
@@ -0,0 +1,312 @@
+// Package client creates object storage buckets of any supported provider from a YAML configuration.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/azure"
+	"github.com/improbable-eng/thanos/pkg/objstore/cos"
+	"github.com/improbable-eng/thanos/pkg/objstore/filesystem"
+	"github.com/improbable-eng/thanos/pkg/objstore/gcs"
+	"github.com/improbable-eng/thanos/pkg/objstore/hdfs"
+	"github.com/improbable-eng/thanos/pkg/objstore/memcached"
+	"github.com/improbable-eng/thanos/pkg/objstore/oss"
+	"github.com/improbable-eng/thanos/pkg/objstore/s3"
+	"github.com/improbable-eng/thanos/pkg/objstore/swift"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Supported bucket providers.
+const (
+	GCS        = "GCS"
+	S3         = "S3"
+	AZURE      = "AZURE"
+	SWIFT      = "SWIFT"
+	COS        = "COS"
+	OSS        = "OSS"
+	HDFS       = "HDFS"
+	FILESYSTEM = "FILESYSTEM"
+)
+
+// Supported cache types.
+const (
+	MEMCACHED = "MEMCACHED"
+	INMEMORY  = "IN-MEMORY"
+)
+
+// BucketConfig describes a bucket of any supported provider in a YAML document.
+type BucketConfig struct {
+	// Type of the bucket's provider, e.g. GCS or S3.
+	Type string `yaml:"type"`
+	// Config holds the provider-specific configuration.
+	Config interface{} `yaml:"config"`
+	// Prefix is the directory of the bucket that all objects are stored under. It allows
+	// several installations to share one bucket.
+	Prefix string `yaml:"prefix"`
+	// Retry configures retries of operations that failed with a transient error.
+	Retry objstore.RetryConfig `yaml:"retry"`
+	// RateLimit limits the rate of operations and the bandwidth of transfers.
+	RateLimit objstore.RateLimitConfig `yaml:"rate_limit"`
+	// Cache configures caching of listings and object contents.
+	Cache CacheConfig `yaml:"cache"`
+}
+
+// CacheConfig describes the cache of a bucket and what is cached.
+type CacheConfig struct {
+	// Type of the cache, MEMCACHED or IN-MEMORY. Caching is disabled if it is empty.
+	Type string `yaml:"type"`
+	// Memcached configures the servers of a MEMCACHED cache.
+	Memcached memcached.Config `yaml:"memcached"`
+	// MaxSizeBytes is the maximum size of an IN-MEMORY cache.
+	MaxSizeBytes int64 `yaml:"max_size_bytes"`
+
+	objstore.CachingConfig `yaml:",inline"`
+}
+
+// GCSConfig is the provider-specific configuration of GCS buckets.
+type GCSConfig struct {
+	Bucket string `yaml:"bucket"`
+	// ServiceAccount is the JSON key of a service account to authenticate with. If empty,
+	// Application Default Credentials are used.
+	ServiceAccount string `yaml:"service_account"`
+	// HTTPConfig tunes the connection pool and TLS settings of the client.
+	HTTPConfig objstore.TransportConfig `yaml:"http_config"`
+	// ChunkSizeBytes is the size of the chunks uploads are buffered and sent in. Each
+	// concurrent upload holds one chunk in memory. If zero, 16MiB is used.
+	ChunkSizeBytes int `yaml:"chunk_size_bytes"`
+}
+
+// FilesystemConfig is the provider-specific configuration of filesystem buckets.
+type FilesystemConfig struct {
+	Directory string `yaml:"directory"`
+}
+
+// configError marks an error as caused by an invalid configuration.
+type configError struct {
+	err error
+}
+
+func (e configError) Error() string { return e.err.Error() }
+func (e configError) Cause() error  { return e.err }
+
+// IsConfigError returns true if the error was caused by an invalid configuration rather than
+// a failure to create the bucket.
+func IsConfigError(err error) bool {
+	for err != nil {
+		if _, ok := err.(configError); ok {
+			return true
+		}
+		c, ok := err.(interface {
+			Cause() error
+		})
+		if !ok {
+			return false
+		}
+		err = c.Cause()
+	}
+	return false
+}
+
+// NewBucket creates a bucket from the given YAML configuration. It returns the bucket along
+// with its name and a function that must be called to release the bucket's resources.
+// Connections to the provider are based on tlsConfig if it is not nil, except where the
+// provider's http_config sets its own TLS settings.
+// Metrics of the provider's client are registered with reg if it is not nil.
+func NewBucket(confContentYaml []byte, tlsConfig *tls.Config, reg prometheus.Registerer) (bkt objstore.Bucket, name string, closeFn func() error, err error) {
+	var cfg BucketConfig
+	if err := yaml.UnmarshalStrict(confContentYaml, &cfg); err != nil {
+		return nil, "", nil, configError{errors.Wrap(err, "parse objstore config")}
+	}
+	if err := cfg.Retry.Validate(); err != nil {
+		return nil, "", nil, configError{err}
+	}
+	if err := cfg.RateLimit.Validate(); err != nil {
+		return nil, "", nil, configError{err}
+	}
+	if err := cfg.Cache.Validate(); err != nil {
+		return nil, "", nil, configError{err}
+	}
+	// Decode the provider-specific configuration into its respective type.
+	raw, err := yaml.Marshal(cfg.Config)
+	if err != nil {
+		return nil, "", nil, errors.Wrap(err, "encode provider config")
+	}
+	bkt, name, closeFn, err = newProviderBucket(cfg.Type, raw, tlsConfig, reg)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	bkt = objstore.RetryBucket(name, bkt, cfg.Retry, reg)
+	bkt = objstore.RateLimitedBucket(bkt, cfg.RateLimit)
+
+	bkt, closeFn, err = newCachingBucket(name, bkt, closeFn, cfg.Cache, reg)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return objstore.PrefixedBucket(bkt, cfg.Prefix), name, closeFn, nil
+}
+
+// newCachingBucket wraps the bucket with the configured cache. It returns closeFn, which
+// is called right away if the cache cannot be created.
+func newCachingBucket(name string, bkt objstore.Bucket, closeFn func() error, conf CacheConfig, reg prometheus.Registerer) (objstore.Bucket, func() error, error) {
+	var c objstore.Cache
+
+	switch strings.ToUpper(conf.Type) {
+	case "":
+		return bkt, closeFn, nil
+	case MEMCACHED:
+		if err := conf.Memcached.Validate(); err != nil {
+			closeFn()
+			return nil, nil, configError{err}
+		}
+		mc, err := memcached.NewClient(conf.Memcached, reg)
+		if err != nil {
+			closeFn()
+			return nil, nil, errors.Wrap(err, "create memcached client")
+		}
+		c = mc
+	case INMEMORY:
+		ic, err := objstore.NewInMemoryCache(conf.MaxSizeBytes)
+		if err != nil {
+			closeFn()
+			return nil, nil, configError{errors.Wrap(err, "create in-memory cache")}
+		}
+		c = ic
+	default:
+		closeFn()
+		return nil, nil, configError{errors.Errorf("unsupported cache type %q", conf.Type)}
+	}
+	return objstore.CachingBucket(name, bkt, c, conf.CachingConfig, reg), closeFn, nil
+}
+
+// newProviderBucket creates a bucket of the given provider from its YAML configuration.
+func newProviderBucket(typ string, raw []byte, tlsConfig *tls.Config, reg prometheus.Registerer) (objstore.Bucket, string, func() error, error) {
+	noop := func() error { return nil }
+
+	switch strings.ToUpper(typ) {
+	case GCS:
+		var gcsConfig GCSConfig
+		if err := yaml.UnmarshalStrict(raw, &gcsConfig); err != nil {
+			return nil, "", nil, configError{errors.Wrap(err, "parse GCS config")}
+		}
+		if gcsConfig.Bucket == "" {
+			return nil, "", nil, configError{errors.New("missing GCS bucket name")}
+		}
+		if err := gcsConfig.HTTPConfig.Validate(); err != nil {
+			return nil, "", nil, configError{err}
+		}
+		if gcsConfig.ChunkSizeBytes < 0 {
+			return nil, "", nil, configError{errors.New("GCS chunk size must not be negative")}
+		}
+		gcsClient, err := gcs.NewClient(context.Background(), []byte(gcsConfig.ServiceAccount), gcsConfig.HTTPConfig, tlsConfig)
+		if err != nil {
+			return nil, "", nil, errors.Wrap(err, "create GCS client")
+		}
+		return gcs.NewBucket(gcsConfig.Bucket, gcsClient.Bucket(gcsConfig.Bucket), gcsConfig.ChunkSizeBytes, reg), gcsConfig.Bucket, gcsClient.Close, nil
+	case S3:
+		var s3Config s3.Config
+		if err := yaml.UnmarshalStrict(raw, &s3Config); err != nil {
+			return nil, "", nil, configError{errors.Wrap(err, "parse S3 config")}
+		}
+		if err := s3Config.Validate(); err != nil {
+			return nil, "", nil, configError{err}
+		}
+		// Insecure connections don't use TLS.
+		if !s3Config.Insecure {
+			s3Config.TLSConfig = tlsConfig
+		}
+		b, err := s3.NewBucket(&s3Config, reg)
+		if err != nil {
+			return nil, "", nil, errors.Wrap(err, "create s3 client")
+		}
+		return b, s3Config.Bucket, noop, nil
+	case AZURE:
+		var azureConfig azure.Config
+		if err := yaml.UnmarshalStrict(raw, &azureConfig); err != nil {
+			return nil, "", nil, configError{errors.Wrap(err, "parse Azure config")}
+		}
+		if err := azureConfig.Validate(); err != nil {
+			return nil, "", nil, configError{err}
+		}
+		azureConfig.TLSConfig = tlsConfig
+		b, err := azure.NewBucket(&azureConfig, reg)
+		if err != nil {
+			return nil, "", nil, errors.Wrap(err, "create azure client")
+		}
+		return b, azureConfig.ContainerName, noop, nil
+	case SWIFT:
+		var swiftConfig swift.Config
+		if err := yaml.UnmarshalStrict(raw, &swiftConfig); err != nil {
+			return nil, "", nil, configError{errors.Wrap(err, "parse Swift config")}
+		}
+		if err := swiftConfig.Validate(); err != nil {
+			return nil, "", nil, configError{err}
+		}
+		swiftConfig.TLSConfig = tlsConfig
+		b, err := swift.NewBucket(&swiftConfig, reg)
+		if err != nil {
+			return nil, "", nil, errors.Wrap(err, "create swift client")
+		}
+		return b, swiftConfig.ContainerName, noop, nil
+	case COS:
+		var cosConfig cos.Config
+		if err := yaml.UnmarshalStrict(raw, &cosConfig); err != nil {
+			return nil, "", nil, configError{errors.Wrap(err, "parse COS config")}
+		}
+		if err := cosConfig.Validate(); err != nil {
+			return nil, "", nil, configError{err}
+		}
+		cosConfig.TLSConfig = tlsConfig
+		b, err := cos.NewBucket(&cosConfig, reg)
+		if err != nil {
+			return nil, "", nil, errors.Wrap(err, "create cos client")
+		}
+		return b, cosConfig.Bucket, noop, nil
+	case OSS:
+		var ossConfig oss.Config
+		if err := yaml.UnmarshalStrict(raw, &ossConfig); err != nil {
+			return nil, "", nil, configError{errors.Wrap(err, "parse OSS config")}
+		}
+		if err := ossConfig.Validate(); err != nil {
+			return nil, "", nil, configError{err}
+		}
+		ossConfig.TLSConfig = tlsConfig
+		b, err := oss.NewBucket(&ossConfig, reg)
+		if err != nil {
+			return nil, "", nil, errors.Wrap(err, "create oss client")
+		}
+		return b, ossConfig.Bucket, noop, nil
+	case HDFS:
+		var hdfsConfig hdfs.Config
+		if err := yaml.UnmarshalStrict(raw, &hdfsConfig); err != nil {
+			return nil, "", nil, configError{errors.Wrap(err, "parse HDFS config")}
+		}
+		if err := hdfsConfig.Validate(); err != nil {
+			return nil, "", nil, configError{err}
+		}
+		hdfsConfig.TLSConfig = tlsConfig
+		b, err := hdfs.NewBucket(&hdfsConfig, reg)
+		if err != nil {
+			return nil, "", nil, errors.Wrap(err, "create hdfs client")
+		}
+		return b, hdfsConfig.Directory, noop, nil
+	case FILESYSTEM:
+		var fsConfig FilesystemConfig
+		if err := yaml.UnmarshalStrict(raw, &fsConfig); err != nil {
+			return nil, "", nil, configError{errors.Wrap(err, "parse filesystem config")}
+		}
+		if fsConfig.Directory == "" {
+			return nil, "", nil, configError{errors.New("missing filesystem directory")}
+		}
+		b, err := filesystem.NewBucket(fsConfig.Directory)
+		if err != nil {
+			return nil, "", nil, errors.Wrap(err, "create filesystem bucket")
+		}
+		return b, fsConfig.Directory, noop, nil
+	}
+	return nil, "", nil, configError{errors.Errorf("unsupported bucket type %q", typ)}
+}
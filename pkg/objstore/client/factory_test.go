@@ -0,0 +1,176 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+	"github.com/pkg/errors"
+)
+
+func TestNewBucket_Filesystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "bucket")
+
+	bkt, name, closeFn, err := NewBucket([]byte("type: filesystem\nconfig:\n  directory: "+root+"\n"), nil, nil)
+	testutil.Ok(t, err)
+	defer closeFn()
+
+	testutil.Equals(t, root, name)
+	testutil.Ok(t, bkt.Upload(context.Background(), "a/b", bytes.NewReader([]byte("content"))))
+
+	b, err := ioutil.ReadFile(filepath.Join(root, "a", "b"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "content", string(b))
+}
+
+func TestNewBucket_Prefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	bkt, _, closeFn, err := NewBucket([]byte("type: FILESYSTEM\nconfig:\n  directory: "+dir+"\nprefix: tenant-a\n"), nil, nil)
+	testutil.Ok(t, err)
+	defer closeFn()
+
+	testutil.Ok(t, bkt.Upload(context.Background(), "a/b", bytes.NewReader([]byte("content"))))
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "tenant-a", "a", "b"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "content", string(b))
+}
+
+func TestNewBucket_RetryAndRateLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	bkt, _, closeFn, err := NewBucket([]byte("type: FILESYSTEM\nconfig:\n  directory: "+dir+"\nretry:\n  max_attempts: 3\n  min_backoff: 200ms\n  max_backoff: 5s\nrate_limit:\n  write_ops_per_second: 10\n  read_bytes_per_second: 1000000\n"), nil, nil)
+	testutil.Ok(t, err)
+	defer closeFn()
+
+	testutil.Ok(t, bkt.Upload(context.Background(), "obj", bytes.NewReader([]byte("content"))))
+	testutil.Equals(t, "FILESYSTEM", objstore.BackendType(bkt))
+}
+
+func TestNewBucket_Cache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	bkt, _, closeFn, err := NewBucket([]byte("type: FILESYSTEM\nconfig:\n  directory: "+dir+"\nprefix: tenant-a\ncache:\n  type: in-memory\n  max_size_bytes: 1000000\n  meta_ttl: 1h\n"), nil, nil)
+	testutil.Ok(t, err)
+	defer closeFn()
+
+	ctx := context.Background()
+	testutil.Ok(t, bkt.Upload(ctx, "block/meta.json", bytes.NewReader([]byte("content"))))
+
+	rc, err := bkt.Get(ctx, "block/meta.json")
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+
+	// The cached content is served after the object was removed underneath.
+	testutil.Ok(t, os.Remove(filepath.Join(dir, "tenant-a", "block", "meta.json")))
+
+	rc, err = bkt.Get(ctx, "block/meta.json")
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "content", string(b))
+}
+
+func TestNewBucket_InvalidConfig(t *testing.T) {
+	for _, conf := range []string{
+		"type: [S3",
+		"type: S3\nunknown: field\n",
+		"type: S3\nconfig:\n  bucket: thanos\n",
+		"type: S3\nconfig:\n  unknown: field\n",
+		"type: GCS\nconfig: {}\n",
+		"type: GCS\nconfig:\n  bucket: thanos\n  http_config:\n    max_idle_conns_per_host: -1\n",
+		"type: GCS\nconfig:\n  bucket: thanos\n  chunk_size_bytes: -1\n",
+		"type: GCS\nconfig:\n  bucket: thanos\n  http_config:\n    tls_cipher_suites: [TLS_RSA_WITH_NULL_SHA]\n",
+		"type: HDFS\nconfig:\n  endpoint: namenode:9870\n",
+		"type: HDFS\nconfig:\n  endpoint: namenode:9870\n  directory: thanos\n",
+		"type: HDFS\nconfig:\n  endpoint: namenode:9870\n  directory: /thanos\n  http_config:\n    tls_min_version: \"1.4\"\n",
+		"type: COS\nconfig:\n  bucket: thanos\n  region: ap-guangzhou\n  secret_id: id\n  secret_key: key\n  http_config:\n    max_idle_conns: -1\n",
+		"type: FILESYSTEM\nconfig: {}\n",
+		"type: FTP\nconfig: {}\n",
+		"type: FILESYSTEM\nconfig:\n  directory: /tmp\nretry:\n  max_attempts: -1\n",
+		"type: FILESYSTEM\nconfig:\n  directory: /tmp\nrate_limit:\n  read_ops_per_second: -1\n",
+		"type: FILESYSTEM\nconfig:\n  directory: /tmp\nrate_limit:\n  unknown: 1\n",
+		"type: FILESYSTEM\nconfig:\n  directory: /tmp\nretry:\n  min_backoff: 10s\n  max_backoff: 1s\n",
+		"type: FILESYSTEM\nconfig:\n  directory: /tmp\ncache:\n  type: REDIS\n",
+		"type: FILESYSTEM\nconfig:\n  directory: /tmp\ncache:\n  type: MEMCACHED\n",
+		"type: FILESYSTEM\nconfig:\n  directory: /tmp\ncache:\n  type: IN-MEMORY\n",
+		"type: FILESYSTEM\nconfig:\n  directory: /tmp\ncache:\n  type: IN-MEMORY\n  max_size_bytes: 1000\n  iter_ttl: -1m\n",
+		"",
+	} {
+		_, _, _, err := NewBucket([]byte(conf), nil, nil)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, IsConfigError(err), "expected config error for %q, got %s", conf, err)
+	}
+}
+
+func TestNewBucket_TLSConfig(t *testing.T) {
+	var requests int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS11}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// The server's certificate is self-signed, so only its TLS version is checked. OSS is
+	// left out since it sends requests to a subdomain of its endpoint.
+	newTLSConfig := func(minVersion uint16) *tls.Config {
+		return &tls.Config{MinVersion: minVersion, InsecureSkipVerify: true}
+	}
+	for _, conf := range []string{
+		"type: AZURE\nconfig:\n  container: thanos\n  connection_string: DefaultEndpointsProtocol=https;AccountName=thanos;AccountKey=a2V5;BlobEndpoint=" + srv.URL + "/thanos;\n",
+		"type: COS\nconfig:\n  bucket: thanos-1250000000\n  secret_id: id\n  secret_key: key\n  endpoint: " + srv.URL + "\n",
+		"type: SWIFT\nconfig:\n  container: thanos\n  auth_url: " + srv.URL + "/v3\n  username: user\n  password: pass\n",
+		"type: HDFS\nconfig:\n  endpoint: " + srv.URL + "\n  directory: /thanos\n",
+	} {
+		// exists creates the bucket and probes it. It returns the number of requests that
+		// reached the server.
+		exists := func(tlsConfig *tls.Config) (int32, error) {
+			atomic.StoreInt32(&requests, 0)
+
+			bkt, _, closeFn, err := NewBucket([]byte(conf), tlsConfig, nil)
+			if err != nil {
+				return atomic.LoadInt32(&requests), err
+			}
+			defer closeFn()
+
+			_, err = bkt.Exists(context.Background(), "obj")
+			return atomic.LoadInt32(&requests), err
+		}
+		// The server only speaks TLS 1.1, which the policy rejects before any request is sent.
+		n, err := exists(newTLSConfig(tls.VersionTLS12))
+		testutil.NotOk(t, err)
+		testutil.Assert(t, n == 0, "request reached server despite TLS policy for %q", conf)
+
+		n, _ = exists(newTLSConfig(tls.VersionTLS10))
+		testutil.Assert(t, n > 0, "no request reached server for %q", conf)
+	}
+}
+
+func TestIsConfigError(t *testing.T) {
+	testutil.Assert(t, !IsConfigError(nil), "nil is not a config error")
+	testutil.Assert(t, !IsConfigError(errors.New("connection refused")), "runtime error is not a config error")
+	testutil.Assert(t, IsConfigError(errors.Wrap(configError{errors.New("bad")}, "create bucket")), "wrapped config error not detected")
+}
@@ -0,0 +1,528 @@
+// Package cos implements common object storage abstractions against Tencent Cloud Object Storage.
+package cos
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	opObjectsList  = "GET Bucket"
+	opObjectInsert = "PUT Object"
+	opObjectGet    = "GET Object"
+	opObjectStat   = "HEAD Object"
+	opObjectDelete = "DELETE Object"
+)
+
+// DirDelim is the delimiter used to model a directory structure in an object store bucket.
+const DirDelim = "/"
+
+const (
+	// defaultPartSize is the size of the parts larger objects are uploaded in. Objects of at
+	// most this size are uploaded in a single request.
+	defaultPartSize = 64 * 1024 * 1024
+	// signatureTTL is the time for which request signatures are valid.
+	signatureTTL = 15 * time.Minute
+)
+
+// Config encapsulates the necessary config values to instantiate a COS client.
+type Config struct {
+	// Bucket is the bucket name, optionally including the APPID suffix, e.g. thanos-1250000000.
+	Bucket string `yaml:"bucket"`
+	// AppID is appended to the bucket name unless it already ends with it.
+	AppID     string `yaml:"app_id"`
+	Region    string `yaml:"region"`
+	SecretID  string `yaml:"secret_id"`
+	SecretKey string `yaml:"secret_key"`
+	// Endpoint overrides the bucket endpoint derived from bucket name and region,
+	// e.g. for private deployments.
+	Endpoint string `yaml:"endpoint"`
+	// TLSConfig is the TLS policy of connections to the bucket endpoint, e.g. to enforce a
+	// minimum TLS version. It cannot be set through YAML.
+	TLSConfig *tls.Config `yaml:"-"`
+	// HTTPConfig tunes the connection pool of the client. Its TLS settings take precedence
+	// over TLSConfig.
+	HTTPConfig objstore.TransportConfig `yaml:"http_config"`
+}
+
+// Validate checks to see if any of the COS config options are set.
+func (conf *Config) Validate() error {
+	switch {
+	case conf.Bucket == "":
+		return errors.New("insufficient cos configuration information: missing bucket")
+	case conf.Region == "" && conf.Endpoint == "":
+		return errors.New("insufficient cos configuration information: missing region")
+	case conf.SecretID == "":
+		return errors.New("insufficient cos configuration information: missing secret ID")
+	case conf.SecretKey == "":
+		return errors.New("insufficient cos configuration information: missing secret key")
+	}
+	return conf.HTTPConfig.Validate()
+}
+
+// Bucket implements the store.Bucket and shipper.Bucket interfaces against a COS bucket.
+type Bucket struct {
+	client    *http.Client
+	endpoint  *url.URL
+	name      string
+	secretID  string
+	secretKey string
+	partSize  int
+	opsTotal  *prometheus.CounterVec
+}
+
+// NewBucket returns a new Bucket using the provided COS config values.
+func NewBucket(conf *Config, reg prometheus.Registerer) (*Bucket, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	name := conf.Bucket
+	if conf.AppID != "" && !strings.HasSuffix(name, "-"+conf.AppID) {
+		name += "-" + conf.AppID
+	}
+	endpoint := conf.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.cos.%s.myqcloud.com", name, conf.Region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse cos endpoint %s", endpoint)
+	}
+
+	bkt := &Bucket{
+		client:    &http.Client{Transport: conf.HTTPConfig.NewTransport(conf.TLSConfig)},
+		endpoint:  u,
+		name:      name,
+		secretID:  conf.SecretID,
+		secretKey: conf.SecretKey,
+		partSize:  defaultPartSize,
+		opsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_objstore_cos_bucket_operations_total",
+			Help:        "Total number of operations that were executed against a Tencent COS bucket.",
+			ConstLabels: prometheus.Labels{"bucket": name},
+		}, []string{"operation"}),
+	}
+	if reg != nil {
+		reg.MustRegister(bkt.opsTotal)
+	}
+	return bkt, nil
+}
+
+// Type returns the type of the bucket's backend.
+func (b *Bucket) Type() string {
+	return "COS"
+}
+
+// newRequest returns a new request against the object with the given name. If name is empty,
+// the request is made against the bucket.
+func (b *Bucket) newRequest(ctx context.Context, method, name string, q url.Values, body io.Reader) (*http.Request, error) {
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + name
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(ctx), nil
+}
+
+// do signs and sends the request. It returns an error if the response status is not among the given ones.
+func (b *Bucket) do(req *http.Request, status ...int) (*http.Response, error) {
+	req.Header.Set("Authorization", authorization(b.secretID, b.secretKey, req, time.Now()))
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range status {
+		if resp.StatusCode == s {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	// Responses to HEAD requests have no body to describe the error.
+	if body, err := ioutil.ReadAll(resp.Body); err == nil && len(body) > 0 {
+		xml.Unmarshal(body, &e)
+	}
+	if e.Code == "" {
+		e.Code = resp.Status
+	}
+	return nil, errors.Errorf("%s %s: %s %s", req.Method, req.URL.Path, e.Code, strings.TrimSpace(e.Message))
+}
+
+// authorization returns the value of the Authorization header for the request as described in
+// https://intl.cloud.tencent.com/document/product/436/7778. Only the host header is signed.
+func authorization(secretID, secretKey string, req *http.Request, now time.Time) string {
+	keyTime := fmt.Sprintf("%d;%d", now.Unix(), now.Add(signatureTTL).Unix())
+
+	params, paramList := canonicalize(req.URL.Query())
+	headers, headerList := canonicalize(map[string][]string{"host": {req.URL.Host}})
+
+	httpString := strings.ToLower(req.Method) + "\n" + req.URL.Path + "\n" + params + "\n" + headers + "\n"
+
+	return strings.Join([]string{
+		"q-sign-algorithm=sha1",
+		"q-ak=" + secretID,
+		"q-sign-time=" + keyTime,
+		"q-key-time=" + keyTime,
+		"q-header-list=" + headerList,
+		"q-url-param-list=" + paramList,
+		"q-signature=" + signature(secretKey, keyTime, httpString),
+	}, "&")
+}
+
+// signature returns the signature of the canonical request for the given validity period.
+func signature(secretKey, keyTime, httpString string) string {
+	stringToSign := "sha1\n" + keyTime + "\n" + fmt.Sprintf("%x", sha1.Sum([]byte(httpString))) + "\n"
+	signKey := hmacSHA1([]byte(secretKey), keyTime)
+
+	return hmacSHA1([]byte(signKey), stringToSign)
+}
+
+// canonicalize returns the encoded key-value pairs sorted by their lower-cased keys along with
+// the list of those keys.
+func canonicalize(kvs map[string][]string) (pairs, keys string) {
+	var ks []string
+	m := map[string]string{}
+	for k, vs := range kvs {
+		lk := strings.ToLower(escape(k))
+		ks = append(ks, lk)
+		if len(vs) > 0 {
+			m[lk] = escape(vs[0])
+		}
+	}
+	sort.Strings(ks)
+
+	var ps []string
+	for _, k := range ks {
+		ps = append(ps, k+"="+m[k])
+	}
+	return strings.Join(ps, "&"), strings.Join(ks, ";")
+}
+
+// escape URL-encodes s with spaces encoded as %20.
+func escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hmacSHA1(key []byte, s string) string {
+	h := hmac.New(sha1.New, key)
+	h.Write([]byte(s))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// listResult is the response to a GET Bucket request.
+type listResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated bool   `xml:"IsTruncated"`
+	NextMarker  string `xml:"NextMarker"`
+}
+
+// Iter calls f for each entry in the given directory. The argument to f is the full
+// object name including the prefix of the inspected directory. If the listing is
+// recursive, the names of all objects below the directory are passed to f instead.
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	b.opsTotal.WithLabelValues(opObjectsList).Inc()
+	params := objstore.ApplyIterOptions(options...)
+
+	// Ensure the object name actually ends with a dir suffix. Otherwise we'll just iterate the
+	// object itself as one prefix item.
+	if dir != "" {
+		dir = strings.TrimSuffix(dir, DirDelim) + DirDelim
+	}
+	var marker string
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		q := url.Values{
+			"prefix":    []string{dir},
+			"delimiter": []string{DirDelim},
+		}
+		if params.Recursive {
+			q.Del("delimiter")
+		}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		req, err := b.newRequest(ctx, http.MethodGet, "", q, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := b.do(req, http.StatusOK)
+		if err != nil {
+			return errors.Wrap(err, "list cos objects")
+		}
+		var res listResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return errors.Wrap(err, "decode cos object list")
+		}
+		// Objects and prefixes are listed separately but each page covers a contiguous range of names.
+		var names []string
+		for _, c := range res.Contents {
+			names = append(names, c.Key)
+		}
+		for _, p := range res.CommonPrefixes {
+			names = append(names, p.Prefix)
+		}
+		sort.Strings(names)
+
+		for _, n := range names {
+			if err := f(n); err != nil {
+				return err
+			}
+		}
+		if !res.IsTruncated {
+			return nil
+		}
+		marker = res.NextMarker
+	}
+}
+
+// Get returns a reader for the given object name.
+func (b *Bucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.opsTotal.WithLabelValues(opObjectGet).Inc()
+
+	req, err := b.newRequest(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(req, http.StatusOK)
+	if err != nil {
+		return nil, errors.Wrap(err, "get cos object")
+	}
+	return resp.Body, nil
+}
+
+// GetRange returns a new range reader for the given object name and range.
+func (b *Bucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b.opsTotal.WithLabelValues(opObjectGet).Inc()
+
+	req, err := b.newRequest(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+
+	resp, err := b.do(req, http.StatusOK, http.StatusPartialContent)
+	if err != nil {
+		return nil, errors.Wrap(err, "get cos object range")
+	}
+	return resp.Body, nil
+}
+
+// head returns the response to a HEAD Object request or nil if the object does not exist.
+func (b *Bucket) head(ctx context.Context, name string) (*http.Response, error) {
+	b.opsTotal.WithLabelValues(opObjectStat).Inc()
+
+	req, err := b.newRequest(ctx, http.MethodHead, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(req, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return nil, errors.Wrap(err, "head cos object")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+// Exists checks if the given object exists.
+func (b *Bucket) Exists(ctx context.Context, name string) (bool, error) {
+	resp, err := b.head(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	return resp != nil, nil
+}
+
+// Attributes returns information about the object with the given name.
+func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	resp, err := b.head(ctx, name)
+	if err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	if resp == nil {
+		return objstore.ObjectAttributes{}, errors.Errorf("cos object %s does not exist", name)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrap(err, "parse content length")
+	}
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrap(err, "parse last modified time")
+	}
+	return objstore.ObjectAttributes{
+		Size:         size,
+		LastModified: modified,
+		ETag:         strings.Trim(resp.Header.Get("ETag"), `"`),
+	}, nil
+}
+
+// Upload the contents of the reader as an object into the bucket.
+// Objects larger than the part size are uploaded with a multipart upload.
+func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.opsTotal.WithLabelValues(opObjectInsert).Inc()
+
+	buf := make([]byte, b.partSize)
+
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err := b.put(ctx, name, nil, buf[:n])
+		return errors.Wrap(err, "upload cos object")
+	}
+	if err != nil {
+		return errors.Wrap(err, "read upload")
+	}
+
+	uploadID, err := b.initiateMultipartUpload(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := b.uploadParts(ctx, name, uploadID, r, buf); err != nil {
+		// Abort the upload so that its parts do not linger in the bucket.
+		if req, aerr := b.newRequest(ctx, http.MethodDelete, name, url.Values{"uploadId": []string{uploadID}}, nil); aerr == nil {
+			if resp, aerr := b.do(req, http.StatusNoContent); aerr == nil {
+				resp.Body.Close()
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// initiateMultipartUpload starts a multipart upload of the object and returns its ID.
+func (b *Bucket) initiateMultipartUpload(ctx context.Context, name string) (string, error) {
+	req, err := b.newRequest(ctx, http.MethodPost, name, url.Values{"uploads": []string{""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := b.do(req, http.StatusOK)
+	if err != nil {
+		return "", errors.Wrap(err, "initiate cos multipart upload")
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", errors.Wrap(err, "decode cos multipart upload")
+	}
+	return res.UploadID, nil
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// uploadParts uploads the first part held by buf and the remainder of r as parts of the
+// multipart upload and completes it.
+func (b *Bucket) uploadParts(ctx context.Context, name, uploadID string, r io.Reader, buf []byte) error {
+	var (
+		parts []completePart
+		n     = len(buf)
+		err   error
+	)
+	for err != io.EOF {
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return errors.Wrap(err, "read upload")
+		}
+		num := len(parts) + 1
+
+		q := url.Values{"partNumber": []string{strconv.Itoa(num)}, "uploadId": []string{uploadID}}
+		etag, perr := b.put(ctx, name, q, buf[:n])
+		if perr != nil {
+			return errors.Wrapf(perr, "upload part %d of cos object", num)
+		}
+		parts = append(parts, completePart{PartNumber: num, ETag: etag})
+
+		n, err = io.ReadFull(r, buf)
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return errors.Wrap(err, "encode part list")
+	}
+	req, err := b.newRequest(ctx, http.MethodPost, name, url.Values{"uploadId": []string{uploadID}}, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req, http.StatusOK)
+	if err != nil {
+		return errors.Wrap(err, "complete cos multipart upload")
+	}
+	return resp.Body.Close()
+}
+
+// put sends a PUT request with the given body against the object and returns the ETag of
+// the written data. Without a query, the body is written as the full object.
+func (b *Bucket) put(ctx context.Context, name string, q url.Values, body []byte) (string, error) {
+	req, err := b.newRequest(ctx, http.MethodPut, name, q, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	resp, err := b.do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	return resp.Header.Get("ETag"), nil
+}
+
+// Delete removes the object with the given name.
+func (b *Bucket) Delete(ctx context.Context, name string) error {
+	b.opsTotal.WithLabelValues(opObjectDelete).Inc()
+
+	req, err := b.newRequest(ctx, http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req, http.StatusNoContent)
+	if err != nil {
+		return errors.Wrap(err, "delete cos object")
+	}
+	return resp.Body.Close()
+}
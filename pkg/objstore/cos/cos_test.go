@@ -0,0 +1,286 @@
+package cos
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/objtesting"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+const (
+	testSecretID  = "AKIDQjz3ltompVjBni5LitkWHFlFpwkn9U5q"
+	testSecretKey = "BQYIM75p8x0iWVFSIgqEKwFprpRSVHlz"
+)
+
+// fakeCOS implements the subset of the COS API used by the bucket and verifies the
+// signature of every request.
+type fakeCOS struct {
+	t *testing.T
+
+	mtx      sync.Mutex
+	objects  map[string][]byte
+	parts    map[string][]byte
+	uploads  int
+	aborted  int
+	pageSize int
+}
+
+func newFakeCOS(t *testing.T) (*fakeCOS, *httptest.Server) {
+	s := &fakeCOS{t: t, objects: map[string][]byte{}, parts: map[string][]byte{}, pageSize: 2}
+	return s, httptest.NewServer(s)
+}
+
+// verify checks the Authorization header of the request independently of the client's
+// canonicalization.
+func (s *fakeCOS) verify(r *http.Request) bool {
+	// The values contain semicolons, which url.ParseQuery rejects.
+	auth := url.Values{}
+	for _, kv := range strings.Split(r.Header.Get("Authorization"), "&") {
+		if p := strings.SplitN(kv, "=", 2); len(p) == 2 {
+			auth.Set(p[0], p[1])
+		}
+	}
+	if auth.Get("q-ak") != testSecretID || auth.Get("q-header-list") != "host" {
+		return false
+	}
+	q := r.URL.Query()
+
+	var keys, pairs []string
+	lower := map[string]string{}
+	for k := range q {
+		keys = append(keys, strings.ToLower(k))
+		lower[strings.ToLower(k)] = q.Get(k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+url.QueryEscape(lower[k]))
+	}
+	if auth.Get("q-url-param-list") != strings.Join(keys, ";") {
+		return false
+	}
+	httpString := strings.ToLower(r.Method) + "\n" + r.URL.Path + "\n" + strings.Join(pairs, "&") + "\nhost=" + url.QueryEscape(r.Host) + "\n"
+
+	return auth.Get("q-signature") == signature(testSecretKey, auth.Get("q-key-time"), httpString)
+}
+
+func (s *fakeCOS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.verify(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>SignatureDoesNotMatch</Code><Message>signature mismatch</Message></Error>`)
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	q := r.URL.Query()
+
+	if name == "" {
+		s.list(w, q.Get("prefix"), q.Get("delimiter"), q.Get("marker"))
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch r.Method {
+	case http.MethodPost:
+		if _, ok := q["uploads"]; ok {
+			s.uploads++
+			fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>upload-%d</UploadId></InitiateMultipartUploadResult>", s.uploads)
+			return
+		}
+		var list struct {
+			Parts []completePart `xml:"Part"`
+		}
+		testutil.Ok(s.t, xml.Unmarshal(body, &list))
+
+		var b []byte
+		for i, p := range list.Parts {
+			testutil.Equals(s.t, i+1, p.PartNumber)
+			part := s.parts[q.Get("uploadId")+"/"+strconv.Itoa(p.PartNumber)]
+			testutil.Equals(s.t, fmt.Sprintf(`"%x"`, md5.Sum(part)), p.ETag)
+			b = append(b, part...)
+		}
+		s.objects[name] = b
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case http.MethodPut:
+		if id := q.Get("uploadId"); id != "" {
+			s.parts[id+"/"+q.Get("partNumber")] = body
+		} else {
+			s.objects[name] = body
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+	case http.MethodDelete:
+		if q.Get("uploadId") != "" {
+			s.aborted++
+		} else {
+			delete(s.objects, name)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		b, ok := s.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Unix(1000, 0).UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(b)))
+
+		if rng := r.Header.Get("Range"); rng != "" {
+			var start, end int
+			fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+			if end >= len(b) {
+				end = len(b) - 1
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(b[start : end+1])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	}
+}
+
+// list answers GET Bucket requests with at most pageSize entries per page.
+func (s *fakeCOS) list(w http.ResponseWriter, prefix, delimiter, marker string) {
+	var names []string
+	for n := range s.objects {
+		names = append(names, n)
+	}
+	entries, truncated := objtesting.List(names, prefix, delimiter, marker, s.pageSize)
+
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult>`)
+	fmt.Fprintf(w, "<IsTruncated>%t</IsTruncated>", truncated)
+	if truncated {
+		fmt.Fprintf(w, "<NextMarker>%s</NextMarker>", entries[len(entries)-1].Name)
+	}
+	// Objects are listed before prefixes regardless of their names.
+	for _, e := range entries {
+		if !e.Prefix {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", e.Name)
+		}
+	}
+	for _, e := range entries {
+		if e.Prefix {
+			fmt.Fprintf(w, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", e.Name)
+		}
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func newTestBucket(t *testing.T, endpoint string) *Bucket {
+	bkt, err := NewBucket(&Config{
+		Bucket:    "thanos",
+		AppID:     "1250000000",
+		SecretID:  testSecretID,
+		SecretKey: testSecretKey,
+		Endpoint:  endpoint,
+	}, nil)
+	testutil.Ok(t, err)
+	return bkt
+}
+
+func TestBucket(t *testing.T) {
+	s, srv := newFakeCOS(t)
+	defer srv.Close()
+
+	bkt := newTestBucket(t, srv.URL)
+	bkt.partSize = 4
+
+	objtesting.ObjectsTest(t, bkt, func(b []byte) objstore.ObjectAttributes {
+		return objstore.ObjectAttributes{
+			Size:         int64(len(b)),
+			LastModified: time.Unix(1000, 0).UTC(),
+			ETag:         fmt.Sprintf("%x", md5.Sum(b)),
+		}
+	})
+	testutil.Equals(t, 4, s.uploads)
+
+	// Objects smaller than the part size are uploaded in a single request.
+	testutil.Ok(t, bkt.Upload(context.Background(), "small", bytes.NewReader([]byte("123"))))
+	testutil.Equals(t, 4, s.uploads)
+}
+
+func TestBucket_Acceptance(t *testing.T) {
+	_, srv := newFakeCOS(t)
+	defer srv.Close()
+
+	objtesting.AcceptanceTest(t, newTestBucket(t, srv.URL))
+}
+
+func TestBucket_AbortFailedMultipartUpload(t *testing.T) {
+	s, srv := newFakeCOS(t)
+	defer srv.Close()
+
+	bkt := newTestBucket(t, srv.URL)
+	bkt.partSize = 4
+
+	objtesting.FailedUploadTest(t, bkt)
+	testutil.Equals(t, 1, s.aborted)
+}
+
+func TestBucket_WrongKey(t *testing.T) {
+	_, srv := newFakeCOS(t)
+	defer srv.Close()
+
+	bkt, err := NewBucket(&Config{
+		Bucket:    "thanos-1250000000",
+		SecretID:  testSecretID,
+		SecretKey: "wrong",
+		Endpoint:  srv.URL,
+	}, nil)
+	testutil.Ok(t, err)
+
+	objtesting.WrongCredentialsTest(t, bkt, "SignatureDoesNotMatch")
+}
+
+func TestNewBucket_Endpoint(t *testing.T) {
+	bkt, err := NewBucket(&Config{
+		Bucket:    "thanos",
+		AppID:     "1250000000",
+		Region:    "ap-guangzhou",
+		SecretID:  testSecretID,
+		SecretKey: testSecretKey,
+	}, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "https://thanos-1250000000.cos.ap-guangzhou.myqcloud.com", bkt.endpoint.String())
+
+	// The APPID is not appended twice.
+	bkt, err = NewBucket(&Config{
+		Bucket:    "thanos-1250000000",
+		AppID:     "1250000000",
+		Region:    "ap-guangzhou",
+		SecretID:  testSecretID,
+		SecretKey: testSecretKey,
+	}, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "https://thanos-1250000000.cos.ap-guangzhou.myqcloud.com", bkt.endpoint.String())
+}
+
+func TestConfig_Validate(t *testing.T) {
+	objtesting.ValidateTest(t, []objtesting.ConfigCase{
+		{Conf: &Config{Bucket: "b", Region: "r", SecretID: "i", SecretKey: "k"}, OK: true},
+		{Conf: &Config{Bucket: "b", Endpoint: "http://cos", SecretID: "i", SecretKey: "k"}, OK: true},
+		{Conf: &Config{Region: "r", SecretID: "i", SecretKey: "k"}},
+		{Conf: &Config{Bucket: "b", SecretID: "i", SecretKey: "k"}},
+		{Conf: &Config{Bucket: "b", Region: "r", SecretKey: "k"}},
+		{Conf: &Config{Bucket: "b", Region: "r", SecretID: "i"}},
+	})
+}
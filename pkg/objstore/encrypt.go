@@ -0,0 +1,517 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Encrypted objects start with a header followed by the object's content in chunks of
+// encChunkSize bytes, each sealed with AES-GCM under a random key of the object.
+// The header layout is:
+//
+//	magic (4) | version (1) | nonce prefix (8) | wrapped key length (2) | wrapped key
+//
+// The nonce of a chunk is the prefix followed by the chunk's index, so chunks cannot be
+// reordered. Chunks are authenticated along with a flag marking the last one, so truncated
+// objects are detected.
+const (
+	encMagic         = "TENC"
+	encVersion       = 1
+	encPrefixSize    = 8
+	encHeaderMinSize = len(encMagic) + 1 + encPrefixSize + 2
+	encChunkSize     = 64 * 1024
+	encOverhead      = 16
+	encSealedSize    = encChunkSize + encOverhead
+	encKeySize       = 32
+
+	// encHeaderReadSize is the number of bytes read to get the header of an object, which
+	// suffices for keys wrapped by common key management services.
+	encHeaderReadSize = 1024
+	// encMaxCachedHeaders bounds the number of object headers kept in memory.
+	encMaxCachedHeaders = 4096
+)
+
+// KeyWrapper encrypts and decrypts the keys that objects in an encrypted bucket are encrypted
+// with, e.g. with a master key or through a key management service.
+type KeyWrapper interface {
+	// WrapKey encrypts the given data key.
+	WrapKey(ctx context.Context, key []byte) ([]byte, error)
+	// UnwrapKey decrypts a data key encrypted by WrapKey.
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// NewMasterKeyWrapper returns a KeyWrapper that encrypts data keys with the given 256 bit master
+// key using AES-GCM.
+func NewMasterKeyWrapper(key []byte) (KeyWrapper, error) {
+	if len(key) != encKeySize {
+		return nil, errors.Errorf("master key must be %d bytes long, got %d", encKeySize, len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &masterKeyWrapper{aead: aead}, nil
+}
+
+type masterKeyWrapper struct {
+	aead cipher.AEAD
+}
+
+func (w *masterKeyWrapper) WrapKey(_ context.Context, key []byte) ([]byte, error) {
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "generate nonce")
+	}
+	return w.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func (w *masterKeyWrapper) UnwrapKey(_ context.Context, wrapped []byte) ([]byte, error) {
+	n := w.aead.NonceSize()
+	if len(wrapped) < n {
+		return nil, errors.New("wrapped key too short")
+	}
+	key, err := w.aead.Open(nil, wrapped[:n], wrapped[n:], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "decrypt data key, the object may have been encrypted with a different master key")
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "create cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptedBucket wraps a bucket so that the content of objects is encrypted before it is
+// uploaded and decrypted when it is read. Every object is encrypted with its own key, which
+// is stored with the object after encrypting it with the key wrapper.
+// Object names are not encrypted. Range reads only fetch and decrypt the chunks of the object
+// that overlap with the requested range.
+func EncryptedBucket(b Bucket, keys KeyWrapper) Bucket {
+	return &encryptedBucket{
+		Bucket:  b,
+		keys:    keys,
+		headers: map[string]*encHeader{},
+	}
+}
+
+type encryptedBucket struct {
+	Bucket
+	keys KeyWrapper
+
+	mtx     sync.Mutex
+	headers map[string]*encHeader
+}
+
+// encHeader holds what is needed to decrypt an object.
+type encHeader struct {
+	size   int64
+	prefix []byte
+	aead   cipher.AEAD
+}
+
+func (b *encryptedBucket) Type() string {
+	return BackendType(b.Bucket)
+}
+
+func (b *encryptedBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	key := make([]byte, encKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return errors.Wrap(err, "generate data key")
+	}
+	wrapped, err := b.keys.WrapKey(ctx, key)
+	if err != nil {
+		return errors.Wrap(err, "wrap data key")
+	}
+	if len(wrapped) > 1<<16-1 {
+		return errors.Errorf("wrapped data key too long: %d bytes", len(wrapped))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, encPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return errors.Wrap(err, "generate nonce prefix")
+	}
+
+	hdr := make([]byte, 0, encHeaderMinSize+len(wrapped))
+	hdr = append(hdr, encMagic...)
+	hdr = append(hdr, encVersion)
+	hdr = append(hdr, prefix...)
+	hdr = append(hdr, byte(len(wrapped)>>8), byte(len(wrapped)))
+	hdr = append(hdr, wrapped...)
+
+	// The object may be replaced, so a cached header must not be used for it anymore.
+	b.mtx.Lock()
+	delete(b.headers, name)
+	b.mtx.Unlock()
+
+	return b.Bucket.Upload(ctx, name, io.MultiReader(bytes.NewReader(hdr), &encryptingReader{
+		r:      r,
+		aead:   aead,
+		prefix: prefix,
+		plain:  make([]byte, encChunkSize+1),
+	}))
+}
+
+func (b *encryptedBucket) Delete(ctx context.Context, name string) error {
+	b.mtx.Lock()
+	delete(b.headers, name)
+	b.mtx.Unlock()
+
+	return b.Bucket.Delete(ctx, name)
+}
+
+func (b *encryptedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	fixed := make([]byte, encHeaderMinSize)
+	if _, err := io.ReadFull(rc, fixed); err != nil {
+		rc.Close()
+		return nil, errors.Wrapf(err, "read encryption header of %s", name)
+	}
+	wrapped := make([]byte, int(binary.BigEndian.Uint16(fixed[encHeaderMinSize-2:])))
+	if _, err := io.ReadFull(rc, wrapped); err != nil {
+		rc.Close()
+		return nil, errors.Wrapf(err, "read encryption header of %s", name)
+	}
+	hdr, err := b.parseHeader(ctx, append(fixed, wrapped...))
+	if err != nil {
+		rc.Close()
+		return nil, errors.Wrapf(err, "parse encryption header of %s", name)
+	}
+	return &decryptingReader{
+		rc:           rc,
+		hdr:          hdr,
+		remaining:    -1,
+		requireFinal: true,
+		buf:          make([]byte, encSealedSize),
+		plain:        make([]byte, encChunkSize),
+	}, nil
+}
+
+func (b *encryptedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	hdr, cached, err := b.header(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := b.getRange(ctx, name, hdr, off, length)
+	if err == nil || !cached {
+		return rc, err
+	}
+	// The object may have been replaced since its header was cached.
+	b.mtx.Lock()
+	delete(b.headers, name)
+	b.mtx.Unlock()
+
+	if hdr, _, err = b.header(ctx, name); err != nil {
+		return nil, err
+	}
+	return b.getRange(ctx, name, hdr, off, length)
+}
+
+func (b *encryptedBucket) getRange(ctx context.Context, name string, hdr *encHeader, off, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	first, last := off/encChunkSize, (off+length-1)/encChunkSize
+
+	rc, err := b.Bucket.GetRange(ctx, name, hdr.size+first*encSealedSize, (last-first+1)*encSealedSize)
+	if err != nil {
+		return nil, err
+	}
+	r := &decryptingReader{
+		rc:        rc,
+		hdr:       hdr,
+		index:     uint32(first),
+		skip:      off - first*encChunkSize,
+		remaining: length,
+		buf:       make([]byte, encSealedSize),
+		plain:     make([]byte, encChunkSize),
+	}
+	// Decrypt the first chunk right away to verify that the header is valid for it.
+	if err := r.fill(); err != nil && err != io.EOF {
+		rc.Close()
+		return nil, errors.Wrapf(err, "decrypt %s", name)
+	}
+	return r, nil
+}
+
+func (b *encryptedBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	attrs, err := b.Bucket.Attributes(ctx, name)
+	if err != nil {
+		return attrs, err
+	}
+	hdr, _, err := b.header(ctx, name)
+	if err != nil {
+		return attrs, err
+	}
+	attrs.Size = plaintextSize(attrs.Size - hdr.size)
+	return attrs, nil
+}
+
+// plaintextSize returns the size of the content of an object from the size of its sealed chunks.
+func plaintextSize(sealed int64) int64 {
+	chunks := (sealed + encSealedSize - 1) / encSealedSize
+	return sealed - chunks*encOverhead
+}
+
+// header returns the header of the object with the given name and whether it was cached.
+func (b *encryptedBucket) header(ctx context.Context, name string) (*encHeader, bool, error) {
+	b.mtx.Lock()
+	hdr, ok := b.headers[name]
+	b.mtx.Unlock()
+
+	if ok {
+		return hdr, true, nil
+	}
+	rc, err := b.Bucket.GetRange(ctx, name, 0, encHeaderReadSize)
+	if err != nil {
+		return nil, false, err
+	}
+	buf, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "read encryption header of %s", name)
+	}
+	if len(buf) >= encHeaderMinSize {
+		// Fetch the rest of the header if the wrapped key is exceptionally long.
+		if n := encHeaderMinSize + int(binary.BigEndian.Uint16(buf[encHeaderMinSize-2:])); n > len(buf) && len(buf) == encHeaderReadSize {
+			rc, err := b.Bucket.GetRange(ctx, name, 0, int64(n))
+			if err != nil {
+				return nil, false, err
+			}
+			buf, err = ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, false, errors.Wrapf(err, "read encryption header of %s", name)
+			}
+		}
+	}
+	hdr, err = b.parseHeader(ctx, buf)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "parse encryption header of %s", name)
+	}
+
+	b.mtx.Lock()
+	if len(b.headers) >= encMaxCachedHeaders {
+		b.headers = map[string]*encHeader{}
+	}
+	b.headers[name] = hdr
+	b.mtx.Unlock()
+
+	return hdr, false, nil
+}
+
+// parseHeader parses the header at the beginning of buf and unwraps the data key in it.
+func (b *encryptedBucket) parseHeader(ctx context.Context, buf []byte) (*encHeader, error) {
+	if len(buf) < encHeaderMinSize || string(buf[:len(encMagic)]) != encMagic {
+		return nil, errors.New("object is not encrypted")
+	}
+	if v := buf[len(encMagic)]; v != encVersion {
+		return nil, errors.Errorf("unsupported encryption version %d", v)
+	}
+	size := encHeaderMinSize + int(binary.BigEndian.Uint16(buf[encHeaderMinSize-2:]))
+	if len(buf) < size {
+		return nil, errors.New("truncated encryption header")
+	}
+	key, err := b.keys.UnwrapKey(ctx, buf[encHeaderMinSize:size])
+	if err != nil {
+		return nil, errors.Wrap(err, "unwrap data key")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, encPrefixSize)
+	copy(prefix, buf[len(encMagic)+1:])
+
+	return &encHeader{size: int64(size), prefix: prefix, aead: aead}, nil
+}
+
+// chunkNonce returns the nonce of the chunk with the given index.
+func chunkNonce(prefix []byte, index uint32) []byte {
+	nonce := make([]byte, encPrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encPrefixSize:], index)
+	return nonce
+}
+
+// chunkAAD returns the additional data a chunk is authenticated with.
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptingReader encrypts the content of a reader chunk by chunk.
+type encryptingReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+
+	// plain holds a chunk and a byte read ahead of it to detect the last chunk.
+	plain  []byte
+	carry  bool
+	sealed []byte
+	out    []byte
+	done   bool
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// seal encrypts the next chunk.
+func (r *encryptingReader) seal() error {
+	start := 0
+	if r.carry {
+		start = 1
+	}
+	n, err := io.ReadFull(r.r, r.plain[start:encChunkSize])
+	n += start
+
+	final := false
+	switch err {
+	case nil:
+		// Read ahead by one byte to tell whether this is the last chunk.
+		_, err := io.ReadFull(r.r, r.plain[encChunkSize:])
+		if err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		final = true
+	default:
+		return err
+	}
+	if r.index == 1<<32-1 && !final {
+		return errors.New("object too large to encrypt")
+	}
+	r.sealed = r.aead.Seal(r.sealed[:0], chunkNonce(r.prefix, r.index), r.plain[:n], chunkAAD(final))
+	r.out = r.sealed
+	r.index++
+	r.done = final
+
+	// The byte read ahead starts the next chunk.
+	r.carry = !final
+	if r.carry {
+		r.plain[0] = r.plain[encChunkSize]
+	}
+	return nil
+}
+
+// decryptingReader decrypts sealed chunks starting at a given chunk index.
+type decryptingReader struct {
+	rc    io.ReadCloser
+	hdr   *encHeader
+	index uint32
+
+	// skip is the number of bytes to drop from the start of the first chunk.
+	skip int64
+	// remaining is the number of bytes left to return, or -1 to read up to the end.
+	remaining int64
+	// requireFinal is set if the reader must end with the object's last chunk.
+	requireFinal bool
+
+	buf   []byte
+	plain []byte
+	out   []byte
+	final bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// fill decrypts the next chunk into the output buffer.
+func (r *decryptingReader) fill() error {
+	if r.remaining == 0 {
+		return io.EOF
+	}
+	n, err := io.ReadFull(r.rc, r.buf)
+	switch err {
+	case nil, io.ErrUnexpectedEOF:
+	case io.EOF:
+		if r.requireFinal && !r.final {
+			return errors.New("encrypted object is truncated")
+		}
+		return io.EOF
+	default:
+		return err
+	}
+	if r.final {
+		return errors.New("unexpected data after the last chunk of the encrypted object")
+	}
+	nonce := chunkNonce(r.hdr.prefix, r.index)
+
+	// Only the last chunk can be short, but a full one may be last as well. Decryption
+	// must not happen in place, since a failed attempt overwrites its output.
+	var plain []byte
+	if n == encSealedSize {
+		plain, err = r.hdr.aead.Open(r.plain[:0], nonce, r.buf[:n], chunkAAD(false))
+	}
+	if n < encSealedSize || err != nil {
+		plain, err = r.hdr.aead.Open(r.plain[:0], nonce, r.buf[:n], chunkAAD(true))
+		r.final = true
+	}
+	if err != nil {
+		return errors.Wrapf(err, "decrypt chunk %d", r.index)
+	}
+	r.index++
+
+	if r.skip > 0 {
+		if r.skip > int64(len(plain)) {
+			r.skip = int64(len(plain))
+		}
+		plain = plain[r.skip:]
+		r.skip = 0
+	}
+	if r.remaining >= 0 {
+		if int64(len(plain)) > r.remaining {
+			plain = plain[:r.remaining]
+		}
+		r.remaining -= int64(len(plain))
+	}
+	r.out = plain
+	return nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.rc.Close()
+}
@@ -0,0 +1,160 @@
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/inmem"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+const chunkSize = 64 * 1024
+
+func newMasterKeyWrapper(t *testing.T, b byte) objstore.KeyWrapper {
+	kw, err := objstore.NewMasterKeyWrapper(bytes.Repeat([]byte{b}, 32))
+	testutil.Ok(t, err)
+	return kw
+}
+
+func TestEncryptedBucket_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	randr := rand.New(rand.NewSource(0))
+
+	inner := inmem.NewBucket()
+	bkt := objstore.EncryptedBucket(inner, newMasterKeyWrapper(t, 'k'))
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 5} {
+		content := make([]byte, size)
+		randr.Read(content)
+
+		testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewReader(content)))
+
+		// The content must not be stored in plain text.
+		stored := inner.Objects()["obj"]
+		if size > 16 {
+			testutil.Assert(t, !bytes.Contains(stored, content), "content of size %d stored unencrypted", size)
+		}
+
+		rc, err := bkt.Get(ctx, "obj")
+		testutil.Ok(t, err)
+		b, err := ioutil.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, content, b)
+
+		attrs, err := bkt.Attributes(ctx, "obj")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(size), attrs.Size)
+
+		// Ranges within single chunks, across chunk boundaries and beyond the end must match
+		// the respective content.
+		for _, r := range [][2]int{
+			{0, 1}, {0, size}, {1, 10}, {chunkSize - 3, 6}, {chunkSize, chunkSize},
+			{chunkSize + 1, 2 * chunkSize}, {size - 1, 10}, {size / 2, size},
+		} {
+			off, length := r[0], r[1]
+			if off < 0 || off >= size || length <= 0 {
+				continue
+			}
+			rc, err := bkt.GetRange(ctx, "obj", int64(off), int64(length))
+			testutil.Ok(t, err)
+			b, err := ioutil.ReadAll(rc)
+			testutil.Ok(t, err)
+			testutil.Ok(t, rc.Close())
+
+			end := off + length
+			if end > size {
+				end = size
+			}
+			testutil.Equals(t, content[off:end], b)
+		}
+	}
+}
+
+func TestEncryptedBucket_Tampering(t *testing.T) {
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("thanos"), chunkSize)
+
+	inner := inmem.NewBucket()
+	bkt := objstore.EncryptedBucket(inner, newMasterKeyWrapper(t, 'k'))
+	testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewReader(content)))
+
+	stored := inner.Objects()["obj"]
+
+	readAll := func(b objstore.Bucket) error {
+		rc, err := b.Get(ctx, "obj")
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = ioutil.ReadAll(rc)
+		return err
+	}
+
+	// A different master key cannot decrypt the object.
+	testutil.NotOk(t, readAll(objstore.EncryptedBucket(inner, newMasterKeyWrapper(t, 'x'))))
+
+	// Dropping the last chunk must be detected although all remaining chunks are intact.
+	truncated := stored[:len(stored)-(len(content)%chunkSize+16)]
+	testutil.Ok(t, inner.Upload(ctx, "obj", bytes.NewReader(truncated)))
+	testutil.NotOk(t, readAll(bkt))
+
+	// Modified content must be detected.
+	modified := append([]byte(nil), stored...)
+	modified[len(modified)-20] ^= 1
+	testutil.Ok(t, inner.Upload(ctx, "obj", bytes.NewReader(modified)))
+	testutil.NotOk(t, readAll(bkt))
+
+	// Unencrypted objects cannot be read.
+	testutil.Ok(t, inner.Upload(ctx, "obj", bytes.NewReader(content)))
+	testutil.NotOk(t, readAll(bkt))
+	_, err := bkt.GetRange(ctx, "obj", 0, 10)
+	testutil.NotOk(t, err)
+}
+
+func TestEncryptedBucket_ReplacedObject(t *testing.T) {
+	ctx := context.Background()
+	kw := newMasterKeyWrapper(t, 'k')
+
+	inner := inmem.NewBucket()
+	reader := objstore.EncryptedBucket(inner, kw)
+	writer := objstore.EncryptedBucket(inner, kw)
+
+	read := func() string {
+		rc, err := reader.GetRange(ctx, "obj", 0, 5)
+		testutil.Ok(t, err)
+		defer rc.Close()
+
+		b, err := ioutil.ReadAll(rc)
+		testutil.Ok(t, err)
+		return string(b)
+	}
+
+	testutil.Ok(t, writer.Upload(ctx, "obj", bytes.NewReader([]byte("first"))))
+	testutil.Equals(t, "first", read())
+
+	// The reader caches the header of the object, which is outdated once another
+	// process replaces the object.
+	testutil.Ok(t, writer.Upload(ctx, "obj", bytes.NewReader([]byte("second"))))
+	testutil.Equals(t, "secon", read())
+}
+
+func TestNewMasterKeyWrapper(t *testing.T) {
+	_, err := objstore.NewMasterKeyWrapper([]byte("short"))
+	testutil.NotOk(t, err)
+
+	kw := newMasterKeyWrapper(t, 'k')
+	wrapped, err := kw.WrapKey(context.Background(), []byte("data key"))
+	testutil.Ok(t, err)
+
+	key, err := kw.UnwrapKey(context.Background(), wrapped)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []byte("data key"), key)
+
+	_, err = newMasterKeyWrapper(t, 'x').UnwrapKey(context.Background(), wrapped)
+	testutil.NotOk(t, err)
+}
@@ -0,0 +1,4 @@
+package objstore
+
+// The rate limits are tested against a fake clock so that they do not depend on the wall clock.
+var LimitedBucketWithClock = newLimitedBucket
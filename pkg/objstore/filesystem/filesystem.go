@@ -0,0 +1,271 @@
+// Package filesystem implements common object storage abstractions against a local directory.
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/pkg/errors"
+)
+
+// tmpPrefix is the prefix of files that uploads are written to before they are renamed
+// into place. Such files are not considered objects.
+const tmpPrefix = ".thanos-upload-"
+
+// Bucket implements the store.Bucket and shipper.Bucket interfaces against a local directory,
+// e.g. an NFS mount. Directories of object names map onto directories of the filesystem.
+type Bucket struct {
+	rootDir string
+}
+
+// NewBucket returns a new Bucket rooted at the given directory, which is created if it
+// does not exist yet.
+func NewBucket(rootDir string) (*Bucket, error) {
+	if rootDir == "" {
+		return nil, errors.New("missing filesystem bucket directory")
+	}
+	absDir, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "get absolute path")
+	}
+	if err := os.MkdirAll(absDir, 0777); err != nil {
+		return nil, errors.Wrap(err, "create bucket directory")
+	}
+	return &Bucket{rootDir: absDir}, nil
+}
+
+// Type returns the type of the bucket's backend.
+func (b *Bucket) Type() string {
+	return "FILESYSTEM"
+}
+
+// path returns the filesystem path of the object. It rejects names that would escape
+// the bucket directory.
+func (b *Bucket) path(name string) (string, error) {
+	p := filepath.Join(b.rootDir, filepath.FromSlash(name))
+	if p != b.rootDir && !strings.HasPrefix(p, b.rootDir+string(filepath.Separator)) {
+		return "", errors.Errorf("object name %s is outside of the bucket", name)
+	}
+	return p, nil
+}
+
+// Iter calls f for each entry in the given directory. The argument to f is the full
+// object name including the prefix of the inspected directory. If the listing is
+// recursive, the names of all objects below the directory are passed to f instead.
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	// Ensure the object name actually ends with a dir suffix. Otherwise we'll just iterate the
+	// object itself as one prefix item.
+	if dir != "" {
+		dir = strings.TrimSuffix(dir, objstore.DirDelim) + objstore.DirDelim
+	}
+	absDir, err := b.path(dir)
+	if err != nil {
+		return err
+	}
+	names, err := listDir(absDir, dir, objstore.ApplyIterOptions(options...).Recursive)
+	if err != nil {
+		return err
+	}
+	// Object storages list directories and objects in lexicographical order of their full name.
+	sort.Strings(names)
+
+	for _, n := range names {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if err := f(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listDir returns the names of the entries of absDir, which holds the objects prefixed with
+// dir. If recursive is true, the names of the objects within subdirectories are returned
+// instead of the subdirectories.
+func listDir(absDir, dir string, recursive bool) ([]string, error) {
+	files, err := ioutil.ReadDir(absDir)
+	if os.IsNotExist(err) {
+		// Object storages have no directories, so a missing one is simply empty.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "read dir %s", absDir)
+	}
+	var names []string
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), tmpPrefix) {
+			continue
+		}
+		n := dir + fi.Name()
+		if !fi.IsDir() {
+			names = append(names, n)
+			continue
+		}
+		if !recursive {
+			names = append(names, n+objstore.DirDelim)
+			continue
+		}
+		sub, err := listDir(filepath.Join(absDir, fi.Name()), n+objstore.DirDelim, true)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, sub...)
+	}
+	return names, nil
+}
+
+// open opens the object for reading. Directories are not objects.
+func (b *Bucket) open(name string) (*os.File, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %s", name)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "stat %s", name)
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, errors.Errorf("%s is a directory", name)
+	}
+	return f, nil
+}
+
+// Get returns a reader for the given object name.
+func (b *Bucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.open(name)
+}
+
+type rangeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// GetRange returns a new range reader for the given object name and range.
+func (b *Bucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	f, err := b.open(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "seek %s", name)
+	}
+	return rangeReadCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+// Exists checks if the given object exists.
+func (b *Bucket) Exists(ctx context.Context, name string) (bool, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "stat %s", name)
+	}
+	return !fi.IsDir(), nil
+}
+
+// Attributes returns information about the object with the given name.
+// The ETag is derived from the modification time and size of the file rather than its content.
+func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrapf(err, "stat %s", name)
+	}
+	if fi.IsDir() {
+		return objstore.ObjectAttributes{}, errors.Errorf("%s is a directory", name)
+	}
+	return objstore.ObjectAttributes{
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+		ETag:         fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size()),
+	}, nil
+}
+
+// Upload writes the contents of the reader as an object into the bucket. The content is
+// written to a temporary file first and renamed into place, so readers never observe
+// partially written objects.
+func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) (err error) {
+	p, err := b.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return errors.Wrapf(err, "create dir for %s", name)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), tmpPrefix)
+	if err != nil {
+		return errors.Wrap(err, "create temporary file")
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "write %s", name)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "sync %s", name)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "close %s", name)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return errors.Wrapf(err, "rename %s", name)
+	}
+	return nil
+}
+
+// Delete removes the object with the given name. Directories that become empty are removed
+// as well, since object storages have no empty directories.
+func (b *Bucket) Delete(ctx context.Context, name string) error {
+	p, err := b.path(name)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return errors.Wrapf(err, "stat %s", name)
+	}
+	if fi.IsDir() {
+		return errors.Errorf("%s is a directory", name)
+	}
+	if err := os.Remove(p); err != nil {
+		return errors.Wrapf(err, "delete %s", name)
+	}
+	for dir := filepath.Dir(p); dir != b.rootDir; dir = filepath.Dir(dir) {
+		// Removing fails for directories that are not empty, which ends the cleanup.
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
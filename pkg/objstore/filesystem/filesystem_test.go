@@ -0,0 +1,150 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/objtesting"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+	"github.com/pkg/errors"
+)
+
+func TestBucket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesystem-bucket")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	bkt, err := NewBucket(filepath.Join(dir, "bucket"))
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+
+	for _, n := range []string{"a/1", "a/2", "b/c/1", "c"} {
+		testutil.Ok(t, bkt.Upload(ctx, n, bytes.NewReader([]byte("content of "+n))))
+	}
+	// Leftovers of interrupted uploads are not objects.
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(dir, "bucket", "a", tmpPrefix+"123"), []byte("partial"), 0666))
+
+	var names []string
+	testutil.Ok(t, bkt.Iter(ctx, "", func(n string) error {
+		names = append(names, n)
+		return nil
+	}))
+	testutil.Equals(t, []string{"a/", "b/", "c"}, names)
+
+	names = names[:0]
+	testutil.Ok(t, bkt.Iter(ctx, "a", func(n string) error {
+		names = append(names, n)
+		return nil
+	}))
+	testutil.Equals(t, []string{"a/1", "a/2"}, names)
+
+	names = names[:0]
+	testutil.Ok(t, bkt.Iter(ctx, "", func(n string) error {
+		names = append(names, n)
+		return nil
+	}, objstore.WithRecursiveIter()))
+	testutil.Equals(t, []string{"a/1", "a/2", "b/c/1", "c"}, names)
+
+	testutil.Ok(t, bkt.Iter(ctx, "missing/", func(n string) error {
+		return errors.Errorf("unexpected entry %s", n)
+	}))
+
+	rc, err := bkt.Get(ctx, "a/1")
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "content of a/1", string(b))
+
+	rc, err = bkt.GetRange(ctx, "a/1", 3, 4)
+	testutil.Ok(t, err)
+	b, err = ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "tent", string(b))
+
+	// Uploads replace existing objects.
+	testutil.Ok(t, bkt.Upload(ctx, "c", bytes.NewReader([]byte("new content"))))
+
+	attrs, err := bkt.Attributes(ctx, "c")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(11), attrs.Size)
+
+	_, err = bkt.Get(ctx, "a")
+	testutil.NotOk(t, err)
+	_, err = bkt.Get(ctx, "../outside")
+	testutil.NotOk(t, err)
+
+	ok, err := bkt.Exists(ctx, "a")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "directory reported as object")
+
+	ok, err = bkt.Exists(ctx, "b/c/1")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "object b/c/1 not found")
+
+	testutil.Ok(t, bkt.Delete(ctx, "b/c/1"))
+
+	ok, err = bkt.Exists(ctx, "b/c/1")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "object b/c/1 not deleted")
+
+	testutil.NotOk(t, bkt.Delete(ctx, "b/c/1"))
+
+	// Directories left empty are removed along with the object.
+	names = names[:0]
+	testutil.Ok(t, bkt.Iter(ctx, "", func(n string) error {
+		names = append(names, n)
+		return nil
+	}))
+	testutil.Equals(t, []string{"a/", "c"}, names)
+}
+
+func TestBucket_UploadFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesystem-bucket")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	bkt, err := NewBucket(dir)
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+
+	testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewReader([]byte("old"))))
+	testutil.NotOk(t, bkt.Upload(ctx, "obj", &failingReader{}))
+
+	// A failed upload neither changes the object nor leaves temporary files behind.
+	rc, err := bkt.Get(ctx, "obj")
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "old", string(b))
+
+	files, err := ioutil.ReadDir(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(files))
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestBucket_Acceptance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesystem-bucket")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	bkt, err := NewBucket(filepath.Join(dir, "bucket"))
+	testutil.Ok(t, err)
+
+	objtesting.AcceptanceTest(t, bkt)
+}
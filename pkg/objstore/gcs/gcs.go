@@ -3,12 +3,21 @@ package gcs
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"io"
+	"net/http"
 	"strings"
 
 	"cloud.google.com/go/storage"
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
 const (
@@ -28,14 +37,52 @@ const DirDelim = "/"
 
 // Bucket implements the store.Bucket and shipper.Bucket interfaces against GCS.
 type Bucket struct {
-	bkt      *storage.BucketHandle
-	opsTotal *prometheus.CounterVec
+	bkt       *storage.BucketHandle
+	chunkSize int
+	opsTotal  *prometheus.CounterVec
+}
+
+// NewClient returns a new GCS client. If serviceAccount holds the JSON key of a service account,
+// the client authenticates with it and may only read and write objects. Otherwise Application
+// Default Credentials are used. Connections are based on tlsConfig, which may be nil, and the
+// client's connection pool and TLS settings are tuned by transport.
+func NewClient(ctx context.Context, serviceAccount []byte, transport objstore.TransportConfig, tlsConfig *tls.Config) (*storage.Client, error) {
+	var ts oauth2.TokenSource
+
+	if len(serviceAccount) > 0 {
+		conf, err := google.JWTConfigFromJSON(serviceAccount, storage.ScopeReadWrite)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse service account key")
+		}
+		ts = conf.TokenSource(ctx)
+	}
+	if tlsConfig == nil && !transport.IsSet() {
+		if ts == nil {
+			return storage.NewClient(ctx)
+		}
+		return storage.NewClient(ctx, option.WithTokenSource(ts))
+	}
+
+	// A custom HTTP client replaces the client's authentication, which must be added to
+	// its transport instead.
+	if ts == nil {
+		var err error
+		if ts, err = google.DefaultTokenSource(ctx, storage.ScopeFullControl); err != nil {
+			return nil, errors.Wrap(err, "find default credentials")
+		}
+	}
+	return storage.NewClient(ctx, option.WithHTTPClient(&http.Client{
+		Transport: &oauth2.Transport{Source: ts, Base: transport.NewTransport(tlsConfig)},
+	}))
 }
 
 // NewBucket returns a new Bucket against the given bucket handle.
-func NewBucket(name string, b *storage.BucketHandle, reg prometheus.Registerer) *Bucket {
+// Uploads are buffered and sent in chunks of chunkSize bytes. Each concurrent upload holds
+// one chunk in memory. If chunkSize is zero, the client's default of 16MiB is used.
+func NewBucket(name string, b *storage.BucketHandle, chunkSize int, reg prometheus.Registerer) *Bucket {
 	bkt := &Bucket{
-		bkt: b,
+		bkt:       b,
+		chunkSize: chunkSize,
 		opsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name:        "thanos_objstore_gcs_bucket_operations_total",
 			Help:        "Total number of operations that were executed against a Google Compute Storage bucket.",
@@ -49,18 +96,23 @@ func NewBucket(name string, b *storage.BucketHandle, reg prometheus.Registerer)
 }
 
 // Iter calls f for each entry in the given directory. The argument to f is the full
-// object name including the prefix of the inspected directory.
-func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+// object name including the prefix of the inspected directory. If the listing is
+// recursive, the names of all objects below the directory are passed to f instead.
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
 	b.opsTotal.WithLabelValues(opObjectsList).Inc()
 	// Ensure the object name actually ends with a dir suffix. Otherwise we'll just iterate the
 	// object itself as one prefix item.
 	if dir != "" {
 		dir = strings.TrimSuffix(dir, DirDelim) + DirDelim
 	}
-	it := b.bkt.Objects(ctx, &storage.Query{
+	q := &storage.Query{
 		Prefix:    dir,
 		Delimiter: DirDelim,
-	})
+	}
+	if objstore.ApplyIterOptions(options...).Recursive {
+		q.Delimiter = ""
+	}
+	it := b.bkt.Objects(ctx, q)
 	for {
 		select {
 		case <-ctx.Done():
@@ -92,6 +144,11 @@ func (b *Bucket) GetRange(ctx context.Context, name string, off, length int64) (
 	return b.bkt.Object(name).NewRangeReader(ctx, off, length)
 }
 
+// Type returns the type of the bucket's backend.
+func (b *Bucket) Type() string {
+	return "GCS"
+}
+
 // Handle returns the underlying GCS bucket handle.
 // Used for testing purposes (we return handle, so it is not instrumented).
 func (b *Bucket) Handle() *storage.BucketHandle {
@@ -110,11 +167,30 @@ func (b *Bucket) Exists(ctx context.Context, name string) (bool, error) {
 	return false, nil
 }
 
+// Attributes returns information about the object with the given name.
+// GCS ETags are not exposed by the client, so the hex-encoded MD5 hash of the object is used.
+func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	b.opsTotal.WithLabelValues(opObjectGet).Inc()
+
+	attrs, err := b.bkt.Object(name).Attrs(ctx)
+	if err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	return objstore.ObjectAttributes{
+		Size:         attrs.Size,
+		LastModified: attrs.Updated,
+		ETag:         hex.EncodeToString(attrs.MD5),
+	}, nil
+}
+
 // Upload writes the file specified in src to remote GCS location specified as target.
 func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
 	b.opsTotal.WithLabelValues(opObjectInsert).Inc()
 
 	w := b.bkt.Object(name).NewWriter(ctx)
+	if b.chunkSize > 0 {
+		w.ChunkSize = b.chunkSize
+	}
 
 	if _, err := io.Copy(w, r); err != nil {
 		return err
@@ -128,3 +204,10 @@ func (b *Bucket) Delete(ctx context.Context, name string) error {
 
 	return b.bkt.Object(name).Delete(ctx)
 }
+
+// IsRetryableErr returns true if the error was caused by rate limiting or a server-side
+// failure of GCS.
+func (b *Bucket) IsRetryableErr(err error) bool {
+	e, ok := errors.Cause(err).(*googleapi.Error)
+	return ok && (e.Code == http.StatusTooManyRequests || e.Code >= http.StatusInternalServerError)
+}
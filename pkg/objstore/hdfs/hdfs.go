@@ -0,0 +1,527 @@
+// Package hdfs implements common object storage abstractions against the Hadoop Distributed
+// File System through its WebHDFS REST API.
+package hdfs
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	opListStatus    = "LISTSTATUS"
+	opOpen          = "OPEN"
+	opGetFileStatus = "GETFILESTATUS"
+	opCreate        = "CREATE"
+	opRename        = "RENAME"
+	opDelete        = "DELETE"
+)
+
+// DirDelim is the delimiter used to model a directory structure in an object store bucket.
+const DirDelim = "/"
+
+// tmpPrefix is the prefix of files that uploads are written to before they are renamed
+// into place. Such files are not considered objects.
+const tmpPrefix = ".thanos-upload-"
+
+// Config encapsulates the necessary config values to instantiate a WebHDFS client.
+type Config struct {
+	// Endpoint is the WebHDFS address of the NameNode or of an HttpFS gateway, e.g.
+	// namenode:9870. HTTP is used unless a scheme is given.
+	Endpoint string `yaml:"endpoint"`
+	// Directory is the absolute path of the HDFS directory that objects are stored under.
+	Directory string `yaml:"directory"`
+	// User is the user to act as on clusters using simple authentication.
+	User string `yaml:"user"`
+	// DelegationTokenFile is the path of a file holding a delegation token to authenticate
+	// with on clusters secured by Kerberos, e.g. as written by `hdfs fetchdt`. The file is
+	// read again whenever it changes, so the token can be renewed or replaced externally.
+	DelegationTokenFile string `yaml:"delegation_token_file"`
+	// TLSConfig is the TLS policy of HTTPS connections to the NameNode and DataNodes, e.g.
+	// to enforce a minimum TLS version. It cannot be set through YAML.
+	TLSConfig *tls.Config `yaml:"-"`
+	// HTTPConfig tunes the connection pool of the client. Its TLS settings take precedence
+	// over TLSConfig.
+	HTTPConfig objstore.TransportConfig `yaml:"http_config"`
+}
+
+// Validate checks to see if any of the HDFS config options are set.
+func (conf *Config) Validate() error {
+	switch {
+	case conf.Endpoint == "":
+		return errors.New("insufficient hdfs configuration information: missing endpoint")
+	case conf.Directory == "":
+		return errors.New("insufficient hdfs configuration information: missing directory")
+	case !path.IsAbs(conf.Directory):
+		return errors.Errorf("hdfs directory %s is not an absolute path", conf.Directory)
+	case conf.User != "" && conf.DelegationTokenFile != "":
+		return errors.New("hdfs user and delegation token file must not be configured together")
+	}
+	return conf.HTTPConfig.Validate()
+}
+
+// Bucket implements the store.Bucket and shipper.Bucket interfaces against a directory in HDFS.
+type Bucket struct {
+	client    *http.Client
+	endpoint  *url.URL
+	dir       string
+	user      string
+	tokenFile string
+	opsTotal  *prometheus.CounterVec
+
+	mtx           sync.Mutex
+	token         string
+	tokenModified time.Time
+}
+
+// NewBucket returns a new Bucket using the provided HDFS config values.
+func NewBucket(conf *Config, reg prometheus.Registerer) (*Bucket, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	endpoint := conf.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse hdfs endpoint %s", conf.Endpoint)
+	}
+
+	bkt := &Bucket{
+		// Redirects to DataNodes are followed explicitly since the content of uploads must
+		// only be sent to the DataNode.
+		client: &http.Client{
+			Transport: conf.HTTPConfig.NewTransport(conf.TLSConfig),
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		endpoint:  u,
+		dir:       path.Clean(conf.Directory),
+		user:      conf.User,
+		tokenFile: conf.DelegationTokenFile,
+		opsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_objstore_hdfs_bucket_operations_total",
+			Help:        "Total number of operations that were executed against an HDFS directory.",
+			ConstLabels: prometheus.Labels{"bucket": conf.Directory},
+		}, []string{"operation"}),
+	}
+	if _, err := bkt.delegationToken(); err != nil {
+		return nil, err
+	}
+	if reg != nil {
+		reg.MustRegister(bkt.opsTotal)
+	}
+	return bkt, nil
+}
+
+// Type returns the type of the bucket's backend.
+func (b *Bucket) Type() string {
+	return "HDFS"
+}
+
+// delegationToken returns the token of the delegation token file, which is read again if it
+// was modified. It returns an empty token if no file is configured.
+func (b *Bucket) delegationToken() (string, error) {
+	if b.tokenFile == "" {
+		return "", nil
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	fi, err := os.Stat(b.tokenFile)
+	if err != nil {
+		return "", errors.Wrap(err, "stat hdfs delegation token file")
+	}
+	if b.token != "" && fi.ModTime().Equal(b.tokenModified) {
+		return b.token, nil
+	}
+	t, err := ioutil.ReadFile(b.tokenFile)
+	if err != nil {
+		return "", errors.Wrap(err, "read hdfs delegation token file")
+	}
+	if b.token = strings.TrimSpace(string(t)); b.token == "" {
+		return "", errors.Errorf("hdfs delegation token file %s is empty", b.tokenFile)
+	}
+	b.tokenModified = fi.ModTime()
+
+	return b.token, nil
+}
+
+// newRequest returns a new request of the WebHDFS operation against the object or directory
+// with the given name, which is relative to the bucket's directory.
+func (b *Bucket) newRequest(ctx context.Context, method, name, op string, q url.Values, body io.Reader) (*http.Request, error) {
+	token, err := b.delegationToken()
+	if err != nil {
+		return nil, err
+	}
+	if q == nil {
+		q = url.Values{}
+	}
+	q.Set("op", op)
+	if token != "" {
+		q.Set("delegation", token)
+	} else if b.user != "" {
+		q.Set("user.name", b.user)
+	}
+	u := *b.endpoint
+	u.Path = "/webhdfs/v1" + b.path(name)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(ctx), nil
+}
+
+// path returns the absolute HDFS path of the object or directory with the given name.
+func (b *Bucket) path(name string) string {
+	return path.Join(b.dir, name)
+}
+
+// redirect returns a new request that follows the redirect of the response. The redirect's
+// location carries the authentication of the original request.
+func redirect(ctx context.Context, resp *http.Response, method string, body io.Reader) (*http.Request, error) {
+	loc, err := resp.Location()
+	if err != nil {
+		return nil, errors.Wrap(err, "get redirect location")
+	}
+	req, err := http.NewRequest(method, loc.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(ctx), nil
+}
+
+// do sends the request. It returns an error if the response status is not among the given ones.
+func (b *Bucket) do(req *http.Request, status ...int) (*http.Response, error) {
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range status {
+		if resp.StatusCode == s {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+
+	var e struct {
+		RemoteException struct {
+			Exception string `json:"exception"`
+			Message   string `json:"message"`
+		} `json:"RemoteException"`
+	}
+	if body, err := ioutil.ReadAll(resp.Body); err == nil && len(body) > 0 {
+		json.Unmarshal(body, &e)
+	}
+	if e.RemoteException.Exception == "" {
+		e.RemoteException.Exception = resp.Status
+	}
+	return nil, errors.Errorf("%s %s: %s %s", req.Method, req.URL.Path, e.RemoteException.Exception, e.RemoteException.Message)
+}
+
+// fileStatus describes a file or directory in WebHDFS responses.
+type fileStatus struct {
+	PathSuffix string `json:"pathSuffix"`
+	Type       string `json:"type"`
+	Length     int64  `json:"length"`
+	// ModificationTime is in milliseconds since the epoch.
+	ModificationTime int64 `json:"modificationTime"`
+}
+
+// Iter calls f for each entry in the given directory. The argument to f is the full
+// object name including the prefix of the inspected directory. If the listing is
+// recursive, the names of all objects below the directory are passed to f instead.
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	// Ensure the object name actually ends with a dir suffix. Otherwise we'll just iterate the
+	// object itself as one prefix item.
+	if dir != "" {
+		dir = strings.TrimSuffix(dir, DirDelim) + DirDelim
+	}
+	names, err := b.list(ctx, dir, objstore.ApplyIterOptions(options...).Recursive)
+	if err != nil {
+		return err
+	}
+	// Object storages list directories and objects in lexicographical order of their full name.
+	sort.Strings(names)
+
+	for _, n := range names {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if err := f(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list returns the names of the entries of dir, which is empty or ends with DirDelim. If
+// recursive is true, the names of the objects within subdirectories are returned instead
+// of the subdirectories.
+func (b *Bucket) list(ctx context.Context, dir string, recursive bool) ([]string, error) {
+	b.opsTotal.WithLabelValues(opListStatus).Inc()
+
+	req, err := b.newRequest(ctx, http.MethodGet, dir, opListStatus, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(req, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return nil, errors.Wrap(err, "list hdfs directory")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		// Object storages have no directories, so a missing one is simply empty.
+		return nil, nil
+	}
+	var res struct {
+		FileStatuses struct {
+			FileStatus []fileStatus `json:"FileStatus"`
+		} `json:"FileStatuses"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, errors.Wrap(err, "decode hdfs directory listing")
+	}
+
+	var names []string
+	for _, st := range res.FileStatuses.FileStatus {
+		// Listing a file returns the file itself without a suffix. Files are no directories though.
+		if st.PathSuffix == "" || strings.HasPrefix(st.PathSuffix, tmpPrefix) {
+			continue
+		}
+		name := dir + st.PathSuffix
+
+		if st.Type != "DIRECTORY" {
+			names = append(names, name)
+			continue
+		}
+		if !recursive {
+			names = append(names, name+DirDelim)
+			continue
+		}
+		sub, err := b.list(ctx, name+DirDelim, true)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, sub...)
+	}
+	return names, nil
+}
+
+// open returns a reader for the given object name. The query selects the range to read.
+func (b *Bucket) open(ctx context.Context, name string, q url.Values) (io.ReadCloser, error) {
+	b.opsTotal.WithLabelValues(opOpen).Inc()
+
+	req, err := b.newRequest(ctx, http.MethodGet, name, opOpen, q, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(req, http.StatusOK, http.StatusTemporaryRedirect)
+	if err != nil {
+		return nil, errors.Wrap(err, "open hdfs file")
+	}
+	// Gateways like HttpFS serve the content themselves instead of redirecting to a DataNode.
+	if resp.StatusCode == http.StatusOK {
+		return resp.Body, nil
+	}
+	resp.Body.Close()
+
+	if req, err = redirect(ctx, resp, http.MethodGet, nil); err != nil {
+		return nil, err
+	}
+	if resp, err = b.do(req, http.StatusOK); err != nil {
+		return nil, errors.Wrap(err, "read hdfs file")
+	}
+	return resp.Body, nil
+}
+
+// Get returns a reader for the given object name.
+func (b *Bucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.open(ctx, name, nil)
+}
+
+// GetRange returns a new range reader for the given object name and range.
+func (b *Bucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	return b.open(ctx, name, url.Values{
+		"offset": []string{fmt.Sprint(off)},
+		"length": []string{fmt.Sprint(length)},
+	})
+}
+
+// stat returns the status of the file or directory with the given name or nil if it does not exist.
+func (b *Bucket) stat(ctx context.Context, name string) (*fileStatus, error) {
+	b.opsTotal.WithLabelValues(opGetFileStatus).Inc()
+
+	req, err := b.newRequest(ctx, http.MethodGet, name, opGetFileStatus, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(req, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return nil, errors.Wrap(err, "stat hdfs file")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	var res struct {
+		FileStatus fileStatus `json:"FileStatus"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, errors.Wrap(err, "decode hdfs file status")
+	}
+	return &res.FileStatus, nil
+}
+
+// Exists checks if the given object exists.
+func (b *Bucket) Exists(ctx context.Context, name string) (bool, error) {
+	st, err := b.stat(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	return st != nil && st.Type == "FILE", nil
+}
+
+// Attributes returns information about the object with the given name.
+// The ETag is derived from the modification time and size of the file rather than its content.
+func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	st, err := b.stat(ctx, name)
+	if err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	if st == nil || st.Type != "FILE" {
+		return objstore.ObjectAttributes{}, errors.Errorf("hdfs file %s does not exist", name)
+	}
+	return objstore.ObjectAttributes{
+		Size:         st.Length,
+		LastModified: time.Unix(0, st.ModificationTime*int64(time.Millisecond)),
+		ETag:         fmt.Sprintf("%x-%x", st.ModificationTime, st.Length),
+	}, nil
+}
+
+// Upload writes the contents of the reader as an object into the bucket. The content is
+// written to a temporary file first and renamed into place, so readers never observe
+// partially written objects.
+func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.opsTotal.WithLabelValues(opCreate).Inc()
+
+	tmp := path.Join(path.Dir(name), fmt.Sprintf("%s%s-%x", tmpPrefix, path.Base(name), rand.Int63()))
+
+	// The NameNode redirects the creation to the DataNode that the content is sent to.
+	req, err := b.newRequest(ctx, http.MethodPut, tmp, opCreate, url.Values{"overwrite": []string{"true"}}, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req, http.StatusTemporaryRedirect)
+	if err != nil {
+		return errors.Wrap(err, "create hdfs file")
+	}
+	resp.Body.Close()
+
+	if req, err = redirect(ctx, resp, http.MethodPut, r); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	if resp, err = b.do(req, http.StatusCreated); err != nil {
+		// Cleanup with an uncancelable context, the upload may have been canceled.
+		b.remove(context.Background(), tmp)
+		return errors.Wrap(err, "write hdfs file")
+	}
+	resp.Body.Close()
+
+	if err := b.rename(ctx, tmp, name); err != nil {
+		b.remove(context.Background(), tmp)
+		return err
+	}
+	return nil
+}
+
+// rename moves the file src to dst, replacing an existing file.
+func (b *Bucket) rename(ctx context.Context, src, dst string) error {
+	for i := 0; i < 2; i++ {
+		ok, err := b.booleanOp(ctx, http.MethodPut, src, opRename, url.Values{"destination": []string{b.path(dst)}})
+		if err != nil {
+			return errors.Wrap(err, "rename hdfs file")
+		}
+		if ok {
+			return nil
+		}
+		// Renaming does not replace existing files, so the previous object is deleted first.
+		if _, err := b.remove(ctx, dst); err != nil {
+			return errors.Wrap(err, "delete replaced hdfs file")
+		}
+	}
+	return errors.Errorf("rename hdfs file %s to %s failed", src, dst)
+}
+
+// remove deletes the file or empty directory with the given name. It returns false if it
+// does not exist.
+func (b *Bucket) remove(ctx context.Context, name string) (bool, error) {
+	return b.booleanOp(ctx, http.MethodDelete, name, opDelete, url.Values{"recursive": []string{"false"}})
+}
+
+// booleanOp executes a WebHDFS operation whose result is a boolean.
+func (b *Bucket) booleanOp(ctx context.Context, method, name, op string, q url.Values) (bool, error) {
+	req, err := b.newRequest(ctx, method, name, op, q, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := b.do(req, http.StatusOK)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Boolean bool `json:"boolean"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return false, errors.Wrapf(err, "decode %s result", op)
+	}
+	return res.Boolean, nil
+}
+
+// Delete removes the object with the given name. Directories left empty are removed as well.
+func (b *Bucket) Delete(ctx context.Context, name string) error {
+	b.opsTotal.WithLabelValues(opDelete).Inc()
+
+	ok, err := b.remove(ctx, name)
+	if err != nil {
+		return errors.Wrap(err, "delete hdfs file")
+	}
+	if !ok {
+		return errors.Errorf("hdfs file %s does not exist", name)
+	}
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		// Removing fails for directories that are not empty, which ends the cleanup.
+		if ok, err := b.remove(ctx, dir); err != nil || !ok {
+			break
+		}
+	}
+	return nil
+}
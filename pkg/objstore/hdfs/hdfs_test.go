@@ -0,0 +1,276 @@
+package hdfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore/objtesting"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+// fakeWebHDFS implements the subset of the WebHDFS API used by the bucket. Reads and writes
+// are redirected to a fake DataNode, which is served by the same server.
+type fakeWebHDFS struct {
+	t *testing.T
+	// auth is the expected authentication parameter of every request.
+	auth string
+
+	mtx   sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+}
+
+func newFakeWebHDFS(t *testing.T, auth string) (*fakeWebHDFS, *httptest.Server) {
+	s := &fakeWebHDFS{t: t, auth: auth, files: map[string][]byte{}, dirs: map[string]bool{"/": true}}
+	return s, httptest.NewServer(s)
+}
+
+func remoteException(w http.ResponseWriter, code int, exception, msg string) {
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"RemoteException":{"exception":%q,"javaClassName":"java.io.%s","message":%q}}`, exception, exception, msg)
+}
+
+// mkdirs creates the directory p along with its parents.
+func (s *fakeWebHDFS) mkdirs(p string) {
+	for ; p != "/"; p = path.Dir(p) {
+		s.dirs[p] = true
+	}
+}
+
+// entries returns the status of the direct entries of the directory p.
+func (s *fakeWebHDFS) entries(p string) []fileStatus {
+	var res []fileStatus
+	for f, b := range s.files {
+		if path.Dir(f) == p {
+			res = append(res, fileStatus{PathSuffix: path.Base(f), Type: "FILE", Length: int64(len(b)), ModificationTime: 1500000000000})
+		}
+	}
+	for d := range s.dirs {
+		if d != "/" && path.Dir(d) == p {
+			res = append(res, fileStatus{PathSuffix: path.Base(d), Type: "DIRECTORY"})
+		}
+	}
+	return res
+}
+
+func (s *fakeWebHDFS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	q := r.URL.Query()
+	if q.Get("user.name")+q.Get("delegation") != s.auth || (q.Get("user.name") != "" && q.Get("delegation") != "") {
+		remoteException(w, http.StatusUnauthorized, "SecurityException", "authentication failed")
+		return
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/webhdfs/v1")
+	op := q.Get("op")
+
+	switch op {
+	case opListStatus:
+		var statuses []fileStatus
+		if b, ok := s.files[p]; ok {
+			statuses = []fileStatus{{Type: "FILE", Length: int64(len(b))}}
+		} else if s.dirs[p] {
+			statuses = s.entries(p)
+		} else {
+			remoteException(w, http.StatusNotFound, "FileNotFoundException", "File "+p+" does not exist.")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"FileStatuses": map[string]interface{}{"FileStatus": statuses}})
+	case opGetFileStatus:
+		st := fileStatus{Type: "DIRECTORY"}
+		if b, ok := s.files[p]; ok {
+			st = fileStatus{Type: "FILE", Length: int64(len(b)), ModificationTime: 1500000000000}
+		} else if !s.dirs[p] {
+			remoteException(w, http.StatusNotFound, "FileNotFoundException", "File does not exist: "+p)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"FileStatus": st})
+	case opOpen, opCreate:
+		if q.Get("datanode") == "" {
+			q.Set("datanode", "true")
+			w.Header().Set("Location", "http://"+r.Host+r.URL.Path+"?"+q.Encode())
+			w.WriteHeader(http.StatusTemporaryRedirect)
+			return
+		}
+		if op == opCreate {
+			testutil.Equals(s.t, "true", q.Get("overwrite"))
+			b, err := ioutil.ReadAll(r.Body)
+			testutil.Ok(s.t, err)
+
+			s.mkdirs(path.Dir(p))
+			s.files[p] = b
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		b, ok := s.files[p]
+		if !ok {
+			remoteException(w, http.StatusNotFound, "FileNotFoundException", "File does not exist: "+p)
+			return
+		}
+		off, _ := strconv.Atoi(q.Get("offset"))
+		if off > len(b) {
+			remoteException(w, http.StatusForbidden, "IOException", "Offset out of the range")
+			return
+		}
+		b = b[off:]
+		if l := q.Get("length"); l != "" {
+			if n, _ := strconv.Atoi(l); n < len(b) {
+				b = b[:n]
+			}
+		}
+		w.Write(b)
+	case opRename:
+		dst := q.Get("destination")
+		_, exists := s.files[dst]
+		b, ok := s.files[p]
+		if ok && !exists && s.dirs[path.Dir(dst)] {
+			delete(s.files, p)
+			s.files[dst] = b
+		}
+		fmt.Fprintf(w, `{"boolean":%t}`, ok && !exists)
+	case opDelete:
+		testutil.Equals(s.t, "false", q.Get("recursive"))
+		if _, ok := s.files[p]; ok {
+			delete(s.files, p)
+		} else if !s.dirs[p] {
+			fmt.Fprint(w, `{"boolean":false}`)
+			return
+		} else if len(s.entries(p)) > 0 {
+			remoteException(w, http.StatusForbidden, "PathIsNotEmptyDirectoryException", p+" is non empty")
+			return
+		} else {
+			delete(s.dirs, p)
+		}
+		fmt.Fprint(w, `{"boolean":true}`)
+	default:
+		remoteException(w, http.StatusBadRequest, "IllegalArgumentException", "Invalid value for webhdfs parameter \"op\"")
+	}
+}
+
+func TestBucket_Acceptance(t *testing.T) {
+	s, srv := newFakeWebHDFS(t, "thanos")
+	defer srv.Close()
+
+	bkt, err := NewBucket(&Config{Endpoint: srv.URL, Directory: "/thanos", User: "thanos"}, nil)
+	testutil.Ok(t, err)
+
+	objtesting.AcceptanceTest(t, bkt)
+
+	// Temporary files of uploads must be renamed into place.
+	for p := range s.files {
+		testutil.Assert(t, !strings.Contains(p, tmpPrefix), "temporary file %s left behind", p)
+	}
+}
+
+func TestBucket_Upload(t *testing.T) {
+	s, srv := newFakeWebHDFS(t, "thanos")
+	defer srv.Close()
+
+	bkt, err := NewBucket(&Config{Endpoint: strings.TrimPrefix(srv.URL, "http://"), Directory: "/data/thanos/", User: "thanos"}, nil)
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+	testutil.Ok(t, bkt.Upload(ctx, "block/index", strings.NewReader("index")))
+	testutil.Equals(t, map[string][]byte{"/data/thanos/block/index": []byte("index")}, s.files)
+
+	// Existing objects are replaced.
+	testutil.Ok(t, bkt.Upload(ctx, "block/index", strings.NewReader("index2")))
+	testutil.Equals(t, map[string][]byte{"/data/thanos/block/index": []byte("index2")}, s.files)
+
+	// Files being uploaded are not listed as objects.
+	s.files["/data/thanos/block/"+tmpPrefix+"meta.json-1"] = []byte("{}")
+	var names []string
+	testutil.Ok(t, bkt.Iter(ctx, "block", func(n string) error {
+		names = append(names, n)
+		return nil
+	}))
+	testutil.Equals(t, []string{"block/index"}, names)
+
+	attrs, err := bkt.Attributes(ctx, "block/index")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(6), attrs.Size)
+	testutil.Equals(t, time.Unix(1500000000, 0), attrs.LastModified)
+
+	// Directories are not objects.
+	_, err = bkt.Attributes(ctx, "block")
+	testutil.NotOk(t, err)
+
+	// Deleting the last object keeps the bucket's directory.
+	delete(s.files, "/data/thanos/block/"+tmpPrefix+"meta.json-1")
+	testutil.Ok(t, bkt.Delete(ctx, "block/index"))
+	testutil.Assert(t, s.dirs["/data/thanos"], "bucket directory deleted")
+	testutil.Assert(t, !s.dirs["/data/thanos/block"], "empty directory not deleted")
+
+	testutil.NotOk(t, bkt.Delete(ctx, "block/index"))
+}
+
+func TestBucket_DelegationToken(t *testing.T) {
+	s, srv := newFakeWebHDFS(t, "token-1")
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "hdfs-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	_, err = NewBucket(&Config{Endpoint: srv.URL, Directory: "/thanos", DelegationTokenFile: tokenFile}, nil)
+	testutil.NotOk(t, err)
+
+	testutil.Ok(t, ioutil.WriteFile(tokenFile, []byte("token-1\n"), 0600))
+	bkt, err := NewBucket(&Config{Endpoint: srv.URL, Directory: "/thanos", DelegationTokenFile: tokenFile}, nil)
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+	testutil.Ok(t, bkt.Upload(ctx, "obj", strings.NewReader("content")))
+
+	// A replaced token is picked up without restarting.
+	s.mtx.Lock()
+	s.auth = "token-2"
+	s.mtx.Unlock()
+	testutil.NotOk(t, bkt.Upload(ctx, "obj", strings.NewReader("content")))
+
+	testutil.Ok(t, ioutil.WriteFile(tokenFile, []byte("token-2"), 0600))
+	testutil.Ok(t, os.Chtimes(tokenFile, time.Now(), time.Now().Add(time.Minute)))
+
+	rc, err := bkt.Get(ctx, "obj")
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "content", string(b))
+}
+
+func TestBucket_WrongUser(t *testing.T) {
+	_, srv := newFakeWebHDFS(t, "thanos")
+	defer srv.Close()
+
+	bkt, err := NewBucket(&Config{Endpoint: srv.URL, Directory: "/thanos", User: "other"}, nil)
+	testutil.Ok(t, err)
+
+	objtesting.WrongCredentialsTest(t, bkt, "SecurityException")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	objtesting.ValidateTest(t, []objtesting.ConfigCase{
+		{Conf: &Config{Endpoint: "namenode:9870", Directory: "/thanos"}, OK: true},
+		{Conf: &Config{Endpoint: "https://namenode:9871", Directory: "/thanos", User: "thanos"}, OK: true},
+		{Conf: &Config{Endpoint: "namenode:9870", Directory: "/thanos", DelegationTokenFile: "token"}, OK: true},
+		{Conf: &Config{Directory: "/thanos"}},
+		{Conf: &Config{Endpoint: "namenode:9870"}},
+		{Conf: &Config{Endpoint: "namenode:9870", Directory: "thanos"}},
+		{Conf: &Config{Endpoint: "namenode:9870", Directory: "/thanos", User: "thanos", DelegationTokenFile: "token"}},
+	})
+}
@@ -2,25 +2,112 @@ package inmem
 
 import (
 	"context"
+	"crypto/md5"
+	"fmt"
 	"io"
 	"sort"
+	"sync"
+	"time"
 
 	"bytes"
 	"io/ioutil"
 	"strings"
 
+	"github.com/improbable-eng/thanos/pkg/objstore"
 	"github.com/pkg/errors"
 )
 
 // Bucket implements the store.Bucket and shipper.Bucket interfaces against local memory.
+// It is safe for concurrent use.
+// Failures can be injected to deterministically exercise error paths of its users.
 type Bucket struct {
-	objects map[string][]byte
+	mtx      sync.RWMutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+
+	// uploads is the number of uploads attempted so far.
+	uploads int
+	// uploadFailures maps the number of an upload attempt to the error it fails with.
+	uploadFailures map[int]error
+	// missingReadsAfterUpload is the number of reads for which uploaded objects appear missing.
+	missingReadsAfterUpload int
+	// missingReads is the remaining number of reads for which an object appears missing.
+	missingReads map[string]int
+	// delay is the time every operation takes at least.
+	delay time.Duration
 }
 
 // NewBucket returns a new in memory Bucket.
 // NOTE: Returned bucket is just a naive in memory bucket implementation. For test use cases only.
 func NewBucket() *Bucket {
-	return &Bucket{objects: map[string][]byte{}}
+	return &Bucket{
+		objects:        map[string][]byte{},
+		modified:       map[string]time.Time{},
+		uploadFailures: map[int]error{},
+		missingReads:   map[string]int{},
+	}
+}
+
+// FailUpload makes the nth upload attempted from now on fail with err, starting at 1.
+// The object of a failed upload is not stored.
+func (b *Bucket) FailUpload(n int, err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.uploadFailures[b.uploads+n] = err
+}
+
+// SetMissingReadsAfterUpload makes objects uploaded from now on appear missing for the given
+// number of reads through Get, GetRange, Exists and Attributes. This simulates object storages
+// that are only eventually consistent.
+func (b *Bucket) SetMissingReadsAfterUpload(n int) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.missingReadsAfterUpload = n
+}
+
+// SetDelay makes every operation from now on take at least d before it returns. This simulates
+// slow object storages. Operations return early with an error if their context is canceled.
+func (b *Bucket) SetDelay(d time.Duration) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.delay = d
+}
+
+// wait blocks for the configured delay or until the context is canceled.
+func (b *Bucket) wait(ctx context.Context) error {
+	b.mtx.RLock()
+	d := b.delay
+	b.mtx.RUnlock()
+
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// missingRead returns true if the object must appear missing for the current read.
+func (b *Bucket) missingRead(name string) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.missingReads[name] > 0 {
+		b.missingReads[name]--
+		return true
+	}
+	return false
+}
+
+// Type returns the type of the bucket's backend.
+func (b *Bucket) Type() string {
+	return "INMEM"
 }
 
 // Objects returns internally stored objects.
@@ -30,17 +117,34 @@ func (b *Bucket) Objects() map[string][]byte {
 }
 
 // Iter calls f for each entry in the given directory. The argument to f is the full
-// object name including the prefix of the inspected directory.
-func (b *Bucket) Iter(_ context.Context, dir string, f func(string) error) error {
+// object name including the prefix of the inspected directory. If the listing is
+// recursive, the names of all objects below the directory are passed to f instead.
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	// Ensure the object name actually ends with a dir suffix. Otherwise we'll just iterate the
+	// object itself as one prefix item.
+	if err := b.wait(ctx); err != nil {
+		return err
+	}
+	if dir != "" {
+		dir = strings.TrimSuffix(dir, objstore.DirDelim) + objstore.DirDelim
+	}
+	recursive := objstore.ApplyIterOptions(options...).Recursive
 	unique := map[string]struct{}{}
 
+	b.mtx.RLock()
 	for filename := range b.objects {
 		if !strings.HasPrefix(filename, dir) {
 			continue
 		}
-		parts := strings.SplitAfter(filename, "/")
-		unique[parts[0]] = struct{}{}
+		if recursive {
+			unique[filename] = struct{}{}
+			continue
+		}
+		parts := strings.SplitAfter(strings.TrimPrefix(filename, dir), objstore.DirDelim)
+		unique[dir+parts[0]] = struct{}{}
 	}
+	b.mtx.RUnlock()
+
 	var keys []string
 	for n := range unique {
 		keys = append(keys, n)
@@ -48,6 +152,11 @@ func (b *Bucket) Iter(_ context.Context, dir string, f func(string) error) error
 	sort.Strings(keys)
 
 	for _, k := range keys {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 		if err := f(k); err != nil {
 			return err
 		}
@@ -56,8 +165,17 @@ func (b *Bucket) Iter(_ context.Context, dir string, f func(string) error) error
 }
 
 // Get returns a reader for the given object name.
-func (b *Bucket) Get(_ context.Context, name string) (io.ReadCloser, error) {
+func (b *Bucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.wait(ctx); err != nil {
+		return nil, err
+	}
+	if b.missingRead(name) {
+		return nil, errors.Errorf("no such file %s", name)
+	}
+	b.mtx.RLock()
 	file, ok := b.objects[name]
+	b.mtx.RUnlock()
+
 	if !ok {
 		return nil, errors.Errorf("no such file %s", name)
 	}
@@ -66,8 +184,17 @@ func (b *Bucket) Get(_ context.Context, name string) (io.ReadCloser, error) {
 }
 
 // GetRange returns a new range reader for the given object name and range.
-func (b *Bucket) GetRange(_ context.Context, name string, off, length int64) (io.ReadCloser, error) {
+func (b *Bucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.wait(ctx); err != nil {
+		return nil, err
+	}
+	if b.missingRead(name) {
+		return nil, errors.Errorf("no such file %s", name)
+	}
+	b.mtx.RLock()
 	file, ok := b.objects[name]
+	b.mtx.RUnlock()
+
 	if !ok {
 		return nil, errors.Errorf("no such file %s", name)
 	}
@@ -85,23 +212,78 @@ func (b *Bucket) GetRange(_ context.Context, name string, off, length int64) (io
 }
 
 // Exists checks if the given directory exists in memory.
-func (b *Bucket) Exists(_ context.Context, name string) (bool, error) {
+func (b *Bucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.wait(ctx); err != nil {
+		return false, err
+	}
+	if b.missingRead(name) {
+		return false, nil
+	}
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
 	_, ok := b.objects[name]
 	return ok, nil
 }
 
+// Attributes returns information about the object with the given name.
+func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	if err := b.wait(ctx); err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	if b.missingRead(name) {
+		return objstore.ObjectAttributes{}, errors.Errorf("no such file %s", name)
+	}
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	file, ok := b.objects[name]
+	if !ok {
+		return objstore.ObjectAttributes{}, errors.Errorf("no such file %s", name)
+	}
+	return objstore.ObjectAttributes{
+		Size:         int64(len(file)),
+		LastModified: b.modified[name],
+		ETag:         fmt.Sprintf("%x", md5.Sum(file)),
+	}, nil
+}
+
 // Upload writes the file specified in src to into the memory.
-func (b *Bucket) Upload(_ context.Context, name string, r io.Reader) error {
+func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.wait(ctx); err != nil {
+		return err
+	}
 	body, err := ioutil.ReadAll(r)
 	if err != nil {
 		return err
 	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.uploads++
+	if err, ok := b.uploadFailures[b.uploads]; ok {
+		delete(b.uploadFailures, b.uploads)
+		return err
+	}
 	b.objects[name] = body
+	b.modified[name] = time.Now()
+
+	if b.missingReadsAfterUpload > 0 {
+		b.missingReads[name] = b.missingReadsAfterUpload
+	}
 	return nil
 }
 
 // Delete removes all data prefixed with the dir.
-func (b *Bucket) Delete(_ context.Context, name string) error {
+func (b *Bucket) Delete(ctx context.Context, name string) error {
+	if err := b.wait(ctx); err != nil {
+		return err
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
 	delete(b.objects, name)
+	delete(b.modified, name)
+	delete(b.missingReads, name)
 	return nil
 }
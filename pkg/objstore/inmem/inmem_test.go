@@ -0,0 +1,170 @@
+package inmem
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/objtesting"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+	"github.com/pkg/errors"
+)
+
+func TestBucket_Attributes(t *testing.T) {
+	bkt := NewBucket()
+	ctx := context.Background()
+	start := time.Now()
+
+	testutil.Ok(t, bkt.Upload(ctx, "dir/obj", bytes.NewReader([]byte("hello world"))))
+
+	attrs, err := bkt.Attributes(ctx, "dir/obj")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(11), attrs.Size)
+	testutil.Assert(t, !attrs.LastModified.Before(start), "unexpected modification time %s", attrs.LastModified)
+	testutil.Equals(t, "5eb63bbbe01eeed093cb22bb8f5acdc3", attrs.ETag)
+
+	_, err = bkt.Attributes(ctx, "dir/missing")
+	testutil.NotOk(t, err)
+}
+
+func TestBucket_IterCancel(t *testing.T) {
+	bkt := NewBucket()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	for _, name := range []string{"a/obj", "b/obj", "c/obj"} {
+		testutil.Ok(t, bkt.Upload(ctx, name, bytes.NewReader([]byte("x"))))
+	}
+	var calls int
+
+	err := bkt.Iter(ctx, "", func(string) error {
+		calls++
+		cancel()
+		return nil
+	})
+	testutil.Equals(t, context.Canceled, err)
+	testutil.Equals(t, 1, calls)
+}
+
+func TestBucket_IterDir(t *testing.T) {
+	bkt := NewBucket()
+	ctx := context.Background()
+
+	for _, name := range []string{"a/meta.json", "a/chunks/000001", "a/chunks/000002", "b/index"} {
+		testutil.Ok(t, bkt.Upload(ctx, name, bytes.NewReader([]byte("x"))))
+	}
+	for dir, exp := range map[string][]string{
+		"":         {"a/", "b/"},
+		"a":        {"a/chunks/", "a/meta.json"},
+		"a/":       {"a/chunks/", "a/meta.json"},
+		"a/chunks": {"a/chunks/000001", "a/chunks/000002"},
+	} {
+		var names []string
+		testutil.Ok(t, bkt.Iter(ctx, dir, func(name string) error {
+			names = append(names, name)
+			return nil
+		}))
+		testutil.Equals(t, exp, names)
+	}
+}
+
+func TestBucket_IterRecursive(t *testing.T) {
+	bkt := NewBucket()
+	ctx := context.Background()
+
+	for _, name := range []string{"a/meta.json", "a/chunks/000001", "a/chunks/000002", "b/index"} {
+		testutil.Ok(t, bkt.Upload(ctx, name, bytes.NewReader([]byte("x"))))
+	}
+	for dir, exp := range map[string][]string{
+		"":         {"a/chunks/000001", "a/chunks/000002", "a/meta.json", "b/index"},
+		"a":        {"a/chunks/000001", "a/chunks/000002", "a/meta.json"},
+		"a/chunks": {"a/chunks/000001", "a/chunks/000002"},
+	} {
+		var names []string
+		testutil.Ok(t, bkt.Iter(ctx, dir, func(name string) error {
+			names = append(names, name)
+			return nil
+		}, objstore.WithRecursiveIter()))
+		testutil.Equals(t, exp, names)
+	}
+}
+
+func TestBucket_FailUpload(t *testing.T) {
+	bkt := NewBucket()
+	ctx := context.Background()
+
+	errUpload := errors.New("upload failed")
+	bkt.FailUpload(2, errUpload)
+
+	testutil.Ok(t, bkt.Upload(ctx, "a", bytes.NewReader([]byte("x"))))
+	testutil.Equals(t, errUpload, bkt.Upload(ctx, "b", bytes.NewReader([]byte("x"))))
+	testutil.Ok(t, bkt.Upload(ctx, "c", bytes.NewReader([]byte("x"))))
+
+	// The object of the failed upload must not be stored.
+	ok, err := bkt.Exists(ctx, "b")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "object of failed upload exists")
+
+	// Failures are counted from the time they are configured and only happen once.
+	bkt.FailUpload(1, errUpload)
+	testutil.Equals(t, errUpload, bkt.Upload(ctx, "b", bytes.NewReader([]byte("x"))))
+	testutil.Ok(t, bkt.Upload(ctx, "b", bytes.NewReader([]byte("x"))))
+	testutil.Equals(t, 3, len(bkt.Objects()))
+}
+
+func TestBucket_MissingReadsAfterUpload(t *testing.T) {
+	bkt := NewBucket()
+	ctx := context.Background()
+
+	testutil.Ok(t, bkt.Upload(ctx, "before", bytes.NewReader([]byte("x"))))
+
+	bkt.SetMissingReadsAfterUpload(1)
+	testutil.Ok(t, bkt.Upload(ctx, "exists", bytes.NewReader([]byte("x"))))
+	testutil.Ok(t, bkt.Upload(ctx, "get", bytes.NewReader([]byte("x"))))
+	testutil.Ok(t, bkt.Upload(ctx, "attrs", bytes.NewReader([]byte("x"))))
+
+	// Objects uploaded earlier are not affected.
+	ok, err := bkt.Exists(ctx, "before")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "object uploaded before is missing")
+
+	// Each object appears missing exactly once.
+	ok, err = bkt.Exists(ctx, "exists")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "object not missing on first read")
+	ok, err = bkt.Exists(ctx, "exists")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "object missing on second read")
+
+	_, err = bkt.Get(ctx, "get")
+	testutil.NotOk(t, err)
+	rc, err := bkt.Get(ctx, "get")
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+
+	_, err = bkt.Attributes(ctx, "attrs")
+	testutil.NotOk(t, err)
+	_, err = bkt.Attributes(ctx, "attrs")
+	testutil.Ok(t, err)
+}
+
+func TestBucket_SetDelay(t *testing.T) {
+	bkt := NewBucket()
+	bkt.SetDelay(50 * time.Millisecond)
+
+	start := time.Now()
+	testutil.Ok(t, bkt.Upload(context.Background(), "obj", bytes.NewReader([]byte("a"))))
+	testutil.Assert(t, time.Since(start) >= 50*time.Millisecond, "upload returned before the delay")
+
+	// Canceled operations return right away.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := bkt.Exists(ctx, "obj")
+	testutil.Equals(t, context.Canceled, err)
+}
+
+func TestBucket_Acceptance(t *testing.T) {
+	objtesting.AcceptanceTest(t, NewBucket())
+}
@@ -0,0 +1,396 @@
+package objstore
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LimitedBucket wraps a bucket so that at most maxConcurrency operations are in flight
+// at the same time and operations are started at a rate of at most opsPerSecond.
+// A zero value disables the respective limit.
+// Readers returned by Get and GetRange occupy their slot until they are closed.
+// Iter is only rate limited as its callback commonly issues further operations against
+// the same bucket.
+func LimitedBucket(b Bucket, maxConcurrency int, opsPerSecond float64) Bucket {
+	return newLimitedBucket(b, maxConcurrency, opsPerSecond, wallClock{})
+}
+
+func newLimitedBucket(b Bucket, maxConcurrency int, opsPerSecond float64, c Clock) Bucket {
+	if maxConcurrency <= 0 && opsPerSecond <= 0 {
+		return b
+	}
+	lb := &limitedBucket{bkt: b}
+
+	if maxConcurrency > 0 {
+		lb.slots = make(chan struct{}, maxConcurrency)
+	}
+	lb.limiter = newRateLimiter(opsPerSecond, c)
+	return lb
+}
+
+// Clock tells the time and waits for it to pass. Tests replace it to not depend on the wall clock.
+type Clock interface {
+	Now() time.Time
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time { return time.Now() }
+
+func (wallClock) Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// rateLimiter spaces out events so that they happen at a rate of at most perSecond on average.
+// A nil rateLimiter does not limit the rate.
+type rateLimiter struct {
+	perSecond float64
+	clock     Clock
+
+	mtx  sync.Mutex
+	next time.Time
+}
+
+// newRateLimiter returns a limiter for the given rate, or nil if it is not positive.
+func newRateLimiter(perSecond float64, c Clock) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{perSecond: perSecond, clock: c}
+}
+
+// wait blocks until n more events fit within the rate limit.
+func (l *rateLimiter) wait(ctx context.Context, n int64) error {
+	if l == nil {
+		return nil
+	}
+	l.mtx.Lock()
+	now := l.clock.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	reserved := time.Duration(float64(n) * float64(time.Second) / l.perSecond)
+	l.next = start.Add(reserved)
+	l.mtx.Unlock()
+
+	d := start.Sub(now)
+	if d <= 0 {
+		return nil
+	}
+	if err := l.clock.Sleep(ctx, d); err != nil {
+		// The events will not happen, so later ones need not wait for them.
+		l.mtx.Lock()
+		l.next = l.next.Add(-reserved)
+		l.mtx.Unlock()
+		return err
+	}
+	return nil
+}
+
+type limitedBucket struct {
+	bkt Bucket
+
+	slots   chan struct{}
+	limiter *rateLimiter
+}
+
+func (b *limitedBucket) Type() string {
+	return BackendType(b.bkt)
+}
+
+// wait blocks until the rate limit allows starting another operation.
+func (b *limitedBucket) wait(ctx context.Context) error {
+	return b.limiter.wait(ctx, 1)
+}
+
+// acquire blocks until an operation may be started. If it returns without error,
+// release must be called once the operation is done.
+func (b *limitedBucket) acquire(ctx context.Context) error {
+	if b.slots != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case b.slots <- struct{}{}:
+		}
+	}
+	if err := b.wait(ctx); err != nil {
+		b.release()
+		return err
+	}
+	return nil
+}
+
+func (b *limitedBucket) release() {
+	if b.slots != nil {
+		<-b.slots
+	}
+}
+
+func (b *limitedBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	if err := b.wait(ctx); err != nil {
+		return err
+	}
+	return b.bkt.Iter(ctx, dir, f, options...)
+}
+
+func (b *limitedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.acquire(ctx); err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		b.release()
+		return nil, err
+	}
+	return &releasingReadCloser{ReadCloser: rc, release: b.release}, nil
+}
+
+func (b *limitedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.acquire(ctx); err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		b.release()
+		return nil, err
+	}
+	return &releasingReadCloser{ReadCloser: rc, release: b.release}, nil
+}
+
+func (b *limitedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.acquire(ctx); err != nil {
+		return false, err
+	}
+	defer b.release()
+
+	return b.bkt.Exists(ctx, name)
+}
+
+func (b *limitedBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	if err := b.acquire(ctx); err != nil {
+		return ObjectAttributes{}, err
+	}
+	defer b.release()
+
+	return b.bkt.Attributes(ctx, name)
+}
+
+func (b *limitedBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.acquire(ctx); err != nil {
+		return err
+	}
+	defer b.release()
+
+	return b.bkt.Upload(ctx, name, r)
+}
+
+func (b *limitedBucket) Delete(ctx context.Context, name string) error {
+	if err := b.acquire(ctx); err != nil {
+		return err
+	}
+	defer b.release()
+
+	return b.bkt.Delete(ctx, name)
+}
+
+// releasingReadCloser calls release once when it is closed.
+type releasingReadCloser struct {
+	io.ReadCloser
+
+	once    sync.Once
+	release func()
+}
+
+func (rc *releasingReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.once.Do(rc.release)
+	return err
+}
+
+// RateLimitConfig limits the rate of operations against a bucket and the bandwidth of
+// transfers, separately for reads and writes. A zero value disables the respective limit.
+type RateLimitConfig struct {
+	// ReadOpsPerSecond limits the rate at which Iter, Get, GetRange, Exists and Attributes
+	// calls are started.
+	ReadOpsPerSecond float64 `yaml:"read_ops_per_second"`
+	// WriteOpsPerSecond limits the rate at which Upload and Delete calls are started.
+	WriteOpsPerSecond float64 `yaml:"write_ops_per_second"`
+	// ReadBytesPerSecond limits the combined bandwidth of all readers of the bucket.
+	ReadBytesPerSecond int64 `yaml:"read_bytes_per_second"`
+	// WriteBytesPerSecond limits the combined bandwidth of all uploads to the bucket.
+	WriteBytesPerSecond int64 `yaml:"write_bytes_per_second"`
+}
+
+// Validate checks that no limit is negative.
+func (conf *RateLimitConfig) Validate() error {
+	if conf.ReadOpsPerSecond < 0 || conf.WriteOpsPerSecond < 0 || conf.ReadBytesPerSecond < 0 || conf.WriteBytesPerSecond < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	return nil
+}
+
+// RateLimitedBucket wraps a bucket so that operations and transfers stay within the given
+// limits, e.g. to stay below the request quotas of a cloud provider. Operations wait until
+// the limit allows them to start. If no limit is set, the bucket is returned unchanged.
+func RateLimitedBucket(b Bucket, conf RateLimitConfig) Bucket {
+	return RateLimitedBucketWithClock(b, conf, wallClock{})
+}
+
+// RateLimitedBucketWithClock is like RateLimitedBucket but tells the time and waits with c.
+func RateLimitedBucketWithClock(b Bucket, conf RateLimitConfig, c Clock) Bucket {
+	if conf == (RateLimitConfig{}) {
+		return b
+	}
+	return &rateLimitedBucket{
+		bkt:        b,
+		readOps:    newRateLimiter(conf.ReadOpsPerSecond, c),
+		writeOps:   newRateLimiter(conf.WriteOpsPerSecond, c),
+		readBytes:  newRateLimiter(float64(conf.ReadBytesPerSecond), c),
+		writeBytes: newRateLimiter(float64(conf.WriteBytesPerSecond), c),
+	}
+}
+
+type rateLimitedBucket struct {
+	bkt Bucket
+
+	readOps, writeOps     *rateLimiter
+	readBytes, writeBytes *rateLimiter
+}
+
+func (b *rateLimitedBucket) Type() string {
+	return BackendType(b.bkt)
+}
+
+func (b *rateLimitedBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	if err := b.readOps.wait(ctx, 1); err != nil {
+		return err
+	}
+	return b.bkt.Iter(ctx, dir, f, options...)
+}
+
+func (b *rateLimitedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.readOps.wait(ctx, 1); err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return newRateLimitedReadCloser(ctx, rc, b.readBytes), nil
+}
+
+func (b *rateLimitedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.readOps.wait(ctx, 1); err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		return nil, err
+	}
+	return newRateLimitedReadCloser(ctx, rc, b.readBytes), nil
+}
+
+func (b *rateLimitedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.readOps.wait(ctx, 1); err != nil {
+		return false, err
+	}
+	return b.bkt.Exists(ctx, name)
+}
+
+func (b *rateLimitedBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	if err := b.readOps.wait(ctx, 1); err != nil {
+		return ObjectAttributes{}, err
+	}
+	return b.bkt.Attributes(ctx, name)
+}
+
+func (b *rateLimitedBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.writeOps.wait(ctx, 1); err != nil {
+		return err
+	}
+	if b.writeBytes == nil {
+		return b.bkt.Upload(ctx, name, r)
+	}
+	lr := &rateLimitedReader{ctx: ctx, r: r, limiter: b.writeBytes}
+
+	if f, ok := r.(*os.File); ok {
+		fi, err := f.Stat()
+		if err != nil {
+			return errors.Wrap(err, "stat file")
+		}
+		return b.bkt.Upload(ctx, name, &rateLimitedFile{rateLimitedReader: lr, f: f, size: fi.Size()})
+	}
+	return b.bkt.Upload(ctx, name, lr)
+}
+
+func (b *rateLimitedBucket) Delete(ctx context.Context, name string) error {
+	if err := b.writeOps.wait(ctx, 1); err != nil {
+		return err
+	}
+	return b.bkt.Delete(ctx, name)
+}
+
+// rateLimitedReader limits the rate at which bytes are read from r.
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// Bound single reads to a second worth of data to keep the transfer smooth.
+	if max := int(r.limiter.perSecond); max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.wait(r.ctx, int64(n)); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// rateLimitedFile limits the rate at which a file is read. Unlike a plain reader, it tells
+// the file's size and can be rewound, since backends such as S3 rely on the size to upload
+// files in a single request and retries rewind readers that support seeking.
+type rateLimitedFile struct {
+	*rateLimitedReader
+
+	f    *os.File
+	size int64
+}
+
+// Size returns the size of the file, which the S3 client looks for to learn the object size.
+func (f *rateLimitedFile) Size() int64 {
+	return f.size
+}
+
+func (f *rateLimitedFile) Seek(offset int64, whence int) (int64, error) {
+	return f.f.Seek(offset, whence)
+}
+
+func newRateLimitedReadCloser(ctx context.Context, rc io.ReadCloser, l *rateLimiter) io.ReadCloser {
+	if l == nil {
+		return rc
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&rateLimitedReader{ctx: ctx, r: rc, limiter: l}, rc}
+}
@@ -0,0 +1,262 @@
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/inmem"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+	"github.com/pkg/errors"
+)
+
+// inflightBucket records the maximum number of concurrent Exists calls.
+type inflightBucket struct {
+	*inmem.Bucket
+
+	mtx         sync.Mutex
+	inflight    int
+	maxInflight int
+}
+
+func (b *inflightBucket) Exists(ctx context.Context, name string) (bool, error) {
+	b.mtx.Lock()
+	b.inflight++
+	if b.inflight > b.maxInflight {
+		b.maxInflight = b.inflight
+	}
+	b.mtx.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	b.mtx.Lock()
+	b.inflight--
+	b.mtx.Unlock()
+
+	return false, nil
+}
+
+func TestLimitedBucket_MaxConcurrency(t *testing.T) {
+	inner := &inflightBucket{Bucket: inmem.NewBucket()}
+	bkt := objstore.LimitedBucket(inner, 2, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := bkt.Exists(context.Background(), "obj")
+			testutil.Ok(t, err)
+		}()
+	}
+	wg.Wait()
+
+	testutil.Equals(t, 2, inner.maxInflight)
+}
+
+// fakeClock advances its time by the durations waited for instead of sleeping.
+type fakeClock struct {
+	mtx   sync.Mutex
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.now = c.now.Add(d)
+	c.slept += d
+	return nil
+}
+
+// Slept returns the duration waited for since the last call.
+func (c *fakeClock) Slept() time.Duration {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	d := c.slept
+	c.slept = 0
+	return d
+}
+
+func TestLimitedBucket_RateLimit(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	bkt := objstore.LimitedBucketWithClock(inmem.NewBucket(), 0, 50, clock)
+
+	// The first operation starts immediately, each following one 20ms later.
+	for i := 0; i < 5; i++ {
+		_, err := bkt.Exists(context.Background(), "obj")
+		testutil.Ok(t, err)
+	}
+	testutil.Equals(t, 80*time.Millisecond, clock.Slept())
+}
+
+func TestLimitedBucket_ReaderHoldsSlot(t *testing.T) {
+	inner := inmem.NewBucket()
+	testutil.Ok(t, inner.Upload(context.Background(), "obj", bytes.NewReader([]byte("x"))))
+
+	bkt := objstore.LimitedBucket(inner, 1, 0)
+
+	rc, err := bkt.Get(context.Background(), "obj")
+	testutil.Ok(t, err)
+
+	// No further operation can start until the reader is closed.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = bkt.Exists(ctx, "obj")
+	testutil.Equals(t, context.DeadlineExceeded, err)
+
+	testutil.Ok(t, rc.Close())
+
+	_, err = bkt.Exists(context.Background(), "obj")
+	testutil.Ok(t, err)
+}
+
+func TestRateLimitedBucket_Ops(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	bkt := objstore.RateLimitedBucketWithClock(inmem.NewBucket(), objstore.RateLimitConfig{ReadOpsPerSecond: 50}, clock)
+
+	// Reads are limited while writes are not.
+	for i := 0; i < 5; i++ {
+		testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewReader([]byte("x"))))
+	}
+	testutil.Equals(t, time.Duration(0), clock.Slept())
+
+	for i := 0; i < 5; i++ {
+		_, err := bkt.Exists(ctx, "obj")
+		testutil.Ok(t, err)
+	}
+	testutil.Equals(t, 80*time.Millisecond, clock.Slept())
+}
+
+func TestRateLimitedBucket_Bandwidth(t *testing.T) {
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("x"), 3000)
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	bkt := objstore.RateLimitedBucketWithClock(inmem.NewBucket(), objstore.RateLimitConfig{
+		ReadBytesPerSecond:  10000,
+		WriteBytesPerSecond: 10000,
+	}, clock)
+
+	// The 3000 bytes take 300ms, so the following upload has to wait for them.
+	testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewReader(content)))
+	testutil.Ok(t, bkt.Upload(ctx, "other", bytes.NewReader([]byte("x"))))
+	testutil.Equals(t, 300*time.Millisecond, clock.Slept())
+
+	// Each chunk of 1000 bytes takes 100ms, the first one is transferred immediately.
+	rc, err := bkt.Get(ctx, "obj")
+	testutil.Ok(t, err)
+	b := make([]byte, len(content))
+	for off := 0; off < len(b); off += 1000 {
+		_, err := io.ReadFull(rc, b[off:off+1000])
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, content, b)
+	testutil.Equals(t, 200*time.Millisecond, clock.Slept())
+
+	// Canceling the context stops waiting for the limit.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	testutil.NotOk(t, bkt.Upload(cctx, "obj", bytes.NewReader(bytes.Repeat(content, 10))))
+}
+
+func TestRateLimitedBucket_CanceledWait(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	bkt := objstore.RateLimitedBucketWithClock(inmem.NewBucket(), objstore.RateLimitConfig{ReadBytesPerSecond: 10000}, clock)
+	testutil.Ok(t, bkt.Upload(context.Background(), "obj", bytes.NewReader(make([]byte, 3000))))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rc, err := bkt.Get(ctx, "obj")
+	testutil.Ok(t, err)
+	_, err = io.ReadFull(rc, make([]byte, 1000))
+	testutil.Ok(t, err)
+	cancel()
+	_, err = rc.Read(make([]byte, 1000))
+	testutil.NotOk(t, err)
+	testutil.Ok(t, rc.Close())
+
+	// Only the bytes read before the context was canceled hold up the next reader.
+	rc, err = bkt.Get(context.Background(), "obj")
+	testutil.Ok(t, err)
+	_, err = io.ReadFull(rc, make([]byte, 1000))
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, 100*time.Millisecond, clock.Slept())
+}
+
+// sizedBucket fails uploads of readers that do not tell their size or cannot be rewound.
+// It reads uploads in chunks of 1000 bytes and records their sizes.
+type sizedBucket struct {
+	objstore.Bucket
+
+	mtx   sync.Mutex
+	sizes map[string]int64
+}
+
+func (b *sizedBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	sr, ok := r.(interface{ Size() int64 })
+	if !ok {
+		return errors.Errorf("upload of %s is %T, which does not tell its size", name, r)
+	}
+	if _, ok := r.(io.Seeker); !ok {
+		return errors.Errorf("upload of %s is %T, which cannot be rewound", name, r)
+	}
+	b.mtx.Lock()
+	b.sizes[name] = sr.Size()
+	b.mtx.Unlock()
+
+	var buf bytes.Buffer
+	if _, err := io.CopyBuffer(struct{ io.Writer }{&buf}, r, make([]byte, 1000)); err != nil {
+		return err
+	}
+	return b.Bucket.Upload(ctx, name, &buf)
+}
+
+func TestRateLimitedBucket_FileUpload(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "rate-limited-bucket")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	// Files keep their size through the audit log, which the sidecar puts below the limit.
+	sized := &sizedBucket{Bucket: inmem.NewBucket(), sizes: map[string]int64{}}
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	bkt := objstore.RateLimitedBucketWithClock(objstore.BucketWithAuditLog(sized, log.NewNopLogger()), objstore.RateLimitConfig{
+		WriteBytesPerSecond: 1000,
+	}, clock)
+
+	// Files are throttled as they are read. The first chunk of 1000 bytes is sent right away
+	// and every further one waits for the second taken by the previous one, so that the
+	// 5000 bytes take 4.5s.
+	for _, name := range []string{"a", "b"} {
+		fn := filepath.Join(dir, name)
+		testutil.Ok(t, ioutil.WriteFile(fn, make([]byte, 2500), 0666))
+		testutil.Ok(t, objstore.UploadFile(ctx, bkt, fn, name))
+	}
+	testutil.Equals(t, 4500*time.Millisecond, clock.Slept())
+	testutil.Equals(t, map[string]int64{"a": 2500, "b": 2500}, sized.sizes)
+}
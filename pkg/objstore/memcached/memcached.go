@@ -0,0 +1,221 @@
+// Package memcached implements a cache of bucket data that is held by a set of memcached servers.
+package memcached
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	opGet    = "get"
+	opSet    = "set"
+	opDelete = "delete"
+
+	defaultTimeout            = 500 * time.Millisecond
+	defaultMaxIdleConnections = 16
+	defaultMaxItemSize        = 1024 * 1024
+
+	// maxKeyLength is the maximum length of keys accepted by memcached.
+	maxKeyLength = 250
+	// maxRelativeExpiration is the longest expiration time that memcached interprets as
+	// relative to the current time. Longer ones are taken as a Unix timestamp.
+	maxRelativeExpiration = 30 * 24 * time.Hour
+)
+
+// Config describes the memcached servers to cache data in.
+type Config struct {
+	// Addresses of the memcached servers as host:port. Keys are distributed across them.
+	Addresses []string `yaml:"addresses"`
+	// Timeout of operations against a server, including connecting to it. It defaults to 500ms.
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxIdleConnections is the number of idle connections kept open per server. It defaults to 16.
+	MaxIdleConnections int `yaml:"max_idle_connections"`
+	// MaxItemSize is the maximum size of values to store. It must not exceed the item size
+	// limit of the servers and defaults to 1MiB, which is memcached's default limit.
+	MaxItemSize int `yaml:"max_item_size"`
+}
+
+// Validate returns an error if the configuration is invalid.
+func (conf Config) Validate() error {
+	if len(conf.Addresses) == 0 {
+		return errors.New("no memcached addresses")
+	}
+	if conf.Timeout < 0 {
+		return errors.New("memcached timeout must not be negative")
+	}
+	if conf.MaxIdleConnections < 0 {
+		return errors.New("maximum idle memcached connections must not be negative")
+	}
+	if conf.MaxItemSize < 0 {
+		return errors.New("maximum memcached item size must not be negative")
+	}
+	return nil
+}
+
+// Client caches data in memcached. It implements objstore.Cache.
+// Operations are bounded by the configured timeout rather than by the context.
+type Client struct {
+	mc          *memcache.Client
+	maxItemSize int
+	// concurrency is the number of items that are stored or deleted at once.
+	concurrency int
+
+	ops      *prometheus.CounterVec
+	failures *prometheus.CounterVec
+}
+
+// NewClient returns a client for the memcached servers of the given configuration.
+func NewClient(conf Config, reg prometheus.Registerer) (*Client, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = defaultTimeout
+	}
+	if conf.MaxIdleConnections == 0 {
+		conf.MaxIdleConnections = defaultMaxIdleConnections
+	}
+	if conf.MaxItemSize == 0 {
+		conf.MaxItemSize = defaultMaxItemSize
+	}
+	var servers memcache.ServerList
+	if err := servers.SetServers(conf.Addresses...); err != nil {
+		return nil, errors.Wrap(err, "resolve memcached addresses")
+	}
+	mc := memcache.NewFromSelector(&servers)
+	mc.Timeout = conf.Timeout
+	mc.MaxIdleConns = conf.MaxIdleConnections
+
+	c := &Client{
+		mc:          mc,
+		maxItemSize: conf.MaxItemSize,
+		concurrency: conf.MaxIdleConnections,
+		ops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_memcached_operations_total",
+			Help: "Total number of operations against memcached.",
+		}, []string{"operation"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_memcached_operation_failures_total",
+			Help: "Total number of operations against memcached that failed.",
+		}, []string{"operation"}),
+	}
+	if reg != nil {
+		reg.MustRegister(c.ops, c.failures)
+	}
+	return c, nil
+}
+
+// cacheKey returns a key that is valid in memcached for the given one. Keys that are too
+// long or contain whitespace or control characters are replaced by their hash.
+func cacheKey(key string) string {
+	valid := len(key) <= maxKeyLength
+	for i := 0; valid && i < len(key); i++ {
+		valid = key[i] > ' ' && key[i] != 0x7f
+	}
+	if valid {
+		return key
+	}
+	h := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// Fetch returns the values of the given keys that are in memcached. Keys of servers that
+// fail are treated as missing.
+func (c *Client) Fetch(_ context.Context, keys []string) map[string][]byte {
+	orig := make(map[string]string, len(keys))
+	cacheKeys := make([]string, 0, len(keys))
+
+	for _, k := range keys {
+		ck := cacheKey(k)
+		orig[ck] = k
+		cacheKeys = append(cacheKeys, ck)
+	}
+	c.ops.WithLabelValues(opGet).Inc()
+
+	// Items of the servers that responded are returned along with the error.
+	items, err := c.mc.GetMulti(cacheKeys)
+	if err != nil {
+		c.failures.WithLabelValues(opGet).Inc()
+	}
+	res := make(map[string][]byte, len(items))
+	for ck, it := range items {
+		res[orig[ck]] = it.Value
+	}
+	return res
+}
+
+// Store adds the given values to memcached, which expire after ttl. Values larger than the
+// maximum item size are skipped.
+func (c *Client) Store(_ context.Context, data map[string][]byte, ttl time.Duration) {
+	exp := expiration(ttl, time.Now())
+
+	keys := make([]string, 0, len(data))
+	for k, v := range data {
+		if len(v) <= c.maxItemSize {
+			keys = append(keys, k)
+		}
+	}
+	c.each(opSet, keys, func(key string) error {
+		return c.mc.Set(&memcache.Item{Key: cacheKey(key), Value: data[key], Expiration: exp})
+	})
+}
+
+// Delete removes the given keys from memcached.
+func (c *Client) Delete(_ context.Context, keys []string) {
+	c.each(opDelete, keys, func(key string) error {
+		if err := c.mc.Delete(cacheKey(key)); err != memcache.ErrCacheMiss {
+			return err
+		}
+		return nil
+	})
+}
+
+// each runs the operation op for all keys, bounded by the number of idle connections so
+// that connections are reused.
+func (c *Client) each(op string, keys []string, f func(key string) error) {
+	var (
+		wg sync.WaitGroup
+		ch = make(chan string)
+	)
+	n := c.concurrency
+	if n > len(keys) {
+		n = len(keys)
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for k := range ch {
+				c.ops.WithLabelValues(op).Inc()
+				if err := f(k); err != nil {
+					c.failures.WithLabelValues(op).Inc()
+				}
+			}
+		}()
+	}
+	for _, k := range keys {
+		ch <- k
+	}
+	close(ch)
+	wg.Wait()
+}
+
+// expiration returns the expiration time to pass to memcached for the given TTL.
+func expiration(ttl time.Duration, now time.Time) int32 {
+	if ttl > maxRelativeExpiration {
+		return int32(now.Add(ttl).Unix())
+	}
+	// An expiration time of zero means that items never expire.
+	if s := int32(ttl / time.Second); s > 0 {
+		return s
+	}
+	return 1
+}
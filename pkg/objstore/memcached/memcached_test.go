@@ -0,0 +1,177 @@
+package memcached
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+// fakeServer implements the gets, set and delete commands of memcached's text protocol.
+type fakeServer struct {
+	l net.Listener
+
+	mtx   sync.Mutex
+	items map[string][]byte
+	exps  map[string]int64
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+
+	s := &fakeServer{l: l, items: map[string][]byte{}, exps: map[string]int64{}}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(c net.Conn) {
+	defer c.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return
+		}
+		s.mtx.Lock()
+		switch fields[0] {
+		case "gets":
+			for _, k := range fields[1:] {
+				if v, ok := s.items[k]; ok {
+					fmt.Fprintf(rw, "VALUE %s 0 %d\r\n%s\r\n", k, len(v), v)
+				}
+			}
+			rw.WriteString("END\r\n")
+		case "set":
+			n, _ := strconv.Atoi(fields[4])
+			v := make([]byte, n+2)
+			if _, err := io.ReadFull(rw, v); err != nil {
+				s.mtx.Unlock()
+				return
+			}
+			s.items[fields[1]] = v[:n]
+			s.exps[fields[1]], _ = strconv.ParseInt(fields[3], 10, 64)
+			rw.WriteString("STORED\r\n")
+		case "delete":
+			if _, ok := s.items[fields[1]]; !ok {
+				rw.WriteString("NOT_FOUND\r\n")
+				break
+			}
+			delete(s.items, fields[1])
+			rw.WriteString("DELETED\r\n")
+		default:
+			rw.WriteString("ERROR\r\n")
+		}
+		s.mtx.Unlock()
+
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	s1, s2 := newFakeServer(t), newFakeServer(t)
+	defer s1.l.Close()
+	defer s2.l.Close()
+
+	c, err := NewClient(Config{Addresses: []string{s1.l.Addr().String(), s2.l.Addr().String()}, MaxItemSize: 100}, nil)
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+	data := map[string][]byte{
+		"key-1":                    []byte("value-1"),
+		"key-2":                    []byte("value-2"),
+		"key with spaces":          []byte("value-3"),
+		strings.Repeat("k", 300):   []byte("value-4"),
+		"key-5":                    {},
+		"key-with-too-large-value": make([]byte, 101),
+	}
+	c.Store(ctx, data, time.Minute)
+
+	var keys []string
+	for k := range data {
+		keys = append(keys, k)
+	}
+	res := c.Fetch(ctx, append(keys, "missing"))
+	delete(data, "key-with-too-large-value")
+	testutil.Equals(t, data, res)
+
+	// Keys are distributed across the servers and stored in a valid form.
+	s1.mtx.Lock()
+	s2.mtx.Lock()
+	testutil.Assert(t, len(s1.items) > 0 && len(s2.items) > 0, "keys not distributed across servers")
+	s1.mtx.Unlock()
+	s2.mtx.Unlock()
+	for _, s := range []*fakeServer{s1, s2} {
+		s.mtx.Lock()
+		for k, exp := range s.exps {
+			testutil.Assert(t, len(k) <= maxKeyLength && !strings.Contains(k, " "), "invalid key %q", k)
+			testutil.Equals(t, int64(60), exp)
+		}
+		s.mtx.Unlock()
+	}
+
+	// Deleted keys are missing, deleting missing keys succeeds.
+	c.Delete(ctx, []string{"key-1", "key with spaces", "missing"})
+	delete(data, "key-1")
+	delete(data, "key with spaces")
+	testutil.Equals(t, data, c.Fetch(ctx, keys))
+
+	// Failing servers are treated as misses.
+	s2.l.Close()
+	c, err = NewClient(Config{Addresses: []string{s1.l.Addr().String(), s2.l.Addr().String()}, MaxItemSize: 100}, nil)
+	testutil.Ok(t, err)
+	res = c.Fetch(ctx, keys)
+	testutil.Assert(t, len(res) > 0 && len(res) < len(data), "expected keys of the remaining server only, got %d", len(res))
+}
+
+func TestExpiration(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	testutil.Equals(t, int32(1), expiration(0, now))
+	testutil.Equals(t, int32(1), expiration(100*time.Millisecond, now))
+	testutil.Equals(t, int32(300), expiration(5*time.Minute, now))
+	testutil.Equals(t, int32(1500000000+31*24*3600), expiration(31*24*time.Hour, now))
+}
+
+func TestConfig_Validate(t *testing.T) {
+	for _, c := range []struct {
+		conf Config
+		ok   bool
+	}{
+		{conf: Config{Addresses: []string{"localhost:11211"}}, ok: true},
+		{conf: Config{}, ok: false},
+		{conf: Config{Addresses: []string{"localhost:11211"}, Timeout: -time.Second}, ok: false},
+		{conf: Config{Addresses: []string{"localhost:11211"}, MaxIdleConnections: -1}, ok: false},
+		{conf: Config{Addresses: []string{"localhost:11211"}, MaxItemSize: -1}, ok: false},
+	} {
+		err := c.conf.Validate()
+		if c.ok {
+			testutil.Ok(t, err)
+		} else {
+			testutil.NotOk(t, err)
+		}
+	}
+}
@@ -1,15 +1,20 @@
 package objstore
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/errgroup"
 )
 
 // Bucket provides read and write access to an object storage bucket.
@@ -26,8 +31,12 @@ type Bucket interface {
 // BucketReader provides read access to an object storage bucket.
 type BucketReader interface {
 	// Iter calls f for each entry in the given directory. The argument to f is the full
-	// object name including the prefix of the inspected directory.
-	Iter(ctx context.Context, dir string, f func(string) error) error
+	// object name including the prefix of the inspected directory. Subdirectories are
+	// passed to f as entries ending with DirDelim unless the WithRecursiveIter option is
+	// given, which lists all objects below the directory in one pass.
+	// Iteration stops at the first error returned by f, which is then returned. If ctx is
+	// canceled, iteration stops and ctx.Err() is returned.
+	Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error
 
 	// Get returns a reader for the given object name.
 	Get(ctx context.Context, name string) (io.ReadCloser, error)
@@ -37,6 +46,57 @@ type BucketReader interface {
 
 	// Exists checks if the given object exists in the bucket.
 	Exists(ctx context.Context, name string) (bool, error)
+
+	// Attributes returns information about the object with the given name.
+	Attributes(ctx context.Context, name string) (ObjectAttributes, error)
+}
+
+// IterOption configures a call of Iter.
+type IterOption func(*IterParams)
+
+// IterParams holds the settings of a call of Iter.
+type IterParams struct {
+	// Recursive lists all objects below the directory rather than its direct entries.
+	Recursive bool
+}
+
+// WithRecursiveIter makes Iter list the names of all objects below the directory instead of
+// its direct entries. Since no delimiter is used for the listing, all objects are listed in
+// one pass rather than directory by directory.
+func WithRecursiveIter() IterOption {
+	return func(p *IterParams) {
+		p.Recursive = true
+	}
+}
+
+// ApplyIterOptions returns the settings resulting from the given options.
+func ApplyIterOptions(options ...IterOption) IterParams {
+	var p IterParams
+	for _, o := range options {
+		o(&p)
+	}
+	return p
+}
+
+// BackendType returns the type of the storage backend of the bucket, e.g. GCS or S3.
+// Buckets report it through a Type method, which wrapping buckets forward.
+func BackendType(b BucketReader) string {
+	if t, ok := b.(interface {
+		Type() string
+	}); ok {
+		return t.Type()
+	}
+	return "unknown"
+}
+
+// ObjectAttributes holds metadata about an object in a bucket.
+type ObjectAttributes struct {
+	// Size is the object's size in bytes.
+	Size int64
+	// LastModified is the time the object was last written.
+	LastModified time.Time
+	// ETag identifies the object's content.
+	ETag string
 }
 
 // UploadDir uploads all files in srcdir to the bucket with into a top-level directory
@@ -62,6 +122,90 @@ func UploadDir(ctx context.Context, bkt Bucket, srcdir, dstdir string) error {
 	})
 }
 
+// UploadDirConcurrently is like UploadDir, but uploads up to concurrency files at a time.
+// If verify is set, each object is verified with VerifyFile right after it was uploaded.
+// Files whose base name is one of last are only uploaded once all other files were uploaded
+// successfully, e.g. to make a directory visible to readers only when it is complete.
+// The first failure cancels the remaining uploads.
+func UploadDirConcurrently(ctx context.Context, bkt Bucket, srcdir, dstdir string, concurrency int, verify bool, last ...string) error {
+	df, err := os.Stat(srcdir)
+	if err != nil {
+		return errors.Wrap(err, "stat dir")
+	}
+	if !df.IsDir() {
+		return errors.Errorf("%s is not a directory", srcdir)
+	}
+	var files, lastFiles []string
+
+	err = filepath.Walk(srcdir, func(src string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		for _, n := range last {
+			if fi.Name() == n {
+				lastFiles = append(lastFiles, src)
+				return nil
+			}
+		}
+		files = append(files, src)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	upload := func(ctx context.Context, src string) error {
+		dst := filepath.Join(dstdir, strings.TrimPrefix(src, srcdir))
+
+		if err := UploadFile(ctx, bkt, src, dst); err != nil {
+			return err
+		}
+		if verify {
+			return VerifyFile(ctx, bkt, src, dst)
+		}
+		return nil
+	}
+	if err := forEachConcurrently(ctx, files, concurrency, upload); err != nil {
+		return err
+	}
+	return forEachConcurrently(ctx, lastFiles, concurrency, upload)
+}
+
+// forEachConcurrently calls f for each of the names with up to concurrency calls at a time.
+// It stops at the first error, which is returned, and cancels the context of pending calls.
+func forEachConcurrently(ctx context.Context, names []string, concurrency int, f func(context.Context, string) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	ch := make(chan string)
+
+	for i := 0; i < concurrency; i++ {
+		g.Go(func() error {
+			for n := range ch {
+				if err := f(gctx, n); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+Loop:
+	for _, n := range names {
+		select {
+		case ch <- n:
+		case <-gctx.Done():
+			break Loop
+		}
+	}
+	close(ch)
+
+	return g.Wait()
+}
+
 // UploadFile uploads the file with the given name to the bucket.
 func UploadFile(ctx context.Context, bkt Bucket, src, dst string) error {
 	r, err := os.Open(src)
@@ -79,16 +223,12 @@ func UploadFile(ctx context.Context, bkt Bucket, src, dst string) error {
 // DirDelim is the delimiter used to model a directory structure in an object store bucket.
 const DirDelim = "/"
 
-// DeleteDir removes all objects prefixed with dir from the bucket.
+// DeleteDir removes all objects prefixed with dir from the bucket. It stops at the first
+// object that cannot be deleted.
 func DeleteDir(ctx context.Context, bkt Bucket, dir string) error {
-	bkt.Iter(ctx, dir, func(name string) error {
-		// If we hit a directory, call DeleteDir recursively.
-		if strings.HasSuffix(name, DirDelim) {
-			return DeleteDir(ctx, bkt, name)
-		}
+	return bkt.Iter(ctx, dir, func(name string) error {
 		return bkt.Delete(ctx, name)
-	})
-	return nil
+	}, WithRecursiveIter())
 }
 
 // DownloadFile downloads the src file from the bucket to dst. If dst is an existing
@@ -130,12 +270,17 @@ func DownloadDir(ctx context.Context, bkt BucketReader, src, dst string) error {
 	if err := os.MkdirAll(dst, 0777); err != nil {
 		return errors.Wrap(err, "create dir")
 	}
+	prefix := ""
+	if src != "" {
+		prefix = strings.TrimSuffix(src, DirDelim) + DirDelim
+	}
 	err := bkt.Iter(ctx, src, func(name string) error {
-		if strings.HasSuffix(name, DirDelim) {
-			return DownloadDir(ctx, bkt, name, filepath.Join(dst, filepath.Base(name)))
+		dir := filepath.Join(dst, filepath.FromSlash(path.Dir(strings.TrimPrefix(name, prefix))))
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return errors.Wrap(err, "create dir")
 		}
-		return DownloadFile(ctx, bkt, name, dst)
-	})
+		return DownloadFile(ctx, bkt, name, dir)
+	}, WithRecursiveIter())
 	// Best-effort cleanup if the download failed.
 	if err != nil {
 		os.RemoveAll(dst)
@@ -143,28 +288,62 @@ func DownloadDir(ctx context.Context, bkt BucketReader, src, dst string) error {
 	return err
 }
 
+// CheckWritable verifies that objects can be written to, read from and deleted from the
+// bucket by doing so with a small sentinel object. The object is deleted even if reading
+// it back fails.
+func CheckWritable(ctx context.Context, bkt Bucket) (err error) {
+	name := fmt.Sprintf("thanos-check-%d", time.Now().UnixNano())
+	content := []byte("thanos bucket check")
+
+	if err := bkt.Upload(ctx, name, bytes.NewReader(content)); err != nil {
+		return errors.Wrapf(err, "write check object %s", name)
+	}
+	defer func() {
+		if derr := bkt.Delete(ctx, name); derr != nil && err == nil {
+			err = errors.Wrapf(derr, "delete check object %s", name)
+		}
+	}()
+
+	rc, err := bkt.Get(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "read check object %s", name)
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return errors.Wrapf(err, "read check object %s", name)
+	}
+	if !bytes.Equal(b, content) {
+		return errors.Errorf("read check object %s: unexpected content", name)
+	}
+	return nil
+}
+
 // BucketWithMetrics takes a bucket and registers metrics with the given registry for
-// operations run against the bucket.
+// operations run against the bucket. The metrics are labeled with the bucket name and the
+// type of its backend so that buckets of different providers can be told apart.
 func BucketWithMetrics(name string, b Bucket, r prometheus.Registerer) Bucket {
+	constLabels := prometheus.Labels{"bucket": name, "backend": BackendType(b)}
+
 	bkt := &metricBucket{
 		bkt: b,
 
 		ops: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name:        "thanos_objstore_bucket_operations_total",
 			Help:        "Total number of operations against a bucket.",
-			ConstLabels: prometheus.Labels{"bucket": name},
+			ConstLabels: constLabels,
 		}, []string{"operation"}),
 
 		opsFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name:        "thanos_objstore_bucket_operation_failures_total",
 			Help:        "Total number of operations against a bucket that failed.",
-			ConstLabels: prometheus.Labels{"bucket": name},
+			ConstLabels: constLabels,
 		}, []string{"operation"}),
 
 		opsDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name:        "thanos_objstore_bucket_operation_duration_seconds",
 			Help:        "Duration of operations against the bucket",
-			ConstLabels: prometheus.Labels{"bucket": name},
+			ConstLabels: constLabels,
 			Buckets:     []float64{0.005, 0.01, 0.02, 0.04, 0.08, 0.15, 0.3, 0.6, 1, 1.5, 2.5, 5, 10, 20, 30},
 		}, []string{"operation"}),
 	}
@@ -182,10 +361,14 @@ type metricBucket struct {
 	opsDuration *prometheus.HistogramVec
 }
 
-func (b *metricBucket) Iter(ctx context.Context, dir string, f func(name string) error) error {
+func (b *metricBucket) Type() string {
+	return BackendType(b.bkt)
+}
+
+func (b *metricBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
 	const op = "iter"
 
-	err := b.bkt.Iter(ctx, dir, f)
+	err := b.bkt.Iter(ctx, dir, f, options...)
 	if err != nil {
 		b.opsFailures.WithLabelValues(op).Inc()
 	}
@@ -238,6 +421,20 @@ func (b *metricBucket) Exists(ctx context.Context, name string) (bool, error) {
 	return ok, err
 }
 
+func (b *metricBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	const op = "attributes"
+	start := time.Now()
+
+	attrs, err := b.bkt.Attributes(ctx, name)
+	if err != nil {
+		b.opsFailures.WithLabelValues(op).Inc()
+	}
+	b.ops.WithLabelValues(op).Inc()
+	b.opsDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+
+	return attrs, err
+}
+
 func (b *metricBucket) Upload(ctx context.Context, name string, r io.Reader) error {
 	const op = "upload"
 	start := time.Now()
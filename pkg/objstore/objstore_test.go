@@ -0,0 +1,229 @@
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/gcs"
+	"github.com/improbable-eng/thanos/pkg/objstore/inmem"
+	"github.com/improbable-eng/thanos/pkg/objstore/s3"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// readOnlyBucket rejects all writes.
+type readOnlyBucket struct {
+	*inmem.Bucket
+}
+
+func (b readOnlyBucket) Upload(context.Context, string, io.Reader) error {
+	return errors.New("access denied")
+}
+
+// unreadableBucket fails all reads.
+type unreadableBucket struct {
+	*inmem.Bucket
+}
+
+func (b unreadableBucket) Get(context.Context, string) (io.ReadCloser, error) {
+	return nil, errors.New("read failed")
+}
+
+func TestCheckWritable(t *testing.T) {
+	bkt := inmem.NewBucket()
+	testutil.Ok(t, objstore.CheckWritable(context.Background(), bkt))
+
+	// The check must not leave objects behind.
+	testutil.Equals(t, 0, len(bkt.Objects()))
+
+	testutil.NotOk(t, objstore.CheckWritable(context.Background(), readOnlyBucket{inmem.NewBucket()}))
+
+	// The object must be deleted even if it cannot be read back.
+	bkt = inmem.NewBucket()
+	testutil.NotOk(t, objstore.CheckWritable(context.Background(), unreadableBucket{bkt}))
+	testutil.Equals(t, 0, len(bkt.Objects()))
+}
+
+// offlineBucket answers Exists without contacting the backend of the wrapped bucket.
+type offlineBucket struct {
+	objstore.Bucket
+}
+
+func (b offlineBucket) Type() string {
+	return objstore.BackendType(b.Bucket)
+}
+
+func (b offlineBucket) Exists(context.Context, string) (bool, error) {
+	return false, nil
+}
+
+func TestBucketWithMetrics_BackendLabel(t *testing.T) {
+	s3Bkt, err := s3.NewBucket(&s3.Config{
+		Bucket:    "thanos-s3",
+		Endpoint:  "localhost:9000",
+		AccessKey: "key",
+		SecretKey: "secret",
+	}, nil)
+	testutil.Ok(t, err)
+
+	reg := prometheus.NewRegistry()
+
+	// Buckets of different backends can be instrumented in the same registry.
+	for name, bkt := range map[string]objstore.Bucket{
+		"thanos-gcs": gcs.NewBucket("thanos-gcs", nil, 0, nil),
+		"thanos-s3":  s3Bkt,
+	} {
+		_, err := objstore.BucketWithMetrics(name, offlineBucket{bkt}, reg).Exists(context.Background(), "obj")
+		testutil.Ok(t, err)
+	}
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+
+	backends := map[string]string{}
+	for _, mf := range mfs {
+		if mf.GetName() != "thanos_objstore_bucket_operation_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			lbls := map[string]string{}
+			for _, l := range m.GetLabel() {
+				lbls[l.GetName()] = l.GetValue()
+			}
+			backends[lbls["bucket"]] = lbls["backend"]
+		}
+	}
+	testutil.Equals(t, map[string]string{"thanos-gcs": "GCS", "thanos-s3": "S3"}, backends)
+
+	// Wrapping buckets retain the type of the backend.
+	gcsBkt := objstore.BucketWithMetrics("thanos-gcs", gcs.NewBucket("thanos-gcs", nil, 0, nil), nil)
+	testutil.Equals(t, "GCS", objstore.BackendType(objstore.LimitedBucket(gcsBkt, 1, 0)))
+	testutil.Equals(t, "INMEM", objstore.BackendType(readOnlyBucket{}))
+	testutil.Equals(t, "unknown", objstore.BackendType(struct{ objstore.Bucket }{}))
+}
+
+func TestDownloadDir(t *testing.T) {
+	ctx := context.Background()
+	bkt := inmem.NewBucket()
+	for _, name := range []string{"block/meta.json", "block/chunks/000001", "block/chunks/000002", "other/index"} {
+		testutil.Ok(t, bkt.Upload(ctx, name, bytes.NewReader([]byte(name))))
+	}
+
+	dir, err := ioutil.TempDir("", "download-dir")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	testutil.Ok(t, objstore.DownloadDir(ctx, bkt, "block", filepath.Join(dir, "block")))
+
+	for _, name := range []string{"block/meta.json", "block/chunks/000001", "block/chunks/000002"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		testutil.Ok(t, err)
+		testutil.Equals(t, name, string(b))
+	}
+	_, err = os.Stat(filepath.Join(dir, "other"))
+	testutil.Assert(t, os.IsNotExist(err), "objects outside of the directory must not be downloaded")
+
+	testutil.Ok(t, objstore.DeleteDir(ctx, bkt, "block"))
+	testutil.Equals(t, 1, len(bkt.Objects()))
+}
+
+// undeletableBucket fails all deletions.
+type undeletableBucket struct {
+	*inmem.Bucket
+}
+
+func (b undeletableBucket) Delete(context.Context, string) error {
+	return errors.New("delete failed")
+}
+
+func TestDeleteDir(t *testing.T) {
+	ctx := context.Background()
+	bkt := inmem.NewBucket()
+	for _, name := range []string{"block/meta.json", "block/chunks/000001", "other/index"} {
+		testutil.Ok(t, bkt.Upload(ctx, name, bytes.NewReader([]byte(name))))
+	}
+
+	testutil.NotOk(t, objstore.DeleteDir(ctx, undeletableBucket{bkt}, "block"))
+	testutil.Equals(t, 3, len(bkt.Objects()))
+
+	testutil.Ok(t, objstore.DeleteDir(ctx, bkt, "block"))
+	testutil.Equals(t, 1, len(bkt.Objects()))
+}
+
+// barrierBucket holds back uploads until the given number of them is in flight and records
+// the order in which they completed.
+type barrierBucket struct {
+	*inmem.Bucket
+
+	mtx      sync.Mutex
+	wait     int
+	inflight int
+	ready    chan struct{}
+	uploaded []string
+}
+
+func (b *barrierBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.mtx.Lock()
+	b.inflight++
+	if b.inflight == b.wait {
+		close(b.ready)
+	}
+	b.mtx.Unlock()
+
+	select {
+	case <-b.ready:
+	case <-time.After(5 * time.Second):
+		return errors.Errorf("upload of %s was not concurrent", name)
+	}
+	if err := b.Bucket.Upload(ctx, name, r); err != nil {
+		return err
+	}
+	b.mtx.Lock()
+	b.uploaded = append(b.uploaded, name)
+	b.mtx.Unlock()
+	return nil
+}
+
+func TestUploadDirConcurrently(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "upload-dir")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	testutil.Ok(t, os.MkdirAll(filepath.Join(dir, "chunks"), 0777))
+	for _, name := range []string{"chunks/000001", "chunks/000002", "chunks/000003", "index", "meta.json"} {
+		testutil.Ok(t, ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(name), 0666))
+	}
+
+	// All files but the meta file must be in flight at once before it is uploaded.
+	bkt := &barrierBucket{Bucket: inmem.NewBucket(), wait: 4, ready: make(chan struct{})}
+	testutil.Ok(t, objstore.UploadDirConcurrently(ctx, bkt, dir, "block", 4, true, "meta.json"))
+
+	testutil.Equals(t, 5, len(bkt.uploaded))
+	testutil.Equals(t, "block/meta.json", bkt.uploaded[4])
+	for name, b := range bkt.Objects() {
+		testutil.Equals(t, name, "block/"+string(b))
+	}
+
+	// A failed upload stops the directory's upload before the meta file is uploaded.
+	errUpload := errors.New("upload failed")
+	fbkt := inmem.NewBucket()
+	fbkt.FailUpload(2, errUpload)
+
+	err = objstore.UploadDirConcurrently(ctx, fbkt, dir, "block", 2, false, "meta.json")
+	testutil.Equals(t, errUpload, errors.Cause(err))
+
+	ok, err := fbkt.Exists(ctx, "block/meta.json")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "meta file of failed upload was uploaded")
+}
@@ -0,0 +1,117 @@
+package objtesting
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+// AcceptanceTest checks that bkt behaves like an object storage bucket as expected by the
+// rest of Thanos. It covers listing, reading whole objects and ranges of them, handling of
+// missing objects, overwrites and deletions. The bucket must be empty and is left empty if
+// the test passes.
+func AcceptanceTest(t *testing.T, bkt objstore.Bucket) {
+	ctx := context.Background()
+
+	t.Run("missing object", func(t *testing.T) {
+		ok, err := bkt.Exists(ctx, "id1/obj_1.some")
+		testutil.Ok(t, err)
+		testutil.Assert(t, !ok, "missing object exists")
+
+		_, err = bkt.Get(ctx, "id1/obj_1.some")
+		testutil.NotOk(t, err)
+
+		_, err = bkt.GetRange(ctx, "id1/obj_1.some", 0, 1)
+		testutil.NotOk(t, err)
+
+		_, err = bkt.Attributes(ctx, "id1/obj_1.some")
+		testutil.NotOk(t, err)
+
+		// Listing a missing directory is not an error since object storages have no directories.
+		testutil.Equals(t, []string(nil), iter(t, bkt, "id1"))
+	})
+
+	t.Run("read", func(t *testing.T) {
+		testutil.Ok(t, bkt.Upload(ctx, "id1/obj_1.some", strings.NewReader("@test-data@")))
+
+		ok, err := bkt.Exists(ctx, "id1/obj_1.some")
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "uploaded object does not exist")
+
+		testutil.Equals(t, "@test-data@", get(t, bkt, "id1/obj_1.some"))
+
+		attrs, err := bkt.Attributes(ctx, "id1/obj_1.some")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(11), attrs.Size)
+		testutil.Assert(t, !attrs.LastModified.IsZero(), "missing modification time")
+
+		testutil.Equals(t, "test", getRange(t, bkt, "id1/obj_1.some", 1, 4))
+		testutil.Equals(t, "@test-data@", getRange(t, bkt, "id1/obj_1.some", 0, 11))
+		// Ranges beyond the end of the object are truncated.
+		testutil.Equals(t, "data@", getRange(t, bkt, "id1/obj_1.some", 6, 100))
+
+		// Directories are not objects.
+		ok, err = bkt.Exists(ctx, "id1")
+		testutil.Ok(t, err)
+		testutil.Assert(t, !ok, "directory exists as object")
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		testutil.Ok(t, bkt.Upload(ctx, "id1/obj_1.some", strings.NewReader("@test-data2@")))
+		testutil.Equals(t, "@test-data2@", get(t, bkt, "id1/obj_1.some"))
+
+		attrs, err := bkt.Attributes(ctx, "id1/obj_1.some")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(12), attrs.Size)
+
+		// Empty objects are valid.
+		testutil.Ok(t, bkt.Upload(ctx, "id1/obj_1.some", bytes.NewReader(nil)))
+		testutil.Equals(t, "", get(t, bkt, "id1/obj_1.some"))
+	})
+
+	t.Run("iter", func(t *testing.T) {
+		for _, n := range []string{"id1/obj_2.some", "id1/obj_3.some", "id1/sub/obj_4.some", "id2/obj_5.some", "obj_6.some"} {
+			testutil.Ok(t, bkt.Upload(ctx, n, strings.NewReader("@test-data@")))
+		}
+
+		testutil.Equals(t, []string{"id1/", "id2/", "obj_6.some"}, iter(t, bkt, ""))
+
+		exp := []string{"id1/obj_1.some", "id1/obj_2.some", "id1/obj_3.some", "id1/sub/"}
+		testutil.Equals(t, exp, iter(t, bkt, "id1"))
+		testutil.Equals(t, exp, iter(t, bkt, "id1/"))
+
+		// Names sharing the directory's name as a prefix are not part of the directory.
+		testutil.Equals(t, []string(nil), iter(t, bkt, "id"))
+		testutil.Equals(t, []string{"id1/sub/obj_4.some"}, iter(t, bkt, "id1/sub"))
+
+		testutil.Equals(t, []string{
+			"id1/obj_1.some", "id1/obj_2.some", "id1/obj_3.some", "id1/sub/obj_4.some",
+		}, iter(t, bkt, "id1", objstore.WithRecursiveIter()))
+		testutil.Equals(t, []string{
+			"id1/obj_1.some", "id1/obj_2.some", "id1/obj_3.some", "id1/sub/obj_4.some", "id2/obj_5.some", "obj_6.some",
+		}, iter(t, bkt, "", objstore.WithRecursiveIter()))
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		testutil.Ok(t, bkt.Delete(ctx, "id1/sub/obj_4.some"))
+
+		ok, err := bkt.Exists(ctx, "id1/sub/obj_4.some")
+		testutil.Ok(t, err)
+		testutil.Assert(t, !ok, "deleted object exists")
+
+		_, err = bkt.Get(ctx, "id1/sub/obj_4.some")
+		testutil.NotOk(t, err)
+
+		// Directories disappear along with their last object.
+		testutil.Equals(t, []string{"id1/obj_1.some", "id1/obj_2.some", "id1/obj_3.some"}, iter(t, bkt, "id1"))
+
+		testutil.Ok(t, objstore.DeleteDir(ctx, bkt, "id1"))
+		testutil.Ok(t, objstore.DeleteDir(ctx, bkt, "id2"))
+		testutil.Ok(t, bkt.Delete(ctx, "obj_6.some"))
+		testutil.Equals(t, []string(nil), iter(t, bkt, ""))
+	})
+}
@@ -0,0 +1,178 @@
+// Package objtesting provides tests that every implementation of objstore.Bucket must pass and
+// helpers for testing implementations against fake servers.
+package objtesting
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+// ListEntry is an entry of a listing page returned by List.
+type ListEntry struct {
+	Name string
+	// Prefix is true for common prefixes, which end with the delimiter.
+	Prefix bool
+}
+
+// List computes a page of a listing of the objects with the given names the way object storages
+// answer list requests. Only names with the prefix and after the marker are listed, in order.
+// If a delimiter is given, names containing it after the prefix are rolled up into a common
+// prefix. At most limit entries are returned and truncated reports whether more follow.
+func List(names []string, prefix, delimiter, marker string, limit int) (entries []ListEntry, truncated bool) {
+	unique := map[string]bool{}
+	for _, n := range names {
+		if !strings.HasPrefix(n, prefix) {
+			continue
+		}
+		if i := strings.Index(n[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			unique[n[:len(prefix)+i+len(delimiter)]] = true
+		} else {
+			unique[n] = false
+		}
+	}
+	for n, isPrefix := range unique {
+		if n > marker {
+			entries = append(entries, ListEntry{Name: n, Prefix: isPrefix})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	if len(entries) > limit {
+		return entries[:limit], true
+	}
+	return entries, false
+}
+
+// ObjectsTest checks writing, listing, reading and deleting a few objects in bkt, which must be
+// empty. Provider tests run it against fake servers configured with small part and page sizes
+// so that the objects are uploaded in several parts and listed over several pages. attrs returns
+// the attributes the server reports for an object with the given content. The object c is
+// deleted by the test while a/1, a/2 and b/1 are left in place.
+func ObjectsTest(t *testing.T, bkt objstore.Bucket, attrs func(b []byte) objstore.ObjectAttributes) {
+	ctx := context.Background()
+
+	for _, n := range []string{"a/1", "a/2", "b/1", "c"} {
+		testutil.Ok(t, bkt.Upload(ctx, n, strings.NewReader("content of "+n)))
+	}
+	testutil.Equals(t, []string{"a/", "b/", "c"}, iter(t, bkt, ""))
+	testutil.Equals(t, []string{"a/1", "a/2"}, iter(t, bkt, "a"))
+
+	testutil.Equals(t, "content of a/1", get(t, bkt, "a/1"))
+	testutil.Equals(t, "tent", getRange(t, bkt, "a/1", 3, 4))
+
+	a, err := bkt.Attributes(ctx, "c")
+	testutil.Ok(t, err)
+	testutil.Equals(t, attrs([]byte("content of c")), a)
+
+	ok, err := bkt.Exists(ctx, "c")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "object c not found")
+
+	testutil.Ok(t, bkt.Delete(ctx, "c"))
+
+	ok, err = bkt.Exists(ctx, "c")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "object c not deleted")
+
+	_, err = bkt.Get(ctx, "c")
+	testutil.NotOk(t, err)
+	_, err = bkt.Attributes(ctx, "c")
+	testutil.NotOk(t, err)
+}
+
+// FailedUploadTest checks that an upload whose reader fails after 8 bytes returns an error and
+// leaves no object behind. Buckets uploading in parts should be configured with a part size
+// below 8 bytes so that the reader fails after some parts were uploaded.
+func FailedUploadTest(t *testing.T, bkt objstore.Bucket) {
+	ctx := context.Background()
+
+	err := bkt.Upload(ctx, "obj", FailingReader([]byte("12345678")))
+	testutil.NotOk(t, err)
+
+	ok, err := bkt.Exists(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "object of failed upload exists")
+}
+
+// FailingReader returns a reader that returns an error once data is consumed.
+func FailingReader(data []byte) io.Reader {
+	return &failingReader{data: data}
+}
+
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, fmt.Errorf("read failed")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// WrongCredentialsTest checks that an upload to bkt, which is configured with credentials the
+// server rejects, fails with an error mentioning the server's error code.
+func WrongCredentialsTest(t *testing.T, bkt objstore.Bucket, code string) {
+	err := bkt.Upload(context.Background(), "obj", bytes.NewReader([]byte("a")))
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), code), "unexpected error %s", err)
+}
+
+// ConfigCase is a provider config along with whether it is valid.
+type ConfigCase struct {
+	Conf interface {
+		Validate() error
+	}
+	OK bool
+}
+
+// ValidateTest checks that Validate accepts exactly the valid configs.
+func ValidateTest(t *testing.T, cases []ConfigCase) {
+	for _, c := range cases {
+		err := c.Conf.Validate()
+		testutil.Assert(t, (err == nil) == c.OK, "unexpected validation result %v for %+v", err, c.Conf)
+	}
+}
+
+// iter returns the sorted names passed by Iter, since providers differ in the order in
+// which they list directories and objects.
+func iter(t *testing.T, bkt objstore.Bucket, dir string, options ...objstore.IterOption) []string {
+	var names []string
+	testutil.Ok(t, bkt.Iter(context.Background(), dir, func(n string) error {
+		names = append(names, n)
+		return nil
+	}, options...))
+	sort.Strings(names)
+	return names
+}
+
+func get(t *testing.T, bkt objstore.Bucket, name string) string {
+	rc, err := bkt.Get(context.Background(), name)
+	testutil.Ok(t, err)
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	return string(b)
+}
+
+func getRange(t *testing.T, bkt objstore.Bucket, name string, off, length int64) string {
+	rc, err := bkt.GetRange(context.Background(), name, off, length)
+	testutil.Ok(t, err)
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	return string(b)
+}
@@ -1,4 +1,4 @@
-package testutil
+package objtesting
 
 import (
 	"context"
@@ -12,16 +12,16 @@ import (
 
 	"cloud.google.com/go/storage"
 	"github.com/improbable-eng/thanos/pkg/objstore/gcs"
-
+	"github.com/improbable-eng/thanos/pkg/testutil"
 	"google.golang.org/api/iterator"
 )
 
-// NewObjectStoreBucket creates a new GCS bucket with a random name and a cleanup function
+// NewGCSBucket creates a new GCS bucket with a random name and a cleanup function
 // that deletes it.
 //
 // TODO(fabxc): define object storage interface and have this method return
 // mocks or actual remote buckets depending on env vars.
-func NewObjectStoreBucket(t testing.TB) (*gcs.Bucket, func()) {
+func NewGCSBucket(t testing.TB) (*gcs.Bucket, func()) {
 	project, ok := os.LookupEnv("GCP_PROJECT")
 	// TODO(fabxc): make it run against a mock store if no actual bucket is configured.
 	if !ok {
@@ -30,16 +30,16 @@ func NewObjectStoreBucket(t testing.TB) (*gcs.Bucket, func()) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	gcsClient, err := storage.NewClient(ctx)
-	Ok(t, err)
+	testutil.Ok(t, err)
 
 	src := rand.NewSource(time.Now().UnixNano())
-	Ok(t, err)
+	testutil.Ok(t, err)
 	name := fmt.Sprintf("test_%s_%x", strings.ToLower(t.Name()), src.Int63())
 
 	bkt := gcsClient.Bucket(name)
-	Ok(t, bkt.Create(ctx, project, nil))
+	testutil.Ok(t, bkt.Create(ctx, project, nil))
 
-	return gcs.NewBucket(name, bkt, nil), func() {
+	return gcs.NewBucket(name, bkt, 0, nil), func() {
 		deleteAllBucket(t, ctx, bkt)
 		cancel()
 		gcsClient.Close()
@@ -55,7 +55,7 @@ func deleteAllBucket(t testing.TB, ctx context.Context, bkt *storage.BucketHandl
 		if err == iterator.Done {
 			break
 		}
-		Ok(t, err)
+		testutil.Ok(t, err)
 
 		wg.Add(1)
 		go func() {
@@ -67,5 +67,5 @@ func deleteAllBucket(t testing.TB, ctx context.Context, bkt *storage.BucketHandl
 	}
 	wg.Wait()
 
-	Ok(t, bkt.Delete(ctx))
+	testutil.Ok(t, bkt.Delete(ctx))
 }
@@ -0,0 +1,540 @@
+// Package oss implements common object storage abstractions against Alibaba Cloud Object Storage Service.
+package oss
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	opObjectsList  = "GetBucket"
+	opObjectInsert = "PutObject"
+	opObjectGet    = "GetObject"
+	opObjectStat   = "HeadObject"
+	opObjectDelete = "DeleteObject"
+)
+
+// DirDelim is the delimiter used to model a directory structure in an object store bucket.
+const DirDelim = "/"
+
+const (
+	// defaultPartSize is the size of the parts larger objects are uploaded in. Objects of at
+	// most this size are uploaded in a single request.
+	defaultPartSize = 64 * 1024 * 1024
+	// listLimit is the maximum number of entries returned per listing request.
+	listLimit = 1000
+)
+
+// subResources are the query parameters that are part of the signed resource.
+var subResources = map[string]bool{
+	"partNumber": true,
+	"uploadId":   true,
+	"uploads":    true,
+}
+
+// Config encapsulates the necessary config values to instantiate an OSS client.
+type Config struct {
+	// Endpoint is the OSS endpoint of the bucket's region without the bucket name,
+	// e.g. oss-cn-hangzhou.aliyuncs.com. HTTPS is used unless a scheme is given.
+	Endpoint        string `yaml:"endpoint"`
+	Bucket          string `yaml:"bucket"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	AccessKeySecret string `yaml:"access_key_secret"`
+	// TLSConfig is the TLS policy of connections to the OSS endpoint, e.g. to enforce a
+	// minimum TLS version. It cannot be set through YAML.
+	TLSConfig *tls.Config `yaml:"-"`
+	// HTTPConfig tunes the connection pool of the client. Its TLS settings take precedence
+	// over TLSConfig.
+	HTTPConfig objstore.TransportConfig `yaml:"http_config"`
+}
+
+// Validate checks to see if any of the OSS config options are set.
+func (conf *Config) Validate() error {
+	switch {
+	case conf.Bucket == "":
+		return errors.New("insufficient oss configuration information: missing bucket")
+	case conf.Endpoint == "":
+		return errors.New("insufficient oss configuration information: missing endpoint")
+	case conf.AccessKeyID == "":
+		return errors.New("insufficient oss configuration information: missing access key ID")
+	case conf.AccessKeySecret == "":
+		return errors.New("insufficient oss configuration information: missing access key secret")
+	}
+	return conf.HTTPConfig.Validate()
+}
+
+// Bucket implements the store.Bucket and shipper.Bucket interfaces against an OSS bucket.
+type Bucket struct {
+	client       *http.Client
+	endpoint     *url.URL
+	name         string
+	accessKeyID  string
+	accessSecret string
+	partSize     int
+	opsTotal     *prometheus.CounterVec
+}
+
+// NewBucket returns a new Bucket using the provided OSS config values.
+func NewBucket(conf *Config, reg prometheus.Registerer) (*Bucket, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	endpoint := conf.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse oss endpoint %s", conf.Endpoint)
+	}
+	// Requests are made against the virtual-hosted style bucket endpoint.
+	u.Host = conf.Bucket + "." + u.Host
+
+	bkt := &Bucket{
+		client:       &http.Client{Transport: conf.HTTPConfig.NewTransport(conf.TLSConfig)},
+		endpoint:     u,
+		name:         conf.Bucket,
+		accessKeyID:  conf.AccessKeyID,
+		accessSecret: conf.AccessKeySecret,
+		partSize:     defaultPartSize,
+		opsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_objstore_oss_bucket_operations_total",
+			Help:        "Total number of operations that were executed against an Alibaba Cloud OSS bucket.",
+			ConstLabels: prometheus.Labels{"bucket": conf.Bucket},
+		}, []string{"operation"}),
+	}
+	if reg != nil {
+		reg.MustRegister(bkt.opsTotal)
+	}
+	return bkt, nil
+}
+
+// Type returns the type of the bucket's backend.
+func (b *Bucket) Type() string {
+	return "OSS"
+}
+
+// newRequest returns a new request against the object with the given name. If name is empty,
+// the request is made against the bucket.
+func (b *Bucket) newRequest(ctx context.Context, method, name string, q url.Values, body io.Reader) (*http.Request, error) {
+	u := *b.endpoint
+	u.Path = "/" + name
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+	return req, nil
+}
+
+// do signs and sends the request. It returns an error if the response status is not among the given ones.
+func (b *Bucket) do(req *http.Request, status ...int) (*http.Response, error) {
+	req.Header.Set("Authorization", "OSS "+b.accessKeyID+":"+signature(b.accessSecret, b.name, req))
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range status {
+		if resp.StatusCode == s {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	// Responses to HEAD requests have no body to describe the error.
+	if body, err := ioutil.ReadAll(resp.Body); err == nil && len(body) > 0 {
+		xml.Unmarshal(body, &e)
+	}
+	if e.Code == "" {
+		e.Code = resp.Status
+	}
+	return nil, errors.Errorf("%s %s: %s %s", req.Method, req.URL.Path, e.Code, strings.TrimSpace(e.Message))
+}
+
+// signature returns the signature of the request as described in
+// https://www.alibabacloud.com/help/doc-detail/31951.htm.
+func signature(secret, bucket string, req *http.Request) string {
+	var headers []string
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-oss-") {
+			headers = append(headers, lk+":"+strings.TrimSpace(req.Header.Get(k))+"\n")
+		}
+	}
+	sort.Strings(headers)
+
+	q := req.URL.Query()
+	var params []string
+	for k := range q {
+		if !subResources[k] {
+			continue
+		}
+		if v := q.Get(k); v != "" {
+			params = append(params, k+"="+v)
+		} else {
+			params = append(params, k)
+		}
+	}
+	sort.Strings(params)
+
+	resource := "/" + bucket + req.URL.Path
+	if len(params) > 0 {
+		resource += "?" + strings.Join(params, "&")
+	}
+	stringToSign := req.Method + "\n" +
+		req.Header.Get("Content-MD5") + "\n" +
+		req.Header.Get("Content-Type") + "\n" +
+		req.Header.Get("Date") + "\n" +
+		strings.Join(headers, "") +
+		resource
+
+	h := hmac.New(sha1.New, []byte(secret))
+	h.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// listResult is the response to a GetBucket request.
+type listResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated bool   `xml:"IsTruncated"`
+	NextMarker  string `xml:"NextMarker"`
+}
+
+// Iter calls f for each entry in the given directory. The argument to f is the full
+// object name including the prefix of the inspected directory. If the listing is
+// recursive, the names of all objects below the directory are passed to f instead.
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	b.opsTotal.WithLabelValues(opObjectsList).Inc()
+	params := objstore.ApplyIterOptions(options...)
+
+	// Ensure the object name actually ends with a dir suffix. Otherwise we'll just iterate the
+	// object itself as one prefix item.
+	if dir != "" {
+		dir = strings.TrimSuffix(dir, DirDelim) + DirDelim
+	}
+	var marker string
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		// Names are URL-encoded in the response since XML cannot hold all characters allowed in them.
+		q := url.Values{
+			"prefix":        []string{dir},
+			"delimiter":     []string{DirDelim},
+			"max-keys":      []string{strconv.Itoa(listLimit)},
+			"encoding-type": []string{"url"},
+		}
+		if params.Recursive {
+			q.Del("delimiter")
+		}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		req, err := b.newRequest(ctx, http.MethodGet, "", q, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := b.do(req, http.StatusOK)
+		if err != nil {
+			return errors.Wrap(err, "list oss objects")
+		}
+		var res listResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return errors.Wrap(err, "decode oss object list")
+		}
+		// Objects and prefixes are listed separately but each page covers a contiguous range of names.
+		var names []string
+		for _, c := range res.Contents {
+			names = append(names, c.Key)
+		}
+		for _, p := range res.CommonPrefixes {
+			names = append(names, p.Prefix)
+		}
+		for i, n := range names {
+			if names[i], err = url.QueryUnescape(n); err != nil {
+				return errors.Wrapf(err, "decode oss object name %s", n)
+			}
+		}
+		sort.Strings(names)
+
+		for _, n := range names {
+			if err := f(n); err != nil {
+				return err
+			}
+		}
+		if !res.IsTruncated {
+			return nil
+		}
+		// Unlike S3, OSS returns a next marker also without a delimiter, and it is encoded as well.
+		if marker, err = url.QueryUnescape(res.NextMarker); err != nil {
+			return errors.Wrapf(err, "decode oss marker %s", res.NextMarker)
+		}
+	}
+}
+
+// Get returns a reader for the given object name.
+func (b *Bucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.opsTotal.WithLabelValues(opObjectGet).Inc()
+
+	req, err := b.newRequest(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(req, http.StatusOK)
+	if err != nil {
+		return nil, errors.Wrap(err, "get oss object")
+	}
+	return resp.Body, nil
+}
+
+// GetRange returns a new range reader for the given object name and range.
+func (b *Bucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b.opsTotal.WithLabelValues(opObjectGet).Inc()
+
+	req, err := b.newRequest(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	// By default OSS ignores ranges exceeding the object and returns all of it. With the standard
+	// behavior such ranges are truncated to the object's end or rejected as in HTTP.
+	req.Header.Set("x-oss-range-behavior", "standard")
+
+	resp, err := b.do(req, http.StatusOK, http.StatusPartialContent)
+	if err != nil {
+		return nil, errors.Wrap(err, "get oss object range")
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		return resp.Body, nil
+	}
+	// The range was ignored, so the requested part is cut out of the full object.
+	if _, err := io.CopyN(ioutil.Discard, resp.Body, off); err != nil {
+		resp.Body.Close()
+		return nil, errors.Wrap(err, "skip to range start")
+	}
+	return rangeReadCloser{Reader: io.LimitReader(resp.Body, length), Closer: resp.Body}, nil
+}
+
+type rangeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// head returns the response to a HEAD Object request or nil if the object does not exist.
+func (b *Bucket) head(ctx context.Context, name string) (*http.Response, error) {
+	b.opsTotal.WithLabelValues(opObjectStat).Inc()
+
+	req, err := b.newRequest(ctx, http.MethodHead, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(req, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return nil, errors.Wrap(err, "head oss object")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+// Exists checks if the given object exists.
+func (b *Bucket) Exists(ctx context.Context, name string) (bool, error) {
+	resp, err := b.head(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	return resp != nil, nil
+}
+
+// Attributes returns information about the object with the given name.
+func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	resp, err := b.head(ctx, name)
+	if err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	if resp == nil {
+		return objstore.ObjectAttributes{}, errors.Errorf("oss object %s does not exist", name)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrap(err, "parse content length")
+	}
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrap(err, "parse last modified time")
+	}
+	return objstore.ObjectAttributes{
+		Size:         size,
+		LastModified: modified,
+		ETag:         strings.Trim(resp.Header.Get("ETag"), `"`),
+	}, nil
+}
+
+// Upload the contents of the reader as an object into the bucket.
+// Objects larger than the part size are uploaded with a multipart upload.
+func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.opsTotal.WithLabelValues(opObjectInsert).Inc()
+
+	buf := make([]byte, b.partSize)
+
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err := b.put(ctx, name, nil, buf[:n])
+		return errors.Wrap(err, "upload oss object")
+	}
+	if err != nil {
+		return errors.Wrap(err, "read upload")
+	}
+
+	uploadID, err := b.initiateMultipartUpload(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := b.uploadParts(ctx, name, uploadID, r, buf); err != nil {
+		// Abort the upload so that its parts do not linger in the bucket.
+		if req, aerr := b.newRequest(ctx, http.MethodDelete, name, url.Values{"uploadId": []string{uploadID}}, nil); aerr == nil {
+			if resp, aerr := b.do(req, http.StatusNoContent); aerr == nil {
+				resp.Body.Close()
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// initiateMultipartUpload starts a multipart upload of the object and returns its ID.
+func (b *Bucket) initiateMultipartUpload(ctx context.Context, name string) (string, error) {
+	req, err := b.newRequest(ctx, http.MethodPost, name, url.Values{"uploads": []string{""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := b.do(req, http.StatusOK)
+	if err != nil {
+		return "", errors.Wrap(err, "initiate oss multipart upload")
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", errors.Wrap(err, "decode oss multipart upload")
+	}
+	return res.UploadID, nil
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// uploadParts uploads the first part held by buf and the remainder of r as parts of the
+// multipart upload and completes it.
+func (b *Bucket) uploadParts(ctx context.Context, name, uploadID string, r io.Reader, buf []byte) error {
+	var (
+		parts []completePart
+		n     = len(buf)
+		err   error
+	)
+	for err != io.EOF {
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return errors.Wrap(err, "read upload")
+		}
+		num := len(parts) + 1
+
+		q := url.Values{"partNumber": []string{strconv.Itoa(num)}, "uploadId": []string{uploadID}}
+		etag, perr := b.put(ctx, name, q, buf[:n])
+		if perr != nil {
+			return errors.Wrapf(perr, "upload part %d of oss object", num)
+		}
+		parts = append(parts, completePart{PartNumber: num, ETag: etag})
+
+		n, err = io.ReadFull(r, buf)
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return errors.Wrap(err, "encode part list")
+	}
+	req, err := b.newRequest(ctx, http.MethodPost, name, url.Values{"uploadId": []string{uploadID}}, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req, http.StatusOK)
+	if err != nil {
+		return errors.Wrap(err, "complete oss multipart upload")
+	}
+	return resp.Body.Close()
+}
+
+// put sends a PUT request with the given body against the object and returns the ETag of
+// the written data. Without a query, the body is written as the full object.
+func (b *Bucket) put(ctx context.Context, name string, q url.Values, body []byte) (string, error) {
+	req, err := b.newRequest(ctx, http.MethodPut, name, q, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	resp, err := b.do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	return resp.Header.Get("ETag"), nil
+}
+
+// Delete removes the object with the given name.
+func (b *Bucket) Delete(ctx context.Context, name string) error {
+	b.opsTotal.WithLabelValues(opObjectDelete).Inc()
+
+	req, err := b.newRequest(ctx, http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req, http.StatusNoContent)
+	if err != nil {
+		return errors.Wrap(err, "delete oss object")
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,306 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/objtesting"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+const (
+	testAccessKeyID     = "LTAI4Fexample"
+	testAccessKeySecret = "p7FeJjbYcyexampleSecret"
+)
+
+// fakeOSS implements the subset of the OSS API used by the bucket and verifies the
+// signature of every request.
+type fakeOSS struct {
+	t *testing.T
+
+	mtx     sync.Mutex
+	objects map[string][]byte
+	parts   map[string][]byte
+	uploads int
+	aborted int
+	// ignoreRange makes the server return full objects for range requests.
+	ignoreRange bool
+	pageSize    int
+}
+
+func newFakeOSS(t *testing.T) (*fakeOSS, *httptest.Server) {
+	s := &fakeOSS{t: t, objects: map[string][]byte{}, parts: map[string][]byte{}, pageSize: 2}
+	return s, httptest.NewServer(s)
+}
+
+// verify checks the Authorization header of the request.
+func (s *fakeOSS) verify(r *http.Request) bool {
+	bucket := strings.SplitN(r.Host, ".", 2)[0]
+
+	resource := "/" + bucket + r.URL.Path
+	if id := r.URL.Query().Get("uploadId"); id != "" {
+		if n := r.URL.Query().Get("partNumber"); n != "" {
+			resource += "?partNumber=" + n + "&uploadId=" + id
+		} else {
+			resource += "?uploadId=" + id
+		}
+	} else if _, ok := r.URL.Query()["uploads"]; ok {
+		resource += "?uploads"
+	}
+	var headers string
+	if v := r.Header.Get("x-oss-range-behavior"); v != "" {
+		headers = "x-oss-range-behavior:" + v + "\n"
+	}
+	h := hmac.New(sha1.New, []byte(testAccessKeySecret))
+	fmt.Fprintf(h, "%s\n\n\n%s\n%s%s", r.Method, r.Header.Get("Date"), headers, resource)
+
+	return r.Header.Get("Authorization") == "OSS "+testAccessKeyID+":"+base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (s *fakeOSS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.verify(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>SignatureDoesNotMatch</Code><Message>signature mismatch</Message></Error>`)
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	q := r.URL.Query()
+
+	if name == "" {
+		testutil.Equals(s.t, "url", q.Get("encoding-type"))
+		s.list(w, q.Get("prefix"), q.Get("delimiter"), q.Get("marker"))
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch r.Method {
+	case http.MethodPost:
+		if _, ok := q["uploads"]; ok {
+			s.uploads++
+			fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>upload-%d</UploadId></InitiateMultipartUploadResult>", s.uploads)
+			return
+		}
+		var list struct {
+			Parts []completePart `xml:"Part"`
+		}
+		testutil.Ok(s.t, xml.Unmarshal(body, &list))
+
+		var b []byte
+		for i, p := range list.Parts {
+			testutil.Equals(s.t, i+1, p.PartNumber)
+			part := s.parts[q.Get("uploadId")+"/"+strconv.Itoa(p.PartNumber)]
+			testutil.Equals(s.t, fmt.Sprintf(`"%X"`, md5.Sum(part)), p.ETag)
+			b = append(b, part...)
+		}
+		s.objects[name] = b
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case http.MethodPut:
+		if id := q.Get("uploadId"); id != "" {
+			s.parts[id+"/"+q.Get("partNumber")] = body
+		} else {
+			s.objects[name] = body
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%X"`, md5.Sum(body)))
+	case http.MethodDelete:
+		if q.Get("uploadId") != "" {
+			s.aborted++
+		} else {
+			delete(s.objects, name)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		b, ok := s.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Unix(1000, 0).UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", fmt.Sprintf(`"%X"`, md5.Sum(b)))
+
+		if rng := r.Header.Get("Range"); rng != "" && !s.ignoreRange {
+			testutil.Equals(s.t, "standard", r.Header.Get("x-oss-range-behavior"))
+
+			var start, end int
+			fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+			if end >= len(b) {
+				end = len(b) - 1
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(b[start : end+1])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	}
+}
+
+// list answers GetBucket requests with at most pageSize entries per page and URL-encoded names.
+func (s *fakeOSS) list(w http.ResponseWriter, prefix, delimiter, marker string) {
+	var names []string
+	for n := range s.objects {
+		names = append(names, n)
+	}
+	entries, truncated := objtesting.List(names, prefix, delimiter, marker, s.pageSize)
+
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult>`)
+	fmt.Fprintf(w, "<IsTruncated>%t</IsTruncated>", truncated)
+	if truncated {
+		fmt.Fprintf(w, "<NextMarker>%s</NextMarker>", url.QueryEscape(entries[len(entries)-1].Name))
+	}
+	// Objects are listed before prefixes regardless of their names.
+	for _, e := range entries {
+		if !e.Prefix {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", url.QueryEscape(e.Name))
+		}
+	}
+	for _, e := range entries {
+		if e.Prefix {
+			fmt.Fprintf(w, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", url.QueryEscape(e.Name))
+		}
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+// newTestBucket returns a bucket whose requests to the virtual-hosted bucket endpoint are
+// sent to the test server.
+func newTestBucket(t *testing.T, srv *httptest.Server, secret string) *Bucket {
+	bkt, err := NewBucket(&Config{
+		Endpoint:        "http://oss-cn-hangzhou.aliyuncs.com",
+		Bucket:          "thanos",
+		AccessKeyID:     testAccessKeyID,
+		AccessKeySecret: secret,
+	}, nil)
+	testutil.Ok(t, err)
+
+	bkt.client = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+	}}
+	return bkt
+}
+
+func TestBucket(t *testing.T) {
+	s, srv := newFakeOSS(t)
+	defer srv.Close()
+
+	bkt := newTestBucket(t, srv, testAccessKeySecret)
+	bkt.partSize = 4
+
+	objtesting.ObjectsTest(t, bkt, func(b []byte) objstore.ObjectAttributes {
+		return objstore.ObjectAttributes{
+			Size:         int64(len(b)),
+			LastModified: time.Unix(1000, 0).UTC(),
+			ETag:         fmt.Sprintf("%X", md5.Sum(b)),
+		}
+	})
+	testutil.Equals(t, 4, s.uploads)
+
+	ctx := context.Background()
+
+	// Objects smaller than the part size are uploaded in a single request.
+	testutil.Ok(t, bkt.Upload(ctx, "small", bytes.NewReader([]byte("123"))))
+	testutil.Equals(t, 4, s.uploads)
+
+	// Names are URL-encoded in listings.
+	testutil.Ok(t, bkt.Upload(ctx, "d&e f", bytes.NewReader([]byte("content of d&e f"))))
+	var names []string
+	testutil.Ok(t, bkt.Iter(ctx, "", func(n string) error {
+		names = append(names, n)
+		return nil
+	}))
+	testutil.Equals(t, []string{"a/", "b/", "d&e f", "small"}, names)
+
+	// Ranges are cut out of full objects returned for them.
+	s.ignoreRange = true
+
+	rc, err := bkt.GetRange(ctx, "a/1", 3, 4)
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "tent", string(b))
+}
+
+func TestBucket_Acceptance(t *testing.T) {
+	_, srv := newFakeOSS(t)
+	defer srv.Close()
+
+	objtesting.AcceptanceTest(t, newTestBucket(t, srv, testAccessKeySecret))
+}
+
+func TestBucket_AbortFailedMultipartUpload(t *testing.T) {
+	s, srv := newFakeOSS(t)
+	defer srv.Close()
+
+	bkt := newTestBucket(t, srv, testAccessKeySecret)
+	bkt.partSize = 4
+
+	objtesting.FailedUploadTest(t, bkt)
+	testutil.Equals(t, 1, s.aborted)
+}
+
+func TestBucket_WrongKey(t *testing.T) {
+	_, srv := newFakeOSS(t)
+	defer srv.Close()
+
+	objtesting.WrongCredentialsTest(t, newTestBucket(t, srv, "wrong"), "SignatureDoesNotMatch")
+}
+
+func TestNewBucket_Endpoint(t *testing.T) {
+	bkt, err := NewBucket(&Config{
+		Endpoint:        "oss-cn-hangzhou.aliyuncs.com",
+		Bucket:          "thanos",
+		AccessKeyID:     testAccessKeyID,
+		AccessKeySecret: testAccessKeySecret,
+	}, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "https://thanos.oss-cn-hangzhou.aliyuncs.com", bkt.endpoint.String())
+}
+
+func TestNewBucket_TLSConfig(t *testing.T) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	bkt, err := NewBucket(&Config{
+		Endpoint:        "oss-cn-hangzhou.aliyuncs.com",
+		Bucket:          "thanos",
+		AccessKeyID:     testAccessKeyID,
+		AccessKeySecret: testAccessKeySecret,
+		TLSConfig:       tlsConfig,
+	}, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, tlsConfig, bkt.client.Transport.(*http.Transport).TLSClientConfig)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	objtesting.ValidateTest(t, []objtesting.ConfigCase{
+		{Conf: &Config{Endpoint: "e", Bucket: "b", AccessKeyID: "i", AccessKeySecret: "k"}, OK: true},
+		{Conf: &Config{Bucket: "b", AccessKeyID: "i", AccessKeySecret: "k"}},
+		{Conf: &Config{Endpoint: "e", AccessKeyID: "i", AccessKeySecret: "k"}},
+		{Conf: &Config{Endpoint: "e", Bucket: "b", AccessKeySecret: "k"}},
+		{Conf: &Config{Endpoint: "e", Bucket: "b", AccessKeyID: "i"}},
+	})
+}
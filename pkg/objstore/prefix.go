@@ -0,0 +1,58 @@
+package objstore
+
+import (
+	"context"
+	"io"
+	"strings"
+)
+
+// PrefixedBucket wraps a bucket so that all objects are stored under the given prefix, which
+// allows several installations to share one bucket. Object names passed to and returned by
+// the bucket are relative to the prefix. If prefix is empty, the bucket is returned unchanged.
+func PrefixedBucket(b Bucket, prefix string) Bucket {
+	prefix = strings.Trim(prefix, DirDelim)
+	if prefix == "" {
+		return b
+	}
+	return &prefixedBucket{bkt: b, prefix: prefix + DirDelim}
+}
+
+type prefixedBucket struct {
+	bkt Bucket
+	// prefix ends with DirDelim.
+	prefix string
+}
+
+func (b *prefixedBucket) Type() string {
+	return BackendType(b.bkt)
+}
+
+func (b *prefixedBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	return b.bkt.Iter(ctx, b.prefix+dir, func(name string) error {
+		return f(strings.TrimPrefix(name, b.prefix))
+	}, options...)
+}
+
+func (b *prefixedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.bkt.Get(ctx, b.prefix+name)
+}
+
+func (b *prefixedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	return b.bkt.GetRange(ctx, b.prefix+name, off, length)
+}
+
+func (b *prefixedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	return b.bkt.Exists(ctx, b.prefix+name)
+}
+
+func (b *prefixedBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	return b.bkt.Attributes(ctx, b.prefix+name)
+}
+
+func (b *prefixedBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	return b.bkt.Upload(ctx, b.prefix+name, r)
+}
+
+func (b *prefixedBucket) Delete(ctx context.Context, name string) error {
+	return b.bkt.Delete(ctx, b.prefix+name)
+}
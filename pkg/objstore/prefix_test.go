@@ -0,0 +1,62 @@
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/inmem"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+func TestPrefixedBucket(t *testing.T) {
+	ctx := context.Background()
+	inner := inmem.NewBucket()
+	testutil.Ok(t, inner.Upload(ctx, "other/dir/obj", bytes.NewReader([]byte("other"))))
+
+	bkt := objstore.PrefixedBucket(inner, "/tenant/a/")
+	testutil.Ok(t, bkt.Upload(ctx, "dir/obj", bytes.NewReader([]byte("content"))))
+	testutil.Ok(t, bkt.Upload(ctx, "top", bytes.NewReader([]byte("top"))))
+
+	_, ok := inner.Objects()["tenant/a/dir/obj"]
+	testutil.Assert(t, ok, "object not stored under the prefix")
+
+	var names []string
+	testutil.Ok(t, bkt.Iter(ctx, "", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	testutil.Equals(t, []string{"dir/", "top"}, names)
+
+	names = nil
+	testutil.Ok(t, bkt.Iter(ctx, "dir", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	testutil.Equals(t, []string{"dir/obj"}, names)
+
+	rc, err := bkt.GetRange(ctx, "dir/obj", 1, 3)
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "ont", string(b))
+
+	attrs, err := bkt.Attributes(ctx, "dir/obj")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(len("content")), attrs.Size)
+
+	// Objects outside of the prefix are not visible.
+	ok, err = bkt.Exists(ctx, "other/dir/obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "object outside of the prefix must not be visible")
+
+	testutil.Ok(t, bkt.Delete(ctx, "dir/obj"))
+	_, ok = inner.Objects()["tenant/a/dir/obj"]
+	testutil.Assert(t, !ok, "object not deleted")
+
+	// An empty prefix leaves the bucket unchanged.
+	testutil.Equals(t, objstore.Bucket(inner), objstore.PrefixedBucket(inner, "/"))
+}
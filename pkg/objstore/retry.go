@@ -0,0 +1,272 @@
+package objstore
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Defaults for backoffs that are not configured explicitly.
+const (
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+// RetryConfig configures retries of bucket operations that failed with a transient error.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of attempts of an operation including the first one.
+	// Operations are not retried if it is less than 2.
+	MaxAttempts int `yaml:"max_attempts"`
+	// MinBackoff is the delay before the first retry, which doubles for every further retry.
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	// MaxBackoff caps the delay between two attempts.
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+// Validate checks that the retry settings are consistent.
+func (conf *RetryConfig) Validate() error {
+	if conf.MaxAttempts < 0 {
+		return errors.New("retry max_attempts must not be negative")
+	}
+	if conf.MinBackoff < 0 || conf.MaxBackoff < 0 {
+		return errors.New("retry backoffs must not be negative")
+	}
+	if conf.MaxBackoff > 0 && conf.MaxBackoff < conf.MinBackoff {
+		return errors.New("retry max_backoff must not be less than min_backoff")
+	}
+	return nil
+}
+
+// RetryBucket wraps a bucket so that operations failing with a transient error are retried
+// with an exponential, jittered backoff until they succeed or conf.MaxAttempts is reached.
+// Besides network errors, the wrapped bucket may classify errors of its provider as
+// transient by implementing an IsRetryableErr(error) bool method.
+//
+// Only opening readers is retried for Get and GetRange. Iter resumes after a failed attempt
+// without passing any name to f twice. Uploads are only retried if the reader can be
+// rewound, i.e. implements io.Seeker.
+func RetryBucket(name string, b Bucket, conf RetryConfig, r prometheus.Registerer) Bucket {
+	if conf.MaxAttempts < 2 {
+		return b
+	}
+	if conf.MinBackoff <= 0 {
+		conf.MinBackoff = defaultMinBackoff
+	}
+	if conf.MaxBackoff <= 0 {
+		conf.MaxBackoff = defaultMaxBackoff
+	}
+	if conf.MaxBackoff < conf.MinBackoff {
+		conf.MaxBackoff = conf.MinBackoff
+	}
+	constLabels := prometheus.Labels{"bucket": name, "backend": BackendType(b)}
+
+	bkt := &retryBucket{
+		bkt:  b,
+		conf: conf,
+
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_objstore_bucket_operation_retries_total",
+			Help:        "Total number of retries of operations against a bucket that failed with a transient error.",
+			ConstLabels: constLabels,
+		}, []string{"operation"}),
+
+		exhausted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_objstore_bucket_operation_retries_exhausted_total",
+			Help:        "Total number of operations against a bucket that still failed after all attempts.",
+			ConstLabels: constLabels,
+		}, []string{"operation"}),
+	}
+	if r != nil {
+		r.MustRegister(bkt.retries, bkt.exhausted)
+	}
+	return bkt
+}
+
+type retryBucket struct {
+	bkt  Bucket
+	conf RetryConfig
+
+	retries   *prometheus.CounterVec
+	exhausted *prometheus.CounterVec
+}
+
+// permanentErr marks an error of an attempt that must not be retried regardless of its cause.
+type permanentErr struct {
+	err error
+}
+
+func (e permanentErr) Error() string { return e.err.Error() }
+
+func (b *retryBucket) Type() string {
+	return BackendType(b.bkt)
+}
+
+// do runs f until it succeeds, fails with an error that is not transient or the maximum
+// number of attempts is reached.
+func (b *retryBucket) do(ctx context.Context, op string, f func() error) error {
+	backoff := b.conf.MinBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if p, ok := err.(permanentErr); ok {
+			return p.err
+		}
+		if ctx.Err() != nil || !b.retryable(err) {
+			return err
+		}
+		if attempt >= b.conf.MaxAttempts {
+			b.exhausted.WithLabelValues(op).Inc()
+			return errors.Wrapf(err, "giving up after %d attempts", attempt)
+		}
+		if sleep(ctx, jitter(backoff)) != nil {
+			return err
+		}
+		b.retries.WithLabelValues(op).Inc()
+
+		if backoff *= 2; backoff > b.conf.MaxBackoff {
+			backoff = b.conf.MaxBackoff
+		}
+	}
+}
+
+// retryable returns true if err is transient, either according to the wrapped bucket or
+// because it is a network error.
+func (b *retryBucket) retryable(err error) bool {
+	if c, ok := b.bkt.(interface {
+		IsRetryableErr(error) bool
+	}); ok && c.IsRetryableErr(err) {
+		return true
+	}
+	return isTransientErr(err)
+}
+
+// isTransientErr returns true for errors of the network or of connections closed unexpectedly.
+func isTransientErr(err error) bool {
+	err = errors.Cause(err)
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	// Failures to connect or of established connections are worth another attempt,
+	// e.g. while a load balancer in front of the provider is replaced.
+	if _, ok := err.(*net.OpError); ok {
+		return true
+	}
+	if ne, ok := err.(net.Error); ok {
+		return ne.Timeout() || ne.Temporary()
+	}
+	return false
+}
+
+// jitter returns a random duration between half of d and d so that clients failing at
+// the same time do not retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (b *retryBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	seen := map[string]struct{}{}
+
+	return b.do(ctx, "iter", func() error {
+		var ferr error
+
+		err := b.bkt.Iter(ctx, dir, func(name string) error {
+			if _, ok := seen[name]; ok {
+				return nil
+			}
+			seen[name] = struct{}{}
+
+			ferr = f(name)
+			return ferr
+		}, options...)
+		if err != nil && ferr != nil {
+			return permanentErr{err}
+		}
+		return err
+	})
+}
+
+func (b *retryBucket) Get(ctx context.Context, name string) (rc io.ReadCloser, err error) {
+	err = b.do(ctx, "get", func() error {
+		rc, err = b.bkt.Get(ctx, name)
+		return err
+	})
+	return rc, err
+}
+
+func (b *retryBucket) GetRange(ctx context.Context, name string, off, length int64) (rc io.ReadCloser, err error) {
+	err = b.do(ctx, "get_range", func() error {
+		rc, err = b.bkt.GetRange(ctx, name, off, length)
+		return err
+	})
+	return rc, err
+}
+
+func (b *retryBucket) Exists(ctx context.Context, name string) (ok bool, err error) {
+	err = b.do(ctx, "exists", func() error {
+		ok, err = b.bkt.Exists(ctx, name)
+		return err
+	})
+	return ok, err
+}
+
+func (b *retryBucket) Attributes(ctx context.Context, name string) (attrs ObjectAttributes, err error) {
+	err = b.do(ctx, "attributes", func() error {
+		attrs, err = b.bkt.Attributes(ctx, name)
+		return err
+	})
+	return attrs, err
+}
+
+func (b *retryBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return b.bkt.Upload(ctx, name, r)
+	}
+	start, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return b.bkt.Upload(ctx, name, r)
+	}
+	rewind := false
+
+	return b.do(ctx, "upload", func() error {
+		if rewind {
+			if _, err := s.Seek(start, io.SeekStart); err != nil {
+				return permanentErr{errors.Wrap(err, "rewind upload")}
+			}
+		}
+		rewind = true
+
+		return b.bkt.Upload(ctx, name, r)
+	})
+}
+
+func (b *retryBucket) Delete(ctx context.Context, name string) error {
+	return b.do(ctx, "delete", func() error {
+		return b.bkt.Delete(ctx, name)
+	})
+}
@@ -0,0 +1,181 @@
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/inmem"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+var errTransient = &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+// flakyBucket fails the first calls of each operation with the configured error.
+type flakyBucket struct {
+	*inmem.Bucket
+
+	failures int
+	err      error
+	calls    map[string]int
+}
+
+func newFlakyBucket(failures int, err error) *flakyBucket {
+	return &flakyBucket{Bucket: inmem.NewBucket(), failures: failures, err: err, calls: map[string]int{}}
+}
+
+func (b *flakyBucket) fail(op string) error {
+	b.calls[op]++
+	if b.calls[op] <= b.failures {
+		return b.err
+	}
+	return nil
+}
+
+func (b *flakyBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	// Fail in the middle of the iteration, after some names were passed on already.
+	n := 0
+	return b.Bucket.Iter(ctx, dir, func(name string) error {
+		if n++; n == 2 {
+			if err := b.fail("iter"); err != nil {
+				return err
+			}
+		}
+		return f(name)
+	}, options...)
+}
+
+func (b *flakyBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.fail("get"); err != nil {
+		return nil, err
+	}
+	return b.Bucket.Get(ctx, name)
+}
+
+func (b *flakyBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.fail("exists"); err != nil {
+		return false, err
+	}
+	return b.Bucket.Exists(ctx, name)
+}
+
+func (b *flakyBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.fail("upload"); err != nil {
+		// Consume part of the reader to ensure it is rewound before the next attempt.
+		io.CopyN(ioutil.Discard, r, 3)
+		return err
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func newRetryBucket(b objstore.Bucket, attempts int) objstore.Bucket {
+	return objstore.RetryBucket("test", b, objstore.RetryConfig{
+		MaxAttempts: attempts,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  2 * time.Millisecond,
+	}, nil)
+}
+
+func TestRetryBucket_Transient(t *testing.T) {
+	ctx := context.Background()
+	inner := newFlakyBucket(2, errTransient)
+	bkt := newRetryBucket(inner, 3)
+
+	testutil.Ok(t, bkt.Upload(ctx, "dir/a", bytes.NewReader([]byte("content"))))
+	testutil.Equals(t, "content", string(inner.Objects()["dir/a"]))
+	testutil.Equals(t, 3, inner.calls["upload"])
+
+	ok, err := bkt.Exists(ctx, "dir/a")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "object must exist")
+
+	rc, err := bkt.Get(ctx, "dir/a")
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+
+	// Names must not be passed on twice although the iteration is restarted.
+	for _, name := range []string{"dir/b", "dir/c"} {
+		testutil.Ok(t, inner.Bucket.Upload(ctx, name, bytes.NewReader(nil)))
+	}
+	var names []string
+	testutil.Ok(t, bkt.Iter(ctx, "dir", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	testutil.Equals(t, []string{"dir/a", "dir/b", "dir/c"}, names)
+}
+
+func TestRetryBucket_MaxAttempts(t *testing.T) {
+	inner := newFlakyBucket(3, errTransient)
+	bkt := newRetryBucket(inner, 3)
+
+	_, err := bkt.Exists(context.Background(), "obj")
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 3, inner.calls["exists"])
+}
+
+func TestRetryBucket_NotRetryable(t *testing.T) {
+	ctx := context.Background()
+	inner := newFlakyBucket(1, errors.New("access denied"))
+	bkt := newRetryBucket(inner, 3)
+
+	_, err := bkt.Exists(ctx, "obj")
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 1, inner.calls["exists"])
+
+	// Errors returned by the iteration's callback must be passed on without retrying.
+	inner = newFlakyBucket(0, nil)
+	bkt = newRetryBucket(inner, 3)
+	testutil.Ok(t, inner.Upload(ctx, "obj", bytes.NewReader(nil)))
+
+	calls := 0
+	err = bkt.Iter(ctx, "", func(string) error {
+		calls++
+		return errTransient
+	})
+	testutil.Equals(t, errTransient, err)
+	testutil.Equals(t, 1, calls)
+
+	// Uploads from readers that cannot be rewound are not retried.
+	inner = newFlakyBucket(1, errTransient)
+	bkt = newRetryBucket(inner, 3)
+	testutil.NotOk(t, bkt.Upload(ctx, "obj", ioutil.NopCloser(bytes.NewReader([]byte("content")))))
+	testutil.Equals(t, 1, inner.calls["upload"])
+
+	// A canceled context stops retries.
+	inner = newFlakyBucket(10, errTransient)
+	bkt = objstore.RetryBucket("test", inner, objstore.RetryConfig{MaxAttempts: 10, MinBackoff: time.Hour}, nil)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = bkt.Exists(ctx, "obj")
+	testutil.Equals(t, errTransient, err)
+	testutil.Equals(t, 1, inner.calls["exists"])
+}
+
+func TestRetryConfig_Validate(t *testing.T) {
+	for _, c := range []struct {
+		conf objstore.RetryConfig
+		ok   bool
+	}{
+		{conf: objstore.RetryConfig{}, ok: true},
+		{conf: objstore.RetryConfig{MaxAttempts: 5, MinBackoff: time.Second, MaxBackoff: time.Minute}, ok: true},
+		{conf: objstore.RetryConfig{MaxAttempts: 5, MinBackoff: time.Second}, ok: true},
+		{conf: objstore.RetryConfig{MaxAttempts: -1}, ok: false},
+		{conf: objstore.RetryConfig{MaxAttempts: 5, MinBackoff: -time.Second}, ok: false},
+		{conf: objstore.RetryConfig{MaxAttempts: 5, MinBackoff: time.Minute, MaxBackoff: time.Second}, ok: false},
+	} {
+		err := c.conf.Validate()
+		if c.ok {
+			testutil.Ok(t, err)
+		} else {
+			testutil.NotOk(t, err)
+		}
+	}
+}
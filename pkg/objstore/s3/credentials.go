@@ -0,0 +1,322 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/pkg/credentials"
+	"github.com/pkg/errors"
+)
+
+// expiryWindow is how long before their expiration temporary credentials are refreshed.
+const expiryWindow = 5 * time.Minute
+
+// newCredentialChain returns credentials that are looked up like the AWS SDKs do if no keys are
+// configured: from the environment, a web identity token (e.g. IAM roles for Kubernetes service
+// accounts), the ECS task role and finally the EC2 instance profile.
+func newCredentialChain() *credentials.Credentials {
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	return credentials.NewChain([]credentials.Provider{
+		&credentials.EnvAWS{},
+		newWebIdentityProvider(client),
+		newECSProvider(client),
+		&credentials.IAM{Client: client},
+	})
+}
+
+// webIdentityProvider exchanges the token in AWS_WEB_IDENTITY_TOKEN_FILE for temporary credentials
+// of the role in AWS_ROLE_ARN through STS.
+type webIdentityProvider struct {
+	credentials.Expiry
+
+	client      *http.Client
+	endpoint    string
+	roleARN     string
+	sessionName string
+	tokenFile   string
+}
+
+func newWebIdentityProvider(client *http.Client) *webIdentityProvider {
+	p := &webIdentityProvider{
+		client:      client,
+		endpoint:    "https://sts.amazonaws.com",
+		roleARN:     os.Getenv("AWS_ROLE_ARN"),
+		sessionName: os.Getenv("AWS_ROLE_SESSION_NAME"),
+		tokenFile:   os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"),
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		p.endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com", region)
+	}
+	if p.sessionName == "" {
+		p.sessionName = fmt.Sprintf("thanos-%d", time.Now().UnixNano())
+	}
+	return p
+}
+
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	if p.roleARN == "" || p.tokenFile == "" {
+		return credentials.Value{}, errors.New("web identity: AWS_ROLE_ARN or AWS_WEB_IDENTITY_TOKEN_FILE not set")
+	}
+	// The token is rotated on disk, so it is read again on every refresh.
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return credentials.Value{}, errors.Wrap(err, "web identity: read token")
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {p.roleARN},
+		"RoleSessionName":  {p.sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	resp, err := p.client.PostForm(p.endpoint, form)
+	if err != nil {
+		return credentials.Value{}, errors.Wrap(err, "web identity: assume role")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return credentials.Value{}, errors.Errorf("web identity: assume role: %s: %s", resp.Status, b)
+	}
+	var res struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return credentials.Value{}, errors.Wrap(err, "web identity: decode response")
+	}
+	p.SetExpiration(res.Credentials.Expiration, expiryWindow)
+
+	return credentials.Value{
+		AccessKeyID:     res.Credentials.AccessKeyID,
+		SecretAccessKey: res.Credentials.SecretAccessKey,
+		SessionToken:    res.Credentials.SessionToken,
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+// metadataCredentials are the temporary credentials served by the ECS and EC2 metadata endpoints.
+type metadataCredentials struct {
+	Code            string
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+// getMetadataCredentials fetches temporary credentials from the metadata endpoint behind the request.
+func getMetadataCredentials(client *http.Client, req *http.Request, e *credentials.Expiry) (credentials.Value, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return credentials.Value{}, errors.Errorf("unexpected status %s", resp.Status)
+	}
+	var creds metadataCredentials
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return credentials.Value{}, errors.Wrap(err, "decode credentials")
+	}
+	if creds.Code != "" && creds.Code != "Success" {
+		return credentials.Value{}, errors.Errorf("credentials not available: %s", creds.Code)
+	}
+	e.SetExpiration(creds.Expiration, expiryWindow)
+
+	return credentials.Value{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+// ecsProvider retrieves the credentials of the ECS task role from the container metadata endpoint.
+type ecsProvider struct {
+	credentials.Expiry
+
+	client *http.Client
+	url    string
+	token  string
+}
+
+func newECSProvider(client *http.Client) *ecsProvider {
+	p := &ecsProvider{
+		client: client,
+		url:    os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"),
+		token:  os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"),
+	}
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		p.url = "http://169.254.170.2" + rel
+	}
+	return p
+}
+
+func (p *ecsProvider) Retrieve() (credentials.Value, error) {
+	if p.url == "" {
+		return credentials.Value{}, errors.New("ecs: AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or AWS_CONTAINER_CREDENTIALS_FULL_URI not set")
+	}
+	req, err := http.NewRequest("GET", p.url, nil)
+	if err != nil {
+		return credentials.Value{}, errors.Wrap(err, "ecs: create request")
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", p.token)
+	}
+	v, err := getMetadataCredentials(p.client, req, &p.Expiry)
+	if err != nil {
+		return credentials.Value{}, errors.Wrap(err, "ecs: retrieve task role credentials")
+	}
+	return v, nil
+}
+
+// assumeRoleProvider exchanges the credentials of its source for temporary credentials of
+// another role through STS, e.g. to write into a bucket owned by another AWS account.
+type assumeRoleProvider struct {
+	credentials.Expiry
+
+	client      *http.Client
+	source      *credentials.Credentials
+	endpoint    string
+	region      string
+	roleARN     string
+	sessionName string
+	externalID  string
+}
+
+func newAssumeRoleProvider(source *credentials.Credentials, roleARN, sessionName, externalID, region string) *assumeRoleProvider {
+	p := &assumeRoleProvider{
+		client:      &http.Client{Timeout: 10 * time.Second},
+		source:      source,
+		endpoint:    "https://sts.amazonaws.com",
+		region:      "us-east-1",
+		roleARN:     roleARN,
+		sessionName: sessionName,
+		externalID:  externalID,
+	}
+	if region != "" {
+		p.endpoint, p.region = fmt.Sprintf("https://sts.%s.amazonaws.com", region), region
+	}
+	if p.sessionName == "" {
+		p.sessionName = fmt.Sprintf("thanos-%d", time.Now().UnixNano())
+	}
+	return p
+}
+
+func (p *assumeRoleProvider) Retrieve() (credentials.Value, error) {
+	src, err := p.source.Get()
+	if err != nil {
+		return credentials.Value{}, errors.Wrap(err, "assume role: retrieve source credentials")
+	}
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {p.roleARN},
+		"RoleSessionName": {p.sessionName},
+	}
+	if p.externalID != "" {
+		form.Set("ExternalId", p.externalID)
+	}
+	body := form.Encode()
+
+	req, err := http.NewRequest("POST", p.endpoint, strings.NewReader(body))
+	if err != nil {
+		return credentials.Value{}, errors.Wrap(err, "assume role: create request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signSTS(req, body, src, p.region, time.Now())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return credentials.Value{}, errors.Wrapf(err, "assume role %s", p.roleARN)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return credentials.Value{}, errors.Errorf("assume role %s: %s: %s", p.roleARN, resp.Status, b)
+	}
+	var res struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleResult>Credentials"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return credentials.Value{}, errors.Wrap(err, "assume role: decode response")
+	}
+	p.SetExpiration(res.Credentials.Expiration, expiryWindow)
+
+	return credentials.Value{
+		AccessKeyID:     res.Credentials.AccessKeyID,
+		SecretAccessKey: res.Credentials.SecretAccessKey,
+		SessionToken:    res.Credentials.SessionToken,
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+// signSTS signs a form-encoded STS request with AWS Signature Version 4. The signer of the
+// minio client is limited to the s3 service, so STS requests are signed here.
+func signSTS(req *http.Request, body string, creds credentials.Value, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := strings.Join([]string{amzDate[:8], region, "sts", "aws4_request"}, "/")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	names := []string{"content-type", "host", "x-amz-date"}
+	values := []string{req.Header.Get("Content-Type"), req.URL.Host, amzDate}
+	if creds.SessionToken != "" {
+		names, values = append(names, "x-amz-security-token"), append(values, creds.SessionToken)
+	}
+	var headers string
+	for i, n := range names {
+		headers += n + ":" + values[i] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{req.Method, path, "", headers, signedHeaders, hexSHA256(body)}, "\n")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hexSHA256(canonicalRequest)}, "\n")
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, s := range []string{amzDate[:8], region, "sts", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		creds.AccessKeyID, scope, signedHeaders, hmacSHA256(key, stringToSign)))
+}
+
+func hexSHA256(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
@@ -0,0 +1,170 @@
+package s3
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/testutil"
+	"github.com/minio/minio-go/pkg/credentials"
+)
+
+func TestWebIdentityProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3-web-identity-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	testutil.Ok(t, ioutil.WriteFile(tokenFile, []byte("jwt\n"), 0600))
+
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.Ok(t, r.ParseForm())
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("WebIdentityToken") != "jwt" || r.Form.Get("RoleArn") != "arn:aws:iam::123:role/thanos" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>WEBKEY</AccessKeyId>
+      <SecretAccessKey>websecret</SecretAccessKey>
+      <SessionToken>webtoken</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`, expiration.Format(time.RFC3339))
+	}))
+	defer srv.Close()
+
+	p := &webIdentityProvider{client: http.DefaultClient, endpoint: srv.URL, sessionName: "test"}
+
+	// Without a role and token the provider must be skipped.
+	_, err = p.Retrieve()
+	testutil.NotOk(t, err)
+
+	p.roleARN, p.tokenFile = "arn:aws:iam::123:role/thanos", tokenFile
+
+	v, err := p.Retrieve()
+	testutil.Ok(t, err)
+	testutil.Equals(t, credentials.Value{
+		AccessKeyID:     "WEBKEY",
+		SecretAccessKey: "websecret",
+		SessionToken:    "webtoken",
+		SignerType:      credentials.SignatureV4,
+	}, v)
+	testutil.Assert(t, !p.IsExpired(), "credentials must be valid until shortly before their expiration")
+	p.CurrentTime = func() time.Time { return expiration.Add(-expiryWindow).Add(time.Second) }
+	testutil.Assert(t, p.IsExpired(), "credentials must be refreshed within the expiry window")
+
+	p.roleARN = "arn:aws:iam::123:role/other"
+	_, err = p.Retrieve()
+	testutil.NotOk(t, err)
+}
+
+func TestECSProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/credentials/task" || r.Header.Get("Authorization") != "secret-token" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"AccessKeyId":"ECSKEY","SecretAccessKey":"ecssecret","Token":"ecstoken","Expiration":"%s"}`,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer srv.Close()
+
+	p := &ecsProvider{client: http.DefaultClient}
+
+	_, err := p.Retrieve()
+	testutil.NotOk(t, err)
+
+	p.url, p.token = srv.URL+"/v2/credentials/task", "secret-token"
+
+	v, err := p.Retrieve()
+	testutil.Ok(t, err)
+	testutil.Equals(t, "ECSKEY", v.AccessKeyID)
+	testutil.Equals(t, "ecssecret", v.SecretAccessKey)
+	testutil.Equals(t, "ecstoken", v.SessionToken)
+	testutil.Assert(t, !p.IsExpired(), "credentials must be valid until shortly before their expiration")
+}
+
+func TestAssumeRoleProvider(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.Ok(t, r.ParseForm())
+		if r.Form.Get("Action") != "AssumeRole" || r.Form.Get("RoleArn") != "arn:aws:iam::456:role/archive" || r.Form.Get("ExternalId") != "ext" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		// The request must be signed with the source credentials.
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=SRCKEY/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/us-east-1/sts/aws4_request") ||
+			r.Header.Get("X-Amz-Security-Token") != "srctoken" {
+			http.Error(w, "invalid signature", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ROLEKEY</AccessKeyId>
+      <SecretAccessKey>rolesecret</SecretAccessKey>
+      <SessionToken>roletoken</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`, expiration.Format(time.RFC3339))
+	}))
+	defer srv.Close()
+
+	source := credentials.NewStaticV4("SRCKEY", "srcsecret", "srctoken")
+
+	p := newAssumeRoleProvider(source, "arn:aws:iam::456:role/archive", "", "ext", "")
+	p.endpoint = srv.URL
+	testutil.Assert(t, strings.HasPrefix(p.sessionName, "thanos-"), "unexpected default session name %s", p.sessionName)
+	testutil.Assert(t, p.IsExpired(), "credentials must not be valid before being retrieved")
+
+	v, err := p.Retrieve()
+	testutil.Ok(t, err)
+	testutil.Equals(t, credentials.Value{
+		AccessKeyID:     "ROLEKEY",
+		SecretAccessKey: "rolesecret",
+		SessionToken:    "roletoken",
+		SignerType:      credentials.SignatureV4,
+	}, v)
+	testutil.Assert(t, !p.IsExpired(), "credentials must be valid until shortly before their expiration")
+	p.CurrentTime = func() time.Time { return expiration.Add(-expiryWindow).Add(time.Second) }
+	testutil.Assert(t, p.IsExpired(), "credentials must be refreshed within the expiry window")
+
+	// A missing external ID is rejected by the role's trust policy.
+	p.externalID = ""
+	_, err = p.Retrieve()
+	testutil.NotOk(t, err)
+
+	p = newAssumeRoleProvider(source, "arn:aws:iam::456:role/archive", "thanos", "", "eu-west-1")
+	testutil.Equals(t, "https://sts.eu-west-1.amazonaws.com", p.endpoint)
+	testutil.Equals(t, "thanos", p.sessionName)
+}
+
+func TestSignSTS(t *testing.T) {
+	body := "Action=AssumeRole&ExternalId=ext&RoleArn=arn%3Aaws%3Aiam%3A%3A456%3Arole%2Farchive&RoleSessionName=thanos&Version=2011-06-15"
+	req, err := http.NewRequest("POST", "https://sts.eu-west-1.amazonaws.com", strings.NewReader(body))
+	testutil.Ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	signSTS(req, body, credentials.Value{AccessKeyID: "SRCKEY", SecretAccessKey: "srcsecret", SessionToken: "srctoken"},
+		"eu-west-1", time.Date(2018, 1, 15, 12, 0, 0, 0, time.UTC))
+
+	testutil.Equals(t, "20180115T120000Z", req.Header.Get("X-Amz-Date"))
+	testutil.Equals(t, "srctoken", req.Header.Get("X-Amz-Security-Token"))
+	testutil.Equals(t, "AWS4-HMAC-SHA256 Credential=SRCKEY/20180115/eu-west-1/sts/aws4_request, "+
+		"SignedHeaders=content-type;host;x-amz-date;x-amz-security-token, "+
+		"Signature=3ab277229f70caf7cfb95ada5c121a8a170ab8e68044563f01a0ab21085bd9ec", req.Header.Get("Authorization"))
+}
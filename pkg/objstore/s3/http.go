@@ -0,0 +1,69 @@
+package s3
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/pkg/errors"
+)
+
+// HTTPConfig configures the TLS settings and the connection pool of the client.
+type HTTPConfig struct {
+	// CAFile is the path of a file holding PEM encoded CA certificates to verify the
+	// endpoint's certificate with instead of the system's certificate pool.
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are the paths of a PEM encoded client certificate and its key to
+	// present to the endpoint.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// InsecureSkipVerify disables the verification of the endpoint's certificate.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+
+	objstore.TransportConfig `yaml:",inline"`
+}
+
+// tlsSet returns true if any of the TLS settings is given.
+func (conf *HTTPConfig) tlsSet() bool {
+	return conf.CAFile != "" || conf.CertFile != "" || conf.KeyFile != "" || conf.InsecureSkipVerify
+}
+
+// Validate checks that client certificates are configured along with their keys.
+func (conf *HTTPConfig) Validate() error {
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return errors.New("s3 client certificate and key must be configured together")
+	}
+	return conf.TransportConfig.Validate()
+}
+
+// tlsConfig returns the TLS config for connections to the endpoint, based on base if it is
+// not nil.
+func (conf *HTTPConfig) tlsConfig(base *tls.Config) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	if conf.CAFile != "" {
+		b, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read CA file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("no certificates found in CA file %s", conf.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if conf.InsecureSkipVerify {
+		cfg.InsecureSkipVerify = true
+	}
+	return cfg, nil
+}
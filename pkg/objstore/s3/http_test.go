@@ -0,0 +1,126 @@
+package s3
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+// writeClientCert writes a self-signed client certificate and its key to dir.
+func writeClientCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testutil.Ok(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "thanos"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	testutil.Ok(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	testutil.Ok(t, err)
+
+	certFile, keyFile = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	testutil.Ok(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	testutil.Ok(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestBucket_HTTPConfig(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()["location"]; ok {
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+			return
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	dir, err := ioutil.TempDir("", "s3-http")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.crt")
+	testutil.Ok(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+	certFile, keyFile := writeClientCert(t, dir)
+
+	checkAccess := func(conf HTTPConfig) error {
+		c := &Config{
+			Bucket:     "test",
+			Endpoint:   u.Host,
+			AccessKey:  "key",
+			SecretKey:  "secret",
+			HTTPConfig: conf,
+		}
+		testutil.Ok(t, c.Validate())
+
+		bkt, err := NewBucket(c, nil)
+		testutil.Ok(t, err)
+		return bkt.CheckAccess()
+	}
+	testutil.Ok(t, checkAccess(HTTPConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}))
+	testutil.Ok(t, checkAccess(HTTPConfig{InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile}))
+
+	// The server's certificate is not signed by a CA of the system's pool.
+	testutil.NotOk(t, checkAccess(HTTPConfig{CertFile: certFile, KeyFile: keyFile}))
+	// The server requires a client certificate.
+	testutil.NotOk(t, checkAccess(HTTPConfig{CAFile: caFile}))
+
+	_, err = NewBucket(&Config{Bucket: "test", Endpoint: u.Host, AccessKey: "key", SecretKey: "secret", HTTPConfig: HTTPConfig{CAFile: keyFile}}, nil)
+	testutil.NotOk(t, err)
+}
+
+func TestConfig_ValidateHTTP(t *testing.T) {
+	for _, c := range []struct {
+		conf Config
+		ok   bool
+	}{
+		{conf: Config{}, ok: true},
+		{conf: Config{HTTPConfig: HTTPConfig{CAFile: "ca.crt", CertFile: "client.crt", KeyFile: "client.key"}}, ok: true},
+		{conf: Config{HTTPConfig: HTTPConfig{InsecureSkipVerify: true}}, ok: true},
+		{conf: Config{HTTPConfig: HTTPConfig{CertFile: "client.crt"}}, ok: false},
+		{conf: Config{HTTPConfig: HTTPConfig{KeyFile: "client.key"}}, ok: false},
+		{conf: Config{Insecure: true, HTTPConfig: HTTPConfig{CAFile: "ca.crt"}}, ok: false},
+		{conf: Config{Insecure: true, HTTPConfig: HTTPConfig{TransportConfig: objstore.TransportConfig{MaxIdleConnsPerHost: 100}}}, ok: true},
+		{conf: Config{HTTPConfig: HTTPConfig{TransportConfig: objstore.TransportConfig{IdleConnTimeout: -time.Second}}}, ok: false},
+		{conf: Config{HTTPConfig: HTTPConfig{TransportConfig: objstore.TransportConfig{TLSMinVersion: "1.2"}}}, ok: true},
+		{conf: Config{HTTPConfig: HTTPConfig{TransportConfig: objstore.TransportConfig{TLSMinVersion: "SSL30"}}}, ok: false},
+		{conf: Config{Insecure: true, HTTPConfig: HTTPConfig{TransportConfig: objstore.TransportConfig{TLSMinVersion: "1.2"}}}, ok: false},
+	} {
+		c.conf.Bucket, c.conf.Endpoint = "test", "localhost"
+
+		err := c.conf.Validate()
+		if c.ok {
+			testutil.Ok(t, err)
+		} else {
+			testutil.NotOk(t, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/minio/minio-go"
+	"github.com/pkg/errors"
+)
+
+// uploadInParts uploads objects of at least b.multipartThreshold bytes in parts of b.partSize
+// bytes, of which up to b.uploadConcurrency are sent at the same time. Smaller objects are
+// uploaded with a single request.
+func (b *Bucket) uploadInParts(ctx context.Context, name string, r io.Reader) error {
+	head := make([]byte, b.multipartThreshold)
+
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err = b.client.PutObjectWithContext(ctx, b.bucket, name, bytes.NewReader(head[:n]), int64(n), minio.PutObjectOptions{UserMetadata: b.putHeaders})
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "read object")
+	}
+	r = io.MultiReader(bytes.NewReader(head), r)
+
+	uploadID, err := b.client.NewMultipartUpload(b.bucket, name, minio.PutObjectOptions{UserMetadata: b.putHeaders})
+	if err != nil {
+		return errors.Wrap(err, "initiate multipart upload")
+	}
+	parts, err := b.uploadParts(ctx, name, uploadID, r)
+	if err != nil {
+		// Parts of aborted uploads are deleted so that they are not billed.
+		if abortErr := b.client.AbortMultipartUpload(b.bucket, name, uploadID); abortErr != nil {
+			return errors.Wrapf(err, "abort multipart upload: %s", abortErr)
+		}
+		return err
+	}
+	return errors.Wrap(b.client.CompleteMultipartUpload(b.bucket, name, uploadID, parts), "complete multipart upload")
+}
+
+// uploadParts uploads the content of r as parts of the given multipart upload and returns the
+// uploaded parts ordered by their number.
+func (b *Bucket) uploadParts(ctx context.Context, name, uploadID string, r io.Reader) ([]minio.CompletePart, error) {
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		parts    []minio.CompletePart
+		firstErr error
+	)
+	setErr := func(err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	failed := func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		return firstErr != nil
+	}
+	// Buffers are allocated as needed and reused once their part is uploaded, which bounds
+	// the memory held by a single upload.
+	buffers := make(chan []byte, b.uploadConcurrency)
+	for i := 0; i < b.uploadConcurrency; i++ {
+		buffers <- nil
+	}
+
+	for partID := 1; !failed(); partID++ {
+		var buf []byte
+		select {
+		case <-ctx.Done():
+			setErr(ctx.Err())
+			continue
+		case buf = <-buffers:
+		}
+		if buf == nil {
+			buf = make([]byte, b.partSize)
+		}
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			setErr(errors.Wrap(err, "read object"))
+			break
+		}
+		if partID > maxPartCount {
+			setErr(errors.Errorf("object exceeds %d parts of %d bytes, increase the part size", maxPartCount, b.partSize))
+			break
+		}
+		last := err == io.ErrUnexpectedEOF
+
+		wg.Add(1)
+		go func(partID int, buf []byte, n int) {
+			defer wg.Done()
+			defer func() { buffers <- buf }()
+
+			part, err := b.client.PutObjectPart(b.bucket, name, uploadID, partID, bytes.NewReader(buf[:n]), int64(n), "", "")
+			if err != nil {
+				setErr(errors.Wrapf(err, "upload part %d", partID))
+				return
+			}
+			mtx.Lock()
+			parts = append(parts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+			mtx.Unlock()
+		}(partID, buf, n)
+
+		if last {
+			break
+		}
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts, nil
+}
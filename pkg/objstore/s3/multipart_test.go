@@ -0,0 +1,174 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+// fakeMultipartServer implements the parts of the S3 API used by uploads.
+type fakeMultipartServer struct {
+	mtx       sync.Mutex
+	objects   map[string][]byte
+	parts     map[int][]byte
+	aborted   bool
+	failParts bool
+}
+
+func (s *fakeMultipartServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	q := r.URL.Query()
+	if _, ok := q["location"]; ok {
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch _, uploads := q["uploads"]; {
+	case r.Method == "POST" && uploads:
+		s.parts = map[int][]byte{}
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>test</Bucket><Key>obj</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == "PUT" && q.Get("uploadId") == "upload":
+		if s.failParts {
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+		n, err := strconv.Atoi(q.Get("partNumber"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.parts[n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, n))
+	case r.Method == "POST" && q.Get("uploadId") == "upload":
+		var ids []int
+		for id := range s.parts {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+
+		var content []byte
+		for _, id := range ids {
+			content = append(content, s.parts[id]...)
+		}
+		s.objects[r.URL.Path] = content
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><Bucket>test</Bucket><Key>obj</Key><ETag>"etag"</ETag></CompleteMultipartUploadResult>`)
+	case r.Method == "DELETE" && q.Get("uploadId") == "upload":
+		s.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT":
+		s.objects[r.URL.Path] = body
+		w.Header().Set("ETag", `"etag"`)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func TestBucket_UploadInParts(t *testing.T) {
+	srv := &fakeMultipartServer{objects: map[string][]byte{}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	testutil.Ok(t, err)
+
+	conf := &Config{
+		Bucket:            "test",
+		Endpoint:          u.Host,
+		AccessKey:         "key",
+		SecretKey:         "secret",
+		Insecure:          true,
+		PartSize:          minPartSize,
+		UploadConcurrency: 2,
+	}
+	testutil.Ok(t, conf.Validate())
+
+	bkt, err := NewBucket(conf, nil)
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+
+	// Objects below the threshold are uploaded with a single request.
+	testutil.Ok(t, bkt.Upload(ctx, "small", bytes.NewReader([]byte("content"))))
+	testutil.Equals(t, "content", string(srv.objects["/test/small"]))
+	testutil.Assert(t, srv.parts == nil, "small object must not be uploaded in parts")
+
+	content := make([]byte, 2*minPartSize+100)
+	rand.New(rand.NewSource(0)).Read(content)
+
+	testutil.Ok(t, bkt.Upload(ctx, "large", bytes.NewReader(content)))
+	testutil.Equals(t, 3, len(srv.parts))
+	testutil.Assert(t, bytes.Equal(content, srv.objects["/test/large"]), "content of parts does not match")
+
+	// Failed uploads must be aborted.
+	srv.failParts = true
+	testutil.NotOk(t, bkt.Upload(ctx, "failed", bytes.NewReader(content)))
+	testutil.Assert(t, srv.aborted, "failed upload not aborted")
+	_, ok := srv.objects["/test/failed"]
+	testutil.Assert(t, !ok, "failed upload must not be completed")
+}
+
+func TestConfig_ValidateMultipart(t *testing.T) {
+	for _, c := range []struct {
+		conf Config
+		ok   bool
+	}{
+		{conf: Config{}, ok: true},
+		{conf: Config{PartSize: 16 << 20, MultipartThreshold: 32 << 20, UploadConcurrency: 4}, ok: true},
+		{conf: Config{UploadConcurrency: 4}, ok: true},
+		{conf: Config{PartSize: 1 << 20}, ok: false},
+		{conf: Config{PartSize: 6 << 30}, ok: false},
+		{conf: Config{MultipartThreshold: -1}, ok: false},
+		{conf: Config{UploadConcurrency: -1}, ok: false},
+		{conf: Config{UploadConcurrency: 4, SSE: SSEConfig{Type: SSEC, CustomerKeyFile: "key"}}, ok: false},
+	} {
+		c.conf.Bucket, c.conf.Endpoint = "test", "localhost"
+
+		err := c.conf.Validate()
+		if c.ok {
+			testutil.Ok(t, err)
+		} else {
+			testutil.NotOk(t, err)
+		}
+	}
+}
+
+func TestNewBucket_B2PartSize(t *testing.T) {
+	for _, c := range []struct {
+		conf      Config
+		partSize  int64
+		threshold int64
+	}{
+		// Other stores leave multipart uploads to the client by default.
+		{conf: Config{Endpoint: "s3.amazonaws.com"}},
+		{conf: Config{Endpoint: "s3.us-west-002.backblazeb2.com"}, partSize: b2PartSize, threshold: b2PartSize},
+		{conf: Config{Endpoint: "S3.EU-CENTRAL-003.BACKBLAZEB2.COM"}, partSize: b2PartSize, threshold: b2PartSize},
+		// A configured part size takes precedence.
+		{conf: Config{Endpoint: "s3.us-west-002.backblazeb2.com", PartSize: 16 << 20}, partSize: 16 << 20, threshold: 16 << 20},
+	} {
+		c.conf.Bucket, c.conf.AccessKey, c.conf.SecretKey, c.conf.Region = "test", "key", "secret", "us-east-1"
+
+		bkt, err := NewBucket(&c.conf, nil)
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.partSize, bkt.partSize)
+		testutil.Equals(t, c.threshold, bkt.multipartThreshold)
+	}
+}
@@ -3,10 +3,19 @@ package s3
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/go-ini/ini"
+	"github.com/improbable-eng/thanos/pkg/objstore"
 	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -17,6 +26,7 @@ const (
 	opObjectGet    = "GetObject"
 	opObjectStat   = "StatObject"
 	opObjectDelete = "DeleteObject"
+	opBucketExists = "HeadBucket"
 )
 
 // DirDelim is the delimiter used to model a directory structure in an object store bucket.
@@ -24,56 +34,294 @@ const DirDelim = "/"
 
 // Bucket implements the store.Bucket interface against s3-compatible APIs.
 type Bucket struct {
-	bucket   string
-	client   *minio.Core
-	opsTotal *prometheus.CounterVec
+	bucket        string
+	region        string
+	client        *minio.Core
+	diskBufferDir string
+	putHeaders    map[string]string
+	getHeaders    map[string]string
+	opsTotal      *prometheus.CounterVec
+
+	// listObjectsV2 selects version 2 of the ListObjects API for Iter.
+	listObjectsV2 bool
+
+	// Multipart uploads are handled by the client if partSize is zero.
+	partSize           int64
+	multipartThreshold int64
+	uploadConcurrency  int
 }
 
 // Config encapsulates the necessary config values to instantiate an s3 client.
+// If neither keys nor a profile are configured, credentials are looked up like the AWS
+// SDKs do, i.e. from the environment, a web identity token, the ECS task role or the
+// EC2 instance profile. Temporary credentials are refreshed before they expire.
+// If a role ARN is set, these credentials are only used to assume it.
 type Config struct {
-	Bucket    string
-	Endpoint  string
-	AccessKey string
-	SecretKey string
-	Insecure  bool
+	Bucket    string `yaml:"bucket"`
+	Endpoint  string `yaml:"endpoint"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	Insecure  bool   `yaml:"insecure"`
+	// Region of the bucket. If empty, it is looked up through GetBucketLocation. A region
+	// configured here takes precedence over the region of a profile.
+	Region string `yaml:"region"`
+	// Profile is the name of a profile in the shared AWS config files from which the
+	// credentials and region are loaded. It must not be combined with static keys.
+	Profile string `yaml:"profile"`
+	// RoleARN is a role that is assumed through STS with the credentials configured above,
+	// e.g. to write into a bucket owned by another AWS account.
+	RoleARN string `yaml:"role_arn"`
+	// SessionName identifies the session of the assumed role in CloudTrail. It defaults to
+	// a generated name.
+	SessionName string `yaml:"session_name"`
+	// ExternalID is passed when assuming the role if its trust policy requires one.
+	ExternalID string `yaml:"external_id"`
+	// DiskBufferDir is a directory in which uploads are spooled to determine their size
+	// before sending them. If empty, uploads of unknown size are buffered in memory.
+	DiskBufferDir string `yaml:"disk_buffer_dir"`
+	// TLSConfig overrides the TLS settings of connections to the endpoint, e.g. to enforce
+	// a minimum TLS version. It cannot be set through YAML.
+	TLSConfig *tls.Config `yaml:"-"`
+	// HTTPConfig configures the certificates used for connections to the endpoint, which are
+	// applied on top of TLSConfig, and the client's connection pool.
+	HTTPConfig HTTPConfig `yaml:"http_config"`
+	// SSE configures the server-side encryption of uploaded objects.
+	SSE SSEConfig `yaml:"sse"`
+	// PartSize is the size in bytes of the parts of multipart uploads. It must be between
+	// 5MiB and 5GiB and defaults to 64MiB if any of the multipart settings is given.
+	// Uploads to Backblaze B2 are always done in parts, which default to 100MiB.
+	PartSize int64 `yaml:"part_size"`
+	// MultipartThreshold is the size in bytes from which objects are uploaded in parts.
+	// It defaults to PartSize.
+	MultipartThreshold int64 `yaml:"multipart_threshold"`
+	// UploadConcurrency is the number of parts of an object that are uploaded at the same
+	// time, each of which is held in memory. It defaults to 1.
+	UploadConcurrency int `yaml:"upload_concurrency"`
+	// ListObjectsVersion is the version of the ListObjects API used to list objects, i.e.
+	// v1 or v2. It defaults to v1, which is supported by all S3-compatible stores.
+	ListObjectsVersion string `yaml:"list_objects_version"`
+}
+
+// Supported versions of the ListObjects API.
+const (
+	listObjectsV1 = "v1"
+	listObjectsV2 = "v2"
+)
+
+// Limits of multipart uploads imposed by S3.
+const (
+	minPartSize     = 5 << 20
+	maxPartSize     = 5 << 30
+	maxPartCount    = 10000
+	defaultPartSize = 64 << 20
+)
+
+// multipart returns true if any of the multipart settings is given.
+func (conf *Config) multipart() bool {
+	return conf.PartSize > 0 || conf.MultipartThreshold > 0 || conf.UploadConcurrency > 0
+}
+
+// b2PartSize is the part size Backblaze B2 recommends for large files.
+const b2PartSize = 100 << 20
+
+// isB2 returns true if the endpoint is the S3-compatible API of Backblaze B2.
+// Without a part size, the client buffers parts of several hundred MiB for objects of
+// unknown size, which B2 is prone to time out on.
+func (conf *Config) isB2() bool {
+	return strings.HasSuffix(strings.ToLower(conf.Endpoint), ".backblazeb2.com")
 }
 
 // Validate checks to see if any of the s3 config options are set.
 func (conf *Config) Validate() error {
-	if conf.Bucket == "" ||
-		conf.Endpoint == "" ||
-		conf.AccessKey == "" ||
-		conf.SecretKey == "" {
-		return errors.New("insufficient s3 configuration information")
+	switch {
+	case conf.Bucket == "":
+		return errors.New("insufficient s3 configuration information: missing bucket")
+	case conf.Endpoint == "":
+		return errors.New("insufficient s3 configuration information: missing endpoint")
+	case conf.AccessKey == "" && conf.SecretKey != "":
+		return errors.New("insufficient s3 configuration information: missing access key")
+	case conf.AccessKey != "" && conf.SecretKey == "":
+		return errors.New("insufficient s3 configuration information: missing secret key")
+	case conf.RoleARN == "" && (conf.SessionName != "" || conf.ExternalID != ""):
+		return errors.New("insufficient s3 configuration information: missing role ARN")
+	case conf.PartSize != 0 && (conf.PartSize < minPartSize || conf.PartSize > maxPartSize):
+		return errors.Errorf("s3 part size must be between %d and %d bytes", minPartSize, maxPartSize)
+	case conf.MultipartThreshold < 0:
+		return errors.New("s3 multipart threshold must not be negative")
+	case conf.UploadConcurrency < 0:
+		return errors.New("s3 upload concurrency must not be negative")
+	case conf.multipart() && conf.SSE.Type == SSEC:
+		// Parts would have to carry the customer key, which the client cannot send.
+		return errors.New("s3 multipart settings cannot be combined with SSE-C")
+	case conf.Insecure && (conf.HTTPConfig.tlsSet() || conf.HTTPConfig.TLSSet()):
+		return errors.New("s3 TLS settings cannot be combined with an insecure connection")
+	case conf.ListObjectsVersion != "" && conf.ListObjectsVersion != listObjectsV1 && conf.ListObjectsVersion != listObjectsV2:
+		return errors.Errorf("unsupported s3 list objects version %q, must be %s or %s", conf.ListObjectsVersion, listObjectsV1, listObjectsV2)
 	}
-	return nil
+	if err := conf.HTTPConfig.Validate(); err != nil {
+		return err
+	}
+	return conf.SSE.Validate()
 }
 
 // NewBucket returns a new Bucket using the provided s3 config values.
 func NewBucket(conf *Config, reg prometheus.Registerer) (*Bucket, error) {
-	client, err := minio.NewCore(conf.Endpoint, conf.AccessKey, conf.SecretKey, !conf.Insecure)
+	var (
+		creds  *credentials.Credentials
+		region = conf.Region
+	)
+	if conf.Profile != "" {
+		if conf.AccessKey != "" || conf.SecretKey != "" {
+			return nil, errors.New("s3 profile and static keys must not be configured at the same time")
+		}
+		c, profileRegion, err := loadProfile(conf.Profile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load s3 profile %s", conf.Profile)
+		}
+		if region == "" {
+			region = profileRegion
+		}
+		creds = c
+	} else if conf.AccessKey != "" {
+		creds = credentials.NewStaticV4(conf.AccessKey, conf.SecretKey, "")
+	} else {
+		// Retrieve the credentials right away to fail on startup if none are available.
+		creds = newCredentialChain()
+		v, err := creds.Get()
+		if err != nil {
+			return nil, errors.Wrap(err, "retrieve s3 credentials")
+		}
+		if v.SignerType == credentials.SignatureAnonymous || v.AccessKeyID == "" {
+			return nil, errors.New("no s3 credentials found in the environment, web identity token, ECS task role or EC2 instance profile")
+		}
+	}
+	if conf.RoleARN != "" {
+		creds = credentials.New(newAssumeRoleProvider(creds, conf.RoleARN, conf.SessionName, conf.ExternalID, region))
+		if _, err := creds.Get(); err != nil {
+			return nil, errors.Wrap(err, "retrieve s3 credentials")
+		}
+	}
+	c, err := minio.NewWithCredentials(conf.Endpoint, creds, !conf.Insecure, region)
 	if err != nil {
 		return nil, errors.Wrap(err, "initialize s3 client")
 	}
+	client := &minio.Core{Client: c}
+
+	if conf.TLSConfig != nil || conf.HTTPConfig.tlsSet() || conf.HTTPConfig.TransportConfig.IsSet() {
+		tlsConfig := conf.TLSConfig
+		if conf.HTTPConfig.tlsSet() {
+			var err error
+			if tlsConfig, err = conf.HTTPConfig.tlsConfig(conf.TLSConfig); err != nil {
+				return nil, errors.Wrap(err, "configure s3 TLS")
+			}
+		}
+		client.SetCustomTransport(conf.HTTPConfig.TransportConfig.NewTransport(tlsConfig))
+	}
+	putHeaders, getHeaders, err := conf.SSE.headers()
+	if err != nil {
+		return nil, errors.Wrap(err, "configure s3 encryption")
+	}
 
 	bkt := &Bucket{
-		bucket: conf.Bucket,
-		client: client,
+		bucket:        conf.Bucket,
+		region:        conf.Region,
+		client:        client,
+		diskBufferDir: conf.DiskBufferDir,
+		putHeaders:    putHeaders,
+		getHeaders:    getHeaders,
+		listObjectsV2: conf.ListObjectsVersion == listObjectsV2,
 		opsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name:        "thanos_objstore_s3_bucket_operations_total",
 			Help:        "Total number of operations that were executed against an s3 bucket.",
 			ConstLabels: prometheus.Labels{"bucket": conf.Bucket},
 		}, []string{"operation"}),
 	}
+	if conf.multipart() || (conf.isB2() && conf.SSE.Type != SSEC) {
+		bkt.partSize, bkt.multipartThreshold, bkt.uploadConcurrency = conf.PartSize, conf.MultipartThreshold, conf.UploadConcurrency
+		if bkt.partSize == 0 {
+			bkt.partSize = defaultPartSize
+			if conf.isB2() {
+				bkt.partSize = b2PartSize
+			}
+		}
+		if bkt.multipartThreshold == 0 {
+			bkt.multipartThreshold = bkt.partSize
+		}
+		if bkt.uploadConcurrency == 0 {
+			bkt.uploadConcurrency = 1
+		}
+	}
 	if reg != nil {
 		reg.MustRegister(bkt.opsTotal)
 	}
 	return bkt, nil
 }
 
+// loadProfile loads the credentials and region of the named profile from the shared AWS
+// credentials and config files. Their locations can be overridden through the
+// AWS_SHARED_CREDENTIALS_FILE and AWS_CONFIG_FILE environment variables.
+func loadProfile(profile string) (*credentials.Credentials, string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "determine home directory")
+	}
+	credsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credsFile == "" {
+		credsFile = filepath.Join(home, ".aws", "credentials")
+	}
+	configFile := os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = filepath.Join(home, ".aws", "config")
+	}
+
+	// Retrieve the credentials right away to fail on startup if the profile does not exist.
+	creds := credentials.NewFileAWSCredentials(credsFile, profile)
+	if _, err := creds.Get(); err != nil {
+		return nil, "", errors.Wrapf(err, "read credentials from %s", credsFile)
+	}
+
+	// The region is optional and, unlike the credentials, prefixed with "profile" in the config file.
+	if _, err := os.Stat(configFile); os.IsNotExist(err) {
+		return creds, "", nil
+	}
+	f, err := ini.Load(configFile)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "read config from %s", configFile)
+	}
+	section := "profile " + profile
+	if profile == "default" {
+		section = profile
+	}
+	sec, err := f.GetSection(section)
+	if err != nil {
+		return creds, "", nil
+	}
+	return creds, sec.Key("region").String(), nil
+}
+
+// Type returns the type of the bucket's backend.
+func (b *Bucket) Type() string {
+	return "S3"
+}
+
+// CheckAccess verifies that the bucket exists and that the configured credentials grant access to it.
+func (b *Bucket) CheckAccess() error {
+	b.opsTotal.WithLabelValues(opBucketExists).Inc()
+
+	ok, err := b.client.BucketExists(b.bucket)
+	if err != nil {
+		return errors.Wrapf(b.regionError(err), "check access to bucket %s", b.bucket)
+	}
+	if !ok {
+		return errors.Errorf("bucket %s does not exist", b.bucket)
+	}
+	return nil
+}
+
 // Iter calls f for each entry in the given directory. The argument to f is the full
-// object name including the prefix of the inspected directory.
-func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+// object name including the prefix of the inspected directory. If the listing is
+// recursive, the names of all objects below the directory are passed to f instead.
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
 	b.opsTotal.WithLabelValues(opObjectsList).Inc()
 	// Ensure the object name actually ends with a dir suffix. Otherwise we'll just iterate the
 	// object itself as one prefix item.
@@ -81,7 +329,23 @@ func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) err
 		dir = strings.TrimSuffix(dir, DirDelim) + DirDelim
 	}
 
-	for object := range b.client.Client.ListObjects(b.bucket, dir, false, ctx.Done()) {
+	// Stop the listing once we return so the client does not keep fetching pages.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	list := b.client.Client.ListObjects
+	if b.listObjectsV2 {
+		list = b.client.Client.ListObjectsV2
+	}
+	for object := range list(b.bucket, dir, objstore.ApplyIterOptions(options...).Recursive, ctx.Done()) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if object.Err != nil {
+			return b.regionError(object.Err)
+		}
 		// this sometimes happens with empty buckets
 		if object.Key == "" {
 			continue
@@ -90,51 +354,163 @@ func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) err
 			return err
 		}
 	}
-
-	return nil
+	// The listing also ends early if the context was canceled.
+	return ctx.Err()
 }
 
 // Get returns a reader for the given object name.
 func (b *Bucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
 	b.opsTotal.WithLabelValues(opObjectGet).Inc()
-	return b.client.GetObjectWithContext(ctx, b.bucket, name, minio.GetObjectOptions{})
+	return b.getObject(ctx, name, b.getOptions())
+}
+
+// getObject returns a reader for the object. The client only sends the request on the first
+// read, so an empty read is done right away to return errors such as a missing object here.
+func (b *Bucket) getObject(ctx context.Context, name string, opts minio.GetObjectOptions) (io.ReadCloser, error) {
+	obj, err := b.client.GetObjectWithContext(ctx, b.bucket, name, opts)
+	if err != nil {
+		return nil, b.regionError(err)
+	}
+	if _, err := obj.Read(nil); err != nil && err != io.EOF {
+		obj.Close()
+		return nil, b.regionError(err)
+	}
+	return obj, nil
+}
+
+// getOptions returns the options for reading objects, which carry the encryption key if
+// objects are encrypted with a customer-provided key.
+func (b *Bucket) getOptions() minio.GetObjectOptions {
+	opts := minio.GetObjectOptions{}
+	for k, v := range b.getHeaders {
+		opts.Set(k, v)
+	}
+	return opts
 }
 
 // GetRange returns a new range reader for the given object name and range.
 func (b *Bucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
 	b.opsTotal.WithLabelValues(opObjectGet).Inc()
-	opts := &minio.GetObjectOptions{}
-	err := opts.SetRange(off, off+length)
+	opts := b.getOptions()
+	// The end of the range is inclusive.
+	err := opts.SetRange(off, off+length-1)
 	if err != nil {
 		return nil, err
 	}
-	return b.client.GetObjectWithContext(ctx, b.bucket, name, *opts)
+	return b.getObject(ctx, name, opts)
 }
 
 // Exists checks if the given object exists.
 func (b *Bucket) Exists(ctx context.Context, name string) (bool, error) {
 	b.opsTotal.WithLabelValues(opObjectStat).Inc()
-	_, err := b.client.StatObject(b.bucket, name, minio.StatObjectOptions{})
+	_, err := b.client.StatObject(b.bucket, name, minio.StatObjectOptions{GetObjectOptions: b.getOptions()})
 	if err != nil {
 		errResponse := minio.ToErrorResponse(err)
 		if errResponse.Code == "NoSuchKey" {
 			return false, nil
 		}
-		return false, errors.Wrap(err, "stat s3 object")
+		return false, errors.Wrap(b.regionError(err), "stat s3 object")
 	}
 
 	return true, nil
 }
 
+// Attributes returns information about the object with the given name.
+func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	b.opsTotal.WithLabelValues(opObjectStat).Inc()
+
+	info, err := b.client.StatObject(b.bucket, name, minio.StatObjectOptions{GetObjectOptions: b.getOptions()})
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrap(b.regionError(err), "stat s3 object")
+	}
+	return objstore.ObjectAttributes{
+		Size:         info.Size,
+		LastModified: info.LastModified,
+		ETag:         info.ETag,
+	}, nil
+}
+
 // Upload the contents of the reader as an object into the bucket.
 func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
 	b.opsTotal.WithLabelValues(opObjectInsert).Inc()
-	_, err := b.client.PutObjectWithContext(ctx, b.bucket, name, r, -1, minio.PutObjectOptions{})
-	return errors.Wrap(err, "upload s3 object")
+
+	if b.partSize > 0 {
+		return errors.Wrap(b.regionError(b.uploadInParts(ctx, name, r)), "upload s3 object")
+	}
+	size := int64(-1)
+	if b.diskBufferDir != "" {
+		f, n, err := bufferToDisk(b.diskBufferDir, r)
+		if err != nil {
+			return errors.Wrap(err, "buffer upload on disk")
+		}
+		defer removeBuffer(f)
+
+		r, size = f, n
+	}
+	_, err := b.client.PutObjectWithContext(ctx, b.bucket, name, r, size, minio.PutObjectOptions{UserMetadata: b.putHeaders})
+	return errors.Wrap(b.regionError(err), "upload s3 object")
+}
+
+// bufferToDisk copies r into a new temporary file in dir and returns the file, rewound
+// to its beginning, along with its size.
+func bufferToDisk(dir string, r io.Reader) (*os.File, int64, error) {
+	f, err := ioutil.TempFile(dir, "s3-upload-")
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "create buffer file")
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		removeBuffer(f)
+		return nil, 0, errors.Wrap(err, "copy to buffer file")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		removeBuffer(f)
+		return nil, 0, errors.Wrap(err, "seek buffer file")
+	}
+	return f, n, nil
+}
+
+func removeBuffer(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
 }
 
 // Delete removes the object with the given name.
 func (b *Bucket) Delete(ctx context.Context, name string) error {
 	b.opsTotal.WithLabelValues(opObjectDelete).Inc()
-	return b.client.RemoveObject(b.bucket, name)
+	return b.regionError(b.client.RemoveObject(b.bucket, name))
+}
+
+// IsRetryableErr returns true if the error was caused by throttling or a server-side failure of S3.
+func (b *Bucket) IsRetryableErr(err error) bool {
+	switch minio.ToErrorResponse(errors.Cause(err)).Code {
+	case "InternalError", "ServiceUnavailable", "SlowDown", "RequestTimeout", "RequestTimeTooSkewed":
+		return true
+	}
+	return false
+}
+
+// regionError explains errors caused by signing requests for a region other than the bucket's,
+// which S3 only reports as a malformed request.
+func (b *Bucket) regionError(err error) error {
+	resp := minio.ToErrorResponse(err)
+	switch resp.Code {
+	case "AuthorizationHeaderMalformed", "InvalidRegion", "PermanentRedirect", "IllegalLocationConstraintException":
+	default:
+		// Responses to HEAD requests have no body to carry an error code, but still name
+		// the bucket's region.
+		if resp.Region == "" || b.region == "" || resp.Region == b.region {
+			return err
+		}
+	}
+	region := b.region
+	if region == "" {
+		region = "detected"
+	} else {
+		region = fmt.Sprintf("configured %q", region)
+	}
+	if resp.Region == "" {
+		return errors.Wrapf(err, "bucket %s is not in the %s region, set the bucket's region explicitly", b.bucket, region)
+	}
+	return errors.Wrapf(err, "bucket %s is in region %q rather than the %s region, set the bucket's region accordingly", b.bucket, resp.Region, region)
 }
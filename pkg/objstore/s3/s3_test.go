@@ -0,0 +1,385 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/improbable-eng/thanos/pkg/testutil"
+	"github.com/minio/minio-go"
+)
+
+func TestBufferToDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3-buffer-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	f, n, err := bufferToDisk(dir, bytes.NewReader([]byte("some object contents")))
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(20), n)
+
+	files, err := ioutil.ReadDir(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(files))
+
+	b, err := ioutil.ReadAll(f)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "some object contents", string(b))
+
+	removeBuffer(f)
+
+	files, err = ioutil.ReadDir(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(files))
+}
+
+// newFakeListServer returns a server that answers S3 list requests with two pages of
+// two directories each. Like some S3-compatible stores, it answers requests of the
+// unsupported version of the ListObjects API with an empty listing.
+func newFakeListServer(v2 bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		if _, ok := q["location"]; ok {
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+			return
+		}
+		prefixes, truncated, next := []string{"a/", "b/"}, true, "b/"
+		if q.Get("marker") != "" || q.Get("continuation-token") != "" {
+			prefixes, truncated, next = []string{"c/", "d/"}, false, ""
+		}
+		if v2 != (q.Get("list-type") == "2") {
+			prefixes, truncated, next = nil, false, ""
+		}
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
+<Name>test</Name><Prefix></Prefix><Delimiter>/</Delimiter><MaxKeys>2</MaxKeys>
+<IsTruncated>%t</IsTruncated>`, truncated)
+		if v2 {
+			fmt.Fprintf(w, `<KeyCount>%d</KeyCount><NextContinuationToken>%s</NextContinuationToken>`, len(prefixes), next)
+		} else {
+			fmt.Fprintf(w, `<NextMarker>%s</NextMarker>`, next)
+		}
+		for _, p := range prefixes {
+			fmt.Fprintf(w, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, p)
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	}))
+}
+
+func TestBucket_Iter(t *testing.T) {
+	srv := newFakeListServer(false)
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	bkt, err := NewBucket(&Config{
+		Bucket:    "test",
+		Endpoint:  u.Host,
+		AccessKey: "key",
+		SecretKey: "secret",
+		Insecure:  true,
+	}, nil)
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+
+	// All pages must be listed.
+	var names []string
+	testutil.Ok(t, bkt.Iter(ctx, "", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	testutil.Equals(t, []string{"a/", "b/", "c/", "d/"}, names)
+
+	// An error returned by the callback must stop iteration immediately.
+	var calls int
+	errStop := errors.New("stop")
+
+	err = bkt.Iter(ctx, "", func(string) error {
+		calls++
+		return errStop
+	})
+	testutil.Equals(t, errStop, err)
+	testutil.Equals(t, 1, calls)
+
+	// Canceling the context must stop iteration with the context's error.
+	calls = 0
+	cctx, cancel := context.WithCancel(ctx)
+
+	err = bkt.Iter(cctx, "", func(string) error {
+		calls++
+		cancel()
+		return nil
+	})
+	testutil.Equals(t, context.Canceled, err)
+	testutil.Equals(t, 1, calls)
+}
+
+func TestBucket_IterListObjectsVersion(t *testing.T) {
+	for _, v2 := range []bool{false, true} {
+		srv := newFakeListServer(v2)
+		defer srv.Close()
+
+		u, err := url.Parse(srv.URL)
+		testutil.Ok(t, err)
+
+		iter := func(version string) []string {
+			conf := &Config{
+				Bucket:             "test",
+				Endpoint:           u.Host,
+				AccessKey:          "key",
+				SecretKey:          "secret",
+				Insecure:           true,
+				ListObjectsVersion: version,
+			}
+			testutil.Ok(t, conf.Validate())
+
+			bkt, err := NewBucket(conf, nil)
+			testutil.Ok(t, err)
+
+			var names []string
+			testutil.Ok(t, bkt.Iter(context.Background(), "", func(name string) error {
+				names = append(names, name)
+				return nil
+			}))
+			return names
+		}
+		if v2 {
+			testutil.Equals(t, []string{"a/", "b/", "c/", "d/"}, iter("v2"))
+			testutil.Equals(t, 0, len(iter("v1")))
+		} else {
+			testutil.Equals(t, []string{"a/", "b/", "c/", "d/"}, iter("v1"))
+			testutil.Equals(t, []string{"a/", "b/", "c/", "d/"}, iter(""))
+			testutil.Equals(t, 0, len(iter("v2")))
+		}
+	}
+
+	conf := &Config{Bucket: "test", Endpoint: "localhost", ListObjectsVersion: "v3"}
+	testutil.NotOk(t, conf.Validate())
+}
+
+func TestBucket_CheckAccess(t *testing.T) {
+	status := http.StatusOK
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()["location"]; ok {
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	bkt, err := NewBucket(&Config{
+		Bucket:    "test",
+		Endpoint:  u.Host,
+		AccessKey: "key",
+		SecretKey: "secret",
+		Insecure:  true,
+	}, nil)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, bkt.CheckAccess())
+
+	// Rejected credentials must fail the check.
+	status = http.StatusForbidden
+	testutil.NotOk(t, bkt.CheckAccess())
+
+	// A missing bucket must fail the check.
+	status = http.StatusNotFound
+	testutil.NotOk(t, bkt.CheckAccess())
+}
+
+func TestBucket_TLSConfig(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()["location"]; ok {
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+			return
+		}
+	}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS11}
+	srv.StartTLS()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	newBucket := func(minVersion uint16) *Bucket {
+		bkt, err := NewBucket(&Config{
+			Bucket:    "test",
+			Endpoint:  u.Host,
+			AccessKey: "key",
+			SecretKey: "secret",
+			TLSConfig: &tls.Config{InsecureSkipVerify: true, MinVersion: minVersion},
+		}, nil)
+		testutil.Ok(t, err)
+		return bkt
+	}
+	testutil.Ok(t, newBucket(tls.VersionTLS10).CheckAccess())
+
+	// The server only offers TLS 1.1, which must be refused by the client.
+	testutil.NotOk(t, newBucket(tls.VersionTLS12).CheckAccess())
+}
+
+func TestNewBucket_Profile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3-profile-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	credsFile, configFile := filepath.Join(dir, "credentials"), filepath.Join(dir, "config")
+	testutil.Ok(t, ioutil.WriteFile(credsFile, []byte(`[default]
+aws_access_key_id = DEFAULTKEY
+aws_secret_access_key = defaultsecret
+
+[thanos]
+aws_access_key_id = PROFILEKEY
+aws_secret_access_key = profilesecret
+`), 0600))
+	testutil.Ok(t, ioutil.WriteFile(configFile, []byte(`[default]
+region = us-east-1
+
+[profile thanos]
+region = eu-central-1
+`), 0600))
+
+	for k, v := range map[string]string{"AWS_SHARED_CREDENTIALS_FILE": credsFile, "AWS_CONFIG_FILE": configFile} {
+		defer os.Setenv(k, os.Getenv(k))
+		testutil.Ok(t, os.Setenv(k, v))
+	}
+
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	conf := &Config{
+		Bucket:   "test",
+		Endpoint: u.Host,
+		Insecure: true,
+		Profile:  "thanos",
+	}
+	testutil.Ok(t, conf.Validate())
+
+	bkt, err := NewBucket(conf, nil)
+	testutil.Ok(t, err)
+	testutil.Ok(t, bkt.CheckAccess())
+
+	// Requests must be signed with the profile's keys for its region.
+	testutil.Assert(t, strings.Contains(auth, "Credential=PROFILEKEY/"), "unexpected authorization %q", auth)
+	testutil.Assert(t, strings.Contains(auth, "/eu-central-1/s3/"), "unexpected authorization %q", auth)
+
+	// Unknown profiles must be rejected on startup.
+	conf.Profile = "missing"
+	_, err = NewBucket(conf, nil)
+	testutil.NotOk(t, err)
+
+	// A profile must not be combined with static keys.
+	conf.Profile, conf.AccessKey, conf.SecretKey = "thanos", "key", "secret"
+	_, err = NewBucket(conf, nil)
+	testutil.NotOk(t, err)
+}
+
+func TestBucket_Region(t *testing.T) {
+	var lookups int
+
+	// The bucket lives in eu-west-1 and rejects requests signed for any other region.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()["location"]; ok {
+			lookups++
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">eu-west-1</LocationConstraint>`)
+			return
+		}
+		if !strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/s3/") {
+			w.Header().Set("x-amz-bucket-region", "eu-west-1")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>AuthorizationHeaderMalformed</Code><Message>The authorization header is malformed; the region 'us-east-1' is wrong; expecting 'eu-west-1'</Message><Region>eu-west-1</Region></Error>`)
+			return
+		}
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	newBucket := func(region string) *Bucket {
+		bkt, err := NewBucket(&Config{
+			Bucket:    "test",
+			Endpoint:  u.Host,
+			AccessKey: "key",
+			SecretKey: "secret",
+			Insecure:  true,
+			Region:    region,
+		}, nil)
+		testutil.Ok(t, err)
+		return bkt
+	}
+
+	// Without a region, it is detected.
+	testutil.Ok(t, newBucket("").CheckAccess())
+	testutil.Equals(t, 1, lookups)
+
+	// A configured region is used without looking it up.
+	testutil.Ok(t, newBucket("eu-west-1").CheckAccess())
+	testutil.Equals(t, 1, lookups)
+
+	// A wrong region must be reported along with the bucket's actual region.
+	err = newBucket("us-east-1").CheckAccess()
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), `bucket test is in region "eu-west-1" rather than the configured "us-east-1" region`), "unexpected error: %s", err)
+	testutil.Equals(t, 1, lookups)
+}
+
+func TestBucket_IsRetryableErr(t *testing.T) {
+	b := &Bucket{}
+
+	testutil.Assert(t, b.IsRetryableErr(minio.ErrorResponse{Code: "SlowDown"}), "throttling must be retried")
+	testutil.Assert(t, b.IsRetryableErr(minio.ErrorResponse{Code: "InternalError"}), "server errors must be retried")
+	testutil.Assert(t, !b.IsRetryableErr(minio.ErrorResponse{Code: "AccessDenied"}), "missing permissions must not be retried")
+	testutil.Assert(t, !b.IsRetryableErr(errors.New("unrelated")), "unrelated errors must not be retried")
+}
+
+func TestConfig_ValidateRole(t *testing.T) {
+	for _, c := range []struct {
+		conf Config
+		ok   bool
+	}{
+		{conf: Config{RoleARN: "arn:aws:iam::456:role/archive"}, ok: true},
+		{conf: Config{RoleARN: "arn:aws:iam::456:role/archive", SessionName: "thanos", ExternalID: "ext"}, ok: true},
+		{conf: Config{RoleARN: "arn:aws:iam::456:role/archive", AccessKey: "key", SecretKey: "secret"}, ok: true},
+		{conf: Config{SessionName: "thanos"}, ok: false},
+		{conf: Config{ExternalID: "ext"}, ok: false},
+	} {
+		c.conf.Bucket, c.conf.Endpoint = "test", "s3.amazonaws.com"
+
+		err := c.conf.Validate()
+		if c.ok {
+			testutil.Ok(t, err)
+		} else {
+			testutil.NotOk(t, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Supported types of server-side encryption.
+const (
+	SSES3  = "SSE-S3"
+	SSEKMS = "SSE-KMS"
+	SSEC   = "SSE-C"
+)
+
+// SSEConfig configures the server-side encryption of uploaded objects.
+type SSEConfig struct {
+	// Type is the kind of encryption, i.e. SSE-S3, SSE-KMS or SSE-C. Objects are not
+	// encrypted if it is empty.
+	Type string `yaml:"type"`
+	// KMSKeyID is the ID or ARN of the KMS key used with SSE-KMS. If empty, the
+	// account's default key for S3 is used.
+	KMSKeyID string `yaml:"kms_key_id"`
+	// KMSEncryptionContext is the encryption context passed to KMS with SSE-KMS.
+	KMSEncryptionContext map[string]string `yaml:"kms_encryption_context"`
+	// CustomerKeyFile is the path of a file holding the 256 bit key used with SSE-C.
+	CustomerKeyFile string `yaml:"customer_key_file"`
+}
+
+// Validate checks that the encryption settings match the configured type.
+func (conf *SSEConfig) Validate() error {
+	switch conf.Type {
+	case "":
+		if conf.KMSKeyID != "" || len(conf.KMSEncryptionContext) > 0 || conf.CustomerKeyFile != "" {
+			return errors.New("s3 encryption settings given without an encryption type")
+		}
+	case SSES3:
+		if conf.KMSKeyID != "" || len(conf.KMSEncryptionContext) > 0 || conf.CustomerKeyFile != "" {
+			return errors.New("SSE-S3 does not take a KMS key or customer key")
+		}
+	case SSEKMS:
+		if conf.CustomerKeyFile != "" {
+			return errors.New("SSE-KMS does not take a customer key")
+		}
+	case SSEC:
+		if conf.CustomerKeyFile == "" {
+			return errors.New("SSE-C requires a customer key file")
+		}
+		if conf.KMSKeyID != "" || len(conf.KMSEncryptionContext) > 0 {
+			return errors.New("SSE-C does not take a KMS key")
+		}
+	default:
+		return errors.Errorf("unsupported s3 encryption type %q, must be one of %s, %s or %s", conf.Type, SSES3, SSEKMS, SSEC)
+	}
+	return nil
+}
+
+// headers returns the headers to send when writing objects and the headers to send when
+// reading them. The latter are only needed for customer-provided keys.
+func (conf *SSEConfig) headers() (put, get map[string]string, err error) {
+	switch conf.Type {
+	case SSES3:
+		return map[string]string{"X-Amz-Server-Side-Encryption": "AES256"}, nil, nil
+	case SSEKMS:
+		put = map[string]string{"X-Amz-Server-Side-Encryption": "aws:kms"}
+		if conf.KMSKeyID != "" {
+			put["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"] = conf.KMSKeyID
+		}
+		if len(conf.KMSEncryptionContext) > 0 {
+			b, err := json.Marshal(conf.KMSEncryptionContext)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "encode KMS encryption context")
+			}
+			put["X-Amz-Server-Side-Encryption-Context"] = base64.StdEncoding.EncodeToString(b)
+		}
+		return put, nil, nil
+	case SSEC:
+		key, err := ioutil.ReadFile(conf.CustomerKeyFile)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "read SSE-C customer key")
+		}
+		if len(key) != 32 {
+			return nil, nil, errors.Errorf("SSE-C customer key must be 32 bytes long, got %d", len(key))
+		}
+		sum := md5.Sum(key)
+
+		get = map[string]string{
+			"X-Amz-Server-Side-Encryption-Customer-Algorithm": "AES256",
+			"X-Amz-Server-Side-Encryption-Customer-Key":       base64.StdEncoding.EncodeToString(key),
+			"X-Amz-Server-Side-Encryption-Customer-Key-Md5":   base64.StdEncoding.EncodeToString(sum[:]),
+		}
+		// The same key must be presented on every read of the object.
+		return get, get, nil
+	}
+	return nil, nil, nil
+}
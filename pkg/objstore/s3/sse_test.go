@@ -0,0 +1,144 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+func TestSSEConfig_Validate(t *testing.T) {
+	for _, c := range []struct {
+		conf SSEConfig
+		ok   bool
+	}{
+		{conf: SSEConfig{}, ok: true},
+		{conf: SSEConfig{Type: SSES3}, ok: true},
+		{conf: SSEConfig{Type: SSEKMS}, ok: true},
+		{conf: SSEConfig{Type: SSEKMS, KMSKeyID: "arn:aws:kms:eu-west-1:123:key/abc", KMSEncryptionContext: map[string]string{"a": "b"}}, ok: true},
+		{conf: SSEConfig{Type: SSEC, CustomerKeyFile: "key"}, ok: true},
+		{conf: SSEConfig{KMSKeyID: "abc"}, ok: false},
+		{conf: SSEConfig{Type: SSES3, CustomerKeyFile: "key"}, ok: false},
+		{conf: SSEConfig{Type: SSEKMS, CustomerKeyFile: "key"}, ok: false},
+		{conf: SSEConfig{Type: SSEC}, ok: false},
+		{conf: SSEConfig{Type: SSEC, CustomerKeyFile: "key", KMSKeyID: "abc"}, ok: false},
+		{conf: SSEConfig{Type: "SSE-FOO"}, ok: false},
+	} {
+		err := c.conf.Validate()
+		if c.ok {
+			testutil.Ok(t, err)
+		} else {
+			testutil.NotOk(t, err)
+		}
+	}
+}
+
+func TestBucket_SSE(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3-sse-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key")
+	testutil.Ok(t, ioutil.WriteFile(keyFile, bytes.Repeat([]byte{'k'}, 32), 0600))
+
+	var (
+		mtx     sync.Mutex
+		headers = map[string]http.Header{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()["location"]; ok {
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+			return
+		}
+		mtx.Lock()
+		headers[r.Method] = r.Header
+		mtx.Unlock()
+
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", "7")
+		if r.Method == "GET" {
+			fmt.Fprint(w, "content")
+		}
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	newBucket := func(sse SSEConfig) *Bucket {
+		conf := &Config{
+			Bucket:        "test",
+			Endpoint:      u.Host,
+			AccessKey:     "key",
+			SecretKey:     "secret",
+			Insecure:      true,
+			DiskBufferDir: dir,
+			SSE:           sse,
+		}
+		testutil.Ok(t, conf.Validate())
+
+		bkt, err := NewBucket(conf, nil)
+		testutil.Ok(t, err)
+		return bkt
+	}
+	ctx := context.Background()
+
+	// Objects are not encrypted by default.
+	bkt := newBucket(SSEConfig{})
+	testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewReader([]byte("content"))))
+	testutil.Equals(t, "", headers["PUT"].Get("X-Amz-Server-Side-Encryption"))
+
+	bkt = newBucket(SSEConfig{Type: SSES3})
+	testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewReader([]byte("content"))))
+	testutil.Equals(t, "AES256", headers["PUT"].Get("X-Amz-Server-Side-Encryption"))
+
+	bkt = newBucket(SSEConfig{Type: SSEKMS, KMSKeyID: "arn:aws:kms:eu-west-1:123:key/abc", KMSEncryptionContext: map[string]string{"a": "b"}})
+	testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewReader([]byte("content"))))
+	testutil.Equals(t, "aws:kms", headers["PUT"].Get("X-Amz-Server-Side-Encryption"))
+	testutil.Equals(t, "arn:aws:kms:eu-west-1:123:key/abc", headers["PUT"].Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+	testutil.Equals(t, "eyJhIjoiYiJ9", headers["PUT"].Get("X-Amz-Server-Side-Encryption-Context"))
+
+	// Customer-provided keys must be sent on writes and reads.
+	bkt = newBucket(SSEConfig{Type: SSEC, CustomerKeyFile: keyFile})
+	testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewReader([]byte("content"))))
+
+	rc, err := bkt.GetRange(ctx, "obj", 0, 7)
+	testutil.Ok(t, err)
+	_, err = ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+
+	ok, err := bkt.Exists(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "object must exist")
+
+	for _, m := range []string{"PUT", "GET", "HEAD"} {
+		testutil.Equals(t, "AES256", headers[m].Get("X-Amz-Server-Side-Encryption-Customer-Algorithm"))
+		testutil.Equals(t, "a2tra2tra2tra2tra2tra2tra2tra2tra2tra2tra2s=", headers[m].Get("X-Amz-Server-Side-Encryption-Customer-Key"))
+		testutil.Equals(t, "mT2HRsMGJ5IX5C+0rreZ8Q==", headers[m].Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5"))
+	}
+
+	// Customer keys of the wrong length must be rejected on startup.
+	testutil.Ok(t, ioutil.WriteFile(keyFile, []byte("short"), 0600))
+	_, err = NewBucket(&Config{
+		Bucket:    "test",
+		Endpoint:  u.Host,
+		AccessKey: "key",
+		SecretKey: "secret",
+		Insecure:  true,
+		SSE:       SSEConfig{Type: SSEC, CustomerKeyFile: keyFile},
+	}, nil)
+	testutil.NotOk(t, err)
+}
@@ -0,0 +1,154 @@
+package objstore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// BucketWithSlowOpLog wraps a bucket so that every operation taking longer than threshold
+// is logged at warn level along with the object name, the number of bytes transferred and
+// its duration. Reads are timed until their reader is closed. If threshold is not positive,
+// the bucket is returned unchanged.
+func BucketWithSlowOpLog(b Bucket, logger log.Logger, threshold time.Duration) Bucket {
+	if threshold <= 0 {
+		return b
+	}
+	return &slowOpBucket{
+		bkt:       b,
+		logger:    log.With(logger, "component", "objstore-slow-ops"),
+		threshold: threshold,
+		now:       time.Now,
+	}
+}
+
+type slowOpBucket struct {
+	bkt       Bucket
+	logger    log.Logger
+	threshold time.Duration
+	now       func() time.Time
+}
+
+func (b *slowOpBucket) Type() string {
+	return BackendType(b.bkt)
+}
+
+func (b *slowOpBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	start := b.now()
+
+	err := b.bkt.Iter(ctx, dir, f, options...)
+	b.log("iter", dir, 0, start, err)
+
+	return err
+}
+
+func (b *slowOpBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	start := b.now()
+
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		b.log("get", name, 0, start, err)
+		return nil, err
+	}
+	return &slowOpReadCloser{ReadCloser: rc, bkt: b, op: "get", name: name, start: start}, nil
+}
+
+func (b *slowOpBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	start := b.now()
+
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		b.log("get_range", name, 0, start, err)
+		return nil, err
+	}
+	return &slowOpReadCloser{ReadCloser: rc, bkt: b, op: "get_range", name: name, start: start}, nil
+}
+
+func (b *slowOpBucket) Exists(ctx context.Context, name string) (bool, error) {
+	start := b.now()
+
+	ok, err := b.bkt.Exists(ctx, name)
+	b.log("exists", name, 0, start, err)
+
+	return ok, err
+}
+
+func (b *slowOpBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	start := b.now()
+
+	attrs, err := b.bkt.Attributes(ctx, name)
+	b.log("attributes", name, 0, start, err)
+
+	return attrs, err
+}
+
+func (b *slowOpBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	start := b.now()
+	n, err := countedUpload(r, func(r io.Reader) error {
+		return b.bkt.Upload(ctx, name, r)
+	})
+	b.log("upload", name, n, start, err)
+
+	return err
+}
+
+func (b *slowOpBucket) Delete(ctx context.Context, name string) error {
+	start := b.now()
+
+	err := b.bkt.Delete(ctx, name)
+	b.log("delete", name, 0, start, err)
+
+	return err
+}
+
+// log logs the operation if it took longer than the threshold.
+func (b *slowOpBucket) log(op, name string, size int64, start time.Time, err error) {
+	d := b.now().Sub(start)
+	if d <= b.threshold {
+		return
+	}
+	kvs := []interface{}{
+		"msg", "slow operation",
+		"operation", op,
+		"object", name,
+		"size", size,
+		"duration", d,
+	}
+	if err != nil {
+		kvs = append(kvs, "err", err)
+	}
+	level.Warn(b.logger).Log(kvs...)
+}
+
+// slowOpReadCloser logs a read operation once its reader is closed.
+type slowOpReadCloser struct {
+	io.ReadCloser
+
+	bkt   *slowOpBucket
+	op    string
+	name  string
+	start time.Time
+	n     int64
+	err   error
+}
+
+func (rc *slowOpReadCloser) Read(p []byte) (int, error) {
+	n, err := rc.ReadCloser.Read(p)
+	rc.n += int64(n)
+	if err != nil && err != io.EOF && rc.err == nil {
+		rc.err = err
+	}
+	return n, err
+}
+
+func (rc *slowOpReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	if rc.err == nil {
+		rc.err = err
+	}
+	rc.bkt.log(rc.op, rc.name, rc.n, rc.start, rc.err)
+	return err
+}
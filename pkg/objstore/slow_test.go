@@ -0,0 +1,63 @@
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/inmem"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+func TestBucketWithSlowOpLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.NewLogfmtLogger(log.NewSyncWriter(&buf))
+
+	ib := inmem.NewBucket()
+	bkt := objstore.BucketWithSlowOpLog(objstore.BucketWithMetrics("test", ib, nil), logger, 50*time.Millisecond)
+	testutil.Equals(t, "INMEM", objstore.BackendType(bkt))
+
+	// Fast operations are not logged.
+	testutil.Ok(t, bkt.Upload(context.Background(), "dir/obj", bytes.NewReader([]byte("content"))))
+	_, err := bkt.Exists(context.Background(), "dir/obj")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "", buf.String())
+
+	ib.SetDelay(100 * time.Millisecond)
+
+	testutil.Ok(t, bkt.Upload(context.Background(), "dir/obj", bytes.NewReader([]byte("content"))))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	testutil.Equals(t, 1, len(lines))
+
+	for _, f := range []string{
+		"level=warn",
+		`msg="slow operation"`,
+		"operation=upload",
+		"object=dir/obj",
+		"size=7",
+		"duration=",
+	} {
+		testutil.Assert(t, strings.Contains(lines[0], f), "field %q missing in %q", f, lines[0])
+	}
+
+	// Reads are logged once their reader is closed.
+	buf.Reset()
+	rc, err := bkt.Get(context.Background(), "dir/obj")
+	testutil.Ok(t, err)
+	_, err = ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "", buf.String())
+
+	testutil.Ok(t, rc.Close())
+	testutil.Assert(t, strings.Contains(buf.String(), "operation=get "), "get not logged: %q", buf.String())
+	testutil.Assert(t, strings.Contains(buf.String(), "size=7"), "size of get not logged: %q", buf.String())
+
+	// A disabled threshold leaves the bucket unchanged.
+	testutil.Equals(t, objstore.Bucket(ib), objstore.BucketWithSlowOpLog(ib, logger, 0))
+}
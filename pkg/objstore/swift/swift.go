@@ -0,0 +1,696 @@
+// Package swift implements common object storage abstractions against OpenStack Swift.
+package swift
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	opObjectsList  = "GET container"
+	opObjectInsert = "PUT object"
+	opObjectGet    = "GET object"
+	opObjectStat   = "HEAD object"
+	opObjectDelete = "DELETE object"
+)
+
+// DirDelim is the delimiter used to model a directory structure in an object store bucket.
+const DirDelim = "/"
+
+const (
+	// maxSegmentSize is the largest object Swift accepts in a single request. Larger objects
+	// are uploaded in segments and stitched together by a static large object manifest.
+	maxSegmentSize = 5 * 1024 * 1024 * 1024
+	// defaultListLimit is the maximum number of entries returned per listing request.
+	defaultListLimit = 10000
+	// tokenExpiryMargin is the time before the expiry of a token at which it is renewed.
+	tokenExpiryMargin = time.Minute
+)
+
+// Config encapsulates the necessary config values to instantiate a Swift client.
+type Config struct {
+	// AuthURL is the Keystone endpoint, e.g. https://keystone.example.com/v3.
+	AuthURL string `yaml:"auth_url"`
+	// AuthVersion is the Keystone API version, i.e. 2 or 3. If zero, it is derived from the auth URL.
+	AuthVersion       int    `yaml:"auth_version"`
+	Username          string `yaml:"username"`
+	Password          string `yaml:"password"`
+	UserDomainName    string `yaml:"user_domain_name"`
+	ProjectName       string `yaml:"project_name"`
+	ProjectDomainName string `yaml:"project_domain_name"`
+	// RegionName selects the object storage endpoint of the region from the service catalog.
+	// If empty, the first endpoint is used.
+	RegionName    string `yaml:"region_name"`
+	ContainerName string `yaml:"container"`
+	// SegmentContainerName is the container in which segments of objects larger than 5GiB are stored.
+	// It defaults to the container name suffixed with _segments and is created if it does not exist.
+	SegmentContainerName string `yaml:"segment_container"`
+	// TLSConfig is the TLS policy of connections to Keystone and the object storage
+	// endpoint, e.g. to enforce a minimum TLS version. It cannot be set through YAML.
+	TLSConfig *tls.Config `yaml:"-"`
+	// HTTPConfig tunes the connection pool of the client. Its TLS settings take precedence
+	// over TLSConfig.
+	HTTPConfig objstore.TransportConfig `yaml:"http_config"`
+}
+
+// Validate checks to see if any of the Swift config options are set.
+func (conf *Config) Validate() error {
+	switch {
+	case conf.ContainerName == "":
+		return errors.New("insufficient swift configuration information: missing container")
+	case conf.AuthURL == "":
+		return errors.New("insufficient swift configuration information: missing auth URL")
+	case conf.Username == "":
+		return errors.New("insufficient swift configuration information: missing username")
+	case conf.Password == "":
+		return errors.New("insufficient swift configuration information: missing password")
+	}
+	if _, err := authVersion(conf); err != nil {
+		return err
+	}
+	return conf.HTTPConfig.Validate()
+}
+
+// authVersion returns the configured Keystone API version or derives it from the auth URL.
+func authVersion(conf *Config) (int, error) {
+	switch {
+	case conf.AuthVersion == 2 || conf.AuthVersion == 3:
+		return conf.AuthVersion, nil
+	case conf.AuthVersion != 0:
+		return 0, errors.Errorf("unsupported swift auth version %d", conf.AuthVersion)
+	case strings.Contains(conf.AuthURL, "/v2.0"):
+		return 2, nil
+	case strings.Contains(conf.AuthURL, "/v3"):
+		return 3, nil
+	}
+	return 0, errors.Errorf("cannot determine Keystone version of auth URL %s, set the auth version explicitly", conf.AuthURL)
+}
+
+// Bucket implements the store.Bucket and shipper.Bucket interfaces against a Swift container.
+type Bucket struct {
+	conf        Config
+	version     int
+	client      *http.Client
+	container   string
+	segments    string
+	segmentSize int64
+	listLimit   int
+	opsTotal    *prometheus.CounterVec
+
+	mtx        sync.Mutex
+	token      string
+	expires    time.Time
+	storageURL string
+	// segmentsCreated is true once the segment container was ensured to exist.
+	segmentsCreated bool
+}
+
+// NewBucket returns a new Bucket using the provided Swift config values.
+// It authenticates against Keystone right away to fail early on invalid credentials.
+func NewBucket(conf *Config, reg prometheus.Registerer) (*Bucket, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	version, _ := authVersion(conf)
+
+	segments := conf.SegmentContainerName
+	if segments == "" {
+		segments = conf.ContainerName + "_segments"
+	}
+	bkt := &Bucket{
+		conf:        *conf,
+		version:     version,
+		client:      &http.Client{Transport: conf.HTTPConfig.NewTransport(conf.TLSConfig)},
+		container:   conf.ContainerName,
+		segments:    segments,
+		segmentSize: maxSegmentSize,
+		listLimit:   defaultListLimit,
+		opsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_objstore_swift_bucket_operations_total",
+			Help:        "Total number of operations that were executed against a Swift container.",
+			ConstLabels: prometheus.Labels{"bucket": conf.ContainerName},
+		}, []string{"operation"}),
+	}
+	if _, _, err := bkt.auth(context.Background()); err != nil {
+		return nil, err
+	}
+	if reg != nil {
+		reg.MustRegister(bkt.opsTotal)
+	}
+	return bkt, nil
+}
+
+// Type returns the type of the bucket's backend.
+func (b *Bucket) Type() string {
+	return "SWIFT"
+}
+
+// auth returns a valid token and the object storage URL, authenticating against Keystone
+// if there is no token yet or it is about to expire.
+func (b *Bucket) auth(ctx context.Context) (token, storageURL string, err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.token != "" && (b.expires.IsZero() || time.Now().Add(tokenExpiryMargin).Before(b.expires)) {
+		return b.token, b.storageURL, nil
+	}
+	var a authResult
+	if b.version == 2 {
+		a, err = authV2(ctx, b.client, &b.conf)
+	} else {
+		a, err = authV3(ctx, b.client, &b.conf)
+	}
+	if err != nil {
+		return "", "", errors.Wrap(err, "authenticate against keystone")
+	}
+	b.token, b.expires, b.storageURL = a.token, a.expires, strings.TrimSuffix(a.storageURL, "/")
+
+	return b.token, b.storageURL, nil
+}
+
+// invalidateToken makes the next request authenticate again.
+func (b *Bucket) invalidateToken() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.token = ""
+}
+
+type authResult struct {
+	token      string
+	expires    time.Time
+	storageURL string
+}
+
+// catalogEndpoint returns the URL of the object storage endpoint of the given region.
+func catalogEndpoint(region string, urls map[string]string, order []string) (string, error) {
+	if region != "" {
+		if u, ok := urls[region]; ok {
+			return u, nil
+		}
+		return "", errors.Errorf("no object storage endpoint in region %s", region)
+	}
+	if len(order) == 0 {
+		return "", errors.New("no object storage endpoint in service catalog")
+	}
+	return urls[order[0]], nil
+}
+
+// postJSON sends the JSON encoded request body to the URL and decodes the response into res.
+func postJSON(ctx context.Context, client *http.Client, u string, req, res interface{}) (*http.Response, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(r.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, errors.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return nil, errors.Wrap(err, "decode response")
+	}
+	return resp, nil
+}
+
+// authV2 authenticates against the Keystone v2.0 API.
+func authV2(ctx context.Context, client *http.Client, conf *Config) (authResult, error) {
+	var req struct {
+		Auth struct {
+			PasswordCredentials struct {
+				Username string `json:"username"`
+				Password string `json:"password"`
+			} `json:"passwordCredentials"`
+			TenantName string `json:"tenantName,omitempty"`
+		} `json:"auth"`
+	}
+	req.Auth.PasswordCredentials.Username = conf.Username
+	req.Auth.PasswordCredentials.Password = conf.Password
+	req.Auth.TenantName = conf.ProjectName
+
+	var res struct {
+		Access struct {
+			Token struct {
+				ID      string    `json:"id"`
+				Expires time.Time `json:"expires"`
+			} `json:"token"`
+			ServiceCatalog []struct {
+				Type      string `json:"type"`
+				Endpoints []struct {
+					Region    string `json:"region"`
+					PublicURL string `json:"publicURL"`
+				} `json:"endpoints"`
+			} `json:"serviceCatalog"`
+		} `json:"access"`
+	}
+	if _, err := postJSON(ctx, client, strings.TrimSuffix(conf.AuthURL, "/")+"/tokens", &req, &res); err != nil {
+		return authResult{}, err
+	}
+	urls := map[string]string{}
+	var order []string
+
+	for _, s := range res.Access.ServiceCatalog {
+		if s.Type != "object-store" {
+			continue
+		}
+		for _, e := range s.Endpoints {
+			urls[e.Region] = e.PublicURL
+			order = append(order, e.Region)
+		}
+	}
+	u, err := catalogEndpoint(conf.RegionName, urls, order)
+	if err != nil {
+		return authResult{}, err
+	}
+	return authResult{token: res.Access.Token.ID, expires: res.Access.Token.Expires, storageURL: u}, nil
+}
+
+// authV3 authenticates against the Keystone v3 API.
+func authV3(ctx context.Context, client *http.Client, conf *Config) (authResult, error) {
+	type domain struct {
+		Name string `json:"name"`
+	}
+	type project struct {
+		Name   string  `json:"name"`
+		Domain *domain `json:"domain,omitempty"`
+	}
+	var req struct {
+		Auth struct {
+			Identity struct {
+				Methods  []string `json:"methods"`
+				Password struct {
+					User struct {
+						Name     string  `json:"name"`
+						Password string  `json:"password"`
+						Domain   *domain `json:"domain,omitempty"`
+					} `json:"user"`
+				} `json:"password"`
+			} `json:"identity"`
+			Scope *struct {
+				Project project `json:"project"`
+			} `json:"scope,omitempty"`
+		} `json:"auth"`
+	}
+	req.Auth.Identity.Methods = []string{"password"}
+	req.Auth.Identity.Password.User.Name = conf.Username
+	req.Auth.Identity.Password.User.Password = conf.Password
+	if conf.UserDomainName != "" {
+		req.Auth.Identity.Password.User.Domain = &domain{Name: conf.UserDomainName}
+	}
+	if conf.ProjectName != "" {
+		req.Auth.Scope = &struct {
+			Project project `json:"project"`
+		}{Project: project{Name: conf.ProjectName}}
+
+		if conf.ProjectDomainName != "" {
+			req.Auth.Scope.Project.Domain = &domain{Name: conf.ProjectDomainName}
+		}
+	}
+
+	var res struct {
+		Token struct {
+			ExpiresAt time.Time `json:"expires_at"`
+			Catalog   []struct {
+				Type      string `json:"type"`
+				Endpoints []struct {
+					Interface string `json:"interface"`
+					Region    string `json:"region"`
+					URL       string `json:"url"`
+				} `json:"endpoints"`
+			} `json:"catalog"`
+		} `json:"token"`
+	}
+	resp, err := postJSON(ctx, client, strings.TrimSuffix(conf.AuthURL, "/")+"/auth/tokens", &req, &res)
+	if err != nil {
+		return authResult{}, err
+	}
+	urls := map[string]string{}
+	var order []string
+
+	for _, s := range res.Token.Catalog {
+		if s.Type != "object-store" {
+			continue
+		}
+		for _, e := range s.Endpoints {
+			if e.Interface != "public" {
+				continue
+			}
+			urls[e.Region] = e.URL
+			order = append(order, e.Region)
+		}
+	}
+	u, err := catalogEndpoint(conf.RegionName, urls, order)
+	if err != nil {
+		return authResult{}, err
+	}
+	return authResult{token: resp.Header.Get("X-Subject-Token"), expires: res.Token.ExpiresAt, storageURL: u}, nil
+}
+
+// do sends an authenticated request against the object, or the container if name is empty.
+// It returns an error if the response status is not among the given ones.
+func (b *Bucket) do(ctx context.Context, method, container, name string, q url.Values, h http.Header, body io.Reader, status ...int) (*http.Response, error) {
+	token, storageURL, err := b.auth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u := storageURL + "/" + url.PathEscape(container)
+	if name != "" {
+		u += "/" + escapeObjectName(name)
+	}
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range h {
+		req.Header[k] = vs
+	}
+	req.Header.Set("X-Auth-Token", token)
+
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range status {
+		if resp.StatusCode == s {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		// The token was revoked before it expired.
+		b.invalidateToken()
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, errors.Errorf("%s %s/%s: %s %s", method, container, name, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// escapeObjectName escapes the object name for use in a URL path while keeping its slashes.
+func escapeObjectName(name string) string {
+	parts := strings.Split(name, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Iter calls f for each entry in the given directory. The argument to f is the full
+// object name including the prefix of the inspected directory. If the listing is
+// recursive, the names of all objects below the directory are passed to f instead.
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	b.opsTotal.WithLabelValues(opObjectsList).Inc()
+	params := objstore.ApplyIterOptions(options...)
+
+	// Ensure the object name actually ends with a dir suffix. Otherwise we'll just iterate the
+	// object itself as one prefix item.
+	if dir != "" {
+		dir = strings.TrimSuffix(dir, DirDelim) + DirDelim
+	}
+	var marker string
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		q := url.Values{
+			"format":    []string{"json"},
+			"prefix":    []string{dir},
+			"delimiter": []string{DirDelim},
+			"limit":     []string{strconv.Itoa(b.listLimit)},
+		}
+		if params.Recursive {
+			q.Del("delimiter")
+		}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := b.do(ctx, http.MethodGet, b.container, "", q, nil, nil, http.StatusOK, http.StatusNoContent)
+		if err != nil {
+			return errors.Wrap(err, "list swift objects")
+		}
+		var entries []struct {
+			Name   string `json:"name"`
+			Subdir string `json:"subdir"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&entries)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return errors.Wrap(err, "decode swift object list")
+		}
+		for _, e := range entries {
+			n := e.Name
+			if e.Subdir != "" {
+				n = e.Subdir
+			}
+			if err := f(n); err != nil {
+				return err
+			}
+			marker = n
+		}
+		if len(entries) < b.listLimit {
+			return nil
+		}
+	}
+}
+
+// Get returns a reader for the given object name.
+func (b *Bucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.opsTotal.WithLabelValues(opObjectGet).Inc()
+
+	resp, err := b.do(ctx, http.MethodGet, b.container, name, nil, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, errors.Wrap(err, "get swift object")
+	}
+	return resp.Body, nil
+}
+
+// GetRange returns a new range reader for the given object name and range.
+func (b *Bucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b.opsTotal.WithLabelValues(opObjectGet).Inc()
+
+	h := http.Header{"Range": []string{fmt.Sprintf("bytes=%d-%d", off, off+length-1)}}
+
+	resp, err := b.do(ctx, http.MethodGet, b.container, name, nil, h, nil, http.StatusOK, http.StatusPartialContent)
+	if err != nil {
+		return nil, errors.Wrap(err, "get swift object range")
+	}
+	return resp.Body, nil
+}
+
+// head returns the response to a HEAD request against the object or nil if it does not exist.
+func (b *Bucket) head(ctx context.Context, name string) (*http.Response, error) {
+	b.opsTotal.WithLabelValues(opObjectStat).Inc()
+
+	resp, err := b.do(ctx, http.MethodHead, b.container, name, nil, nil, nil, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return nil, errors.Wrap(err, "head swift object")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+// Exists checks if the given object exists.
+func (b *Bucket) Exists(ctx context.Context, name string) (bool, error) {
+	resp, err := b.head(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	return resp != nil, nil
+}
+
+// Attributes returns information about the object with the given name.
+func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	resp, err := b.head(ctx, name)
+	if err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	if resp == nil {
+		return objstore.ObjectAttributes{}, errors.Errorf("swift object %s does not exist", name)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrap(err, "parse content length")
+	}
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrap(err, "parse last modified time")
+	}
+	return objstore.ObjectAttributes{
+		Size:         size,
+		LastModified: modified,
+		ETag:         strings.Trim(resp.Header.Get("Etag"), `"`),
+	}, nil
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// put streams up to the segment size of bytes from r into the object and returns the number
+// of bytes written along with the ETag of the object.
+func (b *Bucket) put(ctx context.Context, container, name string, r io.Reader) (int64, string, error) {
+	cr := &countingReader{r: io.LimitReader(r, b.segmentSize)}
+
+	// Wrapping the reader hides its size, so the body is sent with chunked transfer encoding.
+	resp, err := b.do(ctx, http.MethodPut, container, name, nil, nil, ioutil.NopCloser(cr), http.StatusCreated)
+	if err != nil {
+		return 0, "", err
+	}
+	resp.Body.Close()
+
+	return cr.n, strings.Trim(resp.Header.Get("Etag"), `"`), nil
+}
+
+// sloSegment is an entry of a static large object manifest.
+type sloSegment struct {
+	Path      string `json:"path"`
+	ETag      string `json:"etag"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// Upload the contents of the reader as an object into the bucket.
+// Objects larger than 5GiB are uploaded in segments into the segment container and
+// written as a static large object.
+func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.opsTotal.WithLabelValues(opObjectInsert).Inc()
+
+	br := bufio.NewReader(r)
+
+	// Most objects fit into a single segment, so the first one is written to the object directly.
+	n, etag, err := b.put(ctx, b.container, name, br)
+	if err != nil {
+		return errors.Wrap(err, "upload swift object")
+	}
+	if n < b.segmentSize {
+		return nil
+	}
+	if _, err := br.Peek(1); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "read upload")
+	}
+	if err := b.ensureSegmentContainer(ctx); err != nil {
+		return err
+	}
+	// Segments of different uploads of the same object must not overwrite each other.
+	prefix := fmt.Sprintf("%s/%d/", name, time.Now().UnixNano())
+	segment := func(i int) string { return fmt.Sprintf("%s%08d", prefix, i) }
+
+	// Copy the first segment server-side, it is overwritten by the manifest.
+	h := http.Header{"X-Copy-From": []string{"/" + url.PathEscape(b.container) + "/" + escapeObjectName(name)}}
+	resp, err := b.do(ctx, http.MethodPut, b.segments, segment(0), nil, h, nil, http.StatusCreated)
+	if err != nil {
+		return errors.Wrap(err, "copy first swift segment")
+	}
+	resp.Body.Close()
+
+	manifest := []sloSegment{{Path: "/" + b.segments + "/" + segment(0), ETag: etag, SizeBytes: n}}
+
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "read upload")
+		}
+		i := len(manifest)
+
+		n, etag, err := b.put(ctx, b.segments, segment(i), br)
+		if err != nil {
+			return errors.Wrapf(err, "upload swift segment %d", i)
+		}
+		manifest = append(manifest, sloSegment{Path: "/" + b.segments + "/" + segment(i), ETag: etag, SizeBytes: n})
+	}
+
+	m, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "encode manifest")
+	}
+	q := url.Values{"multipart-manifest": []string{"put"}}
+
+	resp, err = b.do(ctx, http.MethodPut, b.container, name, q, nil, bytes.NewReader(m), http.StatusCreated)
+	if err != nil {
+		return errors.Wrap(err, "upload swift large object manifest")
+	}
+	return resp.Body.Close()
+}
+
+// ensureSegmentContainer creates the segment container unless it was done before.
+func (b *Bucket) ensureSegmentContainer(ctx context.Context) error {
+	b.mtx.Lock()
+	created := b.segmentsCreated
+	b.mtx.Unlock()
+
+	if created {
+		return nil
+	}
+	resp, err := b.do(ctx, http.MethodPut, b.segments, "", nil, nil, nil, http.StatusCreated, http.StatusAccepted)
+	if err != nil {
+		return errors.Wrap(err, "create swift segment container")
+	}
+	resp.Body.Close()
+
+	b.mtx.Lock()
+	b.segmentsCreated = true
+	b.mtx.Unlock()
+
+	return nil
+}
+
+// Delete removes the object with the given name. Segments of large objects are removed as well.
+func (b *Bucket) Delete(ctx context.Context, name string) error {
+	b.opsTotal.WithLabelValues(opObjectDelete).Inc()
+
+	// The query is ignored for objects that are not large objects.
+	q := url.Values{"multipart-manifest": []string{"delete"}}
+
+	resp, err := b.do(ctx, http.MethodDelete, b.container, name, q, nil, nil, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return errors.Wrap(err, "delete swift object")
+	}
+	return resp.Body.Close()
+}
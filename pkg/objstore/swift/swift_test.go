@@ -0,0 +1,381 @@
+package swift
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/objtesting"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+const testToken = "secret-token"
+
+// fakeSwift implements the Keystone token endpoints and the subset of the Swift object
+// storage API used by the bucket.
+type fakeSwift struct {
+	t   *testing.T
+	url string
+
+	mtx     sync.Mutex
+	auths   int
+	objects map[string][]byte
+	slos    map[string][]sloSegment
+}
+
+func newFakeSwift(t *testing.T) (*fakeSwift, *httptest.Server) {
+	s := &fakeSwift{t: t, objects: map[string][]byte{}, slos: map[string][]sloSegment{}}
+	srv := httptest.NewServer(s)
+	s.url = srv.URL
+	return s, srv
+}
+
+func (s *fakeSwift) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	switch r.URL.Path {
+	case "/v2.0/tokens":
+		s.authV2(w, r)
+		return
+	case "/v3/auth/tokens":
+		s.authV3(w, r)
+		return
+	}
+	if r.Header.Get("X-Auth-Token") != testToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// Paths are of the form /v1/AUTH_test/<container>/<object>.
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/AUTH_test/"), "/", 2)
+	q := r.URL.Query()
+
+	if len(parts) == 1 {
+		if r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		limit, err := strconv.Atoi(q.Get("limit"))
+		testutil.Ok(s.t, err)
+		s.list(w, parts[0], q.Get("prefix"), q.Get("delimiter"), q.Get("marker"), limit)
+		return
+	}
+	name := parts[0] + "/" + parts[1]
+
+	switch r.Method {
+	case http.MethodPut:
+		if from := r.Header.Get("X-Copy-From"); from != "" {
+			s.objects[name] = s.objects[strings.TrimPrefix(from, "/")]
+		} else if q.Get("multipart-manifest") == "put" {
+			var m []sloSegment
+			testutil.Ok(s.t, json.NewDecoder(r.Body).Decode(&m))
+			s.slos[name] = m
+			delete(s.objects, name)
+		} else {
+			b, err := ioutil.ReadAll(r.Body)
+			testutil.Ok(s.t, err)
+			if len(b) > 0 {
+				testutil.Equals(s.t, "chunked", strings.Join(r.TransferEncoding, ","))
+			}
+			s.objects[name] = b
+		}
+		w.Header().Set("Etag", fmt.Sprintf("%x", md5.Sum(s.objects[name])))
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		_, ok := s.objects[name]
+		m, isSLO := s.slos[name]
+		if !ok && !isSLO {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if isSLO && q.Get("multipart-manifest") == "delete" {
+			for _, seg := range m {
+				delete(s.objects, strings.TrimPrefix(seg.Path, "/"))
+			}
+		}
+		delete(s.objects, name)
+		delete(s.slos, name)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		b, ok := s.object(name)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Unix(1000, 0).UTC().Format(http.TimeFormat))
+		w.Header().Set("Etag", fmt.Sprintf("%x", md5.Sum(b)))
+
+		if rng := r.Header.Get("Range"); rng != "" {
+			var start, end int
+			fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+			if end >= len(b) {
+				end = len(b) - 1
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(b[start : end+1])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	}
+}
+
+// object returns the content of the object, concatenating the segments of large objects.
+func (s *fakeSwift) object(name string) ([]byte, bool) {
+	if m, ok := s.slos[name]; ok {
+		var b []byte
+		for _, seg := range m {
+			seg := s.objects[strings.TrimPrefix(seg.Path, "/")]
+			b = append(b, seg...)
+		}
+		return b, true
+	}
+	b, ok := s.objects[name]
+	return b, ok
+}
+
+// list answers container listings with at most limit entries per page.
+func (s *fakeSwift) list(w http.ResponseWriter, container, prefix, delimiter, marker string, limit int) {
+	var names []string
+	add := func(n string) {
+		if strings.HasPrefix(n, container+"/") {
+			names = append(names, strings.TrimPrefix(n, container+"/"))
+		}
+	}
+	for n := range s.objects {
+		add(n)
+	}
+	for n := range s.slos {
+		add(n)
+	}
+	entries, _ := objtesting.List(names, prefix, delimiter, marker, limit)
+	if len(entries) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var res []map[string]string
+	for _, e := range entries {
+		if e.Prefix {
+			res = append(res, map[string]string{"subdir": e.Name})
+		} else {
+			res = append(res, map[string]string{"name": e.Name})
+		}
+	}
+	testutil.Ok(s.t, json.NewEncoder(w).Encode(res))
+}
+
+func (s *fakeSwift) authV2(w http.ResponseWriter, r *http.Request) {
+	var req map[string]map[string]interface{}
+	testutil.Ok(s.t, json.NewDecoder(r.Body).Decode(&req))
+
+	creds := req["auth"]["passwordCredentials"].(map[string]interface{})
+	if creds["username"] != "user" || creds["password"] != "pass" || req["auth"]["tenantName"] != "project" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.auths++
+
+	fmt.Fprintf(w, `{"access": {
+		"token": {"id": %q, "expires": %q},
+		"serviceCatalog": [
+			{"type": "compute", "endpoints": [{"region": "one", "publicURL": "http://compute"}]},
+			{"type": "object-store", "endpoints": [
+				{"region": "one", "publicURL": "http://wrong"},
+				{"region": "two", "publicURL": "%s/v1/AUTH_test"}
+			]}
+		]
+	}}`, testToken, time.Now().Add(time.Hour).UTC().Format(time.RFC3339), s.url)
+}
+
+func (s *fakeSwift) authV3(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Auth struct {
+			Identity struct {
+				Methods  []string
+				Password struct {
+					User struct {
+						Name     string
+						Password string
+						Domain   struct{ Name string }
+					}
+				}
+			}
+			Scope struct {
+				Project struct {
+					Name   string
+					Domain struct{ Name string }
+				}
+			}
+		}
+	}
+	testutil.Ok(s.t, json.NewDecoder(r.Body).Decode(&req))
+
+	id, scope := req.Auth.Identity, req.Auth.Scope
+	testutil.Equals(s.t, []string{"password"}, id.Methods)
+	testutil.Equals(s.t, "Default", id.Password.User.Domain.Name)
+	testutil.Equals(s.t, "project", scope.Project.Name)
+	testutil.Equals(s.t, "Default", scope.Project.Domain.Name)
+
+	if id.Password.User.Name != "user" || id.Password.User.Password != "pass" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.auths++
+
+	w.Header().Set("X-Subject-Token", testToken)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"token": {
+		"expires_at": %q,
+		"catalog": [
+			{"type": "object-store", "endpoints": [
+				{"interface": "internal", "region": "two", "url": "http://wrong"},
+				{"interface": "public", "region": "two", "url": "%s/v1/AUTH_test"}
+			]}
+		]
+	}}`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339), s.url)
+}
+
+func TestBucket(t *testing.T) {
+	for _, conf := range []Config{
+		{AuthURL: "/v2.0", RegionName: "two", ProjectName: "project"},
+		{AuthURL: "/v3", UserDomainName: "Default", ProjectName: "project", ProjectDomainName: "Default"},
+	} {
+		t.Run(conf.AuthURL, func(t *testing.T) {
+			s, srv := newFakeSwift(t)
+			defer srv.Close()
+
+			conf.AuthURL = srv.URL + conf.AuthURL
+			conf.Username, conf.Password, conf.ContainerName = "user", "pass", "thanos"
+
+			bkt, err := NewBucket(&conf, nil)
+			testutil.Ok(t, err)
+			bkt.listLimit = 2
+
+			objtesting.ObjectsTest(t, bkt, func(b []byte) objstore.ObjectAttributes {
+				return objstore.ObjectAttributes{
+					Size:         int64(len(b)),
+					LastModified: time.Unix(1000, 0).UTC(),
+					ETag:         fmt.Sprintf("%x", md5.Sum(b)),
+				}
+			})
+			// Unlike with other providers, deleting a missing object is an error.
+			testutil.NotOk(t, bkt.Delete(context.Background(), "c"))
+			// Empty objects are valid.
+			testutil.Ok(t, bkt.Upload(context.Background(), "empty", bytes.NewReader(nil)))
+
+			// The token is reused until it expires.
+			testutil.Equals(t, 1, s.auths)
+		})
+	}
+}
+
+func TestBucket_Acceptance(t *testing.T) {
+	_, srv := newFakeSwift(t)
+	defer srv.Close()
+
+	bkt, err := NewBucket(&Config{
+		AuthURL:           srv.URL + "/v3",
+		Username:          "user",
+		Password:          "pass",
+		UserDomainName:    "Default",
+		ProjectName:       "project",
+		ProjectDomainName: "Default",
+		ContainerName:     "thanos",
+	}, nil)
+	testutil.Ok(t, err)
+
+	objtesting.AcceptanceTest(t, bkt)
+}
+
+func TestBucket_LargeObject(t *testing.T) {
+	s, srv := newFakeSwift(t)
+	defer srv.Close()
+
+	bkt, err := NewBucket(&Config{
+		AuthURL:       srv.URL + "/v2.0",
+		Username:      "user",
+		Password:      "pass",
+		ProjectName:   "project",
+		RegionName:    "two",
+		ContainerName: "thanos",
+	}, nil)
+	testutil.Ok(t, err)
+	bkt.segmentSize = 4
+
+	ctx := context.Background()
+
+	// Objects of exactly the segment size are not segmented.
+	testutil.Ok(t, bkt.Upload(ctx, "small", bytes.NewReader([]byte("1234"))))
+	testutil.Equals(t, 0, len(s.slos))
+
+	testutil.Ok(t, bkt.Upload(ctx, "large", bytes.NewReader([]byte("0123456789"))))
+	testutil.Equals(t, 3, len(s.slos["thanos/large"]))
+
+	for _, seg := range s.slos["thanos/large"] {
+		testutil.Assert(t, strings.HasPrefix(seg.Path, "/thanos_segments/large/"), "unexpected segment path %s", seg.Path)
+	}
+
+	rc, err := bkt.Get(ctx, "large")
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "0123456789", string(b))
+
+	testutil.Ok(t, bkt.Delete(ctx, "large"))
+
+	// Deleting the manifest removes its segments.
+	for n := range s.objects {
+		testutil.Assert(t, !strings.HasPrefix(n, "thanos_segments/"), "segment %s not deleted", n)
+	}
+}
+
+func TestNewBucket_WrongCredentials(t *testing.T) {
+	_, srv := newFakeSwift(t)
+	defer srv.Close()
+
+	_, err := NewBucket(&Config{
+		AuthURL:       srv.URL + "/v2.0",
+		Username:      "user",
+		Password:      "wrong",
+		ProjectName:   "project",
+		ContainerName: "thanos",
+	}, nil)
+	testutil.NotOk(t, err)
+
+	_, err = NewBucket(&Config{
+		AuthURL:       srv.URL + "/v2.0",
+		Username:      "user",
+		Password:      "pass",
+		ProjectName:   "project",
+		RegionName:    "three",
+		ContainerName: "thanos",
+	}, nil)
+	testutil.NotOk(t, err)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	objtesting.ValidateTest(t, []objtesting.ConfigCase{
+		{Conf: &Config{ContainerName: "c", AuthURL: "http://keystone/v3", Username: "u", Password: "p"}, OK: true},
+		{Conf: &Config{ContainerName: "c", AuthURL: "http://keystone/v2.0", Username: "u", Password: "p"}, OK: true},
+		{Conf: &Config{ContainerName: "c", AuthURL: "http://keystone", AuthVersion: 3, Username: "u", Password: "p"}, OK: true},
+		{Conf: &Config{ContainerName: "c", AuthURL: "http://keystone", Username: "u", Password: "p"}},
+		{Conf: &Config{ContainerName: "c", AuthURL: "http://keystone/v3", AuthVersion: 1, Username: "u", Password: "p"}},
+		{Conf: &Config{AuthURL: "http://keystone/v3", Username: "u", Password: "p"}},
+		{Conf: &Config{ContainerName: "c", AuthURL: "http://keystone/v3", Username: "u"}},
+	})
+}
@@ -0,0 +1,147 @@
+package objstore
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/improbable-eng/thanos/pkg/tracing"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// TracingBucket wraps a bucket so that every operation is recorded as a span of the given
+// tracer, which is a child of the span in the operation's context if there is one.
+// Spans are tagged with the object name and, where applicable, the requested byte range
+// and the number of bytes transferred. Spans of reads end once their reader is closed.
+func TracingBucket(b Bucket, tracer opentracing.Tracer) Bucket {
+	return &tracingBucket{bkt: b, tracer: tracer}
+}
+
+type tracingBucket struct {
+	bkt    Bucket
+	tracer opentracing.Tracer
+}
+
+func (b *tracingBucket) Type() string {
+	return BackendType(b.bkt)
+}
+
+func (b *tracingBucket) startSpan(ctx context.Context, op string, tags opentracing.Tags) (opentracing.Span, context.Context) {
+	span, ctx := tracing.StartSpan(tracing.ContextWithTracer(ctx, b.tracer), op, tags)
+	span.SetTag("backend", BackendType(b.bkt))
+
+	return span, ctx
+}
+
+// finishSpan marks the span as failed if err is not nil and finishes it.
+func finishSpan(span opentracing.Span, err error) {
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("error", err.Error())
+	}
+	span.Finish()
+}
+
+func (b *tracingBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	span, ctx := b.startSpan(ctx, "bucket_iter", opentracing.Tags{"dir": dir, "recursive": ApplyIterOptions(options...).Recursive})
+
+	err := b.bkt.Iter(ctx, dir, f, options...)
+	finishSpan(span, err)
+
+	return err
+}
+
+func (b *tracingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	span, ctx := b.startSpan(ctx, "bucket_get", opentracing.Tags{"name": name})
+
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		finishSpan(span, err)
+		return nil, err
+	}
+	return &tracingReadCloser{ReadCloser: rc, span: span}, nil
+}
+
+func (b *tracingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	span, ctx := b.startSpan(ctx, "bucket_get_range", opentracing.Tags{"name": name, "offset": off, "length": length})
+
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		finishSpan(span, err)
+		return nil, err
+	}
+	return &tracingReadCloser{ReadCloser: rc, span: span}, nil
+}
+
+func (b *tracingBucket) Exists(ctx context.Context, name string) (bool, error) {
+	span, ctx := b.startSpan(ctx, "bucket_exists", opentracing.Tags{"name": name})
+
+	ok, err := b.bkt.Exists(ctx, name)
+	span.SetTag("exists", ok)
+	finishSpan(span, err)
+
+	return ok, err
+}
+
+func (b *tracingBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	span, ctx := b.startSpan(ctx, "bucket_attributes", opentracing.Tags{"name": name})
+
+	attrs, err := b.bkt.Attributes(ctx, name)
+	span.SetTag("size", attrs.Size)
+	finishSpan(span, err)
+
+	return attrs, err
+}
+
+func (b *tracingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	span, ctx := b.startSpan(ctx, "bucket_upload", opentracing.Tags{"name": name})
+
+	n, err := countedUpload(r, func(r io.Reader) error {
+		return b.bkt.Upload(ctx, name, r)
+	})
+	span.SetTag("size", n)
+	finishSpan(span, err)
+
+	return err
+}
+
+func (b *tracingBucket) Delete(ctx context.Context, name string) error {
+	span, ctx := b.startSpan(ctx, "bucket_delete", opentracing.Tags{"name": name})
+
+	err := b.bkt.Delete(ctx, name)
+	finishSpan(span, err)
+
+	return err
+}
+
+// tracingReadCloser finishes its span once it is closed, tagged with the number of bytes read.
+type tracingReadCloser struct {
+	io.ReadCloser
+
+	span opentracing.Span
+	n    int64
+	err  error
+	once sync.Once
+}
+
+func (rc *tracingReadCloser) Read(p []byte) (int, error) {
+	n, err := rc.ReadCloser.Read(p)
+	rc.n += int64(n)
+	if err != nil && err != io.EOF {
+		rc.err = err
+	}
+	return n, err
+}
+
+func (rc *tracingReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.once.Do(func() {
+		if rc.err == nil {
+			rc.err = err
+		}
+		rc.span.SetTag("size", rc.n)
+		finishSpan(rc.span, rc.err)
+	})
+	return err
+}
@@ -0,0 +1,62 @@
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/inmem"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+	"github.com/opentracing/basictracer-go"
+	"github.com/opentracing/opentracing-go"
+)
+
+func TestTracingBucket(t *testing.T) {
+	rec := &basictracer.InMemorySpanRecorder{}
+	tracer := basictracer.NewWithOptions(basictracer.Options{
+		ShouldSample:   func(uint64) bool { return true },
+		Recorder:       rec,
+		MaxLogsPerSpan: 10,
+	})
+	bkt := objstore.TracingBucket(inmem.NewBucket(), tracer)
+
+	parent := tracer.StartSpan("parent")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+
+	testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewReader([]byte("content"))))
+
+	rc, err := bkt.GetRange(ctx, "obj", 1, 3)
+	testutil.Ok(t, err)
+	_, err = ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+
+	// The span of a read only ends once its reader is closed.
+	testutil.Equals(t, 1, len(rec.GetSpans()))
+	testutil.Ok(t, rc.Close())
+	testutil.Ok(t, rc.Close())
+
+	_, err = bkt.Get(ctx, "missing")
+	testutil.NotOk(t, err)
+
+	spans := rec.GetSpans()
+	testutil.Equals(t, 3, len(spans))
+
+	upload := spans[0]
+	testutil.Equals(t, "bucket_upload", upload.Operation)
+	testutil.Equals(t, parent.Context().(basictracer.SpanContext).SpanID, upload.ParentSpanID)
+	testutil.Equals(t, "obj", upload.Tags["name"])
+	testutil.Equals(t, int64(7), upload.Tags["size"])
+
+	getRange := spans[1]
+	testutil.Equals(t, "bucket_get_range", getRange.Operation)
+	testutil.Equals(t, int64(1), getRange.Tags["offset"])
+	testutil.Equals(t, int64(3), getRange.Tags["length"])
+	testutil.Equals(t, int64(3), getRange.Tags["size"])
+	testutil.Equals(t, nil, getRange.Tags["error"])
+
+	get := spans[2]
+	testutil.Equals(t, "bucket_get", get.Operation)
+	testutil.Equals(t, true, get.Tags["error"])
+}
@@ -0,0 +1,112 @@
+package objstore
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/tlsconfig"
+	"github.com/pkg/errors"
+)
+
+// TransportConfig tunes the connection pool of the HTTP client that a bucket uses to reach
+// its provider. Zero values keep the defaults of http.DefaultTransport.
+type TransportConfig struct {
+	// MaxIdleConns is the number of idle connections kept open in total.
+	MaxIdleConns int `yaml:"max_idle_conns"`
+	// MaxIdleConnsPerHost is the number of idle connections kept open per host. Since buckets
+	// commonly talk to a single host, it should be raised for highly parallel reads, which
+	// otherwise open a new connection for most requests.
+	MaxIdleConnsPerHost int `yaml:"max_idle_conns_per_host"`
+	// IdleConnTimeout is how long idle connections are kept open.
+	IdleConnTimeout time.Duration `yaml:"idle_conn_timeout"`
+	// ResponseHeaderTimeout is how long to wait for the headers of a response after the
+	// request was sent.
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+	// TLSHandshakeTimeout is how long to wait for the TLS handshake of new connections.
+	TLSHandshakeTimeout time.Duration `yaml:"tls_handshake_timeout"`
+	// TLSMinVersion is the minimum TLS version of connections, i.e. 1.0, 1.1 or 1.2.
+	TLSMinVersion string `yaml:"tls_min_version"`
+	// TLSCipherSuites restricts the cipher suites offered by the client to the given ones,
+	// named like the constants of the crypto/tls package, e.g.
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Both settings accept the same values as the
+	// --tls.min-version and --tls.cipher-suites flags, which they take precedence over.
+	TLSCipherSuites []string `yaml:"tls_cipher_suites"`
+}
+
+// IsSet returns true if any of the settings is given.
+func (c TransportConfig) IsSet() bool {
+	return c.MaxIdleConns != 0 || c.MaxIdleConnsPerHost != 0 || c.IdleConnTimeout != 0 ||
+		c.ResponseHeaderTimeout != 0 || c.TLSHandshakeTimeout != 0 || c.TLSSet()
+}
+
+// TLSSet returns true if any of the TLS settings is given.
+func (c TransportConfig) TLSSet() bool {
+	return c.TLSMinVersion != "" || len(c.TLSCipherSuites) > 0
+}
+
+// Validate returns an error if any of the settings is negative.
+func (c TransportConfig) Validate() error {
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 {
+		return errors.New("maximum number of idle connections must not be negative")
+	}
+	if c.IdleConnTimeout < 0 || c.ResponseHeaderTimeout < 0 || c.TLSHandshakeTimeout < 0 {
+		return errors.New("HTTP transport timeouts must not be negative")
+	}
+	if c.TLSMinVersion != "" {
+		if _, err := tlsconfig.ParseVersion(c.TLSMinVersion); err != nil {
+			return err
+		}
+	}
+	_, err := tlsconfig.ParseCipherSuites(c.TLSCipherSuites)
+	return err
+}
+
+// NewTransport returns a transport equivalent to http.DefaultTransport that uses the given
+// TLS config and the settings of c. The TLS settings of c are applied to a copy of tlsConfig
+// and must have been validated.
+func (c TransportConfig) NewTransport(tlsConfig *tls.Config) *http.Transport {
+	if c.TLSSet() {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		} else {
+			tlsConfig = tlsConfig.Clone()
+		}
+		if c.TLSMinVersion != "" {
+			tlsConfig.MinVersion, _ = tlsconfig.ParseVersion(c.TLSMinVersion)
+		}
+		if len(c.TLSCipherSuites) > 0 {
+			tlsConfig.CipherSuites, _ = tlsconfig.ParseCipherSuites(c.TLSCipherSuites)
+		}
+	}
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+	if c.MaxIdleConns > 0 {
+		t.MaxIdleConns = c.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	if c.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = c.IdleConnTimeout
+	}
+	if c.ResponseHeaderTimeout > 0 {
+		t.ResponseHeaderTimeout = c.ResponseHeaderTimeout
+	}
+	if c.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = c.TLSHandshakeTimeout
+	}
+	return t
+}
@@ -0,0 +1,79 @@
+package objstore_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+func TestTransportConfig_NewTransport(t *testing.T) {
+	def := http.DefaultTransport.(*http.Transport)
+
+	tr := objstore.TransportConfig{}.NewTransport(nil)
+	testutil.Equals(t, def.MaxIdleConns, tr.MaxIdleConns)
+	testutil.Equals(t, def.MaxIdleConnsPerHost, tr.MaxIdleConnsPerHost)
+	testutil.Equals(t, def.IdleConnTimeout, tr.IdleConnTimeout)
+	testutil.Equals(t, def.TLSHandshakeTimeout, tr.TLSHandshakeTimeout)
+
+	tr = objstore.TransportConfig{
+		MaxIdleConns:          500,
+		MaxIdleConnsPerHost:   200,
+		IdleConnTimeout:       5 * time.Minute,
+		ResponseHeaderTimeout: 30 * time.Second,
+		TLSHandshakeTimeout:   time.Second,
+	}.NewTransport(nil)
+	testutil.Equals(t, 500, tr.MaxIdleConns)
+	testutil.Equals(t, 200, tr.MaxIdleConnsPerHost)
+	testutil.Equals(t, 5*time.Minute, tr.IdleConnTimeout)
+	testutil.Equals(t, 30*time.Second, tr.ResponseHeaderTimeout)
+	testutil.Equals(t, time.Second, tr.TLSHandshakeTimeout)
+}
+
+func TestTransportConfig_Validate(t *testing.T) {
+	testutil.Ok(t, objstore.TransportConfig{}.Validate())
+	testutil.Ok(t, objstore.TransportConfig{MaxIdleConnsPerHost: 100, IdleConnTimeout: time.Minute}.Validate())
+	testutil.NotOk(t, objstore.TransportConfig{MaxIdleConns: -1}.Validate())
+	testutil.NotOk(t, objstore.TransportConfig{ResponseHeaderTimeout: -time.Second}.Validate())
+	testutil.Ok(t, objstore.TransportConfig{TLSMinVersion: "1.2", TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}.Validate())
+	testutil.NotOk(t, objstore.TransportConfig{TLSMinVersion: "TLS12"}.Validate())
+	testutil.NotOk(t, objstore.TransportConfig{TLSCipherSuites: []string{"TLS_RSA_WITH_NULL_SHA"}}.Validate())
+	testutil.NotOk(t, objstore.TransportConfig{TLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}.Validate())
+}
+
+func TestTransportConfig_TLS(t *testing.T) {
+	base := &tls.Config{ServerName: "example.com"}
+	tr := objstore.TransportConfig{
+		TLSMinVersion:   "1.2",
+		TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	}.NewTransport(base)
+	testutil.Equals(t, "example.com", tr.TLSClientConfig.ServerName)
+	testutil.Equals(t, uint16(tls.VersionTLS12), tr.TLSClientConfig.MinVersion)
+	testutil.Equals(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, tr.TLSClientConfig.CipherSuites)
+	// The given config may be shared and must not be modified.
+	testutil.Equals(t, &tls.Config{ServerName: "example.com"}, base)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	get := func(suites ...string) error {
+		c := &http.Client{Transport: objstore.TransportConfig{TLSCipherSuites: suites}.NewTransport(&tls.Config{RootCAs: pool})}
+		resp, err := c.Get(srv.URL)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	testutil.Ok(t, get("TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA"))
+	testutil.NotOk(t, get("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"))
+}
@@ -0,0 +1,38 @@
+package shipper
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// countingBucket counts the bytes of files uploaded to the wrapped bucket.
+// The reader is passed through unchanged as backends such as S3 only learn the object size
+// from files and otherwise buffer uploads of unknown size in memory.
+type countingBucket struct {
+	objstore.Bucket
+
+	uploaded prometheus.Counter
+}
+
+// Upload uploads r and counts its size once the upload succeeded. Readers other than
+// files are not counted as their size is unknown without wrapping them.
+func (b *countingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.Bucket.Upload(ctx, name, r); err != nil {
+		return err
+	}
+	f, ok := r.(*os.File)
+	if !ok {
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		// The object was uploaded, only its size is unknown.
+		return nil
+	}
+	b.uploaded.Add(float64(fi.Size()))
+	return nil
+}
@@ -0,0 +1,51 @@
+package shipper
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/inmem"
+	"github.com/improbable-eng/thanos/pkg/testutil"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fileCheckingBucket fails uploads of readers that are not files.
+type fileCheckingBucket struct {
+	objstore.Bucket
+}
+
+func (b fileCheckingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if _, ok := r.(*os.File); !ok {
+		return errors.Errorf("upload of %s is %T, not a file", name, r)
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestCountingBucket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counting-bucket")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	uploaded := prometheus.NewCounter(prometheus.CounterOpts{Name: "uploaded"})
+	bkt := &countingBucket{Bucket: fileCheckingBucket{inmem.NewBucket()}, uploaded: uploaded}
+
+	for _, name := range []string{"a", "b"} {
+		fn := filepath.Join(dir, name)
+		testutil.Ok(t, ioutil.WriteFile(fn, make([]byte, 2500), 0666))
+		testutil.Ok(t, objstore.UploadFile(context.Background(), bkt, fn, name))
+	}
+	// Failed uploads are not counted.
+	testutil.NotOk(t, bkt.Upload(context.Background(), "c", bytes.NewReader(make([]byte, 2500))))
+
+	var m dto.Metric
+	testutil.Ok(t, uploaded.Write(&m))
+	testutil.Equals(t, float64(5000), m.GetCounter().GetValue())
+}
@@ -3,21 +3,29 @@
 package shipper
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/improbable-eng/thanos/pkg/block"
 	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/runutil"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/tsdb/fileutil"
 	"github.com/prometheus/tsdb/labels"
 )
@@ -27,6 +35,13 @@ type metrics struct {
 	dirSyncFailures prometheus.Counter
 	uploads         prometheus.Counter
 	uploadFailures  prometheus.Counter
+	lastUpload      prometheus.Gauge
+	paused          prometheus.Gauge
+	cleanups        prometheus.Counter
+	uploadedBytes   prometheus.Counter
+	tooOld          prometheus.Gauge
+	superseded      prometheus.Counter
+	checksumErrors  prometheus.Counter
 }
 
 func newMetrics(r prometheus.Registerer) *metrics {
@@ -48,6 +63,35 @@ func newMetrics(r prometheus.Registerer) *metrics {
 		Name: "thanos_shipper_upload_failures_total",
 		Help: "Total number of failed object uploads",
 	})
+	m.lastUpload = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_shipper_last_successful_upload_time",
+		Help: "Unix timestamp of the last successful block upload. Failed uploads are counted in thanos_shipper_upload_failures_total",
+	})
+	m.paused = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_shipper_paused",
+		Help: "Boolean indicator whether uploads of the shipper are paused.",
+	})
+
+	m.cleanups = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_shipper_partial_upload_cleanups_total",
+		Help: "Total number of partially uploaded blocks that were deleted from the bucket",
+	})
+	m.uploadedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_shipper_uploaded_bytes_total",
+		Help: "Total number of bytes uploaded to the bucket. Its rate is the current upload throughput",
+	})
+	m.tooOld = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_shipper_too_old_blocks",
+		Help: "Number of local blocks that were not uploaded during the last sync because their data is older than the maximum block age",
+	})
+	m.superseded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_shipper_superseded_blocks_total",
+		Help: "Total number of blocks that were not uploaded because a compacted block containing their data was uploaded instead",
+	})
+	m.checksumErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_shipper_checksum_mismatches_total",
+		Help: "Total number of block uploads that failed because the content of an uploaded object differed from its file",
+	})
 
 	if r != nil {
 		r.MustRegister(
@@ -55,11 +99,28 @@ func newMetrics(r prometheus.Registerer) *metrics {
 			m.dirSyncFailures,
 			m.uploads,
 			m.uploadFailures,
+			m.lastUpload,
+			m.paused,
+			m.cleanups,
+			m.uploadedBytes,
+			m.tooOld,
+			m.superseded,
+			m.checksumErrors,
 		)
 	}
 	return &m
 }
 
+// UploadOrder defines in which order new blocks are uploaded.
+type UploadOrder string
+
+const (
+	// UploadOldestFirst uploads blocks with the oldest data first.
+	UploadOldestFirst UploadOrder = "oldest"
+	// UploadNewestFirst uploads blocks with the most recent data first.
+	UploadNewestFirst UploadOrder = "newest"
+)
+
 // Shipper watches a directory for matching files and directories and uploads
 // them to a remote data store.
 type Shipper struct {
@@ -68,6 +129,67 @@ type Shipper struct {
 	metrics *metrics
 	bucket  objstore.Bucket
 	labels  func() labels.Labels
+	order   UploadOrder
+
+	// uploadManifest enables maintaining a manifest of uploaded blocks in the bucket.
+	uploadManifest bool
+	// uploadTombstones enables uploading the tombstones file of blocks.
+	uploadTombstones bool
+	// verifyChecksums enables verifying the checksums of uploaded objects.
+	verifyChecksums bool
+	// manifestKey is the key of the last manifest that was written to the bucket.
+	manifestKey string
+	// verifyTimeout is the time within which an uploaded block must become visible in the bucket.
+	verifyTimeout time.Duration
+	// uploadTimeout is the time within which a single block must be uploaded.
+	uploadTimeout time.Duration
+	// uploadConcurrency is the number of files of a block that are uploaded at a time.
+	uploadConcurrency int
+	// maxBlockAge is the maximum age of the most recent data in a block for it to be uploaded.
+	maxBlockAge time.Duration
+	// source is recorded in the meta file of uploaded blocks.
+	source block.SourceType
+
+	now func() time.Time
+
+	mtx    sync.Mutex
+	paused bool
+}
+
+// Options configures how a shipper uploads blocks. The zero value uploads blocks one file
+// at a time, oldest first, without further checks or limits.
+type Options struct {
+	// Order is the order of their minimum timestamp in which blocks are uploaded.
+	// It defaults to UploadOldestFirst.
+	Order UploadOrder
+	// UploadManifest enables maintaining a manifest of all uploaded blocks in the bucket.
+	UploadManifest bool
+	// UploadTombstones enables uploading the tombstones file of blocks along with the
+	// meta file, the index and the chunks.
+	UploadTombstones bool
+	// VerifyChecksums enables verifying that every uploaded object holds the content of its
+	// file, see objstore.VerifyFile. Blocks with a mismatch are deleted and retried on the
+	// next sync.
+	VerifyChecksums bool
+	// VerifyTimeout is the time within which an uploaded block must become visible in the
+	// bucket for the upload to succeed, which accounts for eventually consistent object
+	// storages. Zero disables the check.
+	VerifyTimeout time.Duration
+	// UploadTimeout is the time after which uploads of a single block are aborted. Objects of
+	// aborted or failed uploads are deleted from the bucket. Zero disables the timeout.
+	UploadTimeout time.Duration
+	// UploadBandwidth limits all uploads combined to that many bytes per second. Zero disables the limit.
+	UploadBandwidth int64
+	// UploadConcurrency is the number of files of a block that are uploaded at a time. The
+	// meta file is always uploaded last, so a block only becomes visible in the bucket once
+	// it is complete.
+	UploadConcurrency int
+	// MaxBlockAge is the age of their most recent data beyond which blocks are not uploaded.
+	// They are not recorded as uploaded either and are left to age out locally. Zero
+	// disables the limit.
+	MaxBlockAge time.Duration
+	// Source is recorded in the meta file of uploaded blocks along with the labels.
+	Source block.SourceType
 }
 
 // New creates a new shipper that detects new TSDB blocks in dir and uploads them
@@ -78,6 +200,7 @@ func New(
 	dir string,
 	bucket objstore.Bucket,
 	lbls func() labels.Labels,
+	opts Options,
 ) *Shipper {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -85,15 +208,61 @@ func New(
 	if lbls == nil {
 		lbls = func() labels.Labels { return nil }
 	}
+	if opts.Order == "" {
+		opts.Order = UploadOldestFirst
+	}
+	metrics := newMetrics(r)
+
+	// The bandwidth limit is shared by all uploads of the shipper.
+	bucket = objstore.RateLimitedBucket(bucket, objstore.RateLimitConfig{WriteBytesPerSecond: opts.UploadBandwidth})
+
 	return &Shipper{
 		logger:  logger,
 		dir:     dir,
-		bucket:  bucket,
+		bucket:  &countingBucket{Bucket: bucket, uploaded: metrics.uploadedBytes},
 		labels:  lbls,
-		metrics: newMetrics(r),
+		order:   opts.Order,
+		metrics: metrics,
+
+		uploadManifest:    opts.UploadManifest,
+		uploadTombstones:  opts.UploadTombstones,
+		verifyChecksums:   opts.VerifyChecksums,
+		verifyTimeout:     opts.VerifyTimeout,
+		uploadTimeout:     opts.UploadTimeout,
+		uploadConcurrency: opts.UploadConcurrency,
+		maxBlockAge:       opts.MaxBlockAge,
+		source:            opts.Source,
+		now:               time.Now,
 	}
 }
 
+// Pause stops uploads of new blocks until Resume is called. Blocks are still discovered
+// by Sync and uploaded once shipping is resumed.
+func (s *Shipper) Pause() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.paused = true
+	s.metrics.paused.Set(1)
+}
+
+// Resume continues uploads of new blocks after Pause was called.
+func (s *Shipper) Resume() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.paused = false
+	s.metrics.paused.Set(0)
+}
+
+// Paused returns true if uploads are paused.
+func (s *Shipper) Paused() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.paused
+}
+
 // Timestamps returns the minimum timestamp for which data is available and the highest timestamp
 // of blocks that were successfully uploaded.
 func (s *Shipper) Timestamps() (minTime, maxSyncTime int64, err error) {
@@ -141,34 +310,263 @@ func (s *Shipper) Sync(ctx context.Context) {
 	for _, id := range meta.Uploaded {
 		hasUploaded[id] = struct{}{}
 	}
-	// Reset the uploaded slice so we can rebuild it only with blocks that still exist locally.
+	hasCompacted := make(map[ulid.ULID]struct{}, len(meta.Compacted))
+	for _, id := range meta.Compacted {
+		hasCompacted[id] = struct{}{}
+	}
+	// Reset the uploaded slices so we can rebuild them only with blocks that still exist locally.
 	meta.Uploaded = nil
+	meta.Compacted = nil
 
-	s.iterBlockMetas(func(m *block.Meta) error {
+	var metas, uploaded []*block.Meta
+
+	s.metrics.dirSyncs.Inc()
+
+	err = s.iterBlockMetas(func(m *block.Meta) error {
+		metas = append(metas, m)
+		return nil
+	})
+	if err != nil {
+		// Do not touch the meta file as we cannot tell which blocks still exist.
+		s.metrics.dirSyncFailures.Inc()
+		level.Error(s.logger).Log("msg", "reading data directory failed", "dir", s.dir, "err", err)
+		return
+	}
+	sortBlockMetas(metas, s.order)
+
+	paused := s.Paused()
+	if paused {
+		level.Debug(s.logger).Log("msg", "shipping is paused, skipping uploads")
+	}
+	minMaxTime := int64(math.MinInt64)
+	if s.maxBlockAge > 0 {
+		minMaxTime = timestamp.FromTime(s.now().Add(-s.maxBlockAge))
+	}
+	tooOld := 0
+
+	var compacted map[ulid.ULID]compactedState
+	if !paused {
+		compacted = s.compactedStates(ctx, metas, hasUploaded)
+	}
+	// Sources of compacted blocks that are shipped in their place.
+	supersededBy := map[ulid.ULID]ulid.ULID{}
+	for id, st := range compacted {
+		if st.state != compactedShip {
+			continue
+		}
+		for _, src := range st.sources {
+			supersededBy[src] = id
+		}
+	}
+	var (
+		shipped    = map[ulid.ULID]struct{}{}
+		superseded []*block.Meta
+	)
+	for _, m := range metas {
 		// Do not sync a block if we already uploaded it. If it is no longer found in the bucket,
 		// it was generally removed by the compaction process.
 		if _, ok := hasUploaded[m.ULID]; !ok {
+			if paused {
+				continue
+			}
+			// Blocks that are too old are skipped without recording them as uploaded, so that
+			// they are never mistaken for blocks that are safe to delete locally.
+			if m.MaxTime < minMaxTime {
+				tooOld++
+				level.Debug(s.logger).Log("msg", "block is older than the maximum block age, skipping upload", "block", m.ULID)
+				continue
+			}
+			// Sources are recorded as uploaded once the compacted block was shipped.
+			if _, ok := supersededBy[m.ULID]; ok {
+				superseded = append(superseded, m)
+				continue
+			}
+			if m.Compaction.Level > 1 {
+				switch compacted[m.ULID].state {
+				case compactedUnknown:
+					continue
+				case compactedSkip:
+					// The data of the block was shipped through its sources.
+					meta.Uploaded = append(meta.Uploaded, m.ULID)
+					continue
+				}
+			}
 			if err := s.sync(ctx, m); err != nil {
 				level.Error(s.logger).Log("msg", "shipping failed", "block", m.ULID, "err", err)
-				return nil
+				continue
 			}
+			if m.Compaction.Level > 1 {
+				hasCompacted[m.ULID] = struct{}{}
+			}
+			shipped[m.ULID] = struct{}{}
+		}
+		if _, ok := hasCompacted[m.ULID]; ok {
+			meta.Compacted = append(meta.Compacted, m.ULID)
 		}
 		meta.Uploaded = append(meta.Uploaded, m.ULID)
-		return nil
-	})
+		uploaded = append(uploaded, m)
+	}
+	for _, m := range superseded {
+		if _, ok := shipped[supersededBy[m.ULID]]; !ok {
+			continue
+		}
+		level.Info(s.logger).Log("msg", "skipping block superseded by an uploaded compacted block", "block", m.ULID, "compacted", supersededBy[m.ULID])
+		s.metrics.superseded.Inc()
+		meta.Uploaded = append(meta.Uploaded, m.ULID)
+	}
+	s.metrics.tooOld.Set(float64(tooOld))
+
 	if err := WriteMetaFile(s.dir, meta); err != nil {
 		level.Warn(s.logger).Log("msg", "updating meta file failed", "err", err)
 	}
+	if s.uploadManifest && !paused {
+		if err := s.syncManifest(ctx, shippedBlocks(uploaded, hasCompacted)); err != nil {
+			level.Warn(s.logger).Log("msg", "updating manifest failed", "err", err)
+		}
+	}
 }
 
-func (s *Shipper) sync(ctx context.Context, meta *block.Meta) (err error) {
-	dir := filepath.Join(s.dir, meta.ULID.String())
+// Manifest lists the blocks uploaded by a shipper that still exist in its local directory.
+// It allows tooling to inspect what a single source shipped without scanning the bucket.
+type Manifest struct {
+	Version int               `json:"version"`
+	Labels  map[string]string `json:"labels"`
+	Blocks  []ManifestBlock   `json:"blocks"`
+}
+
+// ManifestBlock describes a single uploaded block in the manifest.
+type ManifestBlock struct {
+	ULID    ulid.ULID `json:"ulid"`
+	MinTime int64     `json:"minTime"`
+	MaxTime int64     `json:"maxTime"`
+}
+
+// ManifestPath returns the object name of the manifest for a shipper with the given labels.
+// As HA replicas differ in their replica label, each writes a distinct manifest.
+func ManifestPath(lset labels.Labels) string {
+	return path.Join("shipper", fmt.Sprintf("%016x", lset.Hash()), "uploads.json")
+}
+
+// syncManifest writes the manifest for the given blocks to the bucket if it changed since
+// it was last written. Uploading a single object is atomic, so readers never see a partial manifest.
+func (s *Shipper) syncManifest(ctx context.Context, metas []*block.Meta) error {
+	lset := s.labels()
+
+	m := Manifest{Version: 1, Labels: lset.Map(), Blocks: []ManifestBlock{}}
+	for _, meta := range metas {
+		m.Blocks = append(m.Blocks, ManifestBlock{
+			ULID:    meta.ULID,
+			MinTime: meta.MinTime,
+			MaxTime: meta.MaxTime,
+		})
+	}
+	sort.Slice(m.Blocks, func(i, j int) bool {
+		return m.Blocks[i].MinTime < m.Blocks[j].MinTime
+	})
+	b, err := json.MarshalIndent(&m, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "encode manifest")
+	}
+	name := ManifestPath(lset)
+	key := name + string(b)
 
-	// We only ship of the first compacted block level.
-	if meta.Compaction.Level > 1 {
+	if key == s.manifestKey {
 		return nil
 	}
-	ok, err := s.bucket.Exists(ctx, path.Join(meta.ULID.String(), "meta.json"))
+	if err := s.bucket.Upload(ctx, name, bytes.NewReader(b)); err != nil {
+		return errors.Wrap(err, "upload manifest")
+	}
+	s.manifestKey = key
+	return nil
+}
+
+// shippedBlocks returns the blocks among uploaded whose data is found in the bucket under their own ULID.
+// Blocks of higher compaction levels are only included if they were shipped in place of their
+// sources, which are excluded in turn.
+func shippedBlocks(uploaded []*block.Meta, compacted map[ulid.ULID]struct{}) (res []*block.Meta) {
+	superseded := map[ulid.ULID]struct{}{}
+	for _, m := range uploaded {
+		if _, ok := compacted[m.ULID]; !ok {
+			continue
+		}
+		for _, src := range m.Compaction.Sources {
+			if src != m.ULID {
+				superseded[src] = struct{}{}
+			}
+		}
+	}
+	for _, m := range uploaded {
+		if _, ok := superseded[m.ULID]; ok {
+			continue
+		}
+		if _, ok := compacted[m.ULID]; m.Compaction.Level > 1 && !ok {
+			continue
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+// compactedState describes whether a compacted block is shipped.
+type compactedState struct {
+	state   int
+	sources []ulid.ULID
+}
+
+const (
+	// compactedUnknown blocks are neither shipped nor skipped as it could not be determined
+	// whether their sources were shipped.
+	compactedUnknown = iota
+	// compactedSkip blocks are not shipped as some of their sources were already shipped.
+	compactedSkip
+	// compactedShip blocks are shipped in place of their sources.
+	compactedShip
+)
+
+// compactedStates determines for each compacted block among metas that was not uploaded yet
+// whether it is shipped. Compacted blocks are only shipped if none of their sources was shipped
+// before, as their data would overlap otherwise. Sources are not shipped once the compacted block is.
+func (s *Shipper) compactedStates(ctx context.Context, metas []*block.Meta, hasUploaded map[ulid.ULID]struct{}) map[ulid.ULID]compactedState {
+	res := map[ulid.ULID]compactedState{}
+
+Outer:
+	for _, m := range metas {
+		if _, ok := hasUploaded[m.ULID]; ok || m.Compaction.Level <= 1 {
+			continue
+		}
+		st := compactedState{state: compactedShip}
+
+		for _, src := range m.Compaction.Sources {
+			if src == m.ULID {
+				continue
+			}
+			st.sources = append(st.sources, src)
+
+			if _, ok := hasUploaded[src]; ok {
+				res[m.ULID] = compactedState{state: compactedSkip}
+				continue Outer
+			}
+			// Sources that were deleted locally after being shipped are only known to the bucket.
+			ok, err := s.bucket.Exists(ctx, path.Join(src.String(), block.MetaFilename))
+			if err != nil {
+				level.Warn(s.logger).Log("msg", "checking sources of compacted block failed", "block", m.ULID, "err", err)
+				res[m.ULID] = compactedState{state: compactedUnknown}
+				continue Outer
+			}
+			if ok {
+				res[m.ULID] = compactedState{state: compactedSkip}
+				continue Outer
+			}
+		}
+		res[m.ULID] = st
+	}
+	return res
+}
+
+func (s *Shipper) sync(ctx context.Context, meta *block.Meta) (err error) {
+	dir := filepath.Join(s.dir, meta.ULID.String())
+
+	ok, err := s.bucket.Exists(ctx, path.Join(meta.ULID.String(), block.MetaFilename))
 	if err != nil {
 		return errors.Wrap(err, "check exists")
 	}
@@ -176,12 +574,176 @@ func (s *Shipper) sync(ctx context.Context, meta *block.Meta) (err error) {
 		return nil
 	}
 
-	level.Info(s.logger).Log("msg", "upload new block", "id", meta.ULID)
+	// The labels at the time of the upload are attached, which may differ from the ones
+	// at the time the block was created.
+	lset := s.labels()
+	level.Info(s.logger).Log("msg", "upload new block", "id", meta.ULID, "labels", lset.String())
 
 	// We hard-link the files into a temporary upload directory so we are not affected
 	// by other operations happening against the TSDB directory.
 	updir := filepath.Join(s.dir, "thanos", "upload")
 
+	s.metrics.uploads.Inc()
+
+	// Objects may be left over from an earlier attempt if the process was killed mid-upload.
+	if err := s.cleanupPartialBlock(ctx, meta.ULID); err != nil {
+		s.metrics.uploadFailures.Inc()
+		return err
+	}
+	uctx := ctx
+	if s.uploadTimeout > 0 {
+		var cancel context.CancelFunc
+		uctx, cancel = context.WithTimeout(ctx, s.uploadTimeout)
+		defer cancel()
+	}
+	if err := upload(uctx, s.bucket, dir, updir, meta, lset, s.source, s.uploadTombstones, s.verifyChecksums, s.uploadConcurrency); err != nil {
+		s.metrics.uploadFailures.Inc()
+		if objstore.IsChecksumMismatch(err) {
+			s.metrics.checksumErrors.Inc()
+		}
+
+		// Cleanup the block with an uncancelable context so the next attempt starts clean.
+		if err := s.cleanupPartialBlock(context.Background(), meta.ULID); err != nil {
+			level.Warn(s.logger).Log("msg", "cleaning up block failed", "block", meta.ULID, "err", err)
+		}
+		return err
+	}
+	if err := s.verifyUpload(ctx, meta.ULID); err != nil {
+		s.metrics.uploadFailures.Inc()
+		return err
+	}
+	s.metrics.lastUpload.Set(float64(s.now().Unix()))
+	return nil
+}
+
+// cleanupPartialBlock deletes all objects of the block with the given ID from the bucket.
+// It must only be called for blocks whose meta file was not uploaded yet.
+func (s *Shipper) cleanupPartialBlock(ctx context.Context, id ulid.ULID) error {
+	dir := id.String()
+
+	var found bool
+	err := s.bucket.Iter(ctx, dir, func(string) error {
+		found = true
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "list partially uploaded objects")
+	}
+	if !found {
+		return nil
+	}
+	level.Info(s.logger).Log("msg", "deleting partially uploaded block", "block", id)
+
+	if err := objstore.DeleteDir(ctx, s.bucket, dir); err != nil {
+		return errors.Wrap(err, "delete partially uploaded block")
+	}
+	s.metrics.cleanups.Inc()
+	return nil
+}
+
+// verifyUpload waits until the uploaded block is visible in the bucket. Eventually consistent
+// object storages may briefly report objects as missing right after they were written.
+func (s *Shipper) verifyUpload(ctx context.Context, id ulid.ULID) error {
+	if s.verifyTimeout <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.verifyTimeout)
+	defer cancel()
+
+	interval := s.verifyTimeout / 10
+	if interval > time.Second {
+		interval = time.Second
+	}
+	err := runutil.Retry(interval, ctx.Done(), func() error {
+		ok, err := s.bucket.Exists(ctx, path.Join(id.String(), block.MetaFilename))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("not found")
+		}
+		return nil
+	})
+	return errors.Wrap(err, "verify uploaded block")
+}
+
+// ErrBlockExists is returned by UploadBlock if the block is already present in the bucket.
+var ErrBlockExists = errors.New("block already exists in bucket")
+
+// UploadBlock validates the block in dir and uploads it to the bucket with the given
+// labels attached to its meta file. It returns ErrBlockExists if the block is already
+// present in the bucket, unless overwrite is set, in which case the existing block is
+// replaced.
+func UploadBlock(ctx context.Context, logger log.Logger, bkt objstore.Bucket, dir string, lset labels.Labels, overwrite bool) error {
+	meta, err := block.ReadMetaFile(dir)
+	if err != nil {
+		return errors.Wrap(err, "read meta file")
+	}
+	if err := block.VerifyIndex(filepath.Join(dir, "index")); err != nil {
+		return errors.Wrap(err, "verify index")
+	}
+	bdir := meta.ULID.String()
+
+	ok, err := bkt.Exists(ctx, path.Join(bdir, block.MetaFilename))
+	if err != nil {
+		return errors.Wrap(err, "check exists")
+	}
+	// The objects of an existing block are overwritten in place with the meta file last,
+	// and only objects the new block does not have are deleted once the upload succeeded.
+	// Deleting the existing block first would lose it if the upload failed.
+	var existing []string
+	if ok {
+		if !overwrite {
+			return errors.Wrapf(ErrBlockExists, "block %s", meta.ULID)
+		}
+		level.Info(logger).Log("msg", "overwriting existing block", "id", meta.ULID)
+
+		if err := bkt.Iter(ctx, bdir, func(name string) error {
+			existing = append(existing, name)
+			return nil
+		}, objstore.WithRecursiveIter()); err != nil {
+			return errors.Wrap(err, "list existing block")
+		}
+	}
+	level.Info(logger).Log("msg", "upload block", "id", meta.ULID, "labels", lset.String())
+
+	// The upload directory is created next to the block so it can be hard-linked.
+	updir, err := ioutil.TempDir(filepath.Dir(dir), "thanos-upload")
+	if err != nil {
+		return errors.Wrap(err, "create upload dir")
+	}
+	if err := upload(ctx, bkt, dir, updir, meta, lset, block.BucketUploadSource, false, false, 1); err != nil {
+		// Objects of an existing block may have been overwritten already, so they are left
+		// for another attempt to complete. A new block is cleaned up with an uncancelable context.
+		if len(existing) == 0 {
+			if err2 := objstore.DeleteDir(context.Background(), bkt, bdir); err2 != nil {
+				level.Warn(logger).Log("msg", "cleaning up block failed", "block", meta.ULID, "err", err2)
+			}
+		}
+		return err
+	}
+	for _, name := range existing {
+		rel := strings.TrimPrefix(name, bdir+objstore.DirDelim)
+		// Tombstones are not uploaded, all other files of the local block are.
+		if rel != "tombstones" {
+			if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel))); err == nil {
+				continue
+			}
+		}
+		if err := bkt.Delete(ctx, name); err != nil {
+			return errors.Wrapf(err, "delete stale object %s of existing block", name)
+		}
+	}
+	return nil
+}
+
+// upload hard-links the block in dir into updir, attaches the labels and source to its
+// meta file and uploads it. The upload directory is removed afterwards.
+// The tombstones file is only uploaded if tombstones is set. If verify is set, the checksums
+// of uploaded objects are verified. Up to concurrency files are uploaded at a time, and the
+// meta file is uploaded last.
+// Objects of a failed upload are left in the bucket.
+func upload(ctx context.Context, bkt objstore.Bucket, dir, updir string, meta *block.Meta, lset labels.Labels, source block.SourceType, tombstones, verify bool, concurrency int) error {
 	if err := os.RemoveAll(updir); err != nil {
 		return errors.Wrap(err, "clean upload directory")
 	}
@@ -190,25 +752,18 @@ func (s *Shipper) sync(ctx context.Context, meta *block.Meta) (err error) {
 	}
 	defer os.RemoveAll(updir)
 
-	if err := hardlinkBlock(dir, updir); err != nil {
+	if err := hardlinkBlock(dir, updir, tombstones); err != nil {
 		return errors.Wrap(err, "hard link block")
 	}
 	// Attach current labels and write a new meta file with Thanos extensions.
-	if lset := s.labels(); lset != nil {
+	if lset != nil {
 		meta.Thanos.Labels = lset.Map()
 	}
+	meta.Thanos.Source = source
 	if err := block.WriteMetaFile(updir, meta); err != nil {
 		return errors.Wrap(err, "write meta file")
 	}
-	err = objstore.UploadDir(ctx, s.bucket, updir, meta.ULID.String())
-	if err == nil {
-		return nil
-	}
-	// Cleanup the dir with an uncancelable context.
-	if err2 := objstore.DeleteDir(context.Background(), s.bucket, meta.ULID.String()); err2 != nil {
-		level.Warn(s.logger).Log("msg", "cleaning up block failed", "block", meta.ULID, "err", err)
-	}
-	return err
+	return objstore.UploadDirConcurrently(ctx, bkt, updir, meta.ULID.String(), concurrency, verify, block.MetaFilename)
 }
 
 // iterBlockMetas calls f with the block meta for each block found in dir. It logs
@@ -245,7 +800,19 @@ func (s *Shipper) iterBlockMetas(f func(m *block.Meta) error) error {
 	return nil
 }
 
-func hardlinkBlock(src, dst string) error {
+// sortBlockMetas sorts the metas by their minimum timestamp in the given order.
+func sortBlockMetas(metas []*block.Meta, order UploadOrder) {
+	sort.SliceStable(metas, func(i, j int) bool {
+		if order == UploadNewestFirst {
+			return metas[i].MinTime > metas[j].MinTime
+		}
+		return metas[i].MinTime < metas[j].MinTime
+	})
+}
+
+// hardlinkBlock links the files of the block in src that are shipped into dst. These are the
+// meta file, the index and the chunks, and the tombstones file if tombstones is set and it exists.
+func hardlinkBlock(src, dst string, tombstones bool) error {
 	chunkDir := filepath.Join(dst, "chunks")
 
 	if err := os.MkdirAll(chunkDir, 0777); err != nil {
@@ -259,7 +826,16 @@ func hardlinkBlock(src, dst string) error {
 	for i, fn := range files {
 		files[i] = filepath.Join("chunks", fn)
 	}
-	files = append(files, "meta.json", "index")
+	files = append(files, block.MetaFilename, "index")
+
+	if tombstones {
+		_, err := os.Stat(filepath.Join(src, "tombstones"))
+		if err == nil {
+			files = append(files, "tombstones")
+		} else if !os.IsNotExist(err) {
+			return errors.Wrap(err, "stat tombstones file")
+		}
+	}
 
 	for _, fn := range files {
 		if err := os.Link(filepath.Join(src, fn), filepath.Join(dst, fn)); err != nil {
@@ -273,6 +849,8 @@ func hardlinkBlock(src, dst string) error {
 type Meta struct {
 	Version  int         `json:"version"`
 	Uploaded []ulid.ULID `json:"uploaded"`
+	// Compacted lists the blocks of higher compaction levels that were shipped in place of their sources.
+	Compacted []ulid.ULID `json:"compacted,omitempty"`
 }
 
 // MetaFilename is the known JSON filename for meta information.
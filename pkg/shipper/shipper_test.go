@@ -4,19 +4,30 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/inmem"
+	"github.com/improbable-eng/thanos/pkg/objstore/objtesting"
 
+	"github.com/go-kit/kit/log"
 	"github.com/improbable-eng/thanos/pkg/block"
 	"github.com/improbable-eng/thanos/pkg/testutil"
 	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/tsdb"
 	"github.com/prometheus/tsdb/labels"
@@ -27,12 +38,12 @@ func TestShipper_UploadBlocks(t *testing.T) {
 	testutil.Ok(t, err)
 	defer os.RemoveAll(dir)
 
-	bucket, close := testutil.NewObjectStoreBucket(t)
+	bucket, close := objtesting.NewGCSBucket(t)
 	defer close()
 
 	shipper := New(nil, nil, dir, bucket, func() labels.Labels {
 		return labels.FromStrings("prometheus", "prom-1")
-	})
+	}, Options{Source: block.SidecarSource})
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -83,6 +94,7 @@ func TestShipper_UploadBlocks(t *testing.T) {
 
 		// The external labels must be attached to the meta file on upload.
 		meta.Thanos.Labels = map[string]string{"prometheus": "prom-1"}
+		meta.Thanos.Source = block.SidecarSource
 
 		var buf bytes.Buffer
 		enc := json.NewEncoder(&buf)
@@ -130,3 +142,850 @@ func TestShipper_UploadBlocks(t *testing.T) {
 	testutil.Ok(t, err)
 	testutil.Assert(t, ok == false, "fifth block was reuploaded")
 }
+
+// recordingBucket records the order in which objects are uploaded.
+type recordingBucket struct {
+	*inmem.Bucket
+
+	mtx      sync.Mutex
+	uploaded []string
+}
+
+func (b *recordingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.mtx.Lock()
+	b.uploaded = append(b.uploaded, name)
+	b.mtx.Unlock()
+
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func createBlock(t *testing.T, dir string, id ulid.ULID, mint, maxt int64) {
+	bdir := filepath.Join(dir, id.String())
+	testutil.Ok(t, os.MkdirAll(filepath.Join(bdir, "chunks"), 0777))
+
+	meta := &block.Meta{
+		Version: 1,
+		BlockMeta: tsdb.BlockMeta{
+			ULID:    id,
+			MinTime: mint,
+			MaxTime: maxt,
+		},
+	}
+	testutil.Ok(t, block.WriteMetaFile(bdir, meta))
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(bdir, "index"), []byte("indexcontents"), 0666))
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(bdir, "chunks", "0001"), []byte("chunkcontents"), 0666))
+}
+
+func TestShipper_UploadOrder(t *testing.T) {
+	randr := rand.New(rand.NewSource(0))
+
+	// ULIDs are ordered inversely to the blocks' time ranges.
+	var (
+		ids   []ulid.ULID
+		mints = []int64{3000, 1000, 2000}
+	)
+	for i := range mints {
+		ids = append(ids, ulid.MustNew(uint64(i), randr))
+	}
+
+	for _, c := range []struct {
+		order UploadOrder
+		exp   []ulid.ULID
+	}{
+		{order: UploadOldestFirst, exp: []ulid.ULID{ids[1], ids[2], ids[0]}},
+		{order: UploadNewestFirst, exp: []ulid.ULID{ids[0], ids[2], ids[1]}},
+	} {
+		func() {
+			dir, err := ioutil.TempDir("", "shipper-test")
+			testutil.Ok(t, err)
+			defer os.RemoveAll(dir)
+
+			for i, id := range ids {
+				createBlock(t, dir, id, mints[i], mints[i]+1000)
+			}
+			bkt := &recordingBucket{Bucket: inmem.NewBucket()}
+
+			New(nil, nil, dir, bkt, nil, Options{Order: c.order, Source: block.SidecarSource}).Sync(context.Background())
+
+			// The meta file is the last object uploaded for each block.
+			var act []ulid.ULID
+			for _, name := range bkt.uploaded {
+				if path.Base(name) != block.MetaFilename {
+					continue
+				}
+				id, err := ulid.Parse(path.Dir(name))
+				testutil.Ok(t, err)
+				act = append(act, id)
+			}
+			testutil.Equals(t, c.exp, act)
+		}()
+	}
+}
+
+func TestUploadBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	id, err := testutil.CreateBlock(dir, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+	}, 100, 0, 1000)
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+	bkt := inmem.NewBucket()
+	bdir := filepath.Join(dir, id.String())
+	lset := labels.FromStrings("region", "eu-west")
+
+	testutil.Ok(t, UploadBlock(ctx, log.NewNopLogger(), bkt, bdir, lset, false))
+
+	rc, err := bkt.Get(ctx, path.Join(id.String(), block.MetaFilename))
+	testutil.Ok(t, err)
+	defer rc.Close()
+
+	var meta block.Meta
+	testutil.Ok(t, json.NewDecoder(rc).Decode(&meta))
+	testutil.Equals(t, id, meta.ULID)
+	testutil.Equals(t, map[string]string{"region": "eu-west"}, meta.Thanos.Labels)
+	testutil.Equals(t, block.BucketUploadSource, meta.Thanos.Source)
+
+	// The local block must not be modified and no upload directory must be left behind.
+	local, err := block.ReadMetaFile(bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(local.Thanos.Labels))
+
+	names, err := ioutil.ReadDir(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(names))
+
+	// Uploading again must fail unless overwriting is requested.
+	err = UploadBlock(ctx, log.NewNopLogger(), bkt, bdir, lset, false)
+	testutil.Assert(t, errors.Cause(err) == ErrBlockExists, "unexpected error %v", err)
+
+	// A failed overwrite must leave the existing block in place.
+	err = UploadBlock(ctx, log.NewNopLogger(), &failingBucket{Bucket: bkt, fail: true}, bdir, lset, true)
+	testutil.NotOk(t, err)
+
+	ok, err := bkt.Exists(ctx, path.Join(id.String(), block.MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "existing block deleted by failed overwrite")
+
+	// Overwriting removes objects the new block does not have.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), "chunks", "000099"), strings.NewReader("stale")))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), "tombstones"), strings.NewReader("stale")))
+
+	testutil.Ok(t, UploadBlock(ctx, log.NewNopLogger(), bkt, bdir, lset, true))
+
+	for _, n := range []string{path.Join("chunks", "000099"), "tombstones"} {
+		ok, err := bkt.Exists(ctx, path.Join(id.String(), n))
+		testutil.Ok(t, err)
+		testutil.Assert(t, !ok, "stale object %s not deleted", n)
+	}
+	for _, n := range []string{path.Join("chunks", "000001"), "index", block.MetaFilename} {
+		ok, err := bkt.Exists(ctx, path.Join(id.String(), n))
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "object %s of the new block missing", n)
+	}
+}
+
+type failingBucket struct {
+	*inmem.Bucket
+	fail bool
+}
+
+func (b *failingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if b.fail {
+		return errors.New("upload failed")
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestShipper_LastUploadMetric(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	bkt := &failingBucket{Bucket: inmem.NewBucket()}
+	s := New(nil, reg, dir, bkt, nil, Options{Source: block.SidecarSource})
+	now := time.Unix(1500000000, 0)
+	s.now = func() time.Time { return now }
+	randr := rand.New(rand.NewSource(0))
+
+	// Without any blocks to ship, nothing is uploaded and nothing fails.
+	s.Sync(context.Background())
+	testutil.Equals(t, float64(0), testutil.GaugeValue(t, reg, "thanos_shipper_last_successful_upload_time"))
+	testutil.Equals(t, float64(0), testutil.CounterValue(t, reg, "thanos_shipper_upload_failures_total"))
+
+	createBlock(t, dir, ulid.MustNew(1, randr), 0, 1000)
+	s.Sync(context.Background())
+
+	testutil.Equals(t, float64(now.Unix()), testutil.GaugeValue(t, reg, "thanos_shipper_last_successful_upload_time"))
+	testutil.Equals(t, float64(1), testutil.CounterValue(t, reg, "thanos_shipper_uploads_total"))
+	testutil.Equals(t, float64(0), testutil.CounterValue(t, reg, "thanos_shipper_upload_failures_total"))
+
+	// A failing upload must not advance the timestamp.
+	last := now
+	now = now.Add(time.Minute)
+	bkt.fail = true
+	createBlock(t, dir, ulid.MustNew(2, randr), 1000, 2000)
+	s.Sync(context.Background())
+
+	testutil.Equals(t, float64(last.Unix()), testutil.GaugeValue(t, reg, "thanos_shipper_last_successful_upload_time"))
+	testutil.Equals(t, float64(2), testutil.CounterValue(t, reg, "thanos_shipper_uploads_total"))
+	testutil.Equals(t, float64(1), testutil.CounterValue(t, reg, "thanos_shipper_upload_failures_total"))
+}
+
+func TestShipper_UploadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	bkt := inmem.NewBucket()
+	randr := rand.New(rand.NewSource(0))
+
+	replicas := []labels.Labels{
+		labels.FromStrings("prometheus", "prom-1", "replica", "a"),
+		labels.FromStrings("prometheus", "prom-1", "replica", "b"),
+	}
+	// HA replicas must write distinct manifests.
+	testutil.Assert(t, ManifestPath(replicas[0]) != ManifestPath(replicas[1]), "manifest paths of replicas collide")
+
+	s := New(nil, nil, dir, bkt, func() labels.Labels { return replicas[0] }, Options{UploadManifest: true, Source: block.SidecarSource})
+
+	id1, id2 := ulid.MustNew(1, randr), ulid.MustNew(2, randr)
+	createBlock(t, dir, id2, 1000, 2000)
+	createBlock(t, dir, id1, 0, 1000)
+
+	s.Sync(ctx)
+
+	rc, err := bkt.Get(ctx, ManifestPath(replicas[0]))
+	testutil.Ok(t, err)
+	defer rc.Close()
+
+	var m Manifest
+	testutil.Ok(t, json.NewDecoder(rc).Decode(&m))
+
+	testutil.Equals(t, Manifest{
+		Version: 1,
+		Labels:  replicas[0].Map(),
+		Blocks: []ManifestBlock{
+			{ULID: id1, MinTime: 0, MaxTime: 1000},
+			{ULID: id2, MinTime: 1000, MaxTime: 2000},
+		},
+	}, m)
+
+	ok, err := bkt.Exists(ctx, ManifestPath(replicas[1]))
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "manifest of other replica must not exist")
+}
+
+func TestShipper_DirSyncFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	s := New(nil, reg, filepath.Join(dir, "missing"), inmem.NewBucket(), nil, Options{Source: block.SidecarSource})
+
+	s.Sync(context.Background())
+	testutil.Equals(t, float64(1), testutil.CounterValue(t, reg, "thanos_shipper_dir_syncs_total"))
+	testutil.Equals(t, float64(1), testutil.CounterValue(t, reg, "thanos_shipper_dir_sync_failures_total"))
+
+	testutil.Ok(t, os.MkdirAll(filepath.Join(dir, "missing"), 0777))
+
+	s.Sync(context.Background())
+	testutil.Equals(t, float64(2), testutil.CounterValue(t, reg, "thanos_shipper_dir_syncs_total"))
+	testutil.Equals(t, float64(1), testutil.CounterValue(t, reg, "thanos_shipper_dir_sync_failures_total"))
+}
+
+// eventualBucket reports uploaded objects as missing for the first reads after their upload.
+func TestShipper_VerifyUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	bkt := inmem.NewBucket()
+	bkt.SetMissingReadsAfterUpload(1)
+	s := New(nil, reg, dir, bkt, nil, Options{VerifyTimeout: time.Second, Source: block.SidecarSource})
+	randr := rand.New(rand.NewSource(0))
+
+	// The block is missing on the first read after the upload and must still be considered uploaded.
+	id1 := ulid.MustNew(1, randr)
+	createBlock(t, dir, id1, 0, 1000)
+	s.Sync(context.Background())
+
+	testutil.Equals(t, float64(0), testutil.CounterValue(t, reg, "thanos_shipper_upload_failures_total"))
+
+	meta, err := ReadMetaFile(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{id1}, meta.Uploaded)
+
+	// A block that does not become visible within the timeout must fail and be retried later.
+	bkt.SetMissingReadsAfterUpload(1000)
+	s.verifyTimeout = 100 * time.Millisecond
+
+	id2 := ulid.MustNew(2, randr)
+	createBlock(t, dir, id2, 1000, 2000)
+	s.Sync(context.Background())
+
+	testutil.Equals(t, float64(1), testutil.CounterValue(t, reg, "thanos_shipper_upload_failures_total"))
+
+	meta, err = ReadMetaFile(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{id1}, meta.Uploaded)
+}
+
+func TestShipper_UploadLabelsAtUploadTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		mtx  sync.Mutex
+		lset = labels.FromStrings("region", "eu-west")
+	)
+	bkt := inmem.NewBucket()
+	s := New(nil, nil, dir, bkt, func() labels.Labels {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return lset
+	}, Options{Source: block.SidecarSource})
+
+	// The labels change after the block was created but before it is shipped.
+	id := ulid.MustNew(1, rand.New(rand.NewSource(0)))
+	createBlock(t, dir, id, 0, 1000)
+
+	mtx.Lock()
+	lset = labels.FromStrings("region", "eu-west", "replica", "b")
+	mtx.Unlock()
+
+	s.Sync(context.Background())
+
+	rc, err := bkt.Get(context.Background(), path.Join(id.String(), block.MetaFilename))
+	testutil.Ok(t, err)
+	defer rc.Close()
+
+	var meta block.Meta
+	testutil.Ok(t, json.NewDecoder(rc).Decode(&meta))
+	testutil.Equals(t, map[string]string{"region": "eu-west", "replica": "b"}, meta.Thanos.Labels)
+	testutil.Equals(t, block.SidecarSource, meta.Thanos.Source)
+}
+
+func TestShipper_PauseResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	bkt := inmem.NewBucket()
+	s := New(nil, reg, dir, bkt, nil, Options{Source: block.SidecarSource})
+
+	s.Pause()
+	testutil.Assert(t, s.Paused(), "shipper not paused")
+	testutil.Equals(t, float64(1), testutil.GaugeValue(t, reg, "thanos_shipper_paused"))
+
+	// Blocks created while paused must not be uploaded.
+	id := ulid.MustNew(1, rand.New(rand.NewSource(0)))
+	createBlock(t, dir, id, 0, 1000)
+	s.Sync(context.Background())
+
+	testutil.Equals(t, 0, len(bkt.Objects()))
+	testutil.Equals(t, float64(0), testutil.CounterValue(t, reg, "thanos_shipper_uploads_total"))
+
+	_, maxSyncTime, err := s.Timestamps()
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(math.MinInt64), maxSyncTime)
+
+	// After resuming, the pending block must be uploaded.
+	s.Resume()
+	testutil.Equals(t, float64(0), testutil.GaugeValue(t, reg, "thanos_shipper_paused"))
+	s.Sync(context.Background())
+
+	ok, err := bkt.Exists(context.Background(), path.Join(id.String(), block.MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "block not uploaded after resume")
+
+	_, maxSyncTime, err = s.Timestamps()
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(1000), maxSyncTime)
+}
+
+// partialBucket fails or stalls uploads of objects with the given base name. If failDelete
+// is set, it fails all deletions.
+type partialBucket struct {
+	*inmem.Bucket
+	failName   string
+	stallName  string
+	failDelete bool
+}
+
+func (b *partialBucket) Delete(ctx context.Context, name string) error {
+	if b.failDelete {
+		return errors.New("delete failed")
+	}
+	return b.Bucket.Delete(ctx, name)
+}
+
+func (b *partialBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	switch path.Base(name) {
+	case b.failName:
+		return errors.New("upload failed")
+	case b.stallName:
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestShipper_CleanupPartialUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	bkt := &partialBucket{Bucket: inmem.NewBucket(), failName: block.MetaFilename}
+	s := New(nil, reg, dir, bkt, nil, Options{UploadTimeout: 100 * time.Millisecond, Source: block.SidecarSource})
+	randr := rand.New(rand.NewSource(0))
+
+	// The chunks and index are uploaded before the meta file fails and must be deleted again.
+	createBlock(t, dir, ulid.MustNew(1, randr), 0, 1000)
+	s.Sync(context.Background())
+
+	testutil.Equals(t, 0, len(bkt.Objects()))
+	testutil.Equals(t, float64(1), testutil.CounterValue(t, reg, "thanos_shipper_upload_failures_total"))
+	testutil.Equals(t, float64(1), testutil.CounterValue(t, reg, "thanos_shipper_partial_upload_cleanups_total"))
+
+	// Uploads exceeding the timeout must be aborted and cleaned up as well.
+	bkt.failName, bkt.stallName = "", "index"
+	s.Sync(context.Background())
+
+	testutil.Equals(t, 0, len(bkt.Objects()))
+	testutil.Equals(t, float64(2), testutil.CounterValue(t, reg, "thanos_shipper_upload_failures_total"))
+	testutil.Equals(t, float64(2), testutil.CounterValue(t, reg, "thanos_shipper_partial_upload_cleanups_total"))
+
+	// Objects left behind by a killed process must be deleted before uploading the block again.
+	id := ulid.MustNew(2, randr)
+	createBlock(t, dir, id, 1000, 2000)
+	testutil.Ok(t, bkt.Bucket.Upload(context.Background(), path.Join(id.String(), "chunks", "0002"), bytes.NewReader([]byte("orphan"))))
+
+	bkt.stallName = ""
+	s.Sync(context.Background())
+
+	testutil.Equals(t, float64(3), testutil.CounterValue(t, reg, "thanos_shipper_partial_upload_cleanups_total"))
+	ok, err := bkt.Exists(context.Background(), path.Join(id.String(), "chunks", "0002"))
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "orphaned object not deleted")
+
+	ok, err = bkt.Exists(context.Background(), path.Join(id.String(), block.MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "block not uploaded")
+}
+
+func TestShipper_FailedCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	bkt := &partialBucket{Bucket: inmem.NewBucket(), failName: block.MetaFilename, failDelete: true}
+	s := New(nil, reg, dir, bkt, nil, Options{Source: block.SidecarSource})
+
+	// The chunks and index of the failed upload cannot be deleted, so the cleanup is not counted.
+	createBlock(t, dir, ulid.MustNew(1, rand.New(rand.NewSource(0))), 0, 1000)
+	s.Sync(context.Background())
+
+	testutil.Equals(t, 2, len(bkt.Objects()))
+	testutil.Equals(t, float64(1), testutil.CounterValue(t, reg, "thanos_shipper_upload_failures_total"))
+	testutil.Equals(t, float64(0), testutil.CounterValue(t, reg, "thanos_shipper_partial_upload_cleanups_total"))
+
+	// The next attempt fails as long as the leftovers cannot be deleted.
+	bkt.failName = ""
+	s.Sync(context.Background())
+
+	testutil.Equals(t, 2, len(bkt.Objects()))
+	testutil.Equals(t, float64(2), testutil.CounterValue(t, reg, "thanos_shipper_upload_failures_total"))
+	testutil.Equals(t, float64(0), testutil.CounterValue(t, reg, "thanos_shipper_partial_upload_cleanups_total"))
+
+	bkt.failDelete = false
+	s.Sync(context.Background())
+
+	testutil.Equals(t, 3, len(bkt.Objects()))
+	testutil.Equals(t, float64(2), testutil.CounterValue(t, reg, "thanos_shipper_upload_failures_total"))
+	testutil.Equals(t, float64(1), testutil.CounterValue(t, reg, "thanos_shipper_partial_upload_cleanups_total"))
+}
+
+func TestShipper_MaxBlockAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	bkt := inmem.NewBucket()
+	s := New(nil, reg, dir, bkt, nil, Options{MaxBlockAge: 24 * time.Hour, Source: block.SidecarSource})
+
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	var (
+		randr  = rand.New(rand.NewSource(0))
+		old    = ulid.MustNew(1, randr)
+		recent = ulid.MustNew(2, randr)
+	)
+	createBlock(t, dir, old, timestamp.FromTime(now.Add(-50*time.Hour)), timestamp.FromTime(now.Add(-48*time.Hour)))
+	createBlock(t, dir, recent, timestamp.FromTime(now.Add(-4*time.Hour)), timestamp.FromTime(now.Add(-2*time.Hour)))
+
+	s.Sync(context.Background())
+
+	ok, err := bkt.Exists(context.Background(), path.Join(recent.String(), block.MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "recent block not uploaded")
+
+	ok, err = bkt.Exists(context.Background(), path.Join(old.String(), block.MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "old block uploaded")
+
+	testutil.Equals(t, float64(1), testutil.GaugeValue(t, reg, "thanos_shipper_too_old_blocks"))
+
+	// The old block must neither be recorded as uploaded nor be removed locally.
+	meta, err := ReadMetaFile(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{recent}, meta.Uploaded)
+
+	_, err = os.Stat(filepath.Join(dir, old.String()))
+	testutil.Ok(t, err)
+}
+
+func TestShipper_UploadTombstones(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tombstones=%t", tombstones), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "shipper-test")
+			testutil.Ok(t, err)
+			defer os.RemoveAll(dir)
+
+			bkt := inmem.NewBucket()
+			s := New(nil, nil, dir, bkt, nil, Options{UploadTombstones: tombstones, Source: block.SidecarSource})
+
+			id := ulid.MustNew(1, rand.New(rand.NewSource(0)))
+			createBlock(t, dir, id, 0, 1000)
+			testutil.Ok(t, ioutil.WriteFile(filepath.Join(dir, id.String(), "tombstones"), []byte("tombstonecontents"), 0666))
+
+			s.Sync(context.Background())
+
+			var names []string
+			for n := range bkt.Objects() {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+
+			exp := []string{
+				path.Join(id.String(), "chunks", "0001"),
+				path.Join(id.String(), "index"),
+				path.Join(id.String(), block.MetaFilename),
+			}
+			if tombstones {
+				exp = append(exp, path.Join(id.String(), "tombstones"))
+			}
+			testutil.Equals(t, exp, names)
+		})
+	}
+
+	// Blocks without a tombstones file are uploaded regardless.
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	bkt := inmem.NewBucket()
+	s := New(nil, nil, dir, bkt, nil, Options{UploadTombstones: true, Source: block.SidecarSource})
+
+	id := ulid.MustNew(1, rand.New(rand.NewSource(0)))
+	createBlock(t, dir, id, 0, 1000)
+	s.Sync(context.Background())
+
+	testutil.Equals(t, 3, len(bkt.Objects()))
+}
+
+// sizeCheckingBucket fails uploads of readers that do not tell their size.
+type sizeCheckingBucket struct {
+	objstore.Bucket
+}
+
+func (b sizeCheckingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if _, ok := r.(interface{ Size() int64 }); !ok {
+		return errors.Errorf("upload of %s is %T, which does not tell its size", name, r)
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+// fakeClock advances its time by the durations waited for instead of sleeping.
+type fakeClock struct {
+	mtx sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.now = c.now.Add(d)
+	return nil
+}
+
+// readRecordingBucket reads uploads in chunks of at most 1000 bytes and records the total
+// number of bytes read by each time of the clock.
+type readRecordingBucket struct {
+	objstore.Bucket
+	clock *fakeClock
+
+	mtx   sync.Mutex
+	total int
+	reads []recordedRead
+}
+
+type recordedRead struct {
+	at    time.Time
+	total int
+}
+
+func (b *readRecordingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	var buf bytes.Buffer
+	p := make([]byte, 1000)
+	for {
+		n, err := r.Read(p)
+		if n > 0 {
+			buf.Write(p[:n])
+
+			b.mtx.Lock()
+			b.total += n
+			b.reads = append(b.reads, recordedRead{at: b.clock.Now(), total: b.total})
+			b.mtx.Unlock()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return b.Bucket.Upload(ctx, name, &buf)
+}
+
+func TestShipper_UploadBandwidthLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	// Block files must reach the bucket with their size despite the limit, so that backends
+	// such as S3 do not buffer them in memory.
+	reg := prometheus.NewRegistry()
+	bkt := inmem.NewBucket()
+	start := time.Unix(0, 0)
+	clock := &fakeClock{now: start}
+	rec := &readRecordingBucket{Bucket: bkt, clock: clock}
+	s := New(nil, reg, dir, sizeCheckingBucket{rec}, nil, Options{UploadBandwidth: 1000, Source: block.SidecarSource})
+
+	// Apply the limit the way New does but with the fake clock.
+	s.bucket = &countingBucket{
+		Bucket:   objstore.RateLimitedBucketWithClock(sizeCheckingBucket{rec}, objstore.RateLimitConfig{WriteBytesPerSecond: 1000}, clock),
+		uploaded: s.metrics.uploadedBytes,
+	}
+
+	id := ulid.MustNew(1, rand.New(rand.NewSource(0)))
+	createBlock(t, dir, id, 0, 1000)
+	// The chunks take several seconds worth of the limit.
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(dir, id.String(), "chunks", "0001"), make([]byte, 5000), 0666))
+	s.Sync(context.Background())
+
+	testutil.Equals(t, float64(0), testutil.CounterValue(t, reg, "thanos_shipper_upload_failures_total"))
+	testutil.Equals(t, 3, len(bkt.Objects()))
+
+	var size int
+	for _, b := range bkt.Objects() {
+		size += len(b)
+	}
+	testutil.Equals(t, float64(size), testutil.CounterValue(t, reg, "thanos_shipper_uploaded_bytes_total"))
+	testutil.Equals(t, size, rec.total)
+
+	// Files are throttled as they are read rather than sent at full speed, so that at no
+	// time more than a second worth of bytes is ahead of the limit.
+	for _, r := range rec.reads {
+		elapsed := r.at.Sub(start)
+		testutil.Assert(t, float64(r.total) <= 1000*elapsed.Seconds()+1000, "%d bytes read after %s", r.total, elapsed)
+	}
+}
+
+func TestShipper_CompactedBlocks(t *testing.T) {
+	createCompacted := func(t *testing.T, dir string, id ulid.ULID, sources ...ulid.ULID) {
+		createBlock(t, dir, id, 0, 2000)
+
+		bdir := filepath.Join(dir, id.String())
+		meta, err := block.ReadMetaFile(bdir)
+		testutil.Ok(t, err)
+		meta.Compaction.Level = 2
+		meta.Compaction.Sources = sources
+		testutil.Ok(t, block.WriteMetaFile(bdir, meta))
+	}
+	var (
+		s1 = ulid.MustNew(1, rand.New(rand.NewSource(0)))
+		s2 = ulid.MustNew(2, rand.New(rand.NewSource(0)))
+		c  = ulid.MustNew(3, rand.New(rand.NewSource(0)))
+	)
+
+	// A compacted block is shipped in place of its sources if none of them was shipped.
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	bkt := inmem.NewBucket()
+	s := New(nil, reg, dir, bkt, nil, Options{UploadManifest: true, Source: block.SidecarSource})
+
+	createBlock(t, dir, s1, 0, 1000)
+	createBlock(t, dir, s2, 1000, 2000)
+	createCompacted(t, dir, c, s1, s2)
+
+	s.Sync(context.Background())
+
+	for n := range bkt.Objects() {
+		testutil.Assert(t, !strings.HasPrefix(n, s1.String()) && !strings.HasPrefix(n, s2.String()), "source object %s uploaded", n)
+	}
+	ok, err := bkt.Exists(context.Background(), path.Join(c.String(), block.MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "compacted block not uploaded")
+	testutil.Equals(t, 2.0, testutil.CounterValue(t, reg, "thanos_shipper_superseded_blocks_total"))
+
+	shipMeta, err := ReadMetaFile(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(shipMeta.Uploaded))
+	testutil.Equals(t, []ulid.ULID{c}, shipMeta.Compacted)
+
+	// The manifest only lists the compacted block, also on subsequent syncs.
+	s.Sync(context.Background())
+
+	rc, err := bkt.Get(context.Background(), ManifestPath(nil))
+	testutil.Ok(t, err)
+	defer rc.Close()
+
+	var m Manifest
+	testutil.Ok(t, json.NewDecoder(rc).Decode(&m))
+	testutil.Equals(t, []ManifestBlock{{ULID: c, MinTime: 0, MaxTime: 2000}}, m.Blocks)
+
+	// A compacted block is not shipped if one of its sources already exists in the bucket.
+	dir2, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir2)
+
+	bkt = inmem.NewBucket()
+	s = New(nil, nil, dir2, bkt, nil, Options{Source: block.SidecarSource})
+
+	createBlock(t, dir2, s1, 0, 1000)
+	s.Sync(context.Background())
+
+	// The source was deleted locally after being shipped.
+	testutil.Ok(t, os.RemoveAll(filepath.Join(dir2, s1.String())))
+	createBlock(t, dir2, s2, 1000, 2000)
+	createCompacted(t, dir2, c, s1, s2)
+
+	s.Sync(context.Background())
+
+	ok, err = bkt.Exists(context.Background(), path.Join(c.String(), block.MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "compacted block uploaded despite shipped source")
+
+	ok, err = bkt.Exists(context.Background(), path.Join(s2.String(), block.MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "remaining source not uploaded")
+
+	shipMeta, err = ReadMetaFile(dir2)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(shipMeta.Uploaded))
+	testutil.Equals(t, 0, len(shipMeta.Compacted))
+}
+
+// corruptingBucket flips a byte of objects with the given base name on upload.
+type corruptingBucket struct {
+	*inmem.Bucket
+	corruptName string
+}
+
+func (b *corruptingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if path.Base(name) != b.corruptName {
+		return b.Bucket.Upload(ctx, name, r)
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	content[0] ^= 0xff
+	return b.Bucket.Upload(ctx, name, bytes.NewReader(content))
+}
+
+func TestShipper_VerifyChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	bkt := &corruptingBucket{Bucket: inmem.NewBucket(), corruptName: "index"}
+	s := New(nil, reg, dir, bkt, nil, Options{VerifyChecksums: true, Source: block.SidecarSource})
+
+	id := ulid.MustNew(1, rand.New(rand.NewSource(0)))
+	createBlock(t, dir, id, 0, 1000)
+	s.Sync(context.Background())
+
+	// The corrupted block must be deleted rather than be made visible by its meta file.
+	testutil.Equals(t, 0, len(bkt.Objects()))
+	testutil.Equals(t, float64(1), testutil.CounterValue(t, reg, "thanos_shipper_checksum_mismatches_total"))
+
+	meta, err := ReadMetaFile(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(meta.Uploaded))
+
+	// The block is uploaded again on the next sync.
+	bkt.corruptName = ""
+	s.Sync(context.Background())
+
+	testutil.Equals(t, 3, len(bkt.Objects()))
+	testutil.Equals(t, float64(1), testutil.CounterValue(t, reg, "thanos_shipper_checksum_mismatches_total"))
+}
+
+func TestShipper_UploadConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	bkt := &recordingBucket{Bucket: inmem.NewBucket()}
+	s := New(nil, nil, dir, bkt, nil, Options{
+		UploadTombstones:  true,
+		UploadConcurrency: 4,
+		Source:            block.SidecarSource,
+	})
+
+	id := ulid.MustNew(1, rand.New(rand.NewSource(0)))
+	createBlock(t, dir, id, 0, 1000)
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(dir, id.String(), "chunks", "0002"), []byte("chunkcontents"), 0666))
+	// The tombstones file sorts after the meta file but must be uploaded before it.
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(dir, id.String(), "tombstones"), []byte("tombstonecontents"), 0666))
+
+	s.Sync(context.Background())
+
+	testutil.Equals(t, 5, len(bkt.uploaded))
+	testutil.Equals(t, path.Join(id.String(), block.MetaFilename), bkt.uploaded[4])
+
+	meta, err := ReadMetaFile(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{id}, meta.Uploaded)
+}
@@ -15,6 +15,7 @@ import (
 
 	"github.com/improbable-eng/thanos/pkg/block"
 	"github.com/improbable-eng/thanos/pkg/objstore"
+	"github.com/improbable-eng/thanos/pkg/objstore/objtesting"
 	"github.com/improbable-eng/thanos/pkg/runutil"
 	"github.com/improbable-eng/thanos/pkg/store/storepb"
 	"github.com/improbable-eng/thanos/pkg/testutil"
@@ -24,7 +25,7 @@ import (
 
 // TODO(bplotka): This should go to the e2e tests package. Here should be mocked test.
 func TestBucketStore_e2e(t *testing.T) {
-	bkt, cleanup := testutil.NewObjectStoreBucket(t)
+	bkt, cleanup := objtesting.NewGCSBucket(t)
 	defer cleanup()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -2,6 +2,7 @@ package store
 
 import (
 	"sync"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru/simplelru"
 	"github.com/oklog/ulid"
@@ -182,3 +183,52 @@ func (c *indexCache) series(b ulid.ULID, id uint64) ([]byte, bool) {
 	c.hits.WithLabelValues(cacheTypeSeries).Inc()
 	return v.([]byte), true
 }
+
+// labelValuesCacheSize is the maximum number of label names whose values are cached.
+const labelValuesCacheSize = 1000
+
+type labelValuesEntry struct {
+	values  []string
+	expires time.Time
+}
+
+// labelValuesCache caches label values by label name for a fixed time. Once full,
+// the least recently used entries are evicted.
+type labelValuesCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mtx sync.Mutex
+	lru *lru.LRU
+}
+
+func newLabelValuesCache(ttl time.Duration, now func() time.Time) (*labelValuesCache, error) {
+	l, err := lru.NewLRU(labelValuesCacheSize, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &labelValuesCache{ttl: ttl, now: now, lru: l}, nil
+}
+
+func (c *labelValuesCache) get(name string) ([]string, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	v, ok := c.lru.Get(name)
+	if !ok {
+		return nil, false
+	}
+	e := v.(labelValuesEntry)
+	if !c.now().Before(e.expires) {
+		c.lru.Remove(name)
+		return nil, false
+	}
+	return e.values, true
+}
+
+func (c *labelValuesCache) set(name string, values []string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.lru.Add(name, labelValuesEntry{values: values, expires: c.now().Add(c.ttl)})
+}
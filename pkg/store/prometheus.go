@@ -11,6 +11,7 @@ import (
 	"path"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/gogo/protobuf/proto"
@@ -20,19 +21,126 @@ import (
 	"github.com/improbable-eng/thanos/pkg/tracing"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/tsdb/labels"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+type prometheusStoreMetrics struct {
+	resultSeriesCount  prometheus.Histogram
+	resultSamplesCount prometheus.Histogram
+	sentBytes          prometheus.Histogram
+	limitedRequests    prometheus.Counter
+	shedRequests       prometheus.Counter
+	labelValuesHits    prometheus.Counter
+	labelValuesMisses  prometheus.Counter
+	spilledRequests    prometheus.Counter
+}
+
+func newPrometheusStoreMetrics(reg prometheus.Registerer) *prometheusStoreMetrics {
+	var m prometheusStoreMetrics
+
+	m.resultSeriesCount = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "thanos_prometheus_store_series_result_series",
+		Help:    "Number of series returned for a single series request.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	})
+	m.resultSamplesCount = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "thanos_prometheus_store_series_result_samples",
+		Help:    "Number of samples returned for a single series request.",
+		Buckets: prometheus.ExponentialBuckets(10, 4, 12),
+	})
+	m.sentBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "thanos_prometheus_store_series_sent_bytes",
+		Help:    "Size in bytes of all series responses sent for a single series request.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+	m.limitedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_prometheus_store_series_limited_requests_total",
+		Help: "Total number of series requests that were aborted because they exceeded the series limit.",
+	})
+	m.shedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_prometheus_store_series_shed_requests_total",
+		Help: "Total number of series requests that were rejected because Prometheus was unhealthy.",
+	})
+	m.labelValuesHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_prometheus_store_label_values_cache_hits_total",
+		Help: "Total number of label values requests that were served from the cache.",
+	})
+	m.labelValuesMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_prometheus_store_label_values_cache_misses_total",
+		Help: "Total number of label values requests that were not found in the cache.",
+	})
+	m.spilledRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_prometheus_store_series_spilled_requests_total",
+		Help: "Total number of series requests whose responses exceeded the memory limit and were spilled to disk.",
+	})
+
+	if reg != nil {
+		reg.MustRegister(
+			m.resultSeriesCount,
+			m.resultSamplesCount,
+			m.sentBytes,
+			m.limitedRequests,
+			m.shedRequests,
+			m.labelValuesHits,
+			m.labelValuesMisses,
+			m.spilledRequests,
+		)
+	}
+	return &m
+}
+
 // PrometheusStore implements the store node API on top of the Prometheus remote read API.
+// Series requests are translated into remote read queries against /api/v1/read and the
+// returned raw samples are encoded into chunks.
 type PrometheusStore struct {
 	logger         log.Logger
+	metrics        *prometheusStoreMetrics
 	base           *url.URL
 	client         *http.Client
 	buffers        sync.Pool
 	externalLabels func() labels.Labels
+	queryTimeout   time.Duration
+	maxQueryRange  time.Duration
+	seriesLimit    int
+	healthy        func() bool
+	labelValues    *labelValuesCache
+	memoryLimit    int
+	spillDir       string
+	timestamps     func() (int64, int64)
+	now            func() time.Time
+}
+
+// PrometheusStoreOptions configures how a PrometheusStore serves requests. The zero value
+// serves all data without limits and caching.
+type PrometheusStoreOptions struct {
+	// QueryTimeout is the time after which requests forwarded to Prometheus are aborted.
+	// Zero disables the timeout.
+	QueryTimeout time.Duration
+	// MaxQueryRange limits the data that is served to data younger than MaxQueryRange.
+	// Zero disables the limit.
+	MaxQueryRange time.Duration
+	// SeriesLimit is the number of series beyond which series requests are aborted.
+	// Zero disables the limit.
+	SeriesLimit int
+	// Healthy rejects series requests right away while it returns false instead of adding
+	// load to a struggling Prometheus. It may be nil.
+	Healthy func() bool
+	// MetadataCacheTTL is the time label values retrieved from Prometheus are cached for.
+	// Zero disables the cache.
+	MetadataCacheTTL time.Duration
+	// MemoryLimit is the number of bytes of the responses of a series request that are
+	// buffered in memory. Responses beyond it are spilled into a temporary file in SpillDir.
+	// The response retrieved from Prometheus is decoded one series at a time and released
+	// before the buffered responses are streamed to slow clients. Zero disables buffering.
+	MemoryLimit int
+	SpillDir    string
+	// Timestamps provides the time range of the data available in Prometheus' TSDB that is
+	// advertised through Info. It may be nil.
+	Timestamps func() (mint int64, maxt int64)
 }
 
 // NewPrometheusStore returns a new PrometheusStore that uses the given HTTP client
@@ -44,6 +152,7 @@ func NewPrometheusStore(
 	client *http.Client,
 	baseURL *url.URL,
 	externalLabels func() labels.Labels,
+	opts PrometheusStoreOptions,
 ) (*PrometheusStore, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -55,24 +164,48 @@ func NewPrometheusStore(
 	}
 	p := &PrometheusStore{
 		logger:         logger,
+		metrics:        newPrometheusStoreMetrics(reg),
 		base:           baseURL,
 		client:         client,
 		externalLabels: externalLabels,
+		queryTimeout:   opts.QueryTimeout,
+		maxQueryRange:  opts.MaxQueryRange,
+		seriesLimit:    opts.SeriesLimit,
+		healthy:        opts.Healthy,
+		memoryLimit:    opts.MemoryLimit,
+		spillDir:       opts.SpillDir,
+		timestamps:     opts.Timestamps,
+		now:            time.Now,
+	}
+	if opts.MetadataCacheTTL > 0 {
+		c, err := newLabelValuesCache(opts.MetadataCacheTTL, func() time.Time { return p.now() })
+		if err != nil {
+			return nil, errors.Wrap(err, "create label values cache")
+		}
+		p.labelValues = c
 	}
 	return p, nil
 }
 
 // Info returns store information about the Prometheus instance.
-// NOTE(bplotka): MaxTime & MinTime are not accurate nor adjusted dynamically like these included in gossip meta.
-// This is fine for now, but might be needed in future.
+// The time range is the one provided by the timestamps function, so that it is consistent
+// with the one included in gossip meta. Without it the full time range is returned.
+// The minimum timestamp is limited to the maximum query range in either case.
 func (p *PrometheusStore) Info(ctx context.Context, r *storepb.InfoRequest) (*storepb.InfoResponse, error) {
 	lset := p.externalLabels()
 
 	res := &storepb.InfoResponse{
-		MinTime: 0,
+		MinTime: p.minTime(),
 		MaxTime: math.MaxInt64,
 		Labels:  make([]storepb.Label, 0, len(lset)),
 	}
+	if p.timestamps != nil {
+		mint, maxt := p.timestamps()
+		if mint > res.MinTime {
+			res.MinTime = mint
+		}
+		res.MaxTime = maxt
+	}
 	for _, l := range lset {
 		res.Labels = append(res.Labels, storepb.Label{
 			Name:  l.Name,
@@ -82,6 +215,31 @@ func (p *PrometheusStore) Info(ctx context.Context, r *storepb.InfoRequest) (*st
 	return res, nil
 }
 
+// minTime returns the oldest timestamp that is served.
+func (p *PrometheusStore) minTime() int64 {
+	if p.maxQueryRange <= 0 {
+		return 0
+	}
+	return timestamp.FromTime(p.now().Add(-p.maxQueryRange))
+}
+
+// withQueryTimeout returns a context that is canceled after the configured query timeout.
+func (p *PrometheusStore) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.queryTimeout)
+}
+
+// queryError translates err into a gRPC status error. If the query deadline was
+// exceeded, DeadlineExceeded is returned.
+func queryError(ctx context.Context, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
 func (p *PrometheusStore) getBuffer() []byte {
 	b := p.buffers.Get()
 	if b == nil {
@@ -96,6 +254,10 @@ func (p *PrometheusStore) putBuffer(b []byte) {
 
 // Series returns all series for a requested time range and label matcher.
 func (p *PrometheusStore) Series(r *storepb.SeriesRequest, s storepb.Store_SeriesServer) error {
+	if p.healthy != nil && !p.healthy() {
+		p.metrics.shedRequests.Inc()
+		return status.Error(codes.Unavailable, "Prometheus is unhealthy, rejecting series request")
+	}
 	ext := p.externalLabels()
 
 	match, newMatchers, err := labelsMatches(ext, r.Matchers)
@@ -105,7 +267,16 @@ func (p *PrometheusStore) Series(r *storepb.SeriesRequest, s storepb.Store_Serie
 	if !match {
 		return nil
 	}
-	q := prompb.Query{StartTimestampMs: r.MinTime, EndTimestampMs: r.MaxTime}
+	// Data older than the maximum query range is not served. The query layer
+	// retrieves it from other stores instead.
+	minTime := r.MinTime
+	if mint := p.minTime(); minTime < mint {
+		minTime = mint
+	}
+	if minTime > r.MaxTime {
+		return nil
+	}
+	q := prompb.Query{StartTimestampMs: minTime, EndTimestampMs: r.MaxTime}
 
 	// TODO(fabxc): import common definitions from prompb once we have a stable gRPC
 	// query API there.
@@ -127,15 +298,45 @@ func (p *PrometheusStore) Series(r *storepb.SeriesRequest, s storepb.Store_Serie
 		q.Matchers = append(q.Matchers, pm)
 	}
 
-	resp, err := p.promSeries(s.Context(), q)
+	ctx, cancel := p.withQueryTimeout(s.Context())
+	defer cancel()
+
+	series, err := p.promSeries(ctx, q)
 	if err != nil {
-		return errors.Wrap(err, "query Prometheus")
+		return queryError(ctx, errors.Wrap(err, "query Prometheus"))
 	}
+	defer series.Close()
 
 	span, _ := tracing.StartSpan(s.Context(), "transform_and_respond")
 	defer span.Finish()
 
-	for _, e := range resp.Results[0].Timeseries {
+	var seriesCount, samplesCount, sentBytes int
+	defer func() {
+		p.metrics.resultSeriesCount.Observe(float64(seriesCount))
+		p.metrics.resultSamplesCount.Observe(float64(samplesCount))
+		p.metrics.sentBytes.Observe(float64(sentBytes))
+	}()
+
+	var buf *seriesBuffer
+	send := s.Send
+	if p.memoryLimit > 0 {
+		buf = newSeriesBuffer(p.spillDir, p.memoryLimit)
+		defer buf.Close()
+		send = buf.Add
+	}
+
+	for series.Next() {
+		e := series.At()
+		// Series without samples in the requested range cannot be encoded into a chunk.
+		if len(e.Samples) == 0 {
+			continue
+		}
+		// Series are decoded one at a time. The limit is checked before encoding each
+		// series so that the request is aborted before any further series is decoded.
+		if p.seriesLimit > 0 && seriesCount >= p.seriesLimit {
+			p.metrics.limitedRequests.Inc()
+			return status.Errorf(codes.ResourceExhausted, "series request exceeds limit of %d series", p.seriesLimit)
+		}
 		lset := p.translateAndExtendLabels(e.Labels, ext)
 		// We generally expect all samples of the requested range to be traversed
 		// so we just encode all samples into one big chunk regardless of size.
@@ -151,14 +352,31 @@ func (p *PrometheusStore) Series(r *storepb.SeriesRequest, s storepb.Store_Serie
 				Raw:     &storepb.Chunk{Type: enc, Data: cb},
 			}},
 		})
-		if err := s.Send(resp); err != nil {
+		if err := send(resp); err != nil {
 			return err
 		}
+		seriesCount++
+		samplesCount += len(e.Samples)
+		sentBytes += resp.Size()
 	}
-	return nil
+	if err := series.Err(); err != nil {
+		return status.Error(codes.Unknown, errors.Wrap(err, "decode remote read response").Error())
+	}
+	if buf == nil {
+		return nil
+	}
+	if buf.Spilled() {
+		p.metrics.spilledRequests.Inc()
+	}
+	// Release the response of Prometheus so that no more than the buffered
+	// responses are held in memory while they are streamed to the client.
+	series.Close()
+	return buf.Send(s)
 }
 
-func (p *PrometheusStore) promSeries(ctx context.Context, q prompb.Query) (*prompb.ReadResponse, error) {
+// promSeries queries Prometheus through the remote read API. The returned series are decoded
+// lazily from the decompressed response, which is held until the set is closed.
+func (p *PrometheusStore) promSeries(ctx context.Context, q prompb.Query) (*remoteReadSeriesSet, error) {
 	span, ctx := tracing.StartSpan(ctx, "query_prometheus")
 	defer span.Finish()
 
@@ -198,19 +416,131 @@ func (p *PrometheusStore) promSeries(ctx context.Context, q prompb.Query) (*prom
 		return nil, errors.Wrap(err, "copy response")
 	}
 	decomp, err := snappy.Decode(p.getBuffer(), buf.Bytes())
-	defer p.putBuffer(decomp)
 	if err != nil {
+		p.putBuffer(decomp)
 		return nil, errors.Wrap(err, "decompress response")
 	}
-
-	var data prompb.ReadResponse
-	if err := proto.Unmarshal(decomp, &data); err != nil {
+	res, err := remoteReadResult(decomp)
+	if err != nil {
+		p.putBuffer(decomp)
 		return nil, errors.Wrap(err, "unmarshal response")
 	}
-	if len(data.Results) != 1 {
-		return nil, errors.Errorf("unexepected result size %d", len(data.Results))
+	return &remoteReadSeriesSet{
+		b:       res,
+		release: func() { p.putBuffer(decomp) },
+	}, nil
+}
+
+// remoteReadResult returns the encoded query result of a remote read response, which must
+// contain exactly one.
+func remoteReadResult(b []byte) ([]byte, error) {
+	var (
+		res []byte
+		n   int
+	)
+	for len(b) > 0 {
+		field, wire, v, rest, err := nextProtoField(b)
+		if err != nil {
+			return nil, err
+		}
+		if field == 1 {
+			if wire != proto.WireBytes {
+				return nil, errors.Errorf("unexpected wire type %d of results", wire)
+			}
+			res = v
+			n++
+		}
+		b = rest
+	}
+	if n != 1 {
+		return nil, errors.Errorf("unexepected result size %d", n)
 	}
-	return &data, nil
+	return res, nil
+}
+
+// remoteReadSeriesSet decodes the time series of an encoded remote read query result one at
+// a time. Only the current series is held in decoded form so that the memory used for a
+// request does not grow with the number of series that are skipped or rejected.
+type remoteReadSeriesSet struct {
+	b       []byte
+	cur     prompb.TimeSeries
+	err     error
+	release func()
+}
+
+func (s *remoteReadSeriesSet) Next() bool {
+	for s.err == nil && len(s.b) > 0 {
+		field, wire, v, rest, err := nextProtoField(s.b)
+		if err != nil {
+			s.err = err
+			return false
+		}
+		s.b = rest
+		if field != 1 {
+			continue
+		}
+		if wire != proto.WireBytes {
+			s.err = errors.Errorf("unexpected wire type %d of time series", wire)
+			return false
+		}
+		s.cur.Labels = s.cur.Labels[:0]
+		s.cur.Samples = s.cur.Samples[:0]
+		if err := s.cur.Unmarshal(v); err != nil {
+			s.err = errors.Wrap(err, "unmarshal time series")
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// At returns the current series. It is only valid until the next call to Next.
+func (s *remoteReadSeriesSet) At() prompb.TimeSeries { return s.cur }
+
+func (s *remoteReadSeriesSet) Err() error { return s.err }
+
+// Close releases the response buffer. It may be called multiple times.
+func (s *remoteReadSeriesSet) Close() {
+	if s.release == nil {
+		return
+	}
+	s.b, s.cur = nil, prompb.TimeSeries{}
+	s.release()
+	s.release = nil
+}
+
+// nextProtoField splits the first field off the protobuf encoded message b. It returns the
+// field number, the wire type and the value, which excludes the length prefix of
+// length-delimited fields, along with the remaining bytes.
+func nextProtoField(b []byte) (field uint64, wire uint64, v []byte, rest []byte, err error) {
+	tag, n := proto.DecodeVarint(b)
+	if n == 0 {
+		return 0, 0, nil, nil, errors.New("invalid field tag")
+	}
+	field, wire, b = tag>>3, tag&7, b[n:]
+
+	switch wire {
+	case proto.WireVarint:
+		if _, n = proto.DecodeVarint(b); n == 0 {
+			return 0, 0, nil, nil, errors.New("invalid varint")
+		}
+	case proto.WireFixed64:
+		n = 8
+	case proto.WireFixed32:
+		n = 4
+	case proto.WireBytes:
+		l, m := proto.DecodeVarint(b)
+		if m == 0 || l > uint64(len(b)-m) {
+			return 0, 0, nil, nil, errors.New("invalid length")
+		}
+		return field, wire, b[m : m+int(l)], b[m+int(l):], nil
+	default:
+		return 0, 0, nil, nil, errors.Errorf("unsupported wire type %d", wire)
+	}
+	if n > len(b) {
+		return 0, 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return field, wire, b[:n], b[n:], nil
 }
 
 func labelsMatches(lset labels.Labels, ms []storepb.LabelMatcher) (bool, []storepb.LabelMatcher, error) {
@@ -238,7 +568,8 @@ func labelsMatches(lset labels.Labels, ms []storepb.LabelMatcher) (bool, []store
 	return true, newMatcher, nil
 }
 
-// encodeChunk translates the sample pairs into a chunk.
+// encodeChunk encodes the samples into a single chunk. XOR is the only encoding defined by the
+// Store API, so samples are always re-encoded. Timestamps and values are preserved exactly.
 func (p *PrometheusStore) encodeChunk(ss []prompb.Sample) (storepb.Chunk_Encoding, []byte, error) {
 	c := chunkenc.NewXORChunk()
 
@@ -294,6 +625,13 @@ func (p *PrometheusStore) LabelNames(ctx context.Context, r *storepb.LabelNamesR
 func (p *PrometheusStore) LabelValues(ctx context.Context, r *storepb.LabelValuesRequest) (
 	*storepb.LabelValuesResponse, error,
 ) {
+	if p.labelValues != nil {
+		if values, ok := p.labelValues.get(r.Label); ok {
+			p.metrics.labelValuesHits.Inc()
+			return &storepb.LabelValuesResponse{Values: values}, nil
+		}
+		p.metrics.labelValuesMisses.Inc()
+	}
 	u := *p.base
 	u.Path = path.Join(u.Path, "/api/v1/label/", r.Label, "/values")
 
@@ -302,12 +640,15 @@ func (p *PrometheusStore) LabelValues(ctx context.Context, r *storepb.LabelValue
 		return nil, status.Error(codes.Unknown, err.Error())
 	}
 
+	ctx, cancel := p.withQueryTimeout(ctx)
+	defer cancel()
+
 	span, ctx := tracing.StartSpan(ctx, "/prom_label_values HTTP[client]")
 	defer span.Finish()
 
 	resp, err := p.client.Do(req.WithContext(ctx))
 	if err != nil {
-		return nil, status.Error(codes.Unknown, err.Error())
+		return nil, queryError(ctx, err)
 	}
 	defer resp.Body.Close()
 
@@ -315,9 +656,12 @@ func (p *PrometheusStore) LabelValues(ctx context.Context, r *storepb.LabelValue
 		Data []string `json:"data"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
-		return nil, status.Error(codes.Unknown, err.Error())
+		return nil, queryError(ctx, err)
 	}
 	sort.Strings(m.Data)
 
+	if p.labelValues != nil {
+		p.labelValues.set(r.Label, m.Data)
+	}
 	return &storepb.LabelValuesResponse{Values: m.Data}, nil
 }
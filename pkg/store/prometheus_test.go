@@ -3,15 +3,28 @@ package store
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/improbable-eng/thanos/pkg/store/prompb"
 	"github.com/improbable-eng/thanos/pkg/store/storepb"
 	"github.com/improbable-eng/thanos/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/tsdb/labels"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestPrometheusStore_Series(t *testing.T) {
@@ -35,10 +48,9 @@ func TestPrometheusStore_Series(t *testing.T) {
 	u, err := url.Parse(fmt.Sprintf("http://%s", p.Addr()))
 	testutil.Ok(t, err)
 
-	proxy, err := NewPrometheusStore(nil, nil, nil, u,
-		func() labels.Labels {
-			return labels.FromStrings("region", "eu-west")
-		})
+	proxy, err := NewPrometheusStore(nil, nil, nil, u, func() labels.Labels {
+		return labels.FromStrings("region", "eu-west")
+	}, PrometheusStoreOptions{})
 	testutil.Ok(t, err)
 
 	// Query all three samples except for the first one. Since we round up queried data
@@ -105,7 +117,7 @@ func TestPrometheusStore_LabelValues(t *testing.T) {
 	u, err := url.Parse(fmt.Sprintf("http://%s", p.Addr()))
 	testutil.Ok(t, err)
 
-	proxy, err := NewPrometheusStore(nil, nil, nil, u, nil)
+	proxy, err := NewPrometheusStore(nil, nil, nil, u, nil, PrometheusStoreOptions{})
 	testutil.Ok(t, err)
 
 	resp, err := proxy.LabelValues(ctx, &storepb.LabelValuesRequest{
@@ -116,6 +128,42 @@ func TestPrometheusStore_LabelValues(t *testing.T) {
 	testutil.Equals(t, []string{"a", "b", "c"}, resp.Values)
 }
 
+func TestPrometheusStore_Info(t *testing.T) {
+	u, err := url.Parse("http://localhost:9090")
+	testutil.Ok(t, err)
+
+	// Time range of the blocks in the TSDB as advertised through gossip.
+	mint, maxt := int64(20000), int64(90000)
+	timestamps := func() (int64, int64) { return mint, maxt }
+
+	proxy, err := NewPrometheusStore(nil, nil, nil, u, func() labels.Labels {
+		return labels.FromStrings("region", "eu-west")
+	}, PrometheusStoreOptions{Timestamps: timestamps})
+	testutil.Ok(t, err)
+
+	info, err := proxy.Info(context.Background(), &storepb.InfoRequest{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, []storepb.Label{{Name: "region", Value: "eu-west"}}, info.Labels)
+	testutil.Equals(t, mint, info.MinTime)
+	testutil.Equals(t, maxt, info.MaxTime)
+
+	// Updates of the time range are reflected right away.
+	mint, maxt = 30000, math.MaxInt64
+
+	info, err = proxy.Info(context.Background(), &storepb.InfoRequest{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, mint, info.MinTime)
+	testutil.Equals(t, maxt, info.MaxTime)
+
+	// The minimum timestamp is still limited to the maximum query range.
+	proxy.maxQueryRange = time.Minute
+	proxy.now = func() time.Time { return time.Unix(100, 0) }
+
+	info, err = proxy.Info(context.Background(), &storepb.InfoRequest{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(40000), info.MinTime)
+}
+
 func TestPrometheusStore_Series_MatchExternalLabel(t *testing.T) {
 	p, err := testutil.NewPrometheus()
 	testutil.Ok(t, err)
@@ -137,10 +185,9 @@ func TestPrometheusStore_Series_MatchExternalLabel(t *testing.T) {
 	u, err := url.Parse(fmt.Sprintf("http://%s", p.Addr()))
 	testutil.Ok(t, err)
 
-	proxy, err := NewPrometheusStore(nil, nil, nil, u,
-		func() labels.Labels {
-			return labels.FromStrings("region", "eu-west")
-		})
+	proxy, err := NewPrometheusStore(nil, nil, nil, u, func() labels.Labels {
+		return labels.FromStrings("region", "eu-west")
+	}, PrometheusStoreOptions{})
 	testutil.Ok(t, err)
 	srv := newStoreSeriesServer(ctx)
 
@@ -176,3 +223,532 @@ func TestPrometheusStore_Series_MatchExternalLabel(t *testing.T) {
 	// No series.
 	testutil.Equals(t, 0, len(srv.SeriesSet))
 }
+
+func TestPrometheusStore_Series_QueryTimeout(t *testing.T) {
+	canceled := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Never answer and wait for the client to give up.
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	proxy, err := NewPrometheusStore(nil, nil, nil, u, func() labels.Labels {
+		return labels.FromStrings("region", "eu-west")
+	}, PrometheusStoreOptions{QueryTimeout: 100 * time.Millisecond})
+	testutil.Ok(t, err)
+
+	err = proxy.Series(&storepb.SeriesRequest{
+		MinTime: 0,
+		MaxTime: 300,
+		Matchers: []storepb.LabelMatcher{
+			{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "b"},
+		},
+	}, newStoreSeriesServer(context.Background()))
+	testutil.NotOk(t, err)
+
+	st, ok := status.FromError(err)
+	testutil.Assert(t, ok, "expected gRPC status error, got %v", err)
+	testutil.Equals(t, codes.DeadlineExceeded, st.Code())
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not canceled")
+	}
+}
+
+// fakeRemoteRead is a Prometheus remote read endpoint that records the queries it receives.
+type fakeRemoteRead struct {
+	*httptest.Server
+
+	mtx     sync.Mutex
+	queries []prompb.Query
+}
+
+// newFakeRemoteRead returns a server that answers all remote read requests with the given response.
+func newFakeRemoteRead(t *testing.T, resp *prompb.ReadResponse) *fakeRemoteRead {
+	f := &fakeRemoteRead{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, err := ioutil.ReadAll(r.Body)
+		testutil.Ok(t, err)
+		b, err := snappy.Decode(nil, compressed)
+		testutil.Ok(t, err)
+
+		var req prompb.ReadRequest
+		testutil.Ok(t, proto.Unmarshal(b, &req))
+
+		f.mtx.Lock()
+		f.queries = append(f.queries, req.Queries...)
+		f.mtx.Unlock()
+
+		b, err = proto.Marshal(resp)
+		testutil.Ok(t, err)
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+		w.Write(snappy.Encode(nil, b))
+	}))
+	return f
+}
+
+// Queries returns the queries received so far.
+func (f *fakeRemoteRead) Queries() []prompb.Query {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return append([]prompb.Query(nil), f.queries...)
+}
+
+func TestPrometheusStore_Series_Metrics(t *testing.T) {
+	srv := newFakeRemoteRead(t, &prompb.ReadResponse{
+		Results: []prompb.QueryResult{{
+			Timeseries: []prompb.TimeSeries{
+				{
+					Labels:  []prompb.Label{{Name: "a", Value: "b"}},
+					Samples: []prompb.Sample{{Timestamp: 100, Value: 1}, {Timestamp: 200, Value: 2}},
+				},
+				{
+					Labels:  []prompb.Label{{Name: "a", Value: "c"}},
+					Samples: []prompb.Sample{{Timestamp: 100, Value: 1}},
+				},
+			},
+		}},
+	})
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	reg := prometheus.NewRegistry()
+
+	proxy, err := NewPrometheusStore(nil, reg, nil, u, func() labels.Labels {
+		return labels.FromStrings("region", "eu-west")
+	}, PrometheusStoreOptions{})
+	testutil.Ok(t, err)
+
+	srv2 := newStoreSeriesServer(context.Background())
+	err = proxy.Series(&storepb.SeriesRequest{
+		MinTime: 0,
+		MaxTime: 300,
+		Matchers: []storepb.LabelMatcher{
+			{Type: storepb.LabelMatcher_RE, Name: "a", Value: "b|c"},
+		},
+	}, srv2)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(srv2.SeriesSet))
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+
+	// The store also exposes counters, e.g. for limited requests, which must not
+	// be read as histograms.
+	sums := map[string]float64{}
+	for _, mf := range mfs {
+		switch mf.GetType() {
+		case dto.MetricType_HISTOGRAM:
+			h := mf.GetMetric()[0].GetHistogram()
+			testutil.Equals(t, uint64(1), h.GetSampleCount())
+			sums[mf.GetName()] = h.GetSampleSum()
+		case dto.MetricType_COUNTER:
+			sums[mf.GetName()] = mf.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	testutil.Equals(t, 2.0, sums["thanos_prometheus_store_series_result_series"])
+	testutil.Equals(t, 3.0, sums["thanos_prometheus_store_series_result_samples"])
+	testutil.Assert(t, sums["thanos_prometheus_store_series_sent_bytes"] > 0, "no sent bytes observed")
+	testutil.Equals(t, 0.0, sums["thanos_prometheus_store_series_limited_requests_total"])
+}
+
+func TestPrometheusStore_Series_RemoteReadTranslation(t *testing.T) {
+	srv := newFakeRemoteRead(t, &prompb.ReadResponse{
+		Results: []prompb.QueryResult{{
+			Timeseries: []prompb.TimeSeries{
+				{
+					// The external label must override a colliding label of the series.
+					Labels:  []prompb.Label{{Name: "a", Value: "b"}, {Name: "region", Value: "us-east"}},
+					Samples: []prompb.Sample{{Timestamp: 100, Value: 1}, {Timestamp: 200, Value: 2}},
+				},
+				{
+					// Series without samples must be skipped.
+					Labels: []prompb.Label{{Name: "a", Value: "c"}},
+				},
+			},
+		}},
+	})
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	proxy, err := NewPrometheusStore(nil, nil, nil, u, func() labels.Labels {
+		return labels.FromStrings("region", "eu-west")
+	}, PrometheusStoreOptions{})
+	testutil.Ok(t, err)
+
+	srv2 := newStoreSeriesServer(context.Background())
+	err = proxy.Series(&storepb.SeriesRequest{
+		MinTime: 0,
+		MaxTime: 300,
+		Matchers: []storepb.LabelMatcher{
+			{Type: storepb.LabelMatcher_RE, Name: "a", Value: "b|c"},
+		},
+	}, srv2)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(srv2.SeriesSet))
+
+	testutil.Equals(t, []storepb.Label{
+		{Name: "a", Value: "b"},
+		{Name: "region", Value: "eu-west"},
+	}, srv2.SeriesSet[0].Labels)
+
+	testutil.Equals(t, 1, len(srv2.SeriesSet[0].Chunks))
+
+	c := srv2.SeriesSet[0].Chunks[0]
+	testutil.Equals(t, int64(100), c.MinTime)
+	testutil.Equals(t, int64(200), c.MaxTime)
+
+	chk, err := chunkenc.FromData(chunkenc.EncXOR, c.Raw.Data)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []sample{{100, 1}, {200, 2}}, expandChunk(chk.Iterator()))
+}
+
+func TestPrometheusStore_Series_MaxQueryRange(t *testing.T) {
+	srv := newFakeRemoteRead(t, &prompb.ReadResponse{
+		Results: []prompb.QueryResult{{
+			Timeseries: []prompb.TimeSeries{{
+				Labels:  []prompb.Label{{Name: "a", Value: "b"}},
+				Samples: []prompb.Sample{{Timestamp: 100, Value: 1}},
+			}},
+		}},
+	})
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	proxy, err := NewPrometheusStore(nil, nil, nil, u, func() labels.Labels {
+		return labels.FromStrings("region", "eu-west")
+	}, PrometheusStoreOptions{MaxQueryRange: time.Hour})
+	testutil.Ok(t, err)
+
+	now := time.Unix(100000, 0)
+	proxy.now = func() time.Time { return now }
+	cutoff := timestamp.FromTime(now.Add(-time.Hour))
+
+	info, err := proxy.Info(context.Background(), &storepb.InfoRequest{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, cutoff, info.MinTime)
+
+	matchers := []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "b"}}
+
+	// Requests fully outside the allowed range must not reach Prometheus.
+	srv1 := newStoreSeriesServer(context.Background())
+	testutil.Ok(t, proxy.Series(&storepb.SeriesRequest{
+		MinTime:  0,
+		MaxTime:  cutoff - 1,
+		Matchers: matchers,
+	}, srv1))
+	testutil.Equals(t, 0, len(srv1.SeriesSet))
+	testutil.Equals(t, 0, len(srv.Queries()))
+
+	// Requests partially outside the allowed range must be clamped.
+	srv2 := newStoreSeriesServer(context.Background())
+	testutil.Ok(t, proxy.Series(&storepb.SeriesRequest{
+		MinTime:  0,
+		MaxTime:  cutoff + 1000,
+		Matchers: matchers,
+	}, srv2))
+	testutil.Equals(t, 1, len(srv2.SeriesSet))
+	queries := srv.Queries()
+	testutil.Equals(t, 1, len(queries))
+	testutil.Equals(t, cutoff, queries[0].StartTimestampMs)
+	testutil.Equals(t, cutoff+1000, queries[0].EndTimestampMs)
+
+	// Requests within the allowed range must be unchanged.
+	srv3 := newStoreSeriesServer(context.Background())
+	testutil.Ok(t, proxy.Series(&storepb.SeriesRequest{
+		MinTime:  cutoff + 10,
+		MaxTime:  cutoff + 1000,
+		Matchers: matchers,
+	}, srv3))
+	queries = srv.Queries()
+	testutil.Equals(t, 2, len(queries))
+	testutil.Equals(t, cutoff+10, queries[1].StartTimestampMs)
+}
+
+func TestPrometheusStore_Series_SeriesLimit(t *testing.T) {
+	var series []prompb.TimeSeries
+	for i := 0; i < 10; i++ {
+		series = append(series, prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "a", Value: "b"}, {Name: "i", Value: fmt.Sprintf("%d", i)}},
+			Samples: []prompb.Sample{{Timestamp: 100, Value: 1}},
+		})
+	}
+	srv := newFakeRemoteRead(t, &prompb.ReadResponse{
+		Results: []prompb.QueryResult{{Timeseries: series}},
+	})
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	reg := prometheus.NewRegistry()
+	proxy, err := NewPrometheusStore(nil, reg, nil, u, func() labels.Labels {
+		return labels.FromStrings("region", "eu-west")
+	}, PrometheusStoreOptions{SeriesLimit: 3})
+	testutil.Ok(t, err)
+
+	req := &storepb.SeriesRequest{
+		MinTime:  0,
+		MaxTime:  300,
+		Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "b"}},
+	}
+	seriesSrv := newStoreSeriesServer(context.Background())
+	err = proxy.Series(req, seriesSrv)
+	testutil.NotOk(t, err)
+
+	st, ok := status.FromError(err)
+	testutil.Assert(t, ok, "expected gRPC status error, got %v", err)
+	testutil.Equals(t, codes.ResourceExhausted, st.Code())
+
+	// No more series than the limit must have been sent before aborting.
+	testutil.Equals(t, 3, len(seriesSrv.SeriesSet))
+
+	testutil.Equals(t, float64(1), testutil.CounterValue(t, reg, "thanos_prometheus_store_series_limited_requests_total"))
+
+	// Requests within the limit succeed.
+	proxy.seriesLimit = 10
+	testutil.Ok(t, proxy.Series(req, newStoreSeriesServer(context.Background())))
+}
+
+func TestPrometheusStore_Series_EncodingRoundTrip(t *testing.T) {
+	// Samples with irregular intervals and values that are hard to compress must be
+	// preserved bit by bit.
+	fixture := []prompb.Sample{
+		{Timestamp: 1, Value: 0},
+		{Timestamp: 2, Value: -1.5},
+		{Timestamp: 15002, Value: math.MaxFloat64},
+		{Timestamp: 15003, Value: math.SmallestNonzeroFloat64},
+		{Timestamp: 1e12, Value: math.Inf(1)},
+		{Timestamp: 1e12 + 1, Value: math.Inf(-1)},
+		{Timestamp: 1e12 + 30000, Value: math.NaN()},
+		{Timestamp: 1e12 + 30001, Value: math.Float64frombits(0x7ff8000000000001)},
+		{Timestamp: 1e12 + 60000, Value: 123456.789},
+	}
+	srv := newFakeRemoteRead(t, &prompb.ReadResponse{
+		Results: []prompb.QueryResult{{
+			Timeseries: []prompb.TimeSeries{{
+				Labels:  []prompb.Label{{Name: "a", Value: "b"}},
+				Samples: fixture,
+			}},
+		}},
+	})
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	proxy, err := NewPrometheusStore(nil, nil, nil, u, func() labels.Labels {
+		return labels.FromStrings("region", "eu-west")
+	}, PrometheusStoreOptions{})
+	testutil.Ok(t, err)
+
+	seriesSrv := newStoreSeriesServer(context.Background())
+	testutil.Ok(t, proxy.Series(&storepb.SeriesRequest{
+		MinTime:  0,
+		MaxTime:  math.MaxInt64,
+		Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "b"}},
+	}, seriesSrv))
+	testutil.Equals(t, 1, len(seriesSrv.SeriesSet))
+	testutil.Equals(t, 1, len(seriesSrv.SeriesSet[0].Chunks))
+
+	c := seriesSrv.SeriesSet[0].Chunks[0]
+	testutil.Equals(t, storepb.Chunk_XOR, c.Raw.Type)
+	testutil.Equals(t, fixture[0].Timestamp, c.MinTime)
+	testutil.Equals(t, fixture[len(fixture)-1].Timestamp, c.MaxTime)
+
+	chk, err := chunkenc.FromData(chunkenc.EncXOR, c.Raw.Data)
+	testutil.Ok(t, err)
+	testutil.Equals(t, len(fixture), chk.NumSamples())
+
+	it := chk.Iterator()
+	for i, s := range fixture {
+		testutil.Assert(t, it.Next(), "missing sample %d", i)
+		ts, v := it.At()
+		testutil.Equals(t, s.Timestamp, ts)
+		testutil.Equals(t, math.Float64bits(s.Value), math.Float64bits(v))
+	}
+	testutil.Assert(t, !it.Next(), "unexpected additional samples")
+	testutil.Ok(t, it.Err())
+}
+
+func TestPrometheusStore_Series_ShedWhenUnhealthy(t *testing.T) {
+	srv := newFakeRemoteRead(t, &prompb.ReadResponse{
+		Results: []prompb.QueryResult{{Timeseries: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "a", Value: "b"}},
+			Samples: []prompb.Sample{{Timestamp: 100, Value: 1}},
+		}}}},
+	})
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	healthy := false
+	proxy, err := NewPrometheusStore(nil, nil, nil, u,
+		func() labels.Labels {
+			return labels.FromStrings("region", "eu-west")
+		}, 0, 0, 0, func() bool { return healthy }, 0)
+	testutil.Ok(t, err)
+
+	req := &storepb.SeriesRequest{
+		MinTime:  0,
+		MaxTime:  300,
+		Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "b"}},
+	}
+	seriesSrv := newStoreSeriesServer(context.Background())
+	err = proxy.Series(req, seriesSrv)
+	testutil.NotOk(t, err)
+
+	st, ok := status.FromError(err)
+	testutil.Assert(t, ok, "expected gRPC status error, got %v", err)
+	testutil.Equals(t, codes.Unavailable, st.Code())
+	testutil.Equals(t, 0, len(seriesSrv.SeriesSet))
+
+	var m dto.Metric
+	testutil.Ok(t, proxy.metrics.shedRequests.Write(&m))
+	testutil.Equals(t, float64(1), m.GetCounter().GetValue())
+
+	// Once Prometheus is healthy again, requests must be served.
+	healthy = true
+	seriesSrv = newStoreSeriesServer(context.Background())
+	testutil.Ok(t, proxy.Series(req, seriesSrv))
+	testutil.Equals(t, 1, len(seriesSrv.SeriesSet))
+}
+
+func TestPrometheusStore_LabelValues_Cache(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `{"status":"success","data":["b","a"]}`)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	proxy, err := NewPrometheusStore(nil, nil, nil, u, nil, PrometheusStoreOptions{MetadataCacheTTL: time.Minute})
+	testutil.Ok(t, err)
+
+	now := time.Unix(1000, 0)
+	proxy.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	req := &storepb.LabelValuesRequest{Label: "job"}
+
+	for i := 0; i < 2; i++ {
+		resp, err := proxy.LabelValues(ctx, req)
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{"a", "b"}, resp.Values)
+	}
+	// The second lookup within the TTL must be served from the cache.
+	testutil.Equals(t, 1, requests)
+
+	var m dto.Metric
+	testutil.Ok(t, proxy.metrics.labelValuesHits.Write(&m))
+	testutil.Equals(t, float64(1), m.GetCounter().GetValue())
+	testutil.Ok(t, proxy.metrics.labelValuesMisses.Write(&m))
+	testutil.Equals(t, float64(1), m.GetCounter().GetValue())
+
+	// Other label names are cached separately.
+	_, err = proxy.LabelValues(ctx, &storepb.LabelValuesRequest{Label: "instance"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, requests)
+
+	// Expired entries must be fetched again.
+	now = now.Add(time.Minute)
+	_, err = proxy.LabelValues(ctx, req)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, requests)
+}
+
+// spillCheckingServer records the number of spill files present while responses are sent.
+type spillCheckingServer struct {
+	*storeSeriesServer
+	dir        string
+	spillFiles int
+}
+
+func (s *spillCheckingServer) Send(r *storepb.SeriesResponse) error {
+	fis, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	if len(fis) > s.spillFiles {
+		s.spillFiles = len(fis)
+	}
+	return s.storeSeriesServer.Send(r)
+}
+
+func TestPrometheusStore_Series_SpillToDisk(t *testing.T) {
+	var series []prompb.TimeSeries
+	for i := 0; i < 100; i++ {
+		series = append(series, prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "a", Value: fmt.Sprintf("%d", i)}},
+			Samples: []prompb.Sample{{Timestamp: 100, Value: 1}, {Timestamp: 200, Value: float64(i)}},
+		})
+	}
+	srv := newFakeRemoteRead(t, &prompb.ReadResponse{
+		Results: []prompb.QueryResult{{Timeseries: series}},
+	})
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	dir, err := ioutil.TempDir("", "prometheus-store-spill")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+
+	// The limit only fits a few of the series responses into memory.
+	proxy, err := NewPrometheusStore(nil, reg, nil, u, func() labels.Labels {
+		return labels.FromStrings("region", "eu-west")
+	}, PrometheusStoreOptions{MemoryLimit: 256, SpillDir: dir})
+	testutil.Ok(t, err)
+
+	s := &spillCheckingServer{storeSeriesServer: newStoreSeriesServer(context.Background()), dir: dir}
+	err = proxy.Series(&storepb.SeriesRequest{
+		MinTime: 0,
+		MaxTime: 300,
+		Matchers: []storepb.LabelMatcher{
+			{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"},
+		},
+	}, s)
+	testutil.Ok(t, err)
+
+	// All series must be returned in order.
+	testutil.Equals(t, 100, len(s.SeriesSet))
+	for i, ser := range s.SeriesSet {
+		testutil.Equals(t, []storepb.Label{
+			{Name: "a", Value: fmt.Sprintf("%d", i)},
+			{Name: "region", Value: "eu-west"},
+		}, ser.Labels)
+	}
+	testutil.Equals(t, 1, s.spillFiles)
+
+	m := &dto.Metric{}
+	testutil.Ok(t, proxy.metrics.spilledRequests.Write(m))
+	testutil.Equals(t, 1.0, m.GetCounter().GetValue())
+
+	// The spill file must be removed once the request completed.
+	fis, err := ioutil.ReadDir(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(fis))
+}
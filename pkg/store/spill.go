@@ -0,0 +1,118 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/improbable-eng/thanos/pkg/store/storepb"
+	"github.com/pkg/errors"
+)
+
+// seriesBuffer buffers series responses in memory up to a limit in bytes. Once the limit
+// is exceeded, the responses are spilled into a temporary file in dir instead.
+// Responses are sent in the order they were added.
+type seriesBuffer struct {
+	dir   string
+	limit int
+
+	size    int
+	mem     []*storepb.SeriesResponse
+	f       *os.File
+	w       *bufio.Writer
+	spilled int
+}
+
+func newSeriesBuffer(dir string, limit int) *seriesBuffer {
+	return &seriesBuffer{dir: dir, limit: limit}
+}
+
+// Add buffers the response.
+func (b *seriesBuffer) Add(r *storepb.SeriesResponse) error {
+	// Once responses were spilled, all further ones must be spilled as well to retain the order.
+	if b.f == nil && b.size+r.Size() <= b.limit {
+		b.mem = append(b.mem, r)
+		b.size += r.Size()
+		return nil
+	}
+	if b.f == nil {
+		f, err := ioutil.TempFile(b.dir, "thanos-series-spill-")
+		if err != nil {
+			return errors.Wrap(err, "create spill file")
+		}
+		b.f = f
+		b.w = bufio.NewWriter(f)
+	}
+	data, err := r.Marshal()
+	if err != nil {
+		return errors.Wrap(err, "marshal series response")
+	}
+	var lb [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lb[:], uint64(len(data)))
+
+	if _, err := b.w.Write(lb[:n]); err != nil {
+		return errors.Wrap(err, "write spill file")
+	}
+	if _, err := b.w.Write(data); err != nil {
+		return errors.Wrap(err, "write spill file")
+	}
+	b.spilled++
+	return nil
+}
+
+// Spilled returns true if responses were spilled to disk.
+func (b *seriesBuffer) Spilled() bool {
+	return b.f != nil
+}
+
+// Send sends all buffered responses to the series server.
+func (b *seriesBuffer) Send(s storepb.Store_SeriesServer) error {
+	for _, r := range b.mem {
+		if err := s.Send(r); err != nil {
+			return err
+		}
+	}
+	b.mem = nil
+
+	if b.f == nil {
+		return nil
+	}
+	if err := b.w.Flush(); err != nil {
+		return errors.Wrap(err, "flush spill file")
+	}
+	if _, err := b.f.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "seek spill file")
+	}
+	rd := bufio.NewReader(b.f)
+
+	for i := 0; i < b.spilled; i++ {
+		l, err := binary.ReadUvarint(rd)
+		if err != nil {
+			return errors.Wrap(err, "read spill file")
+		}
+		data := make([]byte, l)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return errors.Wrap(err, "read spill file")
+		}
+		var r storepb.SeriesResponse
+		if err := r.Unmarshal(data); err != nil {
+			return errors.Wrap(err, "unmarshal series response")
+		}
+		if err := s.Send(&r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close releases all buffered responses and removes the spill file, if any.
+func (b *seriesBuffer) Close() error {
+	b.mem = nil
+	if b.f == nil {
+		return nil
+	}
+	b.f.Close()
+	return os.Remove(b.f.Name())
+}
@@ -0,0 +1,31 @@
+package testutil
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// CounterValue returns the value of the first series of the named counter gathered from g.
+func CounterValue(t testing.TB, g prometheus.Gatherer, name string) float64 {
+	return metric(t, g, name).GetCounter().GetValue()
+}
+
+// GaugeValue returns the value of the first series of the named gauge gathered from g.
+func GaugeValue(t testing.TB, g prometheus.Gatherer, name string) float64 {
+	return metric(t, g, name).GetGauge().GetValue()
+}
+
+func metric(t testing.TB, g prometheus.Gatherer, name string) *dto.Metric {
+	mfs, err := g.Gather()
+	Ok(t, err)
+
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return mf.GetMetric()[0]
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return nil
+}
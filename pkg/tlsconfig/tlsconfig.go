@@ -0,0 +1,111 @@
+// Package tlsconfig implements the TLS policy that all TLS connections of Thanos components
+// are based on, i.e. the accepted TLS versions and cipher suites and how they are named.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+// cipherSuites are the cipher suites that may be configured, named like the constants of the
+// crypto/tls package. Suites based on RC4 or 3DES are not supported.
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA256":         tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// DefaultCipherSuites are the cipher suites used if none are configured. They provide
+// forward secrecy and authenticated encryption.
+var DefaultCipherSuites = []string{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305",
+}
+
+// Versions returns the names of the supported TLS versions, e.g. 1.2.
+func Versions() []string {
+	return sortedKeys(versions)
+}
+
+// ParseVersion returns the TLS version of the given name.
+func ParseVersion(name string) (uint16, error) {
+	v, ok := versions[name]
+	if !ok {
+		return 0, errors.Errorf("unknown TLS version %q, valid versions are: %s", name, strings.Join(Versions(), ", "))
+	}
+	return v, nil
+}
+
+// ParseCipherSuites returns the cipher suites of the given names. Surrounding whitespace
+// is ignored, as are empty names.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := cipherSuites[name]
+		if !ok {
+			return nil, errors.Errorf("unknown TLS cipher suite %q, valid cipher suites are: %s", name, strings.Join(sortedKeys(cipherSuites), ", "))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// New returns a TLS config that enforces the given minimum TLS version and cipher suites.
+func New(minVersion string, cipherSuites []string) (*tls.Config, error) {
+	v, err := ParseVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := ParseCipherSuites(cipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no TLS cipher suites configured")
+	}
+	return &tls.Config{
+		MinVersion:               v,
+		CipherSuites:             ids,
+		PreferServerCipherSuites: true,
+	}, nil
+}
+
+func sortedKeys(m map[string]uint16) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
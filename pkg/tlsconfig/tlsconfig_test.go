@@ -0,0 +1,36 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+
+	"github.com/improbable-eng/thanos/pkg/testutil"
+)
+
+func TestNew(t *testing.T) {
+	cfg, err := New("1.2", DefaultCipherSuites)
+	testutil.Ok(t, err)
+	testutil.Equals(t, uint16(tls.VersionTLS12), cfg.MinVersion)
+	testutil.Equals(t, len(DefaultCipherSuites), len(cfg.CipherSuites))
+
+	cfg, err = New("1.1", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", " TLS_RSA_WITH_AES_128_CBC_SHA"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, uint16(tls.VersionTLS11), cfg.MinVersion)
+	testutil.Equals(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_AES_128_CBC_SHA}, cfg.CipherSuites)
+
+	_, err = New("1.4", DefaultCipherSuites)
+	testutil.NotOk(t, err)
+	_, err = New("TLS12", DefaultCipherSuites)
+	testutil.NotOk(t, err)
+
+	// Unknown and weak cipher suites must be rejected with a list of valid ones.
+	for _, name := range []string{"TLS_RSA_WITH_RC4_128_SHA", "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA"} {
+		_, err = New("1.2", []string{name})
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"), "valid cipher suites not listed: %s", err)
+	}
+
+	_, err = New("1.2", []string{""})
+	testutil.NotOk(t, err)
+}